@@ -18,9 +18,11 @@
 package apihttp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/bbva/qed/log"
@@ -91,17 +93,166 @@ func Add(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		response, err := balloon.Add(event.Event)
+		response, err := balloon.Add(LogID(r), event.Event)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
+		snapshot := &protocol.Snapshot{
+			HistoryDigest: response.HistoryDigest,
+			HyperDigest:   response.HyperDigest,
+			Version:       response.Version,
+			EventDigest:   response.EventDigest,
+			LogId:         logSnapshotID(r),
+			TreeFormat:    response.TreeFormat,
+		}
+
+		out, err := json.Marshal(snapshot)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		w.WriteHeader(http.StatusCreated)
+		w.Write(out)
+
+		return
+
+	}
+}
+
+// AddBulk posts a bulk of events into the system:
+// The http post url is:
+//   POST /events/bulk
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 201 and the body contains
+// one snapshot per event, in the same order as the events were sent:
+//   [
+//     {
+//       "HyperDigest": "mHzXvSE/j7eFmNObvC7PdtQTmd4W0q/FPHmiYEjL0eM=",
+//       "HistoryDigest": "Kpbn+7P4XrZi2hKpdhA7freUicZdUsU6GqmUk0vDJ8A=",
+//       "Version": 1,
+//       "EventDigest": "VGhpcyBpcyBteSBmaXJzdCBldmVudA=="
+//     },
+//     ...
+//   ]
+func AddBulk(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Make sure we can only be called with an HTTP POST request.
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Body == nil {
+			http.Error(w, "Please send a request body", http.StatusBadRequest)
+			return
+		}
+
+		var eventsBulk protocol.EventsBulk
+		err := json.NewDecoder(r.Body).Decode(&eventsBulk)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(eventsBulk.Events) == 0 {
+			http.Error(w, "Please send at least one event", http.StatusBadRequest)
+			return
+		}
+
+		// Wait for the response
+		response, err := balloon.AddBulk(LogID(r), eventsBulk.Events)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
+		snapshots := make([]*protocol.Snapshot, len(response))
+		for i, s := range response {
+			snapshots[i] = &protocol.Snapshot{
+				HistoryDigest: s.HistoryDigest,
+				HyperDigest:   s.HyperDigest,
+				Version:       s.Version,
+				EventDigest:   s.EventDigest,
+				LogId:         logSnapshotID(r),
+				TreeFormat:    s.TreeFormat,
+			}
+		}
+
+		out, err := json.Marshal(snapshots)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(out)
+
+		return
+
+	}
+}
+
+// Put stores the value of a key in authenticated key-value mode,
+// replacing its previous value if any:
+// The http post url is:
+//   POST /entries
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 201 and the body contains
+// the snapshot of the new version, whose event digest is the key digest:
+//   {
+//     "HyperDigest": "mHzXvSE/j7eFmNObvC7PdtQTmd4W0q/FPHmiYEjL0eM=",
+//     "HistoryDigest": "Kpbn+7P4XrZi2hKpdhA7freUicZdUsU6GqmUk0vDJ8A=",
+//     "Version": 1,
+//     "EventDigest": "VGhpcyBpcyBteSBmaXJzdCBldmVudA=="
+//   }
+func Put(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Make sure we can only be called with an HTTP POST request.
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Body == nil {
+			http.Error(w, "Please send a request body", http.StatusBadRequest)
+			return
+		}
+
+		var entry protocol.KeyValue
+		err := json.NewDecoder(r.Body).Decode(&entry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(entry.Key) == 0 {
+			http.Error(w, "Please send a key", http.StatusBadRequest)
+			return
+		}
+
+		// Wait for the response
+		response, err := balloon.Put(LogID(r), entry.Key, entry.Value)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
 		snapshot := &protocol.Snapshot{
-			response.HistoryDigest,
-			response.HyperDigest,
-			response.Version,
-			response.EventDigest,
+			HistoryDigest: response.HistoryDigest,
+			HyperDigest:   response.HyperDigest,
+			Version:       response.Version,
+			EventDigest:   response.EventDigest,
+			LogId:         logSnapshotID(r),
+			TreeFormat:    response.TreeFormat,
 		}
 
 		out, err := json.Marshal(snapshot)
@@ -122,6 +273,10 @@ func Add(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 // The http post url is:
 //   POST /proofs/membership
 //
+// If the Accept header of the request lists protocol.BinaryProofMediaType
+// the proof is sent in the compact binary format with that Content-Type,
+// otherwise it is sent in JSON.
+//
 // The following statuses are expected:
 // If everything is alright, the HTTP status is 201 and the body contains:
 //   {
@@ -150,13 +305,16 @@ func Membership(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		proof, err := balloon.QueryMembership(query.Key, query.Version)
+		proof, err := balloon.QueryMembership(LogID(r), query.Key, query.Version)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 			return
 		}
 
-		out, err := json.Marshal(protocol.ToMembershipResult(query.Key, proof))
+		result := protocol.ToMembershipResult(query.Key, proof)
+		out, err := marshalProof(w, r, result, func() ([]byte, error) {
+			return protocol.EncodeMembershipResult(result, proof.Hasher)
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -174,7 +332,8 @@ func Membership(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 //   POST /proofs/digest-membership
 //
 // Differs from Membership in that instead of sending the raw event we query
-// with the keyDigest which is the digest of the event.
+// with the keyDigest which is the digest of the event. The encoding of the
+// proof is negotiated as in Membership.
 //
 // The following statuses are expected:
 // If everything is alright, the HTTP status is 201 and the body contains:
@@ -204,13 +363,86 @@ func DigestMembership(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		proof, err := balloon.QueryDigestMembership(query.KeyDigest, query.Version)
+		proof, err := balloon.QueryDigestMembership(LogID(r), query.KeyDigest, query.Version)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
+		result := protocol.ToMembershipResult([]byte(nil), proof)
+		out, err := marshalProof(w, r, result, func() ([]byte, error) {
+			return protocol.EncodeMembershipResult(result, proof.Hasher)
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		out, err := json.Marshal(protocol.ToMembershipResult([]byte(nil), proof))
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+		return
+
+	}
+}
+
+// BatchMembership returns a single membership proof for several keys
+// The http post url is:
+//   POST /proofs/membership/batch
+//
+// The keys are queried by their digests, all of them at the same version,
+// and the hyper and history audit paths are shared by all the keys. The
+// encoding of the proof is negotiated as in Membership.
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+//   {
+//     "Entries": [
+//       {
+//         "KeyDigest": "NDRkMmY3MjEzYjlhMTI4ZWRhZjQzNWFhNjcyMzUxMGE0YTRhOGY5OWEzOWNiYTVhN2FhMWI5OWEwYTlkYzE2NCAgLQo=",
+//         "Exists": true,
+//         "ActualVersion": 2,
+//         "Height": 0
+//       },
+//       ...
+//     ],
+//     "Hyper": ["<truncated for clarity in docs>"],
+//     "History": ["<truncated for clarity in docs>"],
+//     "CurrentVersion": 8,
+//     "QueryVersion": 8
+//   }
+func BatchMembership(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Make sure we can only be called with an HTTP POST request.
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query protocol.BatchMembershipQuery
+		err := json.NewDecoder(r.Body).Decode(&query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(query.KeyDigests) == 0 {
+			http.Error(w, "Please send at least one key digest", http.StatusBadRequest)
+			return
+		}
+
+		// Wait for the response
+		proof, err := balloon.QueryBatchMembership(LogID(r), query.KeyDigests, query.Version)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
+		result := protocol.ToBatchMembershipResult(proof)
+		out, err := marshalProof(w, r, result, func() ([]byte, error) {
+			return protocol.EncodeBatchMembershipResult(result)
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -227,6 +459,8 @@ func DigestMembership(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 // The http post url is:
 //   POST /proofs/incremental
 //
+// The encoding of the proof is negotiated as in Membership.
+//
 // The following statuses are expected:
 // If everything is alright, the HTTP status is 201 and the body contains:
 //   {
@@ -251,13 +485,16 @@ func Incremental(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		proof, err := balloon.QueryConsistency(request.Start, request.End)
+		proof, err := balloon.QueryConsistency(LogID(r), request.Start, request.End)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
 			return
 		}
 
-		out, err := json.Marshal(protocol.ToIncrementalResponse(proof))
+		response := protocol.ToIncrementalResponse(proof)
+		out, err := marshalProof(w, r, response, func() ([]byte, error) {
+			return protocol.EncodeIncrementalResponse(response)
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -270,6 +507,86 @@ func Incremental(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
 	}
 }
 
+// marshalProof encodes a proof in the binary proof format if the request
+// accepts it, setting the Content-Type of the response accordingly, and
+// in JSON otherwise.
+func marshalProof(w http.ResponseWriter, r *http.Request, result interface{}, encodeBinary func() ([]byte, error)) ([]byte, error) {
+	if protocol.AcceptsBinaryProof(r.Header.Get("Accept")) {
+		out, err := encodeBinary()
+		if err == nil {
+			w.Header().Set("Content-Type", protocol.BinaryProofMediaType)
+		}
+		return out, err
+	}
+	return json.Marshal(result)
+}
+
+type logIDKey struct{}
+
+// LogID returns the id of the log a request refers to, which is the
+// default log unless the request was routed through /logs/{id}/.
+func LogID(r *http.Request) string {
+	if id, ok := r.Context().Value(logIDKey{}).(string); ok {
+		return id
+	}
+	return raftwal.DefaultLogID
+}
+
+// logSnapshotID returns the log id to set in the snapshots returned by a
+// request, which is empty for the default log.
+func logSnapshotID(r *http.Request) string {
+	id := LogID(r)
+	if id == raftwal.DefaultLogID {
+		return ""
+	}
+	return id
+}
+
+func errorStatus(err error, status int) int {
+	if err == raftwal.ErrLogNotFound {
+		return http.StatusNotFound
+	}
+	return status
+}
+
+// LogsRouter serves the events and proofs endpoints of any log hosted by
+// the server, dispatching the request to the same handler as the default
+// log:
+//   POST /logs/{id}/events
+//   POST /logs/{id}/events/bulk
+//   POST /logs/{id}/entries
+//   POST /logs/{id}/proofs/membership
+//   POST /logs/{id}/proofs/digest-membership
+//   POST /logs/{id}/proofs/membership/batch
+//   POST /logs/{id}/proofs/incremental
+//
+// If the route does not exist the HTTP status is 404.
+func LogsRouter(balloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	routes := map[string]http.HandlerFunc{
+		"events":                   Add(balloon),
+		"events/bulk":              AddBulk(balloon),
+		"entries":                  Put(balloon),
+		"proofs/membership":        Membership(balloon),
+		"proofs/digest-membership": DigestMembership(balloon),
+		"proofs/membership/batch":  BatchMembership(balloon),
+		"proofs/incremental":       Incremental(balloon),
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/logs/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		handler, ok := routes[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), logIDKey{}, parts[0])
+		handler(w, r.WithContext(ctx))
+	}
+}
+
 // AuthHandlerMiddleware function is an HTTP handler wrapper that performs
 // simple authorization tasks. Currently only checks that Api-Key it's present.
 //
@@ -290,16 +607,22 @@ func AuthHandlerMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 // NewApiHttp returns a new *http.ServeMux containing the current API handlers.
 //	/health-check -> HealthCheckHandler
 //	/events -> Add
+//	/events/bulk -> AddBulk
 //	/proofs/membership -> Membership
+//	/logs/{id}/... -> the same handlers on the log identified by id
 func NewApiHttp(balloon raftwal.RaftBalloonApi) *http.ServeMux {
 
 	api := http.NewServeMux()
 	api.HandleFunc("/healthcheck", AuthHandlerMiddleware(HealthCheckHandler))
 	api.HandleFunc("/events", AuthHandlerMiddleware(Add(balloon)))
+	api.HandleFunc("/events/bulk", AuthHandlerMiddleware(AddBulk(balloon)))
+	api.HandleFunc("/entries", AuthHandlerMiddleware(Put(balloon)))
 	api.HandleFunc("/proofs/membership", AuthHandlerMiddleware(Membership(balloon)))
 	api.HandleFunc("/proofs/digest-membership", AuthHandlerMiddleware(DigestMembership(balloon)))
+	api.HandleFunc("/proofs/membership/batch", AuthHandlerMiddleware(BatchMembership(balloon)))
 	api.HandleFunc("/proofs/incremental", AuthHandlerMiddleware(Incremental(balloon)))
 	api.HandleFunc("/info/shards", AuthHandlerMiddleware(InfoShardsHandler(balloon)))
+	api.HandleFunc("/logs/", AuthHandlerMiddleware(LogsRouter(balloon)))
 
 	return api
 }
@@ -44,15 +44,27 @@ type fakeRaftBalloon struct {
 	raftID       string
 }
 
-func (b fakeRaftBalloon) Add(event []byte) (*balloon.Snapshot, error) {
-	return &balloon.Snapshot{hashing.Digest{0x02}, hashing.Digest{0x00}, hashing.Digest{0x01}, 0}, nil
+func (b fakeRaftBalloon) Add(logID string, event []byte) (*balloon.Snapshot, error) {
+	return &balloon.Snapshot{hashing.Digest{0x02}, hashing.Digest{0x00}, hashing.Digest{0x01}, 0, hashing.CurrentTreeFormat}, nil
+}
+
+func (b fakeRaftBalloon) AddBulk(logID string, bulk [][]byte) ([]*balloon.Snapshot, error) {
+	snapshots := make([]*balloon.Snapshot, len(bulk))
+	for i := range bulk {
+		snapshots[i] = &balloon.Snapshot{hashing.Digest{0x02}, hashing.Digest{0x00}, hashing.Digest{0x01}, uint64(i), hashing.CurrentTreeFormat}
+	}
+	return snapshots, nil
+}
+
+func (b fakeRaftBalloon) Put(logID string, key, value []byte) (*balloon.Snapshot, error) {
+	return &balloon.Snapshot{hashing.Digest{0x02}, hashing.Digest{0x00}, hashing.Digest{0x01}, 0, hashing.CurrentTreeFormat}, nil
 }
 
 func (b fakeRaftBalloon) Join(nodeID, addr string, metadata map[string]string) error {
 	return nil
 }
 
-func (b fakeRaftBalloon) QueryDigestMembership(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+func (b fakeRaftBalloon) QueryDigestMembership(logID string, keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
 	return &balloon.MembershipProof{
 		Exists:         true,
 		HyperProof:     hyper.NewQueryProof([]byte{0x0}, []byte{0x0}, hyper.AuditPath{}, nil),
@@ -65,7 +77,7 @@ func (b fakeRaftBalloon) QueryDigestMembership(keyDigest hashing.Digest, version
 	}, nil
 }
 
-func (b fakeRaftBalloon) QueryMembership(event []byte, version uint64) (*balloon.MembershipProof, error) {
+func (b fakeRaftBalloon) QueryMembership(logID string, event []byte, version uint64) (*balloon.MembershipProof, error) {
 	hasher := hashing.NewFakeXorHasher()
 	return &balloon.MembershipProof{
 		Exists:         true,
@@ -79,7 +91,25 @@ func (b fakeRaftBalloon) QueryMembership(event []byte, version uint64) (*balloon
 	}, nil
 }
 
-func (b fakeRaftBalloon) QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error) {
+func (b fakeRaftBalloon) QueryBatchMembership(logID string, keyDigests []hashing.Digest, version uint64) (*balloon.BatchMembershipProof, error) {
+	entries := make([]*hyper.BatchQueryEntry, len(keyDigests))
+	for i, keyDigest := range keyDigests {
+		entries[i] = &hyper.BatchQueryEntry{Key: keyDigest, Value: []byte{0x0}}
+	}
+	return &balloon.BatchMembershipProof{
+		Exists:         []bool{true, true},
+		HyperProof:     hyper.NewBatchQueryProof(entries, hyper.AuditPath{}, nil),
+		HistoryProof:   history.NewBatchMembershipProof([]uint64{0, 1}, 1, history.AuditPath{}, nil),
+		CurrentVersion: 1,
+		QueryVersion:   1,
+		ActualVersions: []uint64{0, 1},
+		KeyDigests:     keyDigests,
+		ValueDigests:   make([]hashing.Digest, len(keyDigests)),
+		Hasher:         hashing.NewFakeXorHasher(),
+	}, nil
+}
+
+func (b fakeRaftBalloon) QueryConsistency(logID string, start, end uint64) (*balloon.IncrementalProof, error) {
 	var pathKey [10]byte
 	ip := balloon.IncrementalProof{
 		Start:     2,
@@ -90,6 +120,18 @@ func (b fakeRaftBalloon) QueryConsistency(start, end uint64) (*balloon.Increment
 	return &ip, nil
 }
 
+func (b fakeRaftBalloon) CreateLog(id string) error {
+	return nil
+}
+
+func (b fakeRaftBalloon) DeleteLog(id string) error {
+	return nil
+}
+
+func (b fakeRaftBalloon) Logs() []string {
+	return []string{raftwal.DefaultLogID}
+}
+
 func (b fakeRaftBalloon) Info() map[string]interface{} {
 	return make(map[string]interface{})
 }
@@ -165,6 +207,111 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestLogsRouter(t *testing.T) {
+	data, _ := json.Marshal(&protocol.Event{Event: []byte("this is a sample event")})
+
+	testCases := []struct {
+		path           string
+		expectedStatus int
+		expectedLogId  string
+	}{
+		{"/logs/tenant/events", http.StatusCreated, "tenant"},
+		{"/logs/default/events", http.StatusCreated, ""},
+		{"/logs/tenant/unknown", http.StatusNotFound, ""},
+		{"/logs/tenant", http.StatusNotFound, ""},
+		{"/logs//events", http.StatusNotFound, ""},
+	}
+
+	handler := LogsRouter(fakeRaftBalloon{})
+
+	for i, c := range testCases {
+		req, err := http.NewRequest("POST", c.path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.Equalf(t, c.expectedStatus, rr.Code, "Wrong status code in test case %d", i)
+		if rr.Code != http.StatusCreated {
+			continue
+		}
+
+		snapshot := &protocol.Snapshot{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), snapshot))
+		assert.Equalf(t, c.expectedLogId, snapshot.LogId, "Wrong log id in test case %d", i)
+	}
+}
+
+func TestAddBulk(t *testing.T) {
+	events := [][]byte{
+		[]byte("this is a sample event"),
+		[]byte("this is another sample event"),
+	}
+	data, _ := json.Marshal(&protocol.EventsBulk{Events: events})
+	req, err := http.NewRequest("POST", "/events/bulk", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := AddBulk(fakeRaftBalloon{})
+
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	// Check the body response
+	var snapshots []*protocol.Snapshot
+	json.Unmarshal([]byte(rr.Body.String()), &snapshots)
+
+	assert.Len(t, snapshots, len(events), "There should be one snapshot per event")
+	for i, snapshot := range snapshots {
+		assert.Equal(t, uint64(i), snapshot.Version, "Snapshots should be returned in order")
+	}
+
+	// An empty bulk is a bad request
+	data, _ = json.Marshal(&protocol.EventsBulk{})
+	req, _ = http.NewRequest("POST", "/events/bulk", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPut(t *testing.T) {
+	data, _ := json.Marshal(&protocol.KeyValue{Key: []byte("key"), Value: []byte("value")})
+	req, err := http.NewRequest("POST", "/entries", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Put(fakeRaftBalloon{})
+
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	// Check the body response
+	snapshot := &protocol.Snapshot{}
+	json.Unmarshal([]byte(rr.Body.String()), snapshot)
+	assert.Equal(t, hashing.Digest{0x02}, snapshot.EventDigest, "The event digest should be the key digest")
+
+	// An entry without key is a bad request
+	data, _ = json.Marshal(&protocol.KeyValue{Value: []byte("value")})
+	req, _ = http.NewRequest("POST", "/entries", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
 func TestMembership(t *testing.T) {
 	var version uint64 = 1
 	key := []byte("this is a sample event")
@@ -258,6 +405,89 @@ func TestDigestMembership(t *testing.T) {
 
 }
 
+func TestBatchMembership(t *testing.T) {
+
+	hasher := hashing.NewSha256Hasher()
+	keyDigests := []hashing.Digest{
+		hasher.Do([]byte("this is a sample event")),
+		hasher.Do([]byte("this is another sample event")),
+	}
+
+	query, _ := json.Marshal(protocol.BatchMembershipQuery{
+		KeyDigests: keyDigests,
+		Version:    1,
+	})
+
+	req, err := http.NewRequest("POST", "/proofs/membership/batch", bytes.NewBuffer(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := BatchMembership(fakeRaftBalloon{})
+	expectedResult := &protocol.BatchMembershipResult{
+		Entries: []*protocol.BatchMembershipEntry{
+			{KeyDigest: keyDigests[0], Exists: true, ActualVersion: 0},
+			{KeyDigest: keyDigests[1], Exists: true, ActualVersion: 1},
+		},
+		Hyper:          map[string]hashing.Digest{},
+		History:        map[string]hashing.Digest{},
+		CurrentVersion: 0x1,
+		QueryVersion:   0x1,
+	}
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	actualResult := new(protocol.BatchMembershipResult)
+	json.Unmarshal([]byte(rr.Body.String()), actualResult)
+
+	assert.Equal(t, expectedResult, actualResult, "Incorrect proof")
+
+	// a query without keys is rejected
+	req, _ = http.NewRequest("POST", "/proofs/membership/batch", bytes.NewBufferString(`{"Version":1}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+}
+
+func TestDigestMembershipBinary(t *testing.T) {
+
+	hasher := hashing.NewSha256Hasher()
+	query, _ := json.Marshal(protocol.MembershipDigest{
+		KeyDigest: hasher.Do([]byte("this is a sample event")),
+		Version:   1,
+	})
+
+	handler := DigestMembership(fakeRaftBalloon{})
+
+	req, err := http.NewRequest("POST", "/proofs/digest-membership", bytes.NewBuffer(query))
+	assert.NoError(t, err)
+	req.Header.Set("Accept", protocol.BinaryProofMediaType+", application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, protocol.BinaryProofMediaType, rr.Header().Get("Content-Type"))
+	assert.Equal(t, byte(protocol.BinaryProofVersion), rr.Body.Bytes()[0], "The proof should be binary encoded")
+
+	// clients that do not ask for it keep receiving JSON
+	req, err = http.NewRequest("POST", "/proofs/digest-membership", bytes.NewBuffer(query))
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, protocol.BinaryProofMediaType, rr.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), new(protocol.MembershipResult)))
+
+}
+
 func TestIncremental(t *testing.T) {
 	start := uint64(2)
 	end := uint64(8)
@@ -273,9 +503,9 @@ func TestIncremental(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := Incremental(fakeRaftBalloon{})
 	expectedResult := &protocol.IncrementalResponse{
-		start,
-		end,
-		map[string]hashing.Digest{"0|0": []uint8{0x0}},
+		Start:     start,
+		End:       end,
+		AuditPath: map[string]hashing.Digest{"0|0": []uint8{0x0}},
 	}
 
 	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
@@ -375,7 +605,7 @@ func newNodeBench(b *testing.B, id int) (*raftwal.RaftBalloon, func()) {
 
 	raftPath := fmt.Sprintf("/var/tmp/raft-test/node%d/raft", id)
 	os.MkdirAll(raftPath, os.FileMode(0755))
-	r, err := raftwal.NewRaftBalloon(raftPath, ":8301", fmt.Sprintf("%d", id), rocks, make(chan *protocol.Snapshot))
+	r, err := raftwal.NewRaftBalloon(raftPath, ":8301", fmt.Sprintf("%d", id), rocks, "", make(chan *protocol.Snapshot))
 	assert.NoError(b, err)
 
 	return r, closeF
@@ -18,9 +18,12 @@ package mgmthttp
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/bbva/qed/raftwal"
+	"github.com/bbva/qed/sign"
 )
 
 // NewMgmtHttp will return a mux server with the endpoint required to
@@ -29,6 +32,8 @@ import (
 func NewMgmtHttp(raftBalloon raftwal.RaftBalloonApi) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/join", joinHandle(raftBalloon))
+	mux.HandleFunc("/logs", logsHandle(raftBalloon))
+	mux.HandleFunc("/logs/", logHandle(raftBalloon))
 	return mux
 }
 
@@ -69,7 +74,12 @@ func joinHandle(raftBalloon raftwal.RaftBalloonApi) http.HandlerFunc {
 			metadata[k] = v.(string)
 		}
 
-		if err := raftBalloon.Join(nodeID, remoteAddr, metadata); err != nil {
+		err := raftBalloon.Join(nodeID, remoteAddr, metadata)
+		if err == raftwal.ErrHasherMismatch {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -77,3 +87,115 @@ func joinHandle(raftBalloon raftwal.RaftBalloonApi) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// logsHandle lists the logs hosted by the cluster on GET /logs, and
+// creates a new one on POST /logs with a body like {"id": "tenant"}.
+func logsHandle(raftBalloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			out, err := json.Marshal(raftBalloon.Logs())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(out)
+
+		case "POST":
+			var body struct {
+				Id string `json:"id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := raftwal.ValidateLogID(body.Id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err := raftBalloon.CreateLog(body.Id)
+			if err == raftwal.ErrLogExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// logHandle deletes a log and all its data on DELETE /logs/{id}.
+func logHandle(raftBalloon raftwal.RaftBalloonApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/logs/")
+		if id == "" || strings.Contains(id, "/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err := raftBalloon.DeleteLog(id)
+		if err == raftwal.ErrLogNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RotateKeyHandle makes a new key the active signing key of the server on
+// POST /keys/rotate with a body like {"privateKeyPath": "/path/to/key"}.
+// The new key is cross-signed by the previous one, published to the rest
+// of the cluster with publish, and returned.
+func RotateKeyHandle(keyring *sign.Keyring, publish func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			PrivateKeyPath string `json:"privateKeyPath"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.PrivateKeyPath == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		key, err := keyring.Rotate(body.PrivateKeyPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := publish(); err != nil {
+			http.Error(w, fmt.Sprintf("key %s is active but not published: %v", key.KeyId, err), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+}
@@ -17,6 +17,7 @@
 package balloon
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
@@ -32,12 +33,20 @@ import (
 
 var (
 	BalloonVersionKey = []byte("version")
+	// HyperVersionedSinceKey stores in the BalloonMetadataTable the first
+	// version whose hyper tree state can be queried. Stores created before
+	// versioning existed only keep the states after the first boot with it.
+	HyperVersionedSinceKey = []byte("versioned-since")
+	// TreeFormatKey stores in the BalloonMetadataTable the format of the
+	// trees. Stores created before formats existed follow hashing.TreeFormatV1.
+	TreeFormatKey = []byte("tree-format")
 )
 
 type Balloon struct {
-	version uint64
-	hasherF func() hashing.Hasher
-	store   storage.Store
+	version        uint64
+	versionedSince uint64
+	hasherF        func() hashing.Hasher
+	store          storage.Store
 
 	historyTree *history.HistoryTree
 	hyperTree   *hyper.HyperTree
@@ -46,6 +55,15 @@ type Balloon struct {
 
 func NewBalloon(store storage.Store, hasherF func() hashing.Hasher) (*Balloon, error) {
 
+	format, err := treeFormat(store)
+	if err != nil {
+		return nil, err
+	}
+	hasherF, err = hashing.NewTreeHasherF(hasherF, format)
+	if err != nil {
+		return nil, err
+	}
+
 	// create trees
 	historyTree := history.NewHistoryTree(hasherF, store, 300)
 	hyperTree := hyper.NewHyperTree(hasherF, store, cache.NewFreeCache(hyper.CacheSize))
@@ -60,11 +78,45 @@ func NewBalloon(store storage.Store, hasherF func() hashing.Hasher) (*Balloon, e
 	}
 
 	// update version
-	balloon.RefreshVersion()
+	if err := balloon.RefreshVersion(); err != nil {
+		balloon.Close()
+		return nil, err
+	}
 
 	return balloon, nil
 }
 
+// treeFormat returns the format of the trees of the store, recording
+// the current one if the store is empty.
+func treeFormat(store storage.Store) (int, error) {
+	kv, err := store.Get(storage.BalloonMetadataTable, TreeFormatKey)
+	if err == nil {
+		return int(util.BytesAsUint16(kv.Value)), nil
+	}
+	if err != storage.ErrKeyNotFound {
+		return 0, err
+	}
+
+	format := hashing.CurrentTreeFormat
+	_, err = store.GetLast(storage.HistoryCacheTable)
+	if err == nil {
+		format = hashing.TreeFormatV1
+	} else if err != storage.ErrKeyNotFound {
+		return 0, err
+	}
+
+	err = store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.BalloonMetadataTable, TreeFormatKey, util.Uint16AsBytes(uint16(format))),
+	})
+	return format, err
+}
+
+
+// TreeFormat returns the format of the trees of the balloon.
+func (b Balloon) TreeFormat() int {
+	return hashing.TreeFormat(b.hasher)
+}
+
 // Snapshot is the struct that has both history and hyper digest and the
 // current version for that rootNode digests.
 type Snapshot struct {
@@ -72,6 +124,7 @@ type Snapshot struct {
 	HistoryDigest hashing.Digest
 	HyperDigest   hashing.Digest
 	Version       uint64
+	TreeFormat    int
 }
 
 type Verifiable interface {
@@ -90,6 +143,9 @@ type MembershipProof struct {
 	ActualVersion  uint64 //required for consistency proof
 	KeyDigest      hashing.Digest
 	Hasher         hashing.Hasher
+	// ValueDigest is the digest of the value of the key when it was
+	// stored with Put, nil for events.
+	ValueDigest hashing.Digest
 }
 
 func NewMembershipProof(
@@ -101,14 +157,14 @@ func NewMembershipProof(
 	Hasher hashing.Hasher) *MembershipProof {
 
 	return &MembershipProof{
-		exists,
-		hyperProof,
-		historyProof,
-		currentVersion,
-		queryVersion,
-		actualVersion,
-		keyDigest,
-		Hasher,
+		Exists:         exists,
+		HyperProof:     hyperProof,
+		HistoryProof:   historyProof,
+		CurrentVersion: currentVersion,
+		QueryVersion:   queryVersion,
+		ActualVersion:  actualVersion,
+		KeyDigest:      keyDigest,
+		Hasher:         Hasher,
 	}
 }
 
@@ -116,22 +172,56 @@ func NewMembershipProof(
 // answer and proof are correct and consistent, otherwise false.
 // Run by a client on input that should be verified.
 func (p MembershipProof) DigestVerify(digest hashing.Digest, snapshot *Snapshot) bool {
-	if p.HyperProof == nil || p.HistoryProof == nil {
+	if p.HyperProof == nil {
 		return false
 	}
 
-	hyperCorrect := p.HyperProof.Verify(digest, snapshot.HyperDigest)
+	if !p.Exists {
+		return p.HyperProof.VerifyNonMembership(digest, snapshot.HyperDigest)
+	}
 
-	if p.Exists {
-		if p.ActualVersion <= p.QueryVersion {
-			historyCorrect := p.HistoryProof.Verify(digest, snapshot.HistoryDigest)
-			return hyperCorrect && historyCorrect
+	if p.HistoryProof == nil {
+		return false
+	}
+
+	historyDigest := digest
+	if p.ValueDigest != nil {
+		// the hyper leaf must commit to the value digest and its version,
+		// and the history tree stores the digest of the whole entry. Only
+		// trees which bind the keys to their leaves hold key-value entries.
+		if !hashing.BindsLeafKeys(p.Hasher) || !bytes.Equal(p.HyperProof.Value, hyper.KeyValue(p.ValueDigest, p.ActualVersion)) {
+			return false
 		}
+		historyDigest = EntryDigest(p.Hasher, digest, p.ValueDigest)
+	}
+
+	hyperCorrect := p.HyperProof.Verify(digest, snapshot.HyperDigest)
+
+	if p.ActualVersion <= p.QueryVersion {
+		historyCorrect := p.HistoryProof.Verify(historyDigest, snapshot.HistoryDigest)
+		return hyperCorrect && historyCorrect
 	}
 
 	return hyperCorrect
 }
 
+// DigestVerifyValue verifies a proof from QueryMembership of a key stored
+// with Put. Returns true if the proof is correct and proves that the
+// given value digest is the value of the key, otherwise false.
+func (p MembershipProof) DigestVerifyValue(keyDigest, valueDigest hashing.Digest, snapshot *Snapshot) bool {
+	if !p.Exists || !bytes.Equal(p.ValueDigest, valueDigest) {
+		return false
+	}
+	return p.DigestVerify(keyDigest, snapshot)
+}
+
+// VerifyValue verifies a proof from QueryMembership of a key stored
+// with Put against the expected value of the key.
+// Run by a client on input that should be verified.
+func (p MembershipProof) VerifyValue(key, value []byte, snapshot *Snapshot) bool {
+	return p.DigestVerifyValue(p.Hasher.Do(key), p.Hasher.Do(value), snapshot)
+}
+
 // Verify verifies a proof and answer from QueryMembership. Returns true if the
 // answer and proof are correct and consistent, otherwise false.
 // Run by a client on input that should be verified.
@@ -139,6 +229,91 @@ func (p MembershipProof) Verify(event []byte, snapshot *Snapshot) bool {
 	return p.DigestVerify(p.Hasher.Do(event), snapshot)
 }
 
+// BatchMembershipProof proves the membership or non-membership of several
+// keys in the same snapshot with a single hyper proof and a single history
+// proof. The answers for every key are in the same order as KeyDigests.
+type BatchMembershipProof struct {
+	Exists         []bool
+	HyperProof     *hyper.BatchQueryProof
+	HistoryProof   *history.BatchMembershipProof // nil if no key exists
+	CurrentVersion uint64
+	QueryVersion   uint64
+	ActualVersions []uint64
+	KeyDigests     []hashing.Digest
+	// ValueDigests holds the digests of the values of the keys stored
+	// with Put, nil for events and keys that do not exist.
+	ValueDigests []hashing.Digest
+	Hasher       hashing.Hasher
+}
+
+// DigestVerify verifies a proof and answer from QueryBatchMembership for
+// the given key digests. Returns true if the answers and proof are correct
+// and consistent for every key, otherwise false.
+// Run by a client on input that should be verified.
+func (p BatchMembershipProof) DigestVerify(digests []hashing.Digest, snapshot *Snapshot) bool {
+	if p.HyperProof == nil || len(digests) == 0 {
+		return false
+	}
+
+	n := len(digests)
+	if len(p.KeyDigests) != n || len(p.Exists) != n || len(p.ActualVersions) != n || len(p.ValueDigests) != n || len(p.HyperProof.Entries) != n {
+		return false
+	}
+
+	var indexes []uint64
+	var historyDigests []hashing.Digest
+	for i, digest := range digests {
+		if !bytes.Equal(p.KeyDigests[i], digest) {
+			return false
+		}
+		value := p.HyperProof.Entries[i].Value
+		if p.Exists[i] != (len(value) > 0) {
+			return false
+		}
+		if !p.Exists[i] {
+			continue
+		}
+		historyDigest := digest
+		if p.ValueDigests[i] != nil {
+			// the hyper leaf must commit to the value digest and its version,
+			// and the history tree stores the digest of the whole entry
+			if !hashing.BindsLeafKeys(p.Hasher) || !bytes.Equal(value, hyper.KeyValue(p.ValueDigests[i], p.ActualVersions[i])) {
+				return false
+			}
+			historyDigest = EntryDigest(p.Hasher, digest, p.ValueDigests[i])
+		}
+		indexes = append(indexes, p.ActualVersions[i])
+		historyDigests = append(historyDigests, historyDigest)
+	}
+
+	if !p.HyperProof.Verify(digests, snapshot.HyperDigest) {
+		return false
+	}
+
+	if len(indexes) == 0 {
+		return true
+	}
+	if p.HistoryProof == nil || len(p.HistoryProof.Indexes) != len(indexes) {
+		return false
+	}
+	for i, index := range indexes {
+		if p.HistoryProof.Indexes[i] != index {
+			return false
+		}
+	}
+	return p.HistoryProof.Verify(historyDigests, snapshot.HistoryDigest)
+}
+
+// Verify verifies a proof and answer from QueryBatchMembership for the
+// given events. Run by a client on input that should be verified.
+func (p BatchMembershipProof) Verify(events [][]byte, snapshot *Snapshot) bool {
+	digests := make([]hashing.Digest, len(events))
+	for i, event := range events {
+		digests[i] = p.Hasher.Do(event)
+	}
+	return p.DigestVerify(digests, snapshot)
+}
+
 type IncrementalProof struct {
 	Start, End uint64
 	AuditPath  history.AuditPath
@@ -177,7 +352,23 @@ func (b *Balloon) RefreshVersion() error {
 	} else {
 		b.version = util.BytesAsUint64(kv.Key[:8]) + 1
 	}
-	return nil
+	return b.refreshVersionedSince()
+}
+
+func (b *Balloon) refreshVersionedSince() error {
+	kv, err := b.store.Get(storage.BalloonMetadataTable, HyperVersionedSinceKey)
+	if err == nil {
+		b.versionedSince = util.BytesAsUint64(kv.Value)
+		return nil
+	}
+	if err != storage.ErrKeyNotFound {
+		return err
+	}
+	// past states are only available from now on
+	b.versionedSince = b.version
+	return b.store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.BalloonMetadataTable, HyperVersionedSinceKey, util.Uint64AsBytes(b.versionedSince)),
+	})
 }
 
 func (b *Balloon) Add(event []byte) (*Snapshot, []*storage.Mutation, error) {
@@ -223,6 +414,70 @@ func (b *Balloon) Add(event []byte) (*Snapshot, []*storage.Mutation, error) {
 		HistoryDigest: historyDigest,
 		HyperDigest:   hyperDigest,
 		Version:       version,
+		TreeFormat:    b.TreeFormat(),
+	}
+
+	// Increment version
+	stats.Set("version", metrics.Uint64ToVar(version))
+
+	return snapshot, mutations, nil
+}
+
+// Put stores the digest of a value under the digest of a key, replacing
+// the previous value of the key if any. The history tree records the
+// entry digest of the pair, while the hyper tree keeps the value digest
+// and its version so membership proofs prove the latest value of the key.
+func (b *Balloon) Put(key, value []byte) (*Snapshot, []*storage.Mutation, error) {
+
+	// Activate metrics gathering
+	stats := metrics.Balloon
+
+	// Trees of older formats do not bind the leaves to their keys
+	if !hashing.BindsLeafKeys(b.hasher) {
+		return nil, nil, fmt.Errorf("unable to put a key in a tree of format %d", b.TreeFormat())
+	}
+
+	// Get version
+	version := b.version
+	b.version++
+
+	// Hash key and value
+	keyDigest := b.hasher.Do(key)
+	valueDigest := b.hasher.Do(value)
+	entryDigest := EntryDigest(b.hasher, keyDigest, valueDigest)
+
+	// Update trees
+	var historyDigest hashing.Digest
+	var historyMutations []*storage.Mutation
+	var historyErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		historyDigest, historyMutations, historyErr = b.historyTree.Add(entryDigest, version)
+		wg.Done()
+	}()
+
+	hyperDigest, mutations, hyperErr := b.hyperTree.Put(keyDigest, valueDigest, version)
+
+	wg.Wait()
+
+	if historyErr != nil {
+		return nil, nil, historyErr
+	}
+	if hyperErr != nil {
+		return nil, nil, hyperErr
+	}
+
+	// Append trees mutations
+	mutations = append(mutations, historyMutations...)
+
+	snapshot := &Snapshot{
+		EventDigest:   keyDigest,
+		HistoryDigest: historyDigest,
+		HyperDigest:   hyperDigest,
+		Version:       version,
+		TreeFormat:    b.TreeFormat(),
 	}
 
 	// Increment version
@@ -231,6 +486,77 @@ func (b *Balloon) Add(event []byte) (*Snapshot, []*storage.Mutation, error) {
 	return snapshot, mutations, nil
 }
 
+// EntryDigest returns the digest that the history tree stores for a
+// key-value entry.
+func EntryDigest(hasher hashing.Hasher, keyDigest, valueDigest hashing.Digest) hashing.Digest {
+	return hasher.Do(keyDigest, valueDigest)
+}
+
+// AddBulk adds a sequence of events with consecutive versions. It returns
+// one snapshot per event, in order, and the mutations of both trees folded
+// together so they can be persisted in a single write.
+func (b *Balloon) AddBulk(bulk [][]byte) ([]*Snapshot, []*storage.Mutation, error) {
+
+	if len(bulk) == 0 {
+		return nil, nil, errors.New("unable to add an empty bulk")
+	}
+
+	// Activate metrics gathering
+	stats := metrics.Balloon
+
+	// Get initial version
+	initialVersion := b.version
+	b.version += uint64(len(bulk))
+
+	// Hash events
+	eventDigests := make([]hashing.Digest, len(bulk))
+	for i, event := range bulk {
+		eventDigests[i] = b.hasher.Do(event)
+	}
+
+	// Update trees
+	var historyDigests []hashing.Digest
+	var historyMutations []*storage.Mutation
+	var historyErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		historyDigests, historyMutations, historyErr = b.historyTree.AddBulk(eventDigests, initialVersion)
+		wg.Done()
+	}()
+
+	hyperDigests, mutations, hyperErr := b.hyperTree.AddBulk(eventDigests, initialVersion)
+
+	wg.Wait()
+
+	if historyErr != nil {
+		return nil, nil, historyErr
+	}
+	if hyperErr != nil {
+		return nil, nil, hyperErr
+	}
+
+	// Append trees mutations
+	mutations = append(mutations, historyMutations...)
+
+	snapshots := make([]*Snapshot, len(bulk))
+	for i := range bulk {
+		snapshots[i] = &Snapshot{
+			EventDigest:   eventDigests[i],
+			HistoryDigest: historyDigests[i],
+			HyperDigest:   hyperDigests[i],
+			Version:       initialVersion + uint64(i),
+			TreeFormat:    b.TreeFormat(),
+		}
+	}
+
+	// Increment version
+	stats.Set("version", metrics.Uint64ToVar(b.version-1))
+
+	return snapshots, mutations, nil
+}
+
 func (b Balloon) QueryDigestMembership(keyDigest hashing.Digest, version uint64) (*MembershipProof, error) {
 
 	var proof MembershipProof
@@ -244,7 +570,16 @@ func (b Balloon) QueryDigestMembership(keyDigest hashing.Digest, version uint64)
 		version = proof.CurrentVersion
 	}
 
-	proof.HyperProof, err = b.hyperTree.QueryMembership(keyDigest)
+	if version == proof.CurrentVersion {
+		proof.HyperProof, err = b.hyperTree.QueryMembership(keyDigest)
+	} else {
+		if version < b.versionedSince {
+			return nil, fmt.Errorf("unable to get proof from hyper tree: state at version %d is not available, only since version %d", version, b.versionedSince)
+		}
+		// query the state of the hyper tree at that version so the
+		// proof verifies against the snapshot of that version
+		proof.HyperProof, err = b.hyperTree.QueryMembershipAt(keyDigest, version)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to get proof from hyper tree: %v", err)
 	}
@@ -255,14 +590,11 @@ func (b Balloon) QueryDigestMembership(keyDigest hashing.Digest, version uint64)
 		return &proof, nil
 	}
 
+	var ok bool
 	proof.Exists = true
-	if versionLen := len(proof.HyperProof.Value); versionLen < 8 { // TODO GET RID OF THIS: used only to pass tests
-		// the version is stored in the hyper tree with the length of the event digest
-		// if the length of the value is less than the length of a uint64 in bytes, we have to add padding
-		proof.ActualVersion = util.BytesAsUint64(util.AddPaddingToBytes(proof.HyperProof.Value, 8-versionLen))
-	} else {
-		// if the length of the value is greater or equal than the length of a uint64 in bytes, we have to truncate
-		proof.ActualVersion = util.BytesAsUint64(proof.HyperProof.Value[versionLen-8:])
+	proof.ValueDigest, proof.ActualVersion, ok = hyper.ParseLeafValue(b.hasher, proof.HyperProof.Value)
+	if !ok {
+		return nil, fmt.Errorf("unable to parse the hyper leaf of key %x", keyDigest)
 	}
 
 	if proof.ActualVersion <= version {
@@ -282,6 +614,69 @@ func (b Balloon) QueryMembership(event []byte, version uint64) (*MembershipProof
 	return b.QueryDigestMembership(hasher.Do(event), version)
 }
 
+// QueryBatchMembership returns a single proof of membership or
+// non-membership of all the given key digests in the given version.
+// The hyper and history paths of the keys share their common siblings.
+func (b Balloon) QueryBatchMembership(keyDigests []hashing.Digest, version uint64) (*BatchMembershipProof, error) {
+
+	if len(keyDigests) == 0 {
+		return nil, errors.New("unable to process batch proof: no keys")
+	}
+
+	var proof BatchMembershipProof
+	var err error
+	proof.Hasher = b.hasherF()
+	proof.KeyDigests = keyDigests
+	proof.QueryVersion = version
+	proof.CurrentVersion = b.version - 1
+
+	if version > proof.CurrentVersion {
+		version = proof.CurrentVersion
+	}
+
+	if version == proof.CurrentVersion {
+		proof.HyperProof, err = b.hyperTree.QueryBatchMembership(keyDigests)
+	} else {
+		if version < b.versionedSince {
+			return nil, fmt.Errorf("unable to get proof from hyper tree: state at version %d is not available, only since version %d", version, b.versionedSince)
+		}
+		proof.HyperProof, err = b.hyperTree.QueryBatchMembershipAt(keyDigests, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get proof from hyper tree: %v", err)
+	}
+
+	proof.Exists = make([]bool, len(keyDigests))
+	proof.ActualVersions = make([]uint64, len(keyDigests))
+	proof.ValueDigests = make([]hashing.Digest, len(keyDigests))
+	var indexes []uint64
+	for i, entry := range proof.HyperProof.Entries {
+		if len(entry.Value) == 0 {
+			proof.ActualVersions[i] = version
+			continue
+		}
+		var ok bool
+		proof.Exists[i] = true
+		proof.ValueDigests[i], proof.ActualVersions[i], ok = hyper.ParseLeafValue(b.hasher, entry.Value)
+		if !ok {
+			return nil, fmt.Errorf("unable to parse the hyper leaf of key %x", keyDigests[i])
+		}
+		if proof.ActualVersions[i] > version {
+			return nil, fmt.Errorf("query version %d is greater than the actual version which is %d", version, proof.ActualVersions[i])
+		}
+		indexes = append(indexes, proof.ActualVersions[i])
+	}
+
+	if len(indexes) > 0 {
+		proof.HistoryProof, err = b.historyTree.ProveBatchMembership(indexes, version)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get proof from history tree: %v", err)
+		}
+	}
+
+	return &proof, nil
+}
+
 func (b Balloon) QueryConsistency(start, end uint64) (*IncrementalProof, error) {
 
 	stats := metrics.Balloon
@@ -26,6 +26,7 @@ import (
 
 	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
 	metrics_utils "github.com/bbva/qed/testutils/metrics"
 	"github.com/bbva/qed/testutils/rand"
 	storage_utils "github.com/bbva/qed/testutils/storage"
@@ -55,6 +56,143 @@ func TestAdd(t *testing.T) {
 
 }
 
+func TestAddBulk(t *testing.T) {
+
+	log.SetLogger("TestAddBulk", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	bulkStore, closeBulkF := storage_utils.OpenBPlusTreeStore()
+	defer closeBulkF()
+
+	bulkBalloon, err := NewBalloon(bulkStore, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	events := make([][]byte, 100)
+	for i := range events {
+		events[i] = rand.Bytes(128)
+	}
+
+	snapshots, mutations, err := bulkBalloon.AddBulk(events)
+	require.NoError(t, err)
+	require.NoError(t, bulkStore.Mutate(mutations))
+	require.Len(t, snapshots, len(events))
+	assert.Equal(t, uint64(len(events)), bulkBalloon.Version())
+
+	for i, event := range events {
+		snapshot, mutations, err := balloon.Add(event)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		assert.Equalf(t, snapshot, snapshots[i], "The snapshots should match in test %d", i)
+	}
+
+	lastSnapshot := snapshots[len(snapshots)-1]
+	for i, event := range events {
+		proof, err := bulkBalloon.QueryMembership(event, lastSnapshot.Version)
+		require.NoError(t, err)
+		assert.Truef(t, proof.Verify(event, lastSnapshot), "The proof should verify correctly in test %d", i)
+	}
+
+	_, _, err = bulkBalloon.AddBulk(nil)
+	require.Error(t, err, "An empty bulk should fail")
+
+}
+
+func TestPut(t *testing.T) {
+
+	log.SetLogger("TestPut", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	values := [][]byte{[]byte("first value"), []byte("second value")}
+
+	snapshots := make([]*Snapshot, 0)
+	for _, value := range values {
+		snapshot, mutations, err := balloon.Put(key, value)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		snapshots = append(snapshots, snapshot)
+
+		// other events do not interfere with the key
+		snapshot, mutations, err = balloon.Add(rand.Bytes(128))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		snapshots = append(snapshots, snapshot)
+	}
+
+	lastSnapshot := snapshots[len(snapshots)-1]
+	proof, err := balloon.QueryMembership(key, lastSnapshot.Version)
+	require.NoError(t, err)
+	require.True(t, proof.Exists, "The key should exist")
+	assert.Equal(t, snapshots[2].Version, proof.ActualVersion, "The actual version should be the one of the last put")
+	assert.Equal(t, balloon.hasher.Do(values[1]), proof.ValueDigest, "The value digest should be the one of the last put")
+	assert.True(t, proof.Verify(key, lastSnapshot), "The proof should verify correctly")
+	assert.True(t, proof.VerifyValue(key, values[1], lastSnapshot), "The proof should verify the last value")
+	assert.False(t, proof.VerifyValue(key, values[0], lastSnapshot), "The proof should not verify a previous value")
+
+	// the value at a previous version
+	proof, err = balloon.QueryMembership(key, snapshots[1].Version)
+	require.NoError(t, err)
+	assert.True(t, proof.VerifyValue(key, values[0], snapshots[1]), "The proof should verify the value at that version")
+
+	// a tampered value digest does not verify
+	proof.ValueDigest = balloon.hasher.Do(values[1])
+	assert.False(t, proof.Verify(key, snapshots[1]), "A tampered proof should not verify")
+
+}
+
+func TestTreeFormat(t *testing.T) {
+
+	log.SetLogger("TestTreeFormat", log.SILENT)
+
+	// new stores use the current format
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.Equal(t, hashing.CurrentTreeFormat, balloon.TreeFormat())
+
+	event := rand.Bytes(128)
+	snapshot, mutations, err := balloon.Add(event)
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations))
+
+	proof, err := balloon.QueryMembership(event, snapshot.Version)
+	require.NoError(t, err)
+	require.True(t, proof.Verify(event, snapshot), "The proof should verify in the current format")
+
+	// the format is kept after reopening the store
+	balloon, err = NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.Equal(t, hashing.CurrentTreeFormat, balloon.TreeFormat())
+
+	// stores with data and no format were built with the first one
+	oldStore, closeOldF := storage_utils.OpenBPlusTreeStore()
+	defer closeOldF()
+
+	oldBalloon, err := NewBalloon(oldStore, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	_, mutations, err = oldBalloon.Add(event)
+	require.NoError(t, err)
+	require.NoError(t, oldStore.Mutate(mutations))
+	require.NoError(t, oldStore.DeleteRange(storage.BalloonMetadataTable, TreeFormatKey, append(TreeFormatKey, 0x0)))
+
+	oldBalloon, err = NewBalloon(oldStore, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.Equal(t, hashing.TreeFormatV1, oldBalloon.TreeFormat())
+
+}
+
 func TestQueryMembership(t *testing.T) {
 
 	log.SetLogger("TestQueryMembership", log.SILENT)
@@ -97,6 +235,79 @@ func TestQueryMembership(t *testing.T) {
 
 }
 
+func TestQueryMembershipAtPastVersion(t *testing.T) {
+
+	log.SetLogger("TestQueryMembershipAtPastVersion", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	numEvents := 10
+	events := make([][]byte, numEvents)
+	snapshots := make([]*Snapshot, numEvents)
+	for i := range events {
+		events[i] = rand.Bytes(128)
+		snapshot, mutations, err := balloon.Add(events[i])
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		snapshots[i] = snapshot
+	}
+
+	for version := range snapshots {
+		for i, event := range events {
+			proof, err := balloon.QueryMembership(event, uint64(version))
+			require.NoError(t, err)
+			assert.Equalf(t, i <= version, proof.Exists, "Wrong existence for event %d at version %d", i, version)
+			assert.Truef(t, proof.Verify(event, snapshots[version]), "The proof should verify for event %d at version %d", i, version)
+		}
+	}
+
+	// reopen the balloon: past states remain available
+	balloon.Close()
+	balloon, err = NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	proof, err := balloon.QueryMembership(events[5], uint64(3))
+	require.NoError(t, err)
+	assert.False(t, proof.Exists, "The event should not exist at a previous version")
+	assert.True(t, proof.Verify(events[5], snapshots[3]), "The non-membership proof should verify")
+	assert.False(t, proof.Verify(events[5], snapshots[numEvents-1]), "The non-membership proof should not verify against a later snapshot")
+
+}
+
+func TestQueryMembershipBeforeVersionedSince(t *testing.T) {
+
+	log.SetLogger("TestQueryMembershipBeforeVersionedSince", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, mutations, err := balloon.Add(rand.Bytes(128))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+	}
+
+	// simulate a tree built before past states were recorded
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.BalloonMetadataTable, HyperVersionedSinceKey, util.Uint64AsBytes(3)),
+	}))
+	require.NoError(t, balloon.RefreshVersion())
+
+	_, err = balloon.QueryMembership(rand.Bytes(128), uint64(2))
+	require.Error(t, err, "Querying a version before the versioned-since marker should fail")
+
+	_, err = balloon.QueryMembership(rand.Bytes(128), uint64(3))
+	require.NoError(t, err)
+
+}
+
 func TestQueryConsistencyProof(t *testing.T) {
 
 	log.SetLogger("TestQueryConsistencyProof", log.SILENT)
@@ -309,3 +520,57 @@ func BenchmarkQueryRocksDBParallel(b *testing.B) {
 	})
 
 }
+
+func TestQueryBatchMembership(t *testing.T) {
+
+	log.SetLogger("TestQueryBatchMembership", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	hasher := hashing.NewSha256Hasher()
+
+	numEvents := 10
+	digests := make([]hashing.Digest, 0)
+	snapshots := make([]*Snapshot, 0)
+	for i := 0; i < numEvents; i++ {
+		event := rand.Bytes(128)
+		snapshot, mutations, err := balloon.Add(event)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		digests = append(digests, hasher.Do(event))
+		snapshots = append(snapshots, snapshot)
+	}
+	snapshot, mutations, err := balloon.Put([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations))
+	digests = append(digests, hasher.Do([]byte("key")))
+	snapshots = append(snapshots, snapshot)
+
+	// a key that does not exist
+	digests = append(digests, hasher.Do([]byte("missing")))
+
+	last := uint64(len(snapshots) - 1)
+	proof, err := balloon.QueryBatchMembership(digests, last)
+	require.NoError(t, err)
+	assert.Equal(t, hasher.Do([]byte("value")), proof.ValueDigests[numEvents], "The value digest of the key should be proved")
+	assert.False(t, proof.Exists[numEvents+1], "The missing key should not exist")
+	assert.True(t, proof.DigestVerify(digests, snapshots[last]), "The batch proof should verify")
+	assert.False(t, proof.DigestVerify(digests, snapshots[last-1]), "The batch proof should not verify against another snapshot")
+
+	proof.ValueDigests[numEvents] = hasher.Do([]byte("other value"))
+	assert.False(t, proof.DigestVerify(digests, snapshots[last]), "The batch proof should not verify another value")
+
+	proof, err = balloon.QueryBatchMembership(digests, 4)
+	require.NoError(t, err)
+	for i := range digests {
+		assert.Equalf(t, i <= 4, proof.Exists[i], "Wrong existence for key %d at version 4", i)
+	}
+	assert.True(t, proof.DigestVerify(digests, snapshots[4]), "The batch proof should verify at a past version")
+
+	_, err = balloon.QueryBatchMembership(nil, last)
+	assert.Error(t, err, "A batch without keys cannot be proved")
+
+}
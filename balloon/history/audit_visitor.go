@@ -43,18 +43,18 @@ func (v auditPathVisitor) Result() AuditPath {
 }
 
 func (v *auditPathVisitor) VisitLeafHashOp(op leafHashOp) hashing.Digest {
-	return v.hasher.Salted(op.Position().Bytes(), op.Value)
+	return hashing.LeafHash(v.hasher, op.Position().Bytes(), op.Value)
 }
 
 func (v *auditPathVisitor) VisitInnerHashOp(op innerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
 	rightHash := op.Right.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash, rightHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash, rightHash)
 }
 
 func (v *auditPathVisitor) VisitPartialInnerHashOp(op partialInnerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash)
 }
 
 func (v *auditPathVisitor) VisitGetCacheOp(op getCacheOp) hashing.Digest {
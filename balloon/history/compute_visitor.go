@@ -36,18 +36,18 @@ func newComputeHashVisitor(hasher hashing.Hasher, cache cache.Cache) *computeHas
 }
 
 func (v *computeHashVisitor) VisitLeafHashOp(op leafHashOp) hashing.Digest {
-	return v.hasher.Salted(op.Position().Bytes(), op.Value)
+	return hashing.LeafHash(v.hasher, op.Position().Bytes(), op.Value)
 }
 
 func (v *computeHashVisitor) VisitInnerHashOp(op innerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
 	rightHash := op.Right.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash, rightHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash, rightHash)
 }
 
 func (v *computeHashVisitor) VisitPartialInnerHashOp(op partialInnerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash)
 }
 
 func (v *computeHashVisitor) VisitGetCacheOp(op getCacheOp) hashing.Digest {
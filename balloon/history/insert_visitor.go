@@ -46,18 +46,18 @@ func (v insertVisitor) Result() []*storage.Mutation {
 }
 
 func (v *insertVisitor) VisitLeafHashOp(op leafHashOp) hashing.Digest {
-	return v.hasher.Salted(op.Position().Bytes(), op.Value)
+	return hashing.LeafHash(v.hasher, op.Position().Bytes(), op.Value)
 }
 
 func (v *insertVisitor) VisitInnerHashOp(op innerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
 	rightHash := op.Right.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash, rightHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash, rightHash)
 }
 
 func (v *insertVisitor) VisitPartialInnerHashOp(op partialInnerHashOp) hashing.Digest {
 	leftHash := op.Left.Accept(v)
-	return v.hasher.Salted(op.Position().Bytes(), leftHash)
+	return hashing.InteriorHash(v.hasher, op.Position().Bytes(), leftHash)
 }
 
 func (v *insertVisitor) VisitGetCacheOp(op getCacheOp) hashing.Digest {
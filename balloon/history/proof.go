@@ -85,6 +85,60 @@ func (p MembershipProof) Verify(eventDigest []byte, expectedRootHash hashing.Dig
 	return bytes.Equal(recomputed, expectedRootHash)
 }
 
+// BatchMembershipProof proves the membership of several events in the
+// same version of the tree. Its audit path holds each sibling just once
+// and omits the nodes that can be computed from the other events.
+type BatchMembershipProof struct {
+	AuditPath AuditPath
+	Indexes   []uint64
+	Version   uint64
+	hasher    hashing.Hasher
+}
+
+func NewBatchMembershipProof(indexes []uint64, version uint64, auditPath AuditPath, hasher hashing.Hasher) *BatchMembershipProof {
+	return &BatchMembershipProof{
+		AuditPath: auditPath,
+		Indexes:   indexes,
+		Version:   version,
+		hasher:    hasher,
+	}
+}
+
+// Verify verifies a batch membership proof for the given event digests,
+// in the same order as the indexes of the proof.
+func (p BatchMembershipProof) Verify(eventDigests []hashing.Digest, expectedRootHash hashing.Digest) (correct bool) {
+
+	log.Debugf("Verifying batch membership proof for %d indexes and version %d", len(p.Indexes), p.Version)
+
+	if len(eventDigests) == 0 || len(eventDigests) != len(p.Indexes) {
+		return false
+	}
+
+	digests := make(map[uint64]hashing.Digest, len(p.Indexes))
+	for i, index := range p.Indexes {
+		if index > p.Version {
+			return false
+		}
+		if digest, ok := digests[index]; ok && !bytes.Equal(digest, eventDigests[i]) {
+			return false
+		}
+		digests[index] = eventDigests[i]
+	}
+
+	// the compute visitor panics if the audit path lacks some hash
+	defer func() {
+		if r := recover(); r != nil {
+			correct = false
+		}
+	}()
+
+	// build a visitable pruned tree and then visit it to recompute root hash
+	visitor := newComputeHashVisitor(p.hasher, p.AuditPath)
+	recomputed := pruneToVerifyBatch(p.Version, digests).Accept(visitor)
+
+	return bytes.Equal(recomputed, expectedRootHash)
+}
+
 type IncrementalProof struct {
 	AuditPath                AuditPath
 	StartVersion, EndVersion uint64
@@ -45,3 +45,52 @@ func pruneToFind(version uint64) operation {
 
 	return traverse(newRootPosition(version))
 }
+
+func pruneToFindBatch(indexes targets, version uint64) operation {
+
+	requested := make(map[uint64]bool, len(indexes))
+	for _, index := range indexes {
+		requested[index] = true
+	}
+
+	var traverse func(pos *position, targets targets, shortcut bool) operation
+	traverse = func(pos *position, targets targets, shortcut bool) operation {
+
+		if len(targets) == 0 {
+			if !shortcut {
+				return newCollectOp(newGetCacheOp(pos))
+			}
+			return newGetCacheOp(pos)
+		}
+
+		if pos.IsLeaf() {
+			if requested[pos.Index] {
+				return newLeafHashOp(pos, nil)
+			}
+			if !shortcut {
+				return newCollectOp(newGetCacheOp(pos))
+			}
+			return newGetCacheOp(pos)
+		}
+
+		// the subtree of the last version is not frozen, so its
+		// hash must be computed and collected as a whole
+		if len(targets) == 1 && !requested[targets[0]] && !shortcut {
+			return newCollectOp(traverse(pos, targets, true))
+		}
+
+		rightPos := pos.Right()
+		leftTargets, rightTargets := targets.Split(rightPos.Index)
+
+		left := traverse(pos.Left(), leftTargets, shortcut)
+		right := traverse(rightPos, rightTargets, shortcut)
+
+		if rightPos.Index > version { // partial
+			return newPartialInnerHashOp(pos, left)
+		}
+		return newInnerHashOp(pos, left, right)
+
+	}
+
+	return traverse(newRootPosition(version), indexes.InsertSorted(version), false)
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"fmt"
+
+	"github.com/bbva/qed/hashing"
+)
+
+// siblingsVisitor collects the positions a verification takes from the
+// audit path, in the order they are used and without repetitions.
+type siblingsVisitor struct {
+	positions []*position
+	seen      map[[keySize]byte]bool
+}
+
+func newSiblingsVisitor() *siblingsVisitor {
+	return &siblingsVisitor{seen: make(map[[keySize]byte]bool)}
+}
+
+func (v *siblingsVisitor) VisitLeafHashOp(op leafHashOp) hashing.Digest {
+	return nil
+}
+
+func (v *siblingsVisitor) VisitInnerHashOp(op innerHashOp) hashing.Digest {
+	op.Left.Accept(v)
+	op.Right.Accept(v)
+	return nil
+}
+
+func (v *siblingsVisitor) VisitPartialInnerHashOp(op partialInnerHashOp) hashing.Digest {
+	op.Left.Accept(v)
+	return nil
+}
+
+func (v *siblingsVisitor) VisitGetCacheOp(op getCacheOp) hashing.Digest {
+	key := op.Position().FixedBytes()
+	if !v.seen[key] {
+		v.seen[key] = true
+		v.positions = append(v.positions, op.Position())
+	}
+	return nil
+}
+
+func (v *siblingsVisitor) VisitPutCacheOp(op putCacheOp) hashing.Digest {
+	return op.operation.Accept(v)
+}
+
+func (v *siblingsVisitor) VisitMutateOp(op mutateOp) hashing.Digest {
+	return op.operation.Accept(v)
+}
+
+func (v *siblingsVisitor) VisitCollectOp(op collectOp) hashing.Digest {
+	return op.operation.Accept(v)
+}
+
+func membershipPositions(index, version uint64) []*position {
+	visitor := newSiblingsVisitor()
+	pruneToVerify(index, version, nil).Accept(visitor)
+	return visitor.positions
+}
+
+func incrementalPositions(start, end uint64) []*position {
+	visitor := newSiblingsVisitor()
+	pruneToVerifyIncrementalStart(start).Accept(visitor)
+	pruneToVerifyIncrementalEnd(start, end).Accept(visitor)
+	return visitor.positions
+}
+
+// MembershipSiblings returns the digests of the audit path of a membership
+// proof for the given index and version in the order the verification
+// uses them, so they can be sent without their positions.
+func (p AuditPath) MembershipSiblings(index, version uint64) ([]hashing.Digest, error) {
+	return p.siblings(membershipPositions(index, version))
+}
+
+// IncrementalSiblings returns the digests of the audit path of an
+// incremental proof between the given versions in the order the
+// verification uses them.
+func (p AuditPath) IncrementalSiblings(start, end uint64) ([]hashing.Digest, error) {
+	return p.siblings(incrementalPositions(start, end))
+}
+
+// NewMembershipAuditPath rebuilds the audit path of a membership proof
+// from the digests returned by MembershipSiblings.
+func NewMembershipAuditPath(index, version uint64, siblings []hashing.Digest) (AuditPath, error) {
+	return newAuditPathFromSiblings(membershipPositions(index, version), siblings)
+}
+
+// NewIncrementalAuditPath rebuilds the audit path of an incremental proof
+// from the digests returned by IncrementalSiblings.
+func NewIncrementalAuditPath(start, end uint64, siblings []hashing.Digest) (AuditPath, error) {
+	return newAuditPathFromSiblings(incrementalPositions(start, end), siblings)
+}
+
+func (p AuditPath) siblings(positions []*position) ([]hashing.Digest, error) {
+	siblings := make([]hashing.Digest, len(positions))
+	for i, pos := range positions {
+		digest, ok := p.Get(pos.Bytes())
+		if !ok {
+			return nil, fmt.Errorf("missing digest at position %v in audit path", pos)
+		}
+		siblings[i] = digest
+	}
+	return siblings, nil
+}
+
+func newAuditPathFromSiblings(positions []*position, siblings []hashing.Digest) (AuditPath, error) {
+	if len(positions) != len(siblings) {
+		return nil, fmt.Errorf("expected %d digests in audit path, got %d", len(positions), len(siblings))
+	}
+	auditPath := make(AuditPath, len(positions))
+	for i, pos := range positions {
+		auditPath[pos.FixedBytes()] = siblings[i]
+	}
+	return auditPath, nil
+}
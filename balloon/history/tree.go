@@ -17,6 +17,9 @@
 package history
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/bbva/qed/balloon/cache"
 	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/storage"
@@ -56,6 +59,24 @@ func (t *HistoryTree) Add(eventDigest hashing.Digest, version uint64) (hashing.D
 	return rh, visitor.Result(), nil
 }
 
+// AddBulk inserts a sequence of event digests with consecutive versions
+// starting at initialVersion. It returns the root hash obtained after each
+// insertion and the mutations of the whole sequence, in order.
+func (t *HistoryTree) AddBulk(eventDigests []hashing.Digest, initialVersion uint64) ([]hashing.Digest, []*storage.Mutation, error) {
+
+	// frozen nodes of previous insertions are not persisted yet and
+	// could be evicted from the write cache before being needed again
+	pending := newPendingCache(t.writeCache)
+
+	visitor := newInsertVisitor(t.hasher, pending, storage.HistoryCacheTable)
+	rootHashes := make([]hashing.Digest, len(eventDigests))
+	for i, eventDigest := range eventDigests {
+		rootHashes[i] = pruneToInsert(initialVersion+uint64(i), eventDigest).Accept(visitor)
+	}
+
+	return rootHashes, visitor.Result(), nil
+}
+
 func (t *HistoryTree) ProveMembership(index, version uint64) (*MembershipProof, error) {
 
 	//log.Debugf("Proving membership for index %d with version %d", index, version)
@@ -72,6 +93,29 @@ func (t *HistoryTree) ProveMembership(index, version uint64) (*MembershipProof,
 	return proof, nil
 }
 
+// ProveBatchMembership returns a single proof of membership of the events
+// at the given indexes in the given version of the tree.
+func (t *HistoryTree) ProveBatchMembership(indexes []uint64, version uint64) (*BatchMembershipProof, error) {
+
+	targets := make(targets, 0, len(indexes))
+	for _, index := range indexes {
+		if index > version {
+			return nil, fmt.Errorf("index %d is greater than version %d", index, version)
+		}
+		targets = targets.InsertSorted(index)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no indexes to prove")
+	}
+
+	// build a visitable pruned tree and then visit it to collect the audit path
+	visitor := newAuditPathVisitor(t.hasherF(), t.readCache)
+	pruneToFindBatch(targets, version).Accept(visitor)
+
+	proof := NewBatchMembershipProof(indexes, version, visitor.Result(), t.hasherF())
+	return proof, nil
+}
+
 func (t *HistoryTree) ProveConsistency(start, end uint64) (*IncrementalProof, error) {
 
 	//log.Debugf("Proving consistency between versions %d and %d", start, end)
@@ -90,3 +134,30 @@ func (t *HistoryTree) Close() {
 	t.writeCache = nil
 	t.readCache = nil
 }
+
+// pendingCache keeps every value put during a bulk insertion on top
+// of the write cache, so later insertions of the same bulk always
+// find them.
+type pendingCache struct {
+	cache.ModifiableCache
+	pending *cache.SimpleCache
+}
+
+func newPendingCache(c cache.ModifiableCache) *pendingCache {
+	return &pendingCache{
+		ModifiableCache: c,
+		pending:         cache.NewSimpleCache(0),
+	}
+}
+
+func (c pendingCache) Get(key []byte) ([]byte, bool) {
+	if value, ok := c.pending.Get(key); ok {
+		return value, true
+	}
+	return c.ModifiableCache.Get(key)
+}
+
+func (c *pendingCache) Put(key []byte, value []byte) {
+	c.pending.Put(key, value)
+	c.ModifiableCache.Put(key, value)
+}
@@ -104,6 +104,49 @@ func TestAdd(t *testing.T) {
 
 }
 
+func TestAddBulk(t *testing.T) {
+
+	log.SetLogger("TestAddBulk", log.SILENT)
+
+	numEvents := 1000
+	eventDigests := make([]hashing.Digest, numEvents)
+	for i := 0; i < numEvents; i++ {
+		eventDigests[i] = rand.Bytes(32)
+	}
+
+	store := bplus.NewBPlusTreeStore()
+	tree := NewHistoryTree(hashing.NewSha256Hasher, store, 30)
+
+	bulkStore := bplus.NewBPlusTreeStore()
+	bulkTree := NewHistoryTree(hashing.NewSha256Hasher, bulkStore, 30)
+
+	// the first element is added alone to start the bulk at a non-zero version
+	_, mutations, err := bulkTree.Add(eventDigests[0], 0)
+	require.NoError(t, err)
+	require.NoError(t, bulkStore.Mutate(mutations))
+
+	rootHashes, mutations, err := bulkTree.AddBulk(eventDigests[1:], 1)
+	require.NoError(t, err)
+	require.Len(t, rootHashes, numEvents-1)
+	require.NoError(t, bulkStore.Mutate(mutations))
+
+	for i, eventDigest := range eventDigests {
+		rootHash, mutations, err := tree.Add(eventDigest, uint64(i))
+		require.NoErrorf(t, err, "This should not fail for version %d", i)
+		require.NoError(t, store.Mutate(mutations))
+		if i > 0 {
+			require.Equalf(t, rootHash, rootHashes[i-1], "Incorrect root hash for index %d", i)
+		}
+	}
+
+	lastVersion := uint64(numEvents - 1)
+	for i, eventDigest := range eventDigests {
+		proof, err := bulkTree.ProveMembership(uint64(i), lastVersion)
+		require.NoError(t, err)
+		assert.Truef(t, proof.Verify(eventDigest, rootHashes[numEvents-2]), "The proof should verify for index %d", i)
+	}
+}
+
 func TestProveMembership(t *testing.T) {
 
 	log.SetLogger("TestProveMembership", log.INFO)
@@ -493,3 +536,114 @@ func BenchmarkAdd(b *testing.B) {
 		AddTotal.Inc()
 	}
 }
+
+func TestTreeFormats(t *testing.T) {
+
+	log.SetLogger("TestTreeFormats", log.SILENT)
+
+	for _, format := range []int{hashing.TreeFormatV1, hashing.TreeFormatV2} {
+
+		hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, format)
+		require.NoError(t, err)
+
+		store, closeF := storage_utils.OpenBPlusTreeStore()
+		tree := NewHistoryTree(hasherF, store, 300)
+
+		digests := make([]hashing.Digest, 10)
+		rootHashes := make([]hashing.Digest, 10)
+		for i := range digests {
+			digests[i] = hashing.NewSha256Hasher().Do(rand.Bytes(32))
+			rootHash, mutations, err := tree.Add(digests[i], uint64(i))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations))
+			rootHashes[i] = rootHash
+		}
+
+		mp, err := tree.ProveMembership(3, 9)
+		require.NoError(t, err)
+		require.Truef(t, mp.Verify(digests[3], rootHashes[9]), "The membership proof should verify in format %d", format)
+
+		ip, err := tree.ProveConsistency(2, 9)
+		require.NoError(t, err)
+		require.Truef(t, ip.Verify(rootHashes[2], rootHashes[9]), "The incremental proof should verify in format %d", format)
+
+		// proofs must be verified in the format of the tree
+		other := hashing.TreeFormatV1
+		if format == hashing.TreeFormatV1 {
+			other = hashing.TreeFormatV2
+		}
+		otherHasher, err := hashing.NewTreeHasher(hashing.NewSha256Hasher(), other)
+		require.NoError(t, err)
+		mp = NewMembershipProof(mp.Index, mp.Version, mp.AuditPath, otherHasher)
+		require.Falsef(t, mp.Verify(digests[3], rootHashes[9]), "The membership proof should not verify in format %d", other)
+		ip = NewIncrementalProof(ip.StartVersion, ip.EndVersion, ip.AuditPath, otherHasher)
+		require.Falsef(t, ip.Verify(rootHashes[2], rootHashes[9]), "The incremental proof should not verify in format %d", other)
+
+		closeF()
+	}
+
+}
+
+func TestProveBatchMembership(t *testing.T) {
+
+	log.SetLogger("TestProveBatchMembership", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHistoryTree(hashing.NewSha256Hasher, store, 300)
+
+	numEvents := 100
+	digests := make([]hashing.Digest, numEvents)
+	rootHashes := make([]hashing.Digest, numEvents)
+	for i := range digests {
+		digests[i] = hashing.NewSha256Hasher().Do(rand.Bytes(32))
+		rootHash, mutations, err := tree.Add(digests[i], uint64(i))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		rootHashes[i] = rootHash
+	}
+
+	testCases := []struct {
+		indexes []uint64
+		version uint64
+	}{
+		{indexes: []uint64{0}, version: 0},
+		{indexes: []uint64{3, 0, 10}, version: 10},
+		{indexes: []uint64{99, 1, 5, 37, 38, 64}, version: 99},
+		{indexes: []uint64{7, 7}, version: 50},
+	}
+
+	for i, c := range testCases {
+		proof, err := tree.ProveBatchMembership(c.indexes, c.version)
+		require.NoErrorf(t, err, "The batch proof should not fail for case %d", i)
+
+		eventDigests := make([]hashing.Digest, len(c.indexes))
+		pathLen := 0
+		for j, index := range c.indexes {
+			eventDigests[j] = digests[index]
+			mp, err := tree.ProveMembership(index, c.version)
+			require.NoError(t, err)
+			pathLen += len(mp.AuditPath)
+		}
+
+		assert.Truef(t, proof.Verify(eventDigests, rootHashes[c.version]), "The batch proof should verify for case %d", i)
+		assert.Truef(t, len(proof.AuditPath) <= pathLen, "The batch proof should not be longer than the single ones for case %d", i)
+
+		// swapping the digests breaks the proof
+		eventDigests[0] = hashing.NewSha256Hasher().Do(rand.Bytes(32))
+		assert.Falsef(t, proof.Verify(eventDigests, rootHashes[c.version]), "The batch proof should not verify other digests for case %d", i)
+	}
+
+	// an incomplete audit path does not verify
+	proof, err := tree.ProveBatchMembership([]uint64{3, 60}, 99)
+	require.NoError(t, err)
+	for k := range proof.AuditPath {
+		delete(proof.AuditPath, k)
+		break
+	}
+	assert.False(t, proof.Verify([]hashing.Digest{digests[3], digests[60]}, rootHashes[99]), "An incomplete batch proof should not verify")
+
+	_, err = tree.ProveBatchMembership([]uint64{3, 60}, 50)
+	assert.Error(t, err, "Indexes greater than the version cannot be proved")
+
+}
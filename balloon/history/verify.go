@@ -51,6 +51,40 @@ func pruneToVerify(index, version uint64, eventDigest hashing.Digest) operation
 	return traverse(newRootPosition(version))
 }
 
+func pruneToVerifyBatch(version uint64, eventDigests map[uint64]hashing.Digest) operation {
+
+	var traverse func(pos *position, targets targets) operation
+	traverse = func(pos *position, targets targets) operation {
+
+		if len(targets) == 0 {
+			return newGetCacheOp(pos)
+		}
+
+		if pos.IsLeaf() {
+			return newLeafHashOp(pos, eventDigests[pos.Index])
+		}
+
+		rightPos := pos.Right()
+		leftTargets, rightTargets := targets.Split(rightPos.Index)
+
+		left := traverse(pos.Left(), leftTargets)
+		right := traverse(rightPos, rightTargets)
+
+		if rightPos.Index > version { // partial
+			return newPartialInnerHashOp(pos, left)
+		}
+
+		return newInnerHashOp(pos, left, right)
+
+	}
+
+	targets := make(targets, 0)
+	for index := range eventDigests {
+		targets = targets.InsertSorted(index)
+	}
+	return traverse(newRootPosition(version), targets)
+}
+
 func pruneToVerifyIncrementalStart(version uint64) operation {
 
 	var traverse func(pos *position) operation
@@ -51,21 +51,35 @@ func (b batchNode) String() string {
 }
 
 func (b batchNode) HasLeafAt(i int8) bool {
-	return len(b.batch[i]) > 0 && b.batch[i][b.nodeSize] == byte(1)
+	return len(b.batch[i]) > 0 && isLeafFlag(b.batch[i][b.nodeSize])
 }
 
+// AddHashAt stores the hash of an interior node. The flags are appended
+// to copies, as the same digests are stored in several batches.
 func (b batchNode) AddHashAt(i int8, value []byte) {
-	b.batch[i] = append(value, byte(0))
+	b.batch[i] = append(value[:len(value):len(value)], byte(0))
 }
 
+// AddLeafAt stores a shortcut leaf. Leaves whose value does not take a
+// node are flagged with byte(3) instead of byte(1), and their value is
+// prefixed with its size so it can be known when parsing the batch.
 func (b batchNode) AddLeafAt(i int8, hash hashing.Digest, key, value []byte) {
-	b.batch[i] = append(hash, byte(1))
-	b.batch[2*i+1] = append(key, byte(2))
-	b.batch[2*i+2] = append(value, byte(2))
+	if len(value) == b.nodeSize {
+		b.batch[i] = append(hash[:len(hash):len(hash)], byte(1))
+		b.batch[2*i+2] = append(value[:len(value):len(value)], byte(2))
+	} else {
+		b.batch[i] = append(hash[:len(hash):len(hash)], byte(3))
+		b.batch[2*i+2] = append(append([]byte{byte(len(value))}, value...), byte(2))
+	}
+	b.batch[2*i+1] = append(key[:len(key):len(key)], byte(2))
 }
 
 func (b batchNode) GetLeafKVAt(i int8) ([]byte, []byte) {
-	return b.batch[2*i+1][:b.nodeSize], b.batch[2*i+2][:b.nodeSize]
+	value := b.batch[2*i+2]
+	if isSizedLeaf(b.nodeSize, b.batch[i]) {
+		value = value[1:]
+	}
+	return b.batch[2*i+1][:b.nodeSize], value[:len(value)-1]
 }
 
 func (b batchNode) HasElementAt(i int8) bool {
@@ -96,17 +110,30 @@ func parseBatch(nodeSize int, value []byte) [][]byte {
 	bitmap := value[:4]             // the first 4 bytes define the bitmap
 	size := nodeSize + 1
 
-	j := 0
+	offset := 4
 	for i := 0; i < 31; i++ {
 		if bitIsSet(bitmap, i) {
-			batch[i] = value[4+size*j : 4+size*(j+1)]
-			j++
+			elemSize := size
+			if i > 0 && i%2 == 0 && isSizedLeaf(nodeSize, batch[(i-2)/2]) {
+				// the value is prefixed with its size
+				elemSize = 1 + int(value[offset]) + 1
+			}
+			batch[i] = value[offset : offset+elemSize]
+			offset += elemSize
 		}
 	}
 
 	return batch
 }
 
+func isLeafFlag(flag byte) bool {
+	return flag == byte(1) || flag == byte(3)
+}
+
+func isSizedLeaf(nodeSize int, node []byte) bool {
+	return len(node) > 0 && node[nodeSize] == byte(3)
+}
+
 func parseBatchNode(nodeSize int, value []byte) *batchNode {
 	return newBatchNode(nodeSize, parseBatch(nodeSize, value))
 }
@@ -0,0 +1,192 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/log"
+)
+
+// BatchQueryEntry is the answer for one of the keys of a batch query.
+type BatchQueryEntry struct {
+	Key, Value []byte
+	// Height is the height of the node where the path of the key
+	// ends: its own leaf, an empty subtree or a shortcut leaf.
+	Height uint16
+	// ShortcutKey and ShortcutValue are set when the key does not
+	// exist and its path ends in a shortcut leaf of another key.
+	ShortcutKey, ShortcutValue []byte
+}
+
+// BatchQueryProof proves the membership or non-membership of several
+// keys against the same root hash. Its audit path holds each sibling
+// just once and omits the nodes that can be computed from the paths
+// of the other keys.
+type BatchQueryProof struct {
+	Entries   []*BatchQueryEntry
+	AuditPath AuditPath
+	hasher    hashing.Hasher
+}
+
+func NewBatchQueryProof(entries []*BatchQueryEntry, auditPath AuditPath, hasher hashing.Hasher) *BatchQueryProof {
+	return &BatchQueryProof{
+		Entries:   entries,
+		AuditPath: auditPath,
+		hasher:    hasher,
+	}
+}
+
+// Verify verifies a batch query for the provided keys, in the same order
+// as the entries of the proof, from an expected root hash that fixes the
+// hyper tree. Entries with a value prove membership and entries without
+// one prove non-membership. Returns true if the proof is valid for all
+// the keys, false otherwise.
+func (p BatchQueryProof) Verify(keys []hashing.Digest, expectedRootHash hashing.Digest) (valid bool) {
+
+	log.Debugf("Verifying batch query proof for %d keys", len(keys))
+
+	if len(keys) == 0 || len(keys) != len(p.Entries) {
+		return false
+	}
+	for i, entry := range p.Entries {
+		if !bytes.Equal(keys[i], entry.Key) {
+			return false
+		}
+	}
+
+	recomputed, ok := computeBatchRoot(p.hasher, p.Entries, p.AuditPath, nil)
+
+	return ok && bytes.Equal(recomputed, expectedRootHash)
+
+}
+
+// computeBatchRoot recomputes the root hash from the paths of all the
+// entries, taking the hashes of the subtrees out of those paths from
+// the audit path. If used is not nil, the hashes taken from the audit
+// path are collected in it. Returns false if the entries are not
+// consistent or the audit path lacks some hash.
+//
+// Entries are checked as the proofs of a single key are: shortcut leaves
+// only prove non-membership and key-value leaves only prove membership in
+// trees which bind the keys to their leaves, and the entries whose paths end in the same node must agree on it.
+func computeBatchRoot(hasher hashing.Hasher, entries []*BatchQueryEntry, auditPath, used AuditPath) (hashing.Digest, bool) {
+
+	numBits := hasher.Len()
+	sorted := make([]*BatchQueryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry.Key) != int(numBits/8) || entry.Height >= numBits {
+			return nil, false
+		}
+		if entry.ShortcutKey != nil {
+			if !hashing.BindsLeafKeys(hasher) || len(entry.Value) > 0 || bytes.Equal(entry.ShortcutKey, entry.Key) || !sharePath(entry.Key, entry.ShortcutKey, entry.Height) {
+				return nil, false
+			}
+		}
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if bytes.Equal(sorted[i-1].Key, sorted[i].Key) {
+			return nil, false
+		}
+	}
+
+	var defaultHashes []hashing.Digest
+	terminalHash := func(pos position, entry *BatchQueryEntry) hashing.Digest {
+		switch {
+		case len(entry.Value) > 0:
+			return leafDigest(hasher, pos, entry.Key, entry.Value)
+		case entry.ShortcutKey != nil:
+			return leafDigest(hasher, pos, entry.ShortcutKey, entry.ShortcutValue)
+		default:
+			if defaultHashes == nil {
+				defaultHashes = computeDefaultHashes(hasher)
+			}
+			return defaultHashes[pos.Height]
+		}
+	}
+
+	var compute func(pos position, entries []*BatchQueryEntry) (hashing.Digest, bool)
+	compute = func(pos position, entries []*BatchQueryEntry) (hashing.Digest, bool) {
+
+		if len(entries) == 0 {
+			digest, ok := auditPath.Get(pos)
+			if ok && used != nil {
+				used[pos.StringId()] = digest
+			}
+			return digest, ok
+		}
+
+		// every entry whose path ends here must end in the same node:
+		// the same empty subtree, or the leaf of the same key
+		var terminal hashing.Digest
+		var terminalKey []byte
+		for _, entry := range entries {
+			if entry.Height != pos.Height {
+				continue
+			}
+			digest := terminalHash(pos, entry)
+			key := leafKey(entry)
+			if terminal != nil && (!bytes.Equal(terminal, digest) || !bytes.Equal(terminalKey, key)) {
+				return nil, false
+			}
+			terminal, terminalKey = digest, key
+		}
+		if terminal != nil {
+			for _, entry := range entries {
+				if entry.Height != pos.Height {
+					return nil, false
+				}
+			}
+			return terminal, true
+		}
+
+		rightPos := pos.Right()
+		split := sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(entries[i].Key, rightPos.Index) >= 0
+		})
+		left, ok := compute(pos.Left(), entries[:split])
+		if !ok {
+			return nil, false
+		}
+		right, ok := compute(rightPos, entries[split:])
+		if !ok {
+			return nil, false
+		}
+
+		// the operations stack of the tree pops the right child first,
+		// so interior nodes hash their children in that order
+		return hashing.InteriorHash(hasher, pos.Bytes(), right, left), true
+	}
+
+	return compute(newRootPosition(numBits/8), sorted)
+
+}
+
+// leafKey returns the key of the leaf where the path of an entry ends, or
+// nil if it ends in an empty subtree.
+func leafKey(entry *BatchQueryEntry) []byte {
+	if len(entry.Value) > 0 {
+		return entry.Key
+	}
+	return entry.ShortcutKey
+}
@@ -19,8 +19,6 @@ package hyper
 import (
 	"bytes"
 	"sort"
-
-	"github.com/bbva/qed/util"
 )
 
 type leaf struct {
@@ -129,7 +127,7 @@ func pruneToInsert(index []byte, value []byte, cacheHeightLimit uint16, batches
 			// create or update the leaf with a new shortcut
 			newBatch := newEmptyBatchNode(len(pos.Index))
 			ops.PushAll(
-				leafHash(pos, leaves[0].Value),
+				leafHash(pos, leaves[0].Index, leaves[0].Value),
 				updateBatchShortcut(pos, 0, newBatch, leaves[0].Index, leaves[0].Value),
 				mutateBatch(pos, newBatch),
 				updateBatchNode(pos, iBatch, batch),
@@ -154,7 +152,7 @@ func pruneToInsert(index []byte, value []byte, cacheHeightLimit uint16, batches
 			// nil value (no previous node stored) so create a new shortcut batch
 			newBatch := newEmptyBatchNode(len(pos.Index))
 			ops.PushAll(
-				leafHash(pos, leaves[0].Value),
+				leafHash(pos, leaves[0].Index, leaves[0].Value),
 				updateBatchShortcut(pos, 0, newBatch, leaves[0].Index, leaves[0].Value),
 				mutateBatch(pos, newBatch),
 				updateBatchNode(pos, iBatch, batch),
@@ -168,7 +166,7 @@ func pruneToInsert(index []byte, value []byte, cacheHeightLimit uint16, batches
 			// we found a nil in our path -> create a shortcut leaf
 			if !batch.HasElementAt(iBatch) {
 				ops.PushAll(
-					leafHash(pos, leaves[0].Value),
+					leafHash(pos, leaves[0].Index, leaves[0].Value),
 					updateBatchShortcut(pos, iBatch, batch, leaves[0].Index, leaves[0].Value),
 				)
 				if pos.Height%4 == 0 { // at the root or at a leaf of the subtree (not necessary to check iBatch)
@@ -205,10 +203,8 @@ func pruneToInsert(index []byte, value []byte, cacheHeightLimit uint16, batches
 	}
 
 	ops := newOperationsStack()
-	version := util.AddPaddingToBytes(value, len(index))
-	version = version[len(version)-len(index):] // TODO GET RID OF THIS: used only to pass tests
 	leaves := make(leaves, 0)
-	leaves = leaves.InsertSorted(leaf{index, version})
+	leaves = leaves.InsertSorted(leaf{index, value})
 	traverse(newRootPosition(uint16(len(index))), leaves, nil, 0, ops)
 	return ops
 }
@@ -21,6 +21,7 @@ import (
 
 	"github.com/bbva/qed/balloon/cache"
 	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
 )
 
 type batchLoader interface {
@@ -69,3 +70,68 @@ func (l defaultBatchLoader) loadBatchFromStore(pos position) *batchNode {
 	batch := parseBatchNode(len(pos.Index), kv.Value)
 	return batch
 }
+
+// pendingBatchLoader loads batches from a set of mutations that have not
+// been persisted yet, falling back to the wrapped loader otherwise.
+type pendingBatchLoader struct {
+	loader  batchLoader
+	pending map[string][]byte
+}
+
+func newPendingBatchLoader(loader batchLoader) *pendingBatchLoader {
+	return &pendingBatchLoader{
+		loader:  loader,
+		pending: make(map[string][]byte),
+	}
+}
+
+func (l pendingBatchLoader) Load(pos position) *batchNode {
+	if value, ok := l.pending[string(pos.Bytes())]; ok {
+		return parseBatchNode(len(pos.Index), value)
+	}
+	return l.loader.Load(pos)
+}
+
+// Track registers the given mutations as pending so subsequent loads
+// see their values.
+func (l *pendingBatchLoader) Track(mutations []*storage.Mutation) {
+	for _, m := range mutations {
+		if m.Table == storage.HyperCacheTable {
+			l.pending[string(m.Key)] = m.Value
+		}
+	}
+}
+
+// versionedBatchLoader loads batches as they were at a given version,
+// that is, the last copy of every batch stored at or before that version.
+type versionedBatchLoader struct {
+	store   storage.Store
+	version []byte
+}
+
+func newVersionedBatchLoader(store storage.Store, version uint64) *versionedBatchLoader {
+	return &versionedBatchLoader{
+		store:   store,
+		version: util.Uint64AsBytes(version),
+	}
+}
+
+func (l versionedBatchLoader) Load(pos position) *batchNode {
+	start := versionedKey(pos, util.Uint64AsBytes(0))
+	end := versionedKey(pos, l.version)
+	kv, err := l.store.GetLastInRange(storage.HyperVersionedTable, start, end)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return newEmptyBatchNode(len(pos.Index))
+		}
+		log.Fatalf("Oops, something went wrong. Unable to load versioned batch: %v", err)
+	}
+	return parseBatchNode(len(pos.Index), kv.Value)
+}
+
+// versionedKey returns the key of the copy of a batch at a given version.
+func versionedKey(pos position, version []byte) []byte {
+	key := make([]byte, 0, len(pos.Bytes())+len(version))
+	key = append(key, pos.Bytes()...)
+	return append(key, version...)
+}
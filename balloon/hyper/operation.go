@@ -30,6 +30,23 @@ type pruningContext struct {
 	Mutations     []*storage.Mutation
 	AuditPath     AuditPath
 	Value         []byte
+
+	// ShortcutKey and ShortcutValue hold the shortcut leaf found
+	// in place of a searched index that does not exist.
+	ShortcutKey, ShortcutValue []byte
+
+	// BatchVersion, if set, makes every modified batch to be
+	// also stored as a copy for that version.
+	BatchVersion []byte
+}
+
+// versionBatch appends a mutation with a copy of the batch for the
+// version being inserted, if any.
+func (c *pruningContext) versionBatch(pos position, serialized []byte) {
+	if c.BatchVersion == nil {
+		return
+	}
+	c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperVersionedTable, versionedKey(pos, c.BatchVersion), serialized))
 }
 
 type operationCode int
@@ -44,6 +61,7 @@ const (
 	putInCacheCode
 	mutateBatchCode
 	collectValueCode
+	collectShortcutCode
 	collectHashCode
 	getFromPathCode
 	useHashCode
@@ -58,16 +76,26 @@ type operation struct {
 	Interpret interpreter
 }
 
-func leafHash(pos position, value []byte) *operation {
+func leafHash(pos position, key, value []byte) *operation {
 	return &operation{
 		Code: leafHashCode,
 		Pos:  pos,
 		Interpret: func(ops *operationsStack, c *pruningContext) hashing.Digest {
-			return c.Hasher.Salted(pos.Bytes(), value)
+			return leafDigest(c.Hasher, pos, key, value)
 		},
 	}
 }
 
+// leafDigest returns the hash of the shortcut leaf of a key. Trees which
+// bind the keys to their leaves hash the key along with the value, the
+// rest only the value.
+func leafDigest(hasher hashing.Hasher, pos position, key, value []byte) hashing.Digest {
+	if hashing.BindsLeafKeys(hasher) {
+		return hashing.LeafHash(hasher, pos.Bytes(), key, value)
+	}
+	return hashing.LeafHash(hasher, pos.Bytes(), value)
+}
+
 func innerHash(pos position) *operation {
 	return &operation{
 		Code: innerHashCode,
@@ -75,7 +103,7 @@ func innerHash(pos position) *operation {
 		Interpret: func(ops *operationsStack, c *pruningContext) hashing.Digest {
 			leftHash := ops.Pop().Interpret(ops, c)
 			rightHash := ops.Pop().Interpret(ops, c)
-			return c.Hasher.Salted(pos.Bytes(), leftHash, rightHash)
+			return hashing.InteriorHash(c.Hasher, pos.Bytes(), leftHash, rightHash)
 		},
 	}
 }
@@ -130,7 +158,9 @@ func putInCache(pos position, batch *batchNode) *operation {
 		Pos:  pos,
 		Interpret: func(ops *operationsStack, c *pruningContext) hashing.Digest {
 			hash := ops.Pop().Interpret(ops, c)
-			c.Cache.Put(pos.Bytes(), batch.Serialize())
+			serialized := batch.Serialize()
+			c.Cache.Put(pos.Bytes(), serialized)
+			c.versionBatch(pos, serialized)
 			return hash
 		},
 	}
@@ -142,7 +172,9 @@ func mutateBatch(pos position, batch *batchNode) *operation {
 		Pos:  pos,
 		Interpret: func(ops *operationsStack, c *pruningContext) hashing.Digest {
 			hash := ops.Pop().Interpret(ops, c)
-			c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperCacheTable, pos.Bytes(), batch.Serialize()))
+			serialized := batch.Serialize()
+			c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperCacheTable, pos.Bytes(), serialized))
+			c.versionBatch(pos, serialized)
 			return hash
 		},
 	}
@@ -160,6 +192,18 @@ func collectValue(pos position, value []byte) *operation {
 	}
 }
 
+func collectShortcut(pos position, key, value []byte) *operation {
+	return &operation{
+		Code: collectShortcutCode,
+		Pos:  pos,
+		Interpret: func(ops *operationsStack, c *pruningContext) hashing.Digest {
+			hash := ops.Pop().Interpret(ops, c)
+			c.ShortcutKey, c.ShortcutValue = key, value
+			return hash
+		},
+	}
+}
+
 func collectHash(pos position) *operation {
 	return &operation{
 		Code: collectHashCode,
@@ -37,7 +37,10 @@ func NewAuditPath() AuditPath {
 type QueryProof struct {
 	AuditPath  AuditPath
 	Key, Value []byte
-	hasher     hashing.Hasher
+	// ShortcutKey and ShortcutValue are set when the queried key does
+	// not exist and its path ends in a shortcut leaf of another key.
+	ShortcutKey, ShortcutValue []byte
+	hasher                     hashing.Hasher
 }
 
 func NewQueryProof(key, value []byte, auditPath AuditPath, hasher hashing.Hasher) *QueryProof {
@@ -72,3 +75,67 @@ func (p QueryProof) Verify(key []byte, expectedRootHash hashing.Digest) (valid b
 	return bytes.Equal(key, p.Key) && bytes.Equal(recomputed, expectedRootHash)
 
 }
+
+// VerifyNonMembership verifies that the provided key does not exist in the
+// hyper tree fixed by the expected root hash. The path of the key must end
+// either in an empty subtree or in a shortcut leaf of a different key.
+// Returns true if the proof is valid, false otherwise.
+//
+// Shortcut leaves only prove non-membership in trees which bind the keys
+// to their leaves, see hashing.TreeFormatV2. In older trees, the leaf of
+// the queried key could be presented as the shortcut of another key with
+// the same path.
+func (p QueryProof) VerifyNonMembership(key []byte, expectedRootHash hashing.Digest) (valid bool) {
+
+	log.Debugf("Verifying non-membership query proof for key %x", p.Key)
+
+	if len(p.AuditPath) == 0 || len(p.Value) > 0 {
+		// an empty audit path (empty tree) is not verifiable
+		return false
+	}
+
+	height := p.hasher.Len() - uint16(len(p.AuditPath))
+	var terminal func(pos position) *operation
+	if p.ShortcutKey != nil {
+		if !hashing.BindsLeafKeys(p.hasher) {
+			return false
+		}
+		if bytes.Equal(p.ShortcutKey, key) || !sharePath(key, p.ShortcutKey, height) {
+			return false
+		}
+		terminal = func(pos position) *operation {
+			return leafHash(pos, p.ShortcutKey, p.ShortcutValue)
+		}
+	} else {
+		defaultHashes := computeDefaultHashes(p.hasher)
+		terminal = func(pos position) *operation {
+			return useHash(pos, defaultHashes[pos.Height])
+		}
+	}
+
+	// build a stack of operations and then interpret it to recompute the root hash
+	ops := pruneToVerifyPath(key, height, terminal)
+	ctx := &pruningContext{
+		Hasher:    p.hasher,
+		AuditPath: p.AuditPath,
+	}
+	recomputed := ops.Pop().Interpret(ops, ctx)
+
+	return bytes.Equal(key, p.Key) && bytes.Equal(recomputed, expectedRootHash)
+
+}
+
+// sharePath returns true if both indexes go through the same
+// node at the given height.
+func sharePath(a, b []byte, height uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	numBits := uint16(len(a)) * 8
+	for i := uint16(0); i < numBits-height; i++ {
+		if bitIsSet(a, int(i)) != bitIsSet(b, int(i)) {
+			return false
+		}
+	}
+	return true
+}
@@ -64,6 +64,8 @@ func pruneToFind(index []byte, batches batchLoader) *operationsStack {
 			k, v := batch.GetLeafKVAt(iBatch)
 			if bytes.Equal(k, index) {
 				ops.Push(collectValue(pos, v)) // collect value if the key matches the queried index
+			} else {
+				ops.Push(collectShortcut(pos, k, v)) // otherwise collect the shortcut to prove non-membership
 			}
 			return
 		}
@@ -115,6 +115,7 @@ func TestPruneToFind(t *testing.T) {
 				{innerHashCode, pos(0, 5)},
 				{collectHashCode, pos(16, 4)},
 				{getDefaultHashCode, pos(16, 4)},
+				{collectShortcutCode, pos(0, 4)}, // collect the shortcut to prove non-membership
 				{getProvidedHashCode, pos(0, 4)}, // stop at the position of the shorcut (index=0)
 			},
 		},
@@ -219,6 +220,7 @@ func TestPruneToFind(t *testing.T) {
 				{innerHashCode, pos(0, 5)},
 				{collectHashCode, pos(16, 4)},
 				{getDefaultHashCode, pos(16, 4)},
+				{collectShortcutCode, pos(0, 4)}, // collect the shortcut to prove non-membership
 				{getProvidedHashCode, pos(0, 4)}, // stop at the position of the shorcut (index=0)
 			},
 		},
@@ -0,0 +1,99 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bbva/qed/hashing"
+)
+
+// pathSiblings returns the positions of the first n siblings of the
+// path of the given index, from the root down.
+func pathSiblings(index []byte, n int) []position {
+	siblings := make([]position, 0, n)
+	pos := newRootPosition(uint16(len(index)))
+	for i := 0; i < n && !pos.IsLeaf(); i++ {
+		rightPos := pos.Right()
+		if bytes.Compare(index, rightPos.Index) < 0 { // go to left
+			siblings = append(siblings, rightPos)
+			pos = pos.Left()
+		} else { // go to right
+			siblings = append(siblings, pos.Left())
+			pos = rightPos
+		}
+	}
+	return siblings
+}
+
+// CompactSiblings returns the digests of the audit path of the given key
+// from the root down, leaving out the hashes of empty subtrees, which the
+// verifier can recompute. The returned bitmap has the bit i set, starting
+// from the most significant bit of the first byte, if the i-th sibling
+// is an empty subtree. The audit path must belong to a proof of the key.
+func (p AuditPath) CompactSiblings(key []byte, hasher hashing.Hasher) (defaults []byte, siblings []hashing.Digest, err error) {
+	positions := pathSiblings(key, len(p))
+	if len(positions) != len(p) {
+		return nil, nil, fmt.Errorf("audit path of %d digests too long for a key of %d bytes", len(p), len(key))
+	}
+
+	defaultHashes := computeDefaultHashes(hasher)
+	defaults = make([]byte, (len(positions)+7)/8)
+	siblings = make([]hashing.Digest, 0)
+	for i, pos := range positions {
+		digest, ok := p.Get(pos)
+		if !ok {
+			return nil, nil, fmt.Errorf("missing digest at position %v in audit path", pos)
+		}
+		if bytes.Equal(digest, defaultHashes[pos.Height]) {
+			bitSet(defaults, uint16(i))
+			continue
+		}
+		siblings = append(siblings, digest)
+	}
+	return defaults, siblings, nil
+}
+
+// NewAuditPathFromSiblings rebuilds the audit path of n digests of the
+// given key from the output of CompactSiblings.
+func NewAuditPathFromSiblings(key []byte, n int, defaults []byte, siblings []hashing.Digest, hasher hashing.Hasher) (AuditPath, error) {
+	if n < 0 || n > len(key)*8 {
+		return nil, fmt.Errorf("invalid audit path of %d digests for a key of %d bytes", n, len(key))
+	}
+	positions := pathSiblings(key, n)
+	if len(positions) != n || len(defaults) != (n+7)/8 {
+		return nil, fmt.Errorf("invalid audit path of %d digests for a key of %d bytes", n, len(key))
+	}
+
+	defaultHashes := computeDefaultHashes(hasher)
+	auditPath := make(AuditPath, n)
+	for i, pos := range positions {
+		if bitIsSet(defaults, i) {
+			auditPath[pos.StringId()] = defaultHashes[pos.Height]
+			continue
+		}
+		if len(siblings) == 0 {
+			return nil, fmt.Errorf("expected more digests in audit path")
+		}
+		auditPath[pos.StringId()], siblings = siblings[0], siblings[1:]
+	}
+	if len(siblings) > 0 {
+		return nil, fmt.Errorf("unexpected %d digests in audit path", len(siblings))
+	}
+	return auditPath, nil
+}
@@ -17,6 +17,7 @@
 package hyper
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/bbva/qed/log"
@@ -57,15 +58,10 @@ func NewHyperTree(hasherF func() hashing.Hasher, store storage.Store, cache cach
 		hasherF:          hasherF,
 		hasher:           hasher,
 		cacheHeightLimit: cacheHeightLimit,
-		defaultHashes:    make([]hashing.Digest, numBits),
+		defaultHashes:    computeDefaultHashes(hasher),
 		batchLoader:      NewDefaultBatchLoader(store, cache, cacheHeightLimit),
 	}
 
-	tree.defaultHashes[0] = tree.hasher.Do([]byte{0x0}, []byte{0x0})
-	for i := uint16(1); i < hasher.Len(); i++ {
-		tree.defaultHashes[i] = tree.hasher.Do(tree.defaultHashes[i-1], tree.defaultHashes[i-1])
-	}
-
 	// warm-up cache
 	tree.RebuildCache()
 
@@ -78,20 +74,74 @@ func (t *HyperTree) Add(eventDigest hashing.Digest, version uint64) (hashing.Dig
 
 	//log.Debugf("Adding new event digest %x with version %d", eventDigest, version)
 
-	versionAsBytes := util.Uint64AsBytes(version)
+	rh, mutations := t.add(eventDigest, EventValue(t.hasher, version), version, t.batchLoader)
+
+	return rh, mutations, nil
+}
+
+// Put inserts or updates the value digest stored under the given key
+// digest. Unlike Add, the leaf value is the value digest followed by
+// the version, so membership proofs prove the latest value of the key.
+// Only trees whose leaves are bound to their keys accept key-value
+// entries, otherwise the leaf of a key could be presented as the leaf of
+// any other key sharing its path.
+func (t *HyperTree) Put(keyDigest, valueDigest hashing.Digest, version uint64) (hashing.Digest, []*storage.Mutation, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if !hashing.BindsLeafKeys(t.hasher) {
+		return nil, nil, fmt.Errorf("key-value entries require tree format %d or later", hashing.TreeFormatV2)
+	}
+	if len(valueDigest) != len(keyDigest) {
+		return nil, nil, fmt.Errorf("invalid value digest length %d, expected %d", len(valueDigest), len(keyDigest))
+	}
+
+	rh, mutations := t.add(keyDigest, KeyValue(valueDigest, version), version, t.batchLoader)
+
+	return rh, mutations, nil
+}
+
+// AddBulk inserts a sequence of event digests with consecutive versions
+// starting at initialVersion. It returns the root hash obtained after each
+// insertion and the mutations of the whole sequence, in order.
+//
+// Batches mutated by previous insertions of the sequence are not yet
+// persisted, so they are served from the pending mutations instead of
+// the store.
+func (t *HyperTree) AddBulk(eventDigests []hashing.Digest, initialVersion uint64) ([]hashing.Digest, []*storage.Mutation, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	loader := newPendingBatchLoader(t.batchLoader)
+	rootHashes := make([]hashing.Digest, len(eventDigests))
+	mutations := make([]*storage.Mutation, 0)
+
+	for i, eventDigest := range eventDigests {
+		version := initialVersion + uint64(i)
+		rh, eventMutations := t.add(eventDigest, EventValue(t.hasher, version), version, loader)
+		loader.Track(eventMutations)
+		rootHashes[i] = rh
+		mutations = append(mutations, eventMutations...)
+	}
+
+	return rootHashes, mutations, nil
+}
+
+func (t *HyperTree) add(eventDigest hashing.Digest, value []byte, version uint64, loader batchLoader) (hashing.Digest, []*storage.Mutation) {
 
 	// build a stack of operations and then interpret it to generate the root hash
-	ops := pruneToInsert(eventDigest, versionAsBytes, t.cacheHeightLimit, t.batchLoader)
+	ops := pruneToInsert(eventDigest, value, t.cacheHeightLimit, loader)
 	ctx := &pruningContext{
 		Hasher:        t.hasher,
 		Cache:         t.cache,
 		DefaultHashes: t.defaultHashes,
 		Mutations:     make([]*storage.Mutation, 0),
+		BatchVersion:  util.Uint64AsBytes(version),
 	}
 
 	rh := ops.Pop().Interpret(ops, ctx)
 
-	return rh, ctx.Mutations, nil
+	return rh, ctx.Mutations
 }
 
 func (t *HyperTree) QueryMembership(eventDigest hashing.Digest) (proof *QueryProof, err error) {
@@ -111,8 +161,96 @@ func (t *HyperTree) QueryMembership(eventDigest hashing.Digest) (proof *QueryPro
 
 	ops.Pop().Interpret(ops, ctx)
 
+	return t.newQueryProof(eventDigest, ctx), nil
+}
+
+// QueryMembershipAt returns a proof of membership or non-membership of
+// the given event digest computed against the state of the tree at the
+// given version, so it verifies against the root hash of that version.
+func (t *HyperTree) QueryMembershipAt(eventDigest hashing.Digest, version uint64) (proof *QueryProof, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	// build a stack of operations and then interpret it to generate the audit path
+	ops := pruneToFind(eventDigest, newVersionedBatchLoader(t.store, version))
+	ctx := &pruningContext{
+		Hasher:        t.hasher,
+		DefaultHashes: t.defaultHashes,
+		AuditPath:     make(AuditPath, 0),
+	}
+
+	ops.Pop().Interpret(ops, ctx)
+
+	return t.newQueryProof(eventDigest, ctx), nil
+}
+
+func (t *HyperTree) newQueryProof(eventDigest hashing.Digest, ctx *pruningContext) *QueryProof {
 	// ctx.Value is nil if the digest does not exist
-	return NewQueryProof(eventDigest, ctx.Value, ctx.AuditPath, t.hasherF()), nil
+	proof := NewQueryProof(eventDigest, ctx.Value, ctx.AuditPath, t.hasherF())
+	if ctx.Value == nil {
+		proof.ShortcutKey, proof.ShortcutValue = ctx.ShortcutKey, ctx.ShortcutValue
+	}
+	return proof
+}
+
+// QueryBatchMembership returns a single proof of membership or
+// non-membership of all the given event digests, whose paths share
+// the siblings they have in common.
+func (t *HyperTree) QueryBatchMembership(eventDigests []hashing.Digest) (*BatchQueryProof, error) {
+	t.Lock()
+	defer t.Unlock()
+	return t.newBatchQueryProof(eventDigests, t.batchLoader, t.cache)
+}
+
+// QueryBatchMembershipAt is like QueryBatchMembership but the proof is
+// computed against the state of the tree at the given version.
+func (t *HyperTree) QueryBatchMembershipAt(eventDigests []hashing.Digest, version uint64) (*BatchQueryProof, error) {
+	t.Lock()
+	defer t.Unlock()
+	return t.newBatchQueryProof(eventDigests, newVersionedBatchLoader(t.store, version), nil)
+}
+
+func (t *HyperTree) newBatchQueryProof(eventDigests []hashing.Digest, batches batchLoader, cache cache.ModifiableCache) (*BatchQueryProof, error) {
+
+	entries := make([]*BatchQueryEntry, len(eventDigests))
+	auditPath := NewAuditPath()
+	seen := make(map[string]bool, len(eventDigests))
+	for i, eventDigest := range eventDigests {
+		if seen[string(eventDigest)] {
+			return nil, fmt.Errorf("duplicated digest %x in a batch query", eventDigest)
+		}
+		seen[string(eventDigest)] = true
+
+		// build a stack of operations and then interpret it to generate the audit path
+		ops := pruneToFind(eventDigest, batches)
+		ctx := &pruningContext{
+			Hasher:        t.hasher,
+			Cache:         cache,
+			DefaultHashes: t.defaultHashes,
+			AuditPath:     make(AuditPath, 0),
+		}
+		ops.Pop().Interpret(ops, ctx)
+
+		proof := t.newQueryProof(eventDigest, ctx)
+		entries[i] = &BatchQueryEntry{
+			Key:           eventDigest,
+			Value:         proof.Value,
+			Height:        t.hasher.Len() - uint16(len(ctx.AuditPath)),
+			ShortcutKey:   proof.ShortcutKey,
+			ShortcutValue: proof.ShortcutValue,
+		}
+		for id, digest := range ctx.AuditPath {
+			auditPath[id] = digest
+		}
+	}
+
+	// keep only the siblings that cannot be computed from the other paths
+	shared := NewAuditPath()
+	if _, ok := computeBatchRoot(t.hasher, entries, auditPath, shared); !ok {
+		return nil, fmt.Errorf("unable to build a batch proof for %d digests", len(eventDigests))
+	}
+
+	return NewBatchQueryProof(entries, shared, t.hasherF()), nil
 }
 
 func (t *HyperTree) RebuildCache() {
@@ -155,6 +293,74 @@ func (t *HyperTree) Close() {
 	t.batchLoader = nil
 }
 
+// Kinds of the leaves of the trees which bind the keys to their leaves.
+// The kind is the first byte of the leaf value.
+const (
+	eventLeaf    byte = 0x00
+	keyValueLeaf byte = 0x01
+)
+
+// versionSize is the number of bytes of the versions in leaf values.
+const versionSize = 8
+
+// EventValue returns the leaf value of an event added with the given
+// version to a tree built with the given hasher. Trees which bind the
+// keys to their leaves tag the version as an event. Older trees pad it
+// to the length of the digests when they are longer than a version.
+func EventValue(hasher hashing.Hasher, version uint64) []byte {
+	if hashing.BindsLeafKeys(hasher) {
+		return append([]byte{eventLeaf}, util.Uint64AsBytes(version)...)
+	}
+	size := int(hasher.Len() / 8)
+	if size < versionSize {
+		size = versionSize
+	}
+	return util.Uint64AsPaddedBytes(version, size)
+}
+
+// KeyValue returns the leaf value of a key-value entry: the value
+// digest followed by the version of its last update, tagged as a
+// key-value entry.
+func KeyValue(valueDigest hashing.Digest, version uint64) []byte {
+	value := make([]byte, 0, 1+len(valueDigest)+versionSize)
+	value = append(value, keyValueLeaf)
+	value = append(value, valueDigest...)
+	return append(value, util.Uint64AsBytes(version)...)
+}
+
+// ParseLeafValue splits a leaf value of a tree built with the given
+// hasher into its value digest, nil for events, and its version. It
+// returns false if the leaf value is malformed.
+func ParseLeafValue(hasher hashing.Hasher, value []byte) (hashing.Digest, uint64, bool) {
+	if !hashing.BindsLeafKeys(hasher) {
+		// older trees only hold events
+		if len(value) < versionSize {
+			return nil, 0, false
+		}
+		return nil, util.BytesAsUint64(value[len(value)-versionSize:]), true
+	}
+	digestLen := int(hasher.Len() / 8)
+	switch {
+	case len(value) == 1+versionSize && value[0] == eventLeaf:
+		return nil, util.BytesAsUint64(value[1:]), true
+	case len(value) == 1+digestLen+versionSize && value[0] == keyValueLeaf:
+		return value[1 : 1+digestLen], util.BytesAsUint64(value[1+digestLen:]), true
+	default:
+		return nil, 0, false
+	}
+}
+
+// computeDefaultHashes returns the hashes of the empty subtrees
+// at every height of the tree.
+func computeDefaultHashes(hasher hashing.Hasher) []hashing.Digest {
+	defaultHashes := make([]hashing.Digest, hasher.Len())
+	defaultHashes[0] = hasher.Do([]byte{0x0}, []byte{0x0})
+	for i := uint16(1); i < hasher.Len(); i++ {
+		defaultHashes[i] = hasher.Do(defaultHashes[i-1], defaultHashes[i-1])
+	}
+	return defaultHashes
+}
+
 func min(x, y uint16) uint16 {
 	if x < y {
 		return x
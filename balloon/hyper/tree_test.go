@@ -27,7 +27,6 @@ import (
 	metrics_utils "github.com/bbva/qed/testutils/metrics"
 	"github.com/bbva/qed/testutils/rand"
 	storage_utils "github.com/bbva/qed/testutils/storage"
-	"github.com/bbva/qed/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -66,6 +65,140 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestAddBulk(t *testing.T) {
+
+	log.SetLogger("TestAddBulk", log.SILENT)
+
+	numEvents := 1000
+	eventDigests := make([]hashing.Digest, numEvents)
+	hasher := hashing.NewSha256Hasher()
+	for i := 0; i < numEvents; i++ {
+		eventDigests[i] = hasher.Do(rand.Bytes(32))
+	}
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, cache.NewSimpleCache(10))
+
+	bulkStore, closeBulkF := storage_utils.OpenBPlusTreeStore()
+	defer closeBulkF()
+	bulkTree := NewHyperTree(hashing.NewSha256Hasher, bulkStore, cache.NewSimpleCache(10))
+
+	rootHashes, mutations, err := bulkTree.AddBulk(eventDigests, 0)
+	require.NoError(t, err)
+	require.Len(t, rootHashes, numEvents)
+	require.NoError(t, bulkStore.Mutate(mutations))
+
+	for i, eventDigest := range eventDigests {
+		rootHash, mutations, err := tree.Add(eventDigest, uint64(i))
+		require.NoErrorf(t, err, "This should not fail for version %d", i)
+		require.NoError(t, store.Mutate(mutations))
+		require.Equalf(t, rootHash, rootHashes[i], "Incorrect root hash for index %d", i)
+	}
+
+	for i, eventDigest := range eventDigests {
+		proof, err := bulkTree.QueryMembership(eventDigest)
+		require.NoError(t, err)
+		assert.Truef(t, proof.Verify(eventDigest, rootHashes[numEvents-1]), "The proof should verify for index %d", i)
+	}
+}
+
+func TestPut(t *testing.T) {
+
+	log.SetLogger("TestPut", log.SILENT)
+
+	hasher := hashing.NewSha256Hasher()
+	numKeys := 100
+	keyDigests := make([]hashing.Digest, numKeys)
+	for i := range keyDigests {
+		keyDigests[i] = hasher.Do(rand.Bytes(32))
+	}
+
+	hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, hashing.TreeFormatV2)
+	require.NoError(t, err)
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+
+	// insert every key and then update half of them
+	version := uint64(0)
+	expected := make(map[int][]byte)
+	var rootHash hashing.Digest
+	for round := 0; round < 2; round++ {
+		for i, keyDigest := range keyDigests {
+			if round == 1 && i%2 == 0 {
+				continue
+			}
+			valueDigest := hasher.Do(rand.Bytes(32))
+			rh, mutations, err := tree.Put(keyDigest, valueDigest, version)
+			require.NoErrorf(t, err, "This should not fail for version %d", version)
+			require.NoError(t, store.Mutate(mutations))
+			expected[i] = KeyValue(valueDigest, version)
+			rootHash = rh
+			version++
+		}
+	}
+
+	for i, keyDigest := range keyDigests {
+		proof, err := tree.QueryMembership(keyDigest)
+		require.NoError(t, err)
+		assert.Equalf(t, expected[i], proof.Value, "The value should be the last one put for key %d", i)
+		assert.Truef(t, proof.Verify(keyDigest, rootHash), "The proof should verify for key %d", i)
+
+		valueDigest, valueVersion, ok := ParseLeafValue(tree.hasher, proof.Value)
+		require.Truef(t, ok, "The value should be a key-value leaf for key %d", i)
+		assert.Equalf(t, expected[i], KeyValue(valueDigest, valueVersion), "The parsed value should match for key %d", i)
+
+		// an event leaf with the same version is told apart by its kind
+		event := EventValue(tree.hasher, valueVersion)
+		eventDigest, _, ok := ParseLeafValue(tree.hasher, event)
+		require.True(t, ok)
+		assert.Nilf(t, eventDigest, "An event leaf should not have a value digest for key %d", i)
+		proof.Value = event
+		assert.Falsef(t, proof.Verify(keyDigest, rootHash), "The key-value leaf should not verify as an event for key %d", i)
+	}
+
+	_, _, err = tree.Put(keyDigests[0], []byte{0x1}, version)
+	require.Error(t, err, "A value digest with a wrong length should fail")
+
+}
+
+func TestQueryMembershipAt(t *testing.T) {
+
+	log.SetLogger("TestQueryMembershipAt", log.SILENT)
+
+	numEvents := 100
+	eventDigests := make([]hashing.Digest, numEvents)
+	rootHashes := make([]hashing.Digest, numEvents)
+	hasher := hashing.NewSha256Hasher()
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, cache.NewSimpleCache(10))
+
+	for i := 0; i < numEvents; i++ {
+		eventDigests[i] = hasher.Do(rand.Bytes(32))
+		rootHash, mutations, err := tree.Add(eventDigests[i], uint64(i))
+		require.NoErrorf(t, err, "This should not fail for version %d", i)
+		require.NoError(t, store.Mutate(mutations))
+		rootHashes[i] = rootHash
+	}
+
+	for _, version := range []int{0, 1, 10, 50, numEvents - 1} {
+		for i, eventDigest := range eventDigests {
+			proof, err := tree.QueryMembershipAt(eventDigest, uint64(version))
+			require.NoError(t, err)
+			if i <= version {
+				assert.Truef(t, proof.Verify(eventDigest, rootHashes[version]), "The proof should verify for index %d at version %d", i, version)
+			} else {
+				assert.Nilf(t, proof.Value, "The event %d should not exist at version %d", i, version)
+				assert.Truef(t, proof.VerifyNonMembership(eventDigest, rootHashes[version]), "The non-membership proof should verify for index %d at version %d", i, version)
+				assert.Falsef(t, proof.VerifyNonMembership(eventDigest, rootHashes[numEvents-1]), "The non-membership proof should not verify against the last root for index %d", i)
+			}
+		}
+	}
+}
+
 func TestProveMembership(t *testing.T) {
 
 	log.SetLogger("TestProveMembership", log.SILENT)
@@ -85,7 +218,7 @@ func TestProveMembership(t *testing.T) {
 				"0x20|5": hashing.Digest{0x0},
 				"0x10|4": hashing.Digest{0x0},
 			},
-			expectedValue: []byte{0x0},
+			expectedValue: []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 		},
 		{
 			addedKeys: map[uint64]hashing.Digest{
@@ -103,7 +236,7 @@ func TestProveMembership(t *testing.T) {
 				"0x02|1": hashing.Digest{0x2},
 				"0x01|0": hashing.Digest{0x1},
 			},
-			expectedValue: []byte{0x0},
+			expectedValue: []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 		},
 	}
 
@@ -153,8 +286,7 @@ func TestAddAndVerify(t *testing.T) {
 		tree := NewHyperTree(c.hasherF, store, simpleCache)
 
 		key := hasher.Do(hashing.Digest("a test event"))
-		valueBytes := util.Uint64AsPaddedBytes(value, len(key))
-		valueBytes = valueBytes[len(valueBytes)-len(key):] // adjust to the key size
+		valueBytes := EventValue(hasher, value)
 
 		rootHash, mutations, err := tree.Add(key, value)
 		require.NoErrorf(t, err, "Add operation should not fail for index %d", i)
@@ -285,3 +417,210 @@ func BenchmarkAdd(b *testing.B) {
 	}
 
 }
+
+func TestTreeFormats(t *testing.T) {
+
+	log.SetLogger("TestTreeFormats", log.SILENT)
+
+	for _, format := range []int{hashing.TreeFormatV1, hashing.TreeFormatV2} {
+
+		hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, format)
+		require.NoError(t, err)
+
+		store, closeF := storage_utils.OpenBPlusTreeStore()
+		tree := NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+
+		var rootHash hashing.Digest
+		keys := make([]hashing.Digest, 10)
+		for i := range keys {
+			keys[i] = hashing.NewSha256Hasher().Do(rand.Bytes(32))
+			var mutations []*storage.Mutation
+			rootHash, mutations, err = tree.Add(keys[i], uint64(i))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations))
+		}
+
+		proof, err := tree.QueryMembership(keys[3])
+		require.NoError(t, err)
+		require.Truef(t, proof.Verify(keys[3], rootHash), "The proof should verify in format %d", format)
+
+		// proofs must be verified in the format of the tree
+		other := hashing.TreeFormatV1
+		if format == hashing.TreeFormatV1 {
+			other = hashing.TreeFormatV2
+		}
+		proof.hasher, err = hashing.NewTreeHasher(hashing.NewSha256Hasher(), other)
+		require.NoError(t, err)
+		require.Falsef(t, proof.Verify(keys[3], rootHash), "The proof should not verify in format %d", other)
+
+		closeF()
+	}
+
+}
+
+func TestQueryBatchMembership(t *testing.T) {
+
+	log.SetLogger("TestQueryBatchMembership", log.SILENT)
+
+	numEvents := 100
+	eventDigests := make([]hashing.Digest, numEvents)
+	rootHashes := make([]hashing.Digest, numEvents)
+	hasher := hashing.NewSha256Hasher()
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, hashing.TreeFormatV2)
+	require.NoError(t, err)
+	tree := NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+
+	for i := 0; i < numEvents; i++ {
+		eventDigests[i] = hasher.Do(rand.Bytes(32))
+		rootHash, mutations, err := tree.Add(eventDigests[i], uint64(i))
+		require.NoErrorf(t, err, "This should not fail for version %d", i)
+		require.NoError(t, store.Mutate(mutations))
+		rootHashes[i] = rootHash
+	}
+
+	// members, a key that does not exist and a key whose path ends in
+	// the shortcut leaf of a member
+	keys := append([]hashing.Digest{}, eventDigests[0:40]...)
+	keys = append(keys, hasher.Do(rand.Bytes(32)), flipLastBit(eventDigests[7]))
+
+	proof, err := tree.QueryBatchMembership(keys)
+	require.NoError(t, err)
+	require.Len(t, proof.Entries, len(keys))
+	assert.True(t, proof.Verify(keys, rootHashes[numEvents-1]), "The batch proof should verify")
+	assert.Nil(t, proof.Entries[40].Value, "The random key should not exist")
+	assert.Equal(t, []byte(eventDigests[7]), proof.Entries[41].ShortcutKey, "The path of the key should end in the leaf of a member")
+	assert.False(t, proof.Verify(keys, rootHashes[numEvents-2]), "The batch proof should not verify against another root")
+
+	_, err = tree.QueryBatchMembership(append(keys, eventDigests[7]))
+	require.Error(t, err, "Repeated keys should be rejected")
+
+	pathLen := 0
+	for _, key := range keys {
+		single, err := tree.QueryMembership(key)
+		require.NoError(t, err)
+		pathLen += len(single.AuditPath)
+	}
+	assert.Truef(t, len(proof.AuditPath) < pathLen, "The batch proof should share siblings: %d >= %d", len(proof.AuditPath), pathLen)
+
+	// the keys must be the ones of the proof, in the same order
+	swapped := append([]hashing.Digest{}, keys...)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	assert.False(t, proof.Verify(swapped, rootHashes[numEvents-1]), "The batch proof should not verify other keys")
+
+	// claiming that a member does not exist breaks the proof
+	value := proof.Entries[3].Value
+	proof.Entries[3].Value = nil
+	assert.False(t, proof.Verify(keys, rootHashes[numEvents-1]), "The batch proof should not verify a missing member")
+	proof.Entries[3].Value = value
+
+	// nor presenting the leaf of a member as the one of another key
+	forged := *proof.Entries[3]
+	forged.ShortcutKey, forged.ShortcutValue, forged.Value = flipLastBit(forged.Key), forged.Value, nil
+	entries := proof.Entries
+	proof.Entries = append(append([]*BatchQueryEntry{}, entries[:3]...), &forged)
+	proof.Entries = append(proof.Entries, entries[4:]...)
+	assert.False(t, proof.Verify(keys, rootHashes[numEvents-1]), "The batch proof should not verify a forged shortcut")
+	proof.Entries = entries
+
+	// a past version only proves the keys added until then
+	proof, err = tree.QueryBatchMembershipAt(keys, 20)
+	require.NoError(t, err)
+	assert.True(t, proof.Verify(keys, rootHashes[20]), "The batch proof should verify at version 20")
+	for i := range eventDigests[0:40] {
+		assert.Equalf(t, i <= 20, proof.Entries[i].Value != nil, "Wrong membership of key %d at version 20", i)
+	}
+
+}
+
+func TestNonMembershipShortcuts(t *testing.T) {
+
+	log.SetLogger("TestNonMembershipShortcuts", log.SILENT)
+
+	for _, format := range []int{hashing.TreeFormatV1, hashing.TreeFormatV2} {
+
+		hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, format)
+		require.NoError(t, err)
+		store, closeF := storage_utils.OpenBPlusTreeStore()
+		tree := NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+
+		var rootHash hashing.Digest
+		keys := make([]hashing.Digest, 10)
+		for i := range keys {
+			keys[i] = hashing.NewSha256Hasher().Do(rand.Bytes(32))
+			var mutations []*storage.Mutation
+			rootHash, mutations, err = tree.Add(keys[i], uint64(i))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations))
+		}
+
+		// the path of a key which differs in the last bit from a member
+		// ends in the shortcut leaf of the member
+		absent := flipLastBit(keys[3])
+		proof, err := tree.QueryMembership(absent)
+		require.NoError(t, err)
+		require.Nil(t, proof.Value)
+		require.Equal(t, []byte(keys[3]), proof.ShortcutKey)
+		require.Equalf(t, format == hashing.TreeFormatV2, proof.VerifyNonMembership(absent, rootHash), "Shortcuts should only prove non-membership in format %d", hashing.TreeFormatV2)
+
+		// the leaf of a member presented as the shortcut of another key
+		member, err := tree.QueryMembership(keys[3])
+		require.NoError(t, err)
+		require.True(t, member.Verify(keys[3], rootHash))
+		member.ShortcutKey, member.ShortcutValue, member.Value = flipLastBit(keys[3]), member.Value, nil
+		require.Falsef(t, member.VerifyNonMembership(keys[3], rootHash), "The non-membership of a member should not verify in format %d", format)
+
+		closeF()
+	}
+
+}
+
+func TestKeyValueLeavesBindKeys(t *testing.T) {
+
+	log.SetLogger("TestKeyValueLeavesBindKeys", log.SILENT)
+
+	hasher := hashing.NewSha256Hasher()
+
+	// trees which do not bind the leaves to their keys refuse key-value entries
+	hasherF, err := hashing.NewTreeHasherF(hashing.NewSha256Hasher, hashing.TreeFormatV1)
+	require.NoError(t, err)
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+	_, _, err = tree.Put(hasher.Do([]byte("key")), hasher.Do([]byte("value")), 0)
+	require.Errorf(t, err, "Key-value entries should fail in format %d", hashing.TreeFormatV1)
+
+	hasherF, err = hashing.NewTreeHasherF(hashing.NewSha256Hasher, hashing.TreeFormatV2)
+	require.NoError(t, err)
+	store, closeF = storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree = NewHyperTree(hasherF, store, cache.NewSimpleCache(10))
+
+	var rootHash hashing.Digest
+	keys := make([]hashing.Digest, 10)
+	for i := range keys {
+		keys[i] = hasher.Do(rand.Bytes(32))
+		var mutations []*storage.Mutation
+		rootHash, mutations, err = tree.Put(keys[i], hasher.Do(rand.Bytes(32)), uint64(i))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+	}
+
+	// the proof of a key presented as the proof of another key which
+	// shares its path up to the shortcut leaf
+	proof, err := tree.QueryMembership(keys[3])
+	require.NoError(t, err)
+	require.True(t, proof.Verify(keys[3], rootHash), "The proof should verify for its own key")
+	other := flipLastBit(keys[3])
+	proof.Key = other
+	require.False(t, proof.Verify(other, rootHash), "The proof of a key should not verify for another key")
+
+}
+
+func flipLastBit(digest hashing.Digest) hashing.Digest {
+	flipped := append(hashing.Digest{}, digest...)
+	flipped[len(flipped)-1] ^= 0x01
+	return flipped
+}
@@ -18,21 +18,25 @@ package hyper
 
 import (
 	"bytes"
-
-	"github.com/bbva/qed/util"
 )
 
 func pruneToVerify(index, value []byte, auditPathHeight uint16) *operationsStack {
+	return pruneToVerifyPath(index, auditPathHeight, func(pos position) *operation {
+		return leafHash(pos, index, value)
+	})
+}
 
-	version := util.AddPaddingToBytes(value, len(index))
-	version = version[len(version)-len(index):] // TODO GET RID OF THIS: used only to pass tests
+// pruneToVerifyPath builds the operations to recompute the root hash from
+// the audit path of an index, using the given terminal operation at the
+// height where the audit path ends.
+func pruneToVerifyPath(index []byte, auditPathHeight uint16, terminal func(pos position) *operation) *operationsStack {
 
 	var traverse func(pos position, ops *operationsStack)
 
 	traverse = func(pos position, ops *operationsStack) {
 
 		if pos.Height <= auditPathHeight {
-			ops.Push(leafHash(pos, version))
+			ops.Push(terminal(pos))
 			return
 		}
 
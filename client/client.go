@@ -32,6 +32,7 @@ import (
 	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
 )
 
 // HTTPClient is an HTTP QED client.
@@ -40,6 +41,8 @@ type HTTPClient struct {
 	retrier             RequestRetrier
 	topology            *topology
 	apiKey              string
+	logID               string
+	binaryProofs        bool
 	readPreference      ReadPref
 	maxRetries          int
 	healthCheckEnabled  bool
@@ -49,8 +52,10 @@ type HTTPClient struct {
 
 	mu                sync.RWMutex // guards the next block
 	running           bool
-	healthCheckStopCh chan bool // notify healthchecker to stop, and notify back
-	discoveryStopCh   chan bool // notify sniffer to stop, and notify back
+	healthCheckStopCh chan bool             // notify healthchecker to stop, and notify back
+	discoveryStopCh   chan bool             // notify sniffer to stop, and notify back
+	hasherF           func() hashing.Hasher // hasher advertised by the server
+	hasherID          string
 }
 
 // NewSimpleHTTPClient creates a new short-lived client thath can be
@@ -267,11 +272,19 @@ func (c *HTTPClient) callPrimary(method, path string, data []byte) ([]byte, erro
 }
 
 func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
+	result, _, err := c.callAnyAccept(method, path, data, "")
+	return result, err
+}
+
+// callAnyAccept is like callAny but it sends the given Accept header, if
+// any, and also returns the Content-Type of the response.
+func (c *HTTPClient) callAnyAccept(method, path string, data []byte, accept string) ([]byte, string, error) {
 
 	var endpoint *endpoint
 	var retried bool
 	var err error
 	var result []byte
+	var contentType string
 	for {
 		// check every endpoint available in a round-robin manner
 		endpoint, err = c.topology.NextReadEndpoint(c.readPreference)
@@ -281,33 +294,41 @@ func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
 				retried = true
 				continue
 			}
-			return nil, err
+			return nil, "", err
 		}
-		result, err = c.doReq(method, endpoint, path, data)
+		result, contentType, err = c.doReqAccept(method, endpoint, path, data, accept)
 		if err == nil {
 			break
 		}
 		endpoint.MarkAsDead()
 	}
-	return result, err
+	return result, contentType, err
 }
 
 func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data []byte) ([]byte, error) {
+	bodyBytes, _, err := c.doReqAccept(method, endpoint, path, data, "")
+	return bodyBytes, err
+}
+
+func (c *HTTPClient) doReqAccept(method string, endpoint *endpoint, path string, data []byte, accept string) ([]byte, string, error) {
 
 	url, err := url.Parse(endpoint.URL() + path)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Build request
 	req, err := NewRetriableRequest(method, url.String(), data)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Api-Key", c.apiKey)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
 
 	// Get response
 	resp, err := c.retrier.DoReq(req)
@@ -315,7 +336,7 @@ func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data
 		log.Infof("Request error: %v\n", err)
 		log.Infof("%s is dead\n", endpoint)
 		endpoint.MarkAsDead()
-		return nil, err
+		return nil, "", err
 	}
 
 	var bodyBytes []byte
@@ -323,18 +344,45 @@ func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data
 		defer resp.Body.Close()
 		bodyBytes, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	}
 
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		return nil, fmt.Errorf("Invalid request %v", string(bodyBytes))
+		return nil, "", fmt.Errorf("Invalid request %v", string(bodyBytes))
 	}
 
 	// we successfully made a request to this endpoint
 	endpoint.MarkAsHealthy()
 
-	return bodyBytes, nil
+	return bodyBytes, resp.Header.Get("Content-Type"), nil
+}
+
+// callProof asks any endpoint for a proof, in the binary proof format if
+// the client prefers it. It returns true if the proof is binary encoded.
+func (c *HTTPClient) callProof(path string, query []byte) ([]byte, bool, error) {
+	var accept string
+	if c.binaryProofs {
+		accept = protocol.BinaryProofMediaType + ", application/json"
+	}
+	body, contentType, err := c.callAnyAccept("POST", path, query, accept)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, protocol.IsBinaryProof(contentType), nil
+}
+
+func (c *HTTPClient) decodeMembershipResult(body []byte, binary bool) (*protocol.MembershipResult, error) {
+	if !binary {
+		var proof *protocol.MembershipResult
+		_ = json.Unmarshal(body, &proof)
+		return proof, nil
+	}
+	hasherF, err := c.HasherF()
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeMembershipResult(body, hasherF())
 }
 
 // healthCheck does a health check on all nodes in the cluster.
@@ -440,6 +488,98 @@ func (c *HTTPClient) startHealthChecker() {
 	}
 }
 
+// logPath returns the path of a route of the log identified by logID.
+// The default log is served from the root path.
+func logPath(logID, route string) string {
+	if logID == "" || logID == "default" {
+		return route
+	}
+	return "/logs/" + url.PathEscape(logID) + route
+}
+
+// HasherF returns the constructor of the hasher the server builds its
+// trees with, as advertised in its /info endpoint. Servers that do not
+// advertise any hasher use the default one.
+func (c *HTTPClient) HasherF() (func() hashing.Hasher, error) {
+	c.mu.RLock()
+	hasherF := c.hasherF
+	c.mu.RUnlock()
+	if hasherF != nil {
+		return hasherF, nil
+	}
+
+	id, err := c.HasherID()
+	if err != nil {
+		return nil, err
+	}
+
+	hasherF, err = hashing.NewHasherF(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.hasherF = hasherF
+	c.mu.Unlock()
+
+	return hasherF, nil
+}
+
+// HasherID returns the identifier of the hasher the server builds its
+// trees with, as advertised in its /info endpoint.
+func (c *HTTPClient) HasherID() (string, error) {
+	c.mu.RLock()
+	id := c.hasherID
+	c.mu.RUnlock()
+	if id != "" {
+		return id, nil
+	}
+
+	body, err := c.callAny("GET", "/info", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		Hasher string
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", err
+	}
+
+	id = info.Hasher
+	if id == "" {
+		id = hashing.DefaultHasher
+	}
+
+	c.mu.Lock()
+	c.hasherID = id
+	c.mu.Unlock()
+
+	return id, nil
+}
+
+// Keys returns the signing keys of the servers, as published in their
+// /keys endpoint, after checking that every key is one of the trusted
+// keys or was cross-signed by one of them, directly or through a chain
+// of rotations.
+func (c *HTTPClient) Keys(trusted *sign.KeySet) (*sign.KeySet, error) {
+	body, err := c.callAny("GET", "/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys sign.KeySet
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, err
+	}
+	if err := keys.Check(trusted); err != nil {
+		return nil, err
+	}
+
+	return &keys, nil
+}
+
 // Ping will do a healthcheck request to the primary node
 func (c *HTTPClient) Ping() error {
 	_, err := c.callPrimary("HEAD", "/healthcheck", nil)
@@ -453,7 +593,53 @@ func (c *HTTPClient) Ping() error {
 func (c *HTTPClient) Add(event string) (*protocol.Snapshot, error) {
 
 	data, _ := json.Marshal(&protocol.Event{Event: []byte(event)})
-	body, err := c.callPrimary("POST", "/events", data)
+	body, err := c.callPrimary("POST", logPath(c.logID, "/events"), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot protocol.Snapshot
+	err = json.Unmarshal(body, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+
+}
+
+// AddBulk will do a request to the server with a post data to store a
+// bulk of events through a single round trip. It returns one snapshot per
+// event, in the same order.
+func (c *HTTPClient) AddBulk(events []string) ([]*protocol.Snapshot, error) {
+
+	bulk := make([][]byte, len(events))
+	for i, event := range events {
+		bulk[i] = []byte(event)
+	}
+
+	data, _ := json.Marshal(&protocol.EventsBulk{Events: bulk})
+	body, err := c.callPrimary("POST", logPath(c.logID, "/events/bulk"), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*protocol.Snapshot
+	err = json.Unmarshal(body, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+
+}
+
+// Put will do a request to the server with a post data to store the value
+// of a key in authenticated key-value mode, replacing its previous value.
+func (c *HTTPClient) Put(key, value string) (*protocol.Snapshot, error) {
+
+	data, _ := json.Marshal(&protocol.KeyValue{Key: []byte(key), Value: []byte(value)})
+	body, err := c.callPrimary("POST", logPath(c.logID, "/entries"), data)
 	if err != nil {
 		return nil, err
 	}
@@ -476,32 +662,63 @@ func (c *HTTPClient) Membership(key []byte, version uint64) (*protocol.Membershi
 		Version: version,
 	})
 
-	body, err := c.callAny("POST", "/proofs/membership", query)
+	body, binary, err := c.callProof(logPath(c.logID, "/proofs/membership"), query)
 	if err != nil {
 		return nil, err
 	}
 
-	var proof *protocol.MembershipResult
-	_ = json.Unmarshal(body, &proof)
-
-	return proof, nil
+	return c.decodeMembershipResult(body, binary)
 
 }
 
 // Membership will ask for a Proof to the server.
 func (c *HTTPClient) MembershipDigest(keyDigest hashing.Digest, version uint64) (*protocol.MembershipResult, error) {
+	return c.LogMembershipDigest(c.logID, keyDigest, version)
+}
+
+// LogMembershipDigest will ask for a Proof to the server on the log
+// identified by logID instead of the one of the client.
+func (c *HTTPClient) LogMembershipDigest(logID string, keyDigest hashing.Digest, version uint64) (*protocol.MembershipResult, error) {
 
 	query, _ := json.Marshal(&protocol.MembershipDigest{
 		KeyDigest: keyDigest,
 		Version:   version,
 	})
 
-	body, err := c.callAny("POST", "/proofs/digest-membership", query)
+	body, binary, err := c.callProof(logPath(logID, "/proofs/digest-membership"), query)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decodeMembershipResult(body, binary)
+
+}
+
+// BatchMembershipDigest will ask the server for a single Proof of all
+// the given key digests at the given version.
+func (c *HTTPClient) BatchMembershipDigest(keyDigests []hashing.Digest, version uint64) (*protocol.BatchMembershipResult, error) {
+	return c.LogBatchMembershipDigest(c.logID, keyDigests, version)
+}
+
+// LogBatchMembershipDigest will ask for a batch Proof to the server on
+// the log identified by logID instead of the one of the client.
+func (c *HTTPClient) LogBatchMembershipDigest(logID string, keyDigests []hashing.Digest, version uint64) (*protocol.BatchMembershipResult, error) {
+
+	query, _ := json.Marshal(&protocol.BatchMembershipQuery{
+		KeyDigests: keyDigests,
+		Version:    version,
+	})
+
+	body, binary, err := c.callProof(logPath(logID, "/proofs/membership/batch"), query)
 	if err != nil {
 		return nil, err
 	}
 
-	var proof *protocol.MembershipResult
+	if binary {
+		return protocol.DecodeBatchMembershipResult(body)
+	}
+
+	var proof *protocol.BatchMembershipResult
 	_ = json.Unmarshal(body, &proof)
 
 	return proof, nil
@@ -510,17 +727,27 @@ func (c *HTTPClient) MembershipDigest(keyDigest hashing.Digest, version uint64)
 
 // Incremental will ask for an IncrementalProof to the server.
 func (c *HTTPClient) Incremental(start, end uint64) (*protocol.IncrementalResponse, error) {
+	return c.LogIncremental(c.logID, start, end)
+}
+
+// LogIncremental will ask for an IncrementalProof to the server on the
+// log identified by logID instead of the one of the client.
+func (c *HTTPClient) LogIncremental(logID string, start, end uint64) (*protocol.IncrementalResponse, error) {
 
 	query, _ := json.Marshal(&protocol.IncrementalRequest{
 		Start: start,
 		End:   end,
 	})
 
-	body, err := c.callAny("POST", "/proofs/incremental", query)
+	body, binary, err := c.callProof(logPath(logID, "/proofs/incremental"), query)
 	if err != nil {
 		return nil, err
 	}
 
+	if binary {
+		return protocol.DecodeIncrementalResponse(body)
+	}
+
 	var response *protocol.IncrementalResponse
 	_ = json.Unmarshal(body, &response)
 
@@ -535,7 +762,10 @@ func (c *HTTPClient) Verify(
 	hasherF func() hashing.Hasher,
 ) bool {
 
-	proof := protocol.ToBalloonProof(result, hasherF)
+	proof, err := protocol.ToBalloonProof(result, hasherF, snap.TreeFormat)
+	if err != nil {
+		return false
+	}
 
 	return proof.Verify(snap.EventDigest, &balloon.Snapshot{
 		EventDigest:   snap.EventDigest,
@@ -554,7 +784,10 @@ func (c *HTTPClient) DigestVerify(
 	hasherF func() hashing.Hasher,
 ) bool {
 
-	proof := protocol.ToBalloonProof(result, hasherF)
+	proof, err := protocol.ToBalloonProof(result, hasherF, snap.TreeFormat)
+	if err != nil {
+		return false
+	}
 
 	return proof.DigestVerify(snap.EventDigest, &balloon.Snapshot{
 		EventDigest:   snap.EventDigest,
@@ -565,13 +798,68 @@ func (c *HTTPClient) DigestVerify(
 
 }
 
+// VerifyValue will compute the Proof given in Membership for a key stored
+// with Put and returns true if it proves that the given value is the value
+// of the key in the given snapshot.
+func (c *HTTPClient) VerifyValue(
+	result *protocol.MembershipResult,
+	snap *protocol.Snapshot,
+	key, value []byte,
+	hasherF func() hashing.Hasher,
+) bool {
+
+	proof, err := protocol.ToBalloonProof(result, hasherF, snap.TreeFormat)
+	if err != nil {
+		return false
+	}
+
+	return proof.VerifyValue(key, value, &balloon.Snapshot{
+		EventDigest:   snap.EventDigest,
+		HistoryDigest: snap.HistoryDigest,
+		HyperDigest:   snap.HyperDigest,
+		Version:       snap.Version,
+	})
+
+}
+
+// BatchDigestVerify will compute the Proof given in BatchMembershipDigest
+// and returns true if it proves the answers for all the key digests in
+// the given snapshot.
+func (c *HTTPClient) BatchDigestVerify(
+	result *protocol.BatchMembershipResult,
+	keyDigests []hashing.Digest,
+	snap *protocol.Snapshot,
+	hasherF func() hashing.Hasher,
+) bool {
+
+	proof, err := protocol.ToBalloonBatchProof(result, hasherF, snap.TreeFormat)
+	if err != nil {
+		return false
+	}
+
+	return proof.DigestVerify(keyDigests, &balloon.Snapshot{
+		EventDigest:   snap.EventDigest,
+		HistoryDigest: snap.HistoryDigest,
+		HyperDigest:   snap.HyperDigest,
+		Version:       snap.Version,
+	})
+
+}
+
 func (c *HTTPClient) VerifyIncremental(
 	result *protocol.IncrementalResponse,
 	startSnapshot, endSnapshot *protocol.Snapshot,
 	hasher hashing.Hasher,
 ) bool {
 
-	proof := protocol.ToIncrementalProof(result, hasher)
+	// both snapshots belong to the same trees
+	if treeFormat(startSnapshot) != treeFormat(endSnapshot) {
+		return false
+	}
+	proof, err := protocol.ToIncrementalProof(result, hasher, endSnapshot.TreeFormat)
+	if err != nil {
+		return false
+	}
 
 	start := &balloon.Snapshot{
 		EventDigest:   startSnapshot.EventDigest,
@@ -588,3 +876,12 @@ func (c *HTTPClient) VerifyIncremental(
 
 	return proof.Verify(start, end)
 }
+
+// treeFormat returns the format of the trees of a snapshot, which is
+// hashing.TreeFormatV1 when omitted.
+func treeFormat(snapshot *protocol.Snapshot) int {
+	if snapshot.TreeFormat == 0 {
+		return hashing.TreeFormatV1
+	}
+	return snapshot.TreeFormat
+}
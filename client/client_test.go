@@ -29,11 +29,16 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/storage"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+	"github.com/bbva/qed/util"
 	"github.com/pkg/errors"
 
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,10 +48,14 @@ func setupServer(input []byte) (string, func()) {
 
 	mux.HandleFunc("/info/shards", infoHandler(server.URL))
 	mux.HandleFunc("/events", defaultHandler(input))
+	mux.HandleFunc("/events/bulk", defaultHandler(input))
+	mux.HandleFunc("/entries", defaultHandler(input))
 	mux.HandleFunc("/proofs/membership", defaultHandler(input))
 	mux.HandleFunc("/proofs/incremental", defaultHandler(input))
 	mux.HandleFunc("/proofs/digest-membership", defaultHandler(input))
+	mux.HandleFunc("/logs/tenant/events", defaultHandler(input))
 	mux.HandleFunc("/healthcheck", defaultHandler(nil))
+	mux.HandleFunc("/info", defaultHandler([]byte(`{"Hasher":"sha3-256"}`)))
 
 	return server.URL, func() {
 		server.Close()
@@ -444,6 +453,300 @@ func TestAddWithServerFailure(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestAddBulkSuccess(t *testing.T) {
+
+	log.SetLogger("TestAddBulkSuccess", log.SILENT)
+
+	events := []string{"Hello world!", "Hello again!"}
+	snaps := make([]*protocol.Snapshot, len(events))
+	for i, event := range events {
+		snaps[i] = &protocol.Snapshot{
+			HistoryDigest: []byte("history"),
+			HyperDigest:   []byte("hyper"),
+			Version:       uint64(i),
+			EventDigest:   []byte(event),
+		}
+	}
+	input, _ := json.Marshal(snaps)
+
+	serverURL, tearDown := setupServer(input)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	snapshots, err := client.AddBulk(events)
+	assert.NoError(t, err)
+	assert.Equal(t, snaps, snapshots, "The snapshots should match")
+}
+
+func TestPutSuccess(t *testing.T) {
+
+	log.SetLogger("TestPutSuccess", log.SILENT)
+
+	snap := &protocol.Snapshot{
+		HistoryDigest: []byte("history"),
+		HyperDigest:   []byte("hyper"),
+		Version:       0,
+		EventDigest:   []byte("key"),
+	}
+	input, _ := json.Marshal(snap)
+
+	serverURL, tearDown := setupServer(input)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	snapshot, err := client.Put("key", "value")
+	assert.NoError(t, err)
+	assert.Equal(t, snap, snapshot, "The snapshots should match")
+}
+
+func TestAddToLog(t *testing.T) {
+
+	log.SetLogger("TestAddToLog", log.SILENT)
+
+	snap := &protocol.Snapshot{
+		HistoryDigest: []byte("history"),
+		HyperDigest:   []byte("hyper"),
+		Version:       0,
+		EventDigest:   []byte("event"),
+		LogId:         "tenant",
+	}
+	input, _ := json.Marshal(snap)
+
+	serverURL, tearDown := setupServer(input)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+	require.NoError(t, SetLogID("tenant")(client))
+
+	snapshot, err := client.Add("Hello world!")
+	assert.NoError(t, err)
+	assert.Equal(t, snap, snapshot, "The snapshots should match")
+
+	// logs without a route in the server
+	require.NoError(t, SetLogID("other")(client))
+	_, err = client.Add("Hello world!")
+	assert.Error(t, err)
+}
+
+func TestHasherF(t *testing.T) {
+
+	log.SetLogger("TestHasherF", log.SILENT)
+
+	serverURL, tearDown := setupServer(nil)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	hasherF, err := client.HasherF()
+	require.NoError(t, err)
+	assert.Equal(t, hashing.NewSha3_256Hasher().Do([]byte("test")), hasherF().Do([]byte("test")), "The hasher should be the advertised one")
+	id, err := client.HasherID()
+	require.NoError(t, err)
+	assert.Equal(t, hashing.SHA3_256, id, "The hasher id should be the advertised one")
+
+	// the hasher is cached once the server is gone
+	tearDown()
+	hasherF, err = client.HasherF()
+	require.NoError(t, err)
+	assert.Equal(t, hashing.NewSha3_256Hasher().Do([]byte("test")), hasherF().Do([]byte("test")), "The hasher should be cached")
+}
+
+func TestKeys(t *testing.T) {
+
+	log.SetLogger("TestKeys", log.SILENT)
+
+	signer := sign.NewEd25519Signer()
+	keys := &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+		NotBefore: 1,
+	}}}
+	input, _ := json.Marshal(keys)
+
+	keys.Keys[0].KeyId = "forged"
+	forged, _ := json.Marshal(keys)
+	keys.Keys[0].KeyId = signer.KeyID()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", defaultHandler(input))
+	mux.HandleFunc("/forged/keys", defaultHandler(forged))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	trusted := &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+	}}}
+
+	client := setupClient(t, []string{server.URL})
+	published, err := client.Keys(trusted)
+	require.NoError(t, err)
+	assert.Equal(t, keys, published, "The keys should be the published ones")
+
+	other := sign.NewEd25519Signer()
+	_, err = client.Keys(&sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     other.KeyID(),
+		Algorithm: other.Algorithm(),
+		PublicKey: other.PublicKey(),
+	}}})
+	assert.Error(t, err, "Keys not anchored in the trusted ones should be rejected")
+
+	client = setupClient(t, []string{server.URL + "/forged"})
+	_, err = client.Keys(trusted)
+	assert.Error(t, err, "Keys that do not match their ids should be rejected")
+
+}
+
+func TestDigestVerifyTreeFormats(t *testing.T) {
+
+	log.SetLogger("TestDigestVerifyTreeFormats", log.SILENT)
+
+	client := setupClient(t, []string{"http://127.0.0.1:0"})
+
+	for _, format := range []int{hashing.TreeFormatV1, hashing.TreeFormatV2} {
+		store, closeF := storage_utils.OpenBPlusTreeStore()
+		require.NoError(t, store.Mutate([]*storage.Mutation{
+			storage.NewMutation(storage.BalloonMetadataTable, balloon.TreeFormatKey, util.Uint16AsBytes(uint16(format))),
+		}))
+		tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+		require.NoError(t, err)
+		require.Equal(t, format, tree.TreeFormat())
+
+		event := []byte("Hello world!")
+		s, mutations, err := tree.Add(event)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+
+		proof, err := tree.QueryMembership(event, s.Version)
+		require.NoError(t, err)
+
+		var result *protocol.MembershipResult
+		out, _ := json.Marshal(protocol.ToMembershipResult(event, proof))
+		require.NoError(t, json.Unmarshal(out, &result))
+
+		snap := &protocol.Snapshot{
+			HistoryDigest: s.HistoryDigest,
+			HyperDigest:   s.HyperDigest,
+			Version:       s.Version,
+			EventDigest:   s.EventDigest,
+			TreeFormat:    s.TreeFormat,
+		}
+		assert.Truef(t, client.DigestVerify(result, snap, hashing.NewSha256Hasher), "The proof should verify in format %d", format)
+
+		// the format is taken from the snapshot and not from the proof
+		other := hashing.TreeFormatV1
+		if format == hashing.TreeFormatV1 {
+			other = hashing.TreeFormatV2
+		}
+		result.TreeFormat = other
+		assert.Truef(t, client.DigestVerify(result, snap, hashing.NewSha256Hasher), "The advertised format should be ignored in format %d", format)
+		snap.TreeFormat = other
+		assert.Falsef(t, client.DigestVerify(result, snap, hashing.NewSha256Hasher), "The proof should not verify in another format than %d", format)
+
+		closeF()
+	}
+}
+
+func TestBatchDigestVerify(t *testing.T) {
+
+	log.SetLogger("TestBatchDigestVerify", log.SILENT)
+
+	client := setupClient(t, []string{"http://127.0.0.1:0"})
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	keyDigests := make([]hashing.Digest, 0)
+	var s *balloon.Snapshot
+	for i := 0; i < 20; i++ {
+		event := []byte(fmt.Sprintf("event %d", i))
+		var mutations []*storage.Mutation
+		s, mutations, err = tree.Add(event)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		keyDigests = append(keyDigests, hasher.Do(event))
+	}
+	keyDigests = append(keyDigests, hasher.Do([]byte("missing")))
+
+	proof, err := tree.QueryBatchMembership(keyDigests, s.Version)
+	require.NoError(t, err)
+
+	var result *protocol.BatchMembershipResult
+	out, _ := json.Marshal(protocol.ToBatchMembershipResult(proof))
+	require.NoError(t, json.Unmarshal(out, &result))
+
+	snap := &protocol.Snapshot{
+		HistoryDigest: s.HistoryDigest,
+		HyperDigest:   s.HyperDigest,
+		Version:       s.Version,
+		EventDigest:   s.EventDigest,
+		TreeFormat:    s.TreeFormat,
+	}
+	assert.True(t, client.BatchDigestVerify(result, keyDigests, snap, hashing.NewSha256Hasher), "The batch proof should verify")
+
+	result.Entries[3].ActualVersion = 4
+	assert.False(t, client.BatchDigestVerify(result, keyDigests, snap, hashing.NewSha256Hasher), "The batch proof should not verify a wrong version")
+}
+
+func TestBinaryProofs(t *testing.T) {
+
+	log.SetLogger("TestBinaryProofs", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	var s *balloon.Snapshot
+	for i := 0; i < 10; i++ {
+		var mutations []*storage.Mutation
+		s, mutations, err = tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+	}
+	proof, err := tree.QueryMembership([]byte("event 3"), s.Version)
+	require.NoError(t, err)
+	result := protocol.ToMembershipResult(nil, proof)
+
+	var accepts []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/info", defaultHandler([]byte(`{"Hasher":"sha256"}`)))
+	mux.HandleFunc("/proofs/digest-membership", func(w http.ResponseWriter, r *http.Request) {
+		accepts = append(accepts, r.Header.Get("Accept"))
+		if protocol.AcceptsBinaryProof(r.Header.Get("Accept")) {
+			out, _ := protocol.EncodeMembershipResult(result, proof.Hasher)
+			w.Header().Set("Content-Type", protocol.BinaryProofMediaType)
+			w.Write(out)
+			return
+		}
+		out, _ := json.Marshal(result)
+		w.Write(out)
+	})
+
+	client := setupClient(t, []string{server.URL})
+	snap := &protocol.Snapshot{
+		HistoryDigest: s.HistoryDigest,
+		HyperDigest:   s.HyperDigest,
+		Version:       s.Version,
+		EventDigest:   proof.KeyDigest,
+		TreeFormat:    s.TreeFormat,
+	}
+
+	for _, binary := range []bool{false, true} {
+		require.NoError(t, SetBinaryProofs(binary)(client))
+		received, err := client.MembershipDigest(proof.KeyDigest, s.Version)
+		require.NoError(t, err)
+		assert.Equalf(t, result, received, "The proof should be received when binary is %v", binary)
+		assert.Truef(t, client.DigestVerify(received, snap, hashing.NewSha256Hasher), "The proof should verify when binary is %v", binary)
+	}
+	assert.Equal(t, []string{"", protocol.BinaryProofMediaType + ", application/json"}, accepts)
+}
+
 func TestMembership(t *testing.T) {
 
 	log.SetLogger("TestMembership", log.SILENT)
@@ -102,6 +102,14 @@ type Config struct {
 	// ApiKey to query the server endpoint.
 	APIKey string `desc:"Set API Key to talk to QED Log service"`
 
+	// LogID is the id of the log to send events and queries to. If empty,
+	// the default log of the server is used.
+	LogID string `desc:"Set the id of the QED log to talk to, the default one if empty"`
+
+	// BinaryProofs makes the client ask for proofs in the compact binary
+	// format instead of JSON.
+	BinaryProofs bool `desc:"Ask for proofs in the compact binary format instead of JSON"`
+
 	// Insecure enables the verification of the server's certificate chain
 	// and host name, allowing MiTM vector attacks.
 	Insecure bool `desc:"Set it to true to disable the verification of the server's certificate chain"`
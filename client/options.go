@@ -32,6 +32,8 @@ func configToOptions(conf *Config) ([]HTTPClientOptionF, error) {
 	if conf != nil {
 		options = []HTTPClientOptionF{
 			SetAPIKey(conf.APIKey),
+			SetLogID(conf.LogID),
+			SetBinaryProofs(conf.BinaryProofs),
 			SetReadPreference(conf.ReadPreference),
 			SetMaxRetries(conf.MaxRetries),
 			SetTopologyDiscovery(conf.EnableTopologyDiscovery),
@@ -105,6 +107,24 @@ func SetAPIKey(key string) HTTPClientOptionF {
 	}
 }
 
+// SetLogID sets the id of the log the client sends events and queries
+// to. An empty id refers to the default log of the server.
+func SetLogID(id string) HTTPClientOptionF {
+	return func(c *HTTPClient) error {
+		c.logID = id
+		return nil
+	}
+}
+
+// SetBinaryProofs makes the client ask for proofs in the compact binary
+// format. Servers that do not support it keep answering in JSON.
+func SetBinaryProofs(enable bool) HTTPClientOptionF {
+	return func(c *HTTPClient) error {
+		c.binaryProofs = enable
+		return nil
+	}
+}
+
 func SetReadPreference(preference ReadPref) HTTPClientOptionF {
 	return func(c *HTTPClient) error {
 		c.readPreference = preference
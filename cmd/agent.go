@@ -18,9 +18,15 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"path/filepath"
 
 	"github.com/bbva/qed/gossip"
 	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/rocks"
 	"github.com/octago/sflags/gen/gpflag"
 	"github.com/spf13/cobra"
 )
@@ -29,12 +35,14 @@ var agentCmd *cobra.Command = &cobra.Command{
 	Use:   "agent",
 	Short: "Provides access to the QED gossip agents",
 	Long: `QED provides standalone agents to help maintain QED security. We have included
-three agents into the distribution:
+four agents into the distribution:
 	* Monitor agent: checks the lag of the system between the QED Log and the
 	  Snapshot Store as seen by the gossip network
 	* Auditor agent: verifies QED membership proofs of the snapshots received
 	  throught the  gossip network
-	* Publisher agent: publish snapshots to the snapshot store`,
+	* Publisher agent: publish snapshots to the snapshot store
+	* Witness agent: cosigns the snapshots consistent with the ones it
+	  cosigned before, so clients can detect split views of the log`,
 	TraverseChildren: true,
 }
 
@@ -59,3 +67,100 @@ func configAgent() context.Context {
 
 	return context.WithValue(Ctx, k("agent.config"), conf)
 }
+
+// startProcessors registers the processors of every factory of the agent:
+// the ones which process the alerts and evidence gossiped by other agents
+// and the snapshots they request, and the one of its role, if any. The
+// agent stops them on shutdown. The snapshots are only processed with
+// trusted keys to verify them.
+func startProcessors(agent *gossip.Agent) error {
+	if err := agent.CheckTrustedKeys(); err != nil {
+		return fmt.Errorf("%v: set --trusted-keys, or --insecure-skip-verify for testing", err)
+	}
+	for _, name := range agent.ProcessorFactories() {
+		if err := agent.StartProcessor(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTasksManager returns the tasks manager of an agent. Unless configured,
+// its dead letter queue is kept in the data path of the agent.
+func newTasksManager(agentConf *gossip.Config, conf *gossip.PriorityTasksManagerConfig) (*gossip.PriorityTasksManager, error) {
+	if conf.DeadLetterPath == "" && agentConf.DataPath != "" {
+		conf.DeadLetterPath = filepath.Join(agentConf.DataPath, "deadletters.json")
+	}
+	return gossip.NewPriorityTasksManagerFromConfig(conf)
+}
+
+// openLocalStore opens the RocksDB database of a local snapshot store,
+// creating the directory if it does not exist.
+func openLocalStore(path string) (storage.Store, error) {
+	return rocks.NewRocksDBStore(path)
+}
+
+// closeSnapshotStore releases the snapshot stores which hold resources,
+// like the local ones.
+func closeSnapshotStore(store gossip.SnapshotStore) {
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Infof("Agent is unable to close its snapshot store: %v", err)
+		}
+	}
+}
+
+// recordSnapshots keeps the verified snapshots with a valid signature in
+// the local snapshot store of an agent. The store is keyed by version, so
+// only the snapshots of the default log are kept.
+func recordSnapshots(agent *gossip.Agent, snapshots ...*protocol.SignedSnapshot) {
+	keys, err := agent.ServerKeys()
+	if err != nil {
+		log.Infof("Agent is unable to get the keys to record the snapshots: %v", err)
+		return
+	}
+	for _, s := range snapshots {
+		if s.Snapshot.LogId != "" {
+			continue
+		}
+		if err := s.VerifyKeySet(keys); err != nil {
+			log.Infof("Agent does not record snapshot %d with an invalid signature: %v", s.Snapshot.Version, err)
+			continue
+		}
+		if err := agent.SnapshotStore.PutSnapshot(s.Snapshot.Version, s); err != nil {
+			log.Infof("Agent is unable to record snapshot %d: %v", s.Snapshot.Version, err)
+		}
+	}
+}
+
+// backfill makes the agent process the snapshots published while it was
+// down, before it joins the gossip network.
+func backfill(agent *gossip.Agent) {
+	batch, err := agent.Backfill()
+	if err == gossip.ErrInconsistentCheckpoint {
+		msg := fmt.Sprintf("Agent is unable to verify the consistency of the snapshot store since its checkpoint %d", agent.Checkpoints.Get("").Version)
+		agent.Notifier.Alert(msg)
+		if err := agent.RaiseAlert(msg); err != nil {
+			log.Infof("Agent is unable to gossip the alert: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Infof("Agent is unable to backfill the snapshots missed since its checkpoint: %v", err)
+		return
+	}
+	if batch == nil || len(batch.Snapshots) == 0 {
+		return
+	}
+	buf, err := batch.Encode()
+	if err != nil {
+		log.Infof("Agent is unable to encode the backfilled snapshots: %v", err)
+		return
+	}
+	// a message with no TTL is not gossiped to other agents
+	agent.In.Publish(&gossip.Message{
+		Kind:    gossip.BatchMessageType,
+		TTL:     0,
+		Payload: buf,
+	})
+}
@@ -21,7 +21,6 @@ import (
 
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/gossip"
-	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/util"
@@ -58,6 +57,38 @@ var (
 			Help: "Number of errors trying to get membership proofs by auditors.",
 		},
 	)
+
+	QedAuditorSnapshotsAuditedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "qed_auditor_snapshots_audited_total",
+			Help: "Number of snapshots audited by auditors, per sampling strategy.",
+		},
+		[]string{"strategy"},
+	)
+
+	QedAuditorSnapshotsSkippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "qed_auditor_snapshots_skipped_total",
+			Help: "Number of snapshots received and not sampled by auditors, per sampling strategy.",
+		},
+		[]string{"strategy"},
+	)
+
+	QedAuditorAuditedVersions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "qed_auditor_audited_versions",
+			Help: "Number of distinct versions audited by auditors, per sampling strategy.",
+		},
+		[]string{"strategy"},
+	)
+
+	QedAuditorCoverageRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "qed_auditor_coverage_ratio",
+			Help: "Fraction of the versions seen which have been audited, per sampling strategy.",
+		},
+		[]string{"strategy"},
+	)
 )
 
 var agentAuditorCmd = &cobra.Command{
@@ -78,9 +109,10 @@ func init() {
 
 type auditorConfig struct {
 	Qed      *client.Config
-	Notifier *gossip.SimpleNotifierConfig
-	Store    *gossip.RestSnapshotStoreConfig
-	Tasks    *gossip.SimpleTasksManagerConfig
+	Notifier *gossip.NotifierConfig
+	Store    *gossip.SnapshotStoreConfig
+	Tasks    *gossip.PriorityTasksManagerConfig
+	Sampling *gossip.SamplerConfig
 }
 
 func newAuditorConfig() *auditorConfig {
@@ -90,9 +122,10 @@ func newAuditorConfig() *auditorConfig {
 	conf.MaxRetries = 1
 	return &auditorConfig{
 		Qed:      conf,
-		Notifier: gossip.DefaultSimpleNotifierConfig(),
-		Store:    gossip.DefaultRestSnapshotStoreConfig(),
-		Tasks:    gossip.DefaultSimpleTasksManagerConfig(),
+		Notifier: gossip.DefaultNotifierConfig(),
+		Store:    gossip.DefaultSnapshotStoreConfig(),
+		Tasks:    gossip.DefaultPriorityTasksManagerConfig(),
+		Sampling: gossip.DefaultSamplerConfig(),
 	}
 }
 
@@ -114,23 +147,54 @@ func runAgentAuditor(cmd *cobra.Command, args []string) error {
 
 	log.SetLogger("auditor", agentConfig.Log)
 
-	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier)
+	notifier, err := gossip.NewNotifierFromConfig(conf.Notifier)
+	if err != nil {
+		return err
+	}
 	qed, err := client.NewHTTPClientFromConfig(conf.Qed)
 	if err != nil {
 		return err
 	}
-	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks)
-	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
+	tm, err := newTasksManager(agentConfig, conf.Tasks)
+	if err != nil {
+		return err
+	}
+	store, err := gossip.NewSnapshotStoreFromConfig(conf.Store, openLocalStore)
+	if err != nil {
+		return err
+	}
+	defer closeSnapshotStore(store)
+	sampler, err := gossip.NewSamplerFromConfig(conf.Sampling)
+	if err != nil {
+		return err
+	}
 
 	agent, err := gossip.NewDefaultAgent(agentConfig, qed, store, tm, notifier)
 	if err != nil {
 		return err
 	}
 
-	bp := gossip.NewBatchProcessor(agent, []gossip.TaskFactory{gossip.PrinterFactory{}, membershipFactory{}})
-	agent.In.Subscribe(gossip.BatchMessageType, bp, 255)
-	defer bp.Stop()
+	mf := newMembershipFactory(sampler)
+	mf.record = conf.Store.IsLocal()
+	tm.RegisterReplayer(auditJobKind, func(payload []byte) (*gossip.Job, error) {
+		var s protocol.SignedSnapshot
+		if err := s.Decode(payload); err != nil {
+			return nil, err
+		}
+		return mf.auditJob(agent, &s)
+	})
+	tf := []gossip.TaskFactory{gossip.PrinterFactory{}, mf}
+	agent.RegisterProcessorFactory("batch", func(a *gossip.Agent) gossip.Processor {
+		return gossip.NewBatchProcessor(a, tf)
+	})
+	if err := startProcessors(agent); err != nil {
+		return err
+	}
 
+	// a local store only has the snapshots the auditor already verified
+	if !conf.Store.IsLocal() {
+		backfill(agent)
+	}
 	agent.Start()
 
 	QedAuditorInstancesCount.Inc()
@@ -139,7 +203,23 @@ func runAgentAuditor(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-type membershipFactory struct{}
+// membershipFactory audits the membership of the events of the sampled
+// snapshots of each batch. Every snapshot is audited in its own task, so
+// the MaxTasks of the tasks manager limits the audits run at the same
+// time. If record is set, the verified snapshots are kept in the snapshot
+// store of the agent.
+type membershipFactory struct {
+	sampler  gossip.Sampler
+	coverage *gossip.AuditCoverage
+	record   bool
+}
+
+func newMembershipFactory(sampler gossip.Sampler) *membershipFactory {
+	return &membershipFactory{
+		sampler:  sampler,
+		coverage: gossip.NewAuditCoverage(),
+	}
+}
 
 func (m membershipFactory) Metrics() []prometheus.Collector {
 	return []prometheus.Collector{
@@ -147,22 +227,71 @@ func (m membershipFactory) Metrics() []prometheus.Collector {
 		QedAuditorBatchesProcessSeconds,
 		QedAuditorBatchesReceivedTotal,
 		QedAuditorGetMembershipProofErrTotal,
+		QedAuditorSnapshotsAuditedTotal,
+		QedAuditorSnapshotsSkippedTotal,
+		QedAuditorAuditedVersions,
+		QedAuditorCoverageRatio,
 	}
 }
 
-func (i membershipFactory) New(ctx context.Context) gossip.Task {
+func (m *membershipFactory) New(ctx context.Context) gossip.Task {
 	a := ctx.Value("agent").(*gossip.Agent)
 	b := ctx.Value("batch").(*protocol.BatchSnapshots)
 
-	s := b.Snapshots[0]
-
 	QedAuditorBatchesReceivedTotal.Inc()
 
+	for _, s := range b.Snapshots {
+		m.coverage.Seen(s.Snapshot)
+	}
+	sample := m.sampler.Sample(b.Snapshots)
+	strategy := m.sampler.Strategy()
+	if skipped := len(b.Snapshots) - len(sample); skipped > 0 {
+		QedAuditorSnapshotsSkippedTotal.WithLabelValues(strategy).Add(float64(skipped))
+	}
+
 	return func() error {
 		timer := prometheus.NewTimer(QedAuditorBatchesProcessSeconds)
 		defer timer.ObserveDuration()
 
-		proof, err := a.Qed.MembershipDigest(s.Snapshot.EventDigest, s.Snapshot.Version)
+		for _, s := range sample {
+			err := m.enqueue(a, s)
+			if err != nil {
+				log.Infof("Auditor is unable to enqueue the audit of snapshot %d: %v", s.Snapshot.Version, err)
+			}
+		}
+		return nil
+	}
+}
+
+// auditJobKind identifies the audits of a snapshot in the dead letter
+// queue of the tasks manager.
+const auditJobKind = "auditor/membership"
+
+// enqueue adds the audit of a snapshot to the tasks manager of the agent,
+// as a job which can be replayed if the manager supports it.
+func (m *membershipFactory) enqueue(a *gossip.Agent, s *protocol.SignedSnapshot) error {
+	jm, ok := a.Tasks.(gossip.JobsManager)
+	if !ok {
+		return a.Tasks.Add(m.audit(a, s))
+	}
+	job, err := m.auditJob(a, s)
+	if err != nil {
+		return err
+	}
+	return jm.AddJob(job)
+}
+
+func (m *membershipFactory) auditJob(a *gossip.Agent, s *protocol.SignedSnapshot) (*gossip.Job, error) {
+	payload, err := s.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return gossip.NewTaskJob(auditJobKind, payload, gossip.NormalPriority, m.audit(a, s)), nil
+}
+
+func (m *membershipFactory) audit(a *gossip.Agent, s *protocol.SignedSnapshot) gossip.Task {
+	return func() error {
+		proof, err := a.Qed.LogMembershipDigest(s.Snapshot.LogId, s.Snapshot.EventDigest, s.Snapshot.Version)
 		if err != nil {
 			log.Infof("Auditor is unable to get membership proof from QED server: %v", err)
 
@@ -176,25 +305,38 @@ func (i membershipFactory) New(ctx context.Context) gossip.Task {
 			return err
 		}
 
-		storedSnap, err := a.SnapshotStore.GetSnapshot(proof.CurrentVersion)
+		hasherF, err := a.Qed.HasherF()
 		if err != nil {
-			log.Infof("Unable to get snapshot from storage: %v", err)
+			log.Infof("Auditor is unable to get the hasher from QED server: %v", err)
 			return err
 		}
 
-		checkSnap := &protocol.Snapshot{
-			HistoryDigest: s.Snapshot.HistoryDigest,
-			HyperDigest:   storedSnap.Snapshot.HyperDigest,
-			Version:       s.Snapshot.Version,
-			EventDigest:   s.Snapshot.EventDigest,
-		}
-
-		ok := a.Qed.DigestVerify(proof, checkSnap, hashing.NewSha256Hasher)
-		if !ok {
+		// the proof is of the version of the snapshot, so the snapshot
+		// has both the history and the hyper digests to verify it
+		ok := a.Qed.DigestVerify(proof, s.Snapshot, hasherF)
+		if ok {
+			// the checkpoint does not move past the versions sampled out
+			// or still being audited
+			if err := a.Checkpoints.Advance(s.Snapshot.Version, s); err != nil {
+				log.Infof("Auditor is unable to save its checkpoint: %v", err)
+			}
+			if m.record {
+				recordSnapshots(a, s)
+			}
+		} else {
 			a.Notifier.Alert(fmt.Sprintf("Unable to verify snapshot %v", s.Snapshot))
 			log.Infof("Unable to verify snapshot %v", s.Snapshot)
+			if err := a.RaiseAlert(fmt.Sprintf("Auditor is unable to verify the membership of the event of snapshot %d of log %q", s.Snapshot.Version, s.Snapshot.LogId)); err != nil {
+				log.Infof("Auditor is unable to gossip the alert: %v", err)
+			}
 		}
 
+		strategy := m.sampler.Strategy()
+		QedAuditorSnapshotsAuditedTotal.WithLabelValues(strategy).Inc()
+		m.coverage.Audited(s.Snapshot)
+		QedAuditorAuditedVersions.WithLabelValues(strategy).Set(float64(m.coverage.Versions()))
+		QedAuditorCoverageRatio.WithLabelValues(strategy).Set(m.coverage.Ratio())
+
 		log.Infof("MembershipTask.Do(): Snapshot %v has been verified by QED", s.Snapshot)
 		return nil
 	}
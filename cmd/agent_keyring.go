@@ -0,0 +1,128 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bbva/qed/gossip"
+	"github.com/hashicorp/memberlist"
+	"github.com/spf13/cobra"
+)
+
+var agentKeyringCmd *cobra.Command = &cobra.Command{
+	Use:   "keyring",
+	Short: "Manage the keys to encrypt the gossip traffic",
+	Long: `Manage the keys to encrypt the gossip traffic, kept in the file given with
+--keyring-path. The first key of the keyring encrypts the messages, and all
+of them decrypt the messages received. To rotate the keys, run each step
+on every agent and server, restarting them, before the next one:
+	* install the new key
+	* use the new key as primary key
+	* remove the old key
+Running agents rotate their keys without restarting through the /keyring
+endpoint of their admin API.`,
+}
+
+var agentKeyringGenerateCmd *cobra.Command = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new key",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := gossip.GenerateGossipKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+var agentKeyringInstallCmd *cobra.Command = &cobra.Command{
+	Use:   "install <key>",
+	Short: "Add a key to the keyring, creating it if it does not exist",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateKeyring(args[0], true, (*memberlist.Keyring).AddKey)
+	},
+}
+
+var agentKeyringUseCmd *cobra.Command = &cobra.Command{
+	Use:   "use <key>",
+	Short: "Make an installed key the primary key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateKeyring(args[0], false, (*memberlist.Keyring).UseKey)
+	},
+}
+
+var agentKeyringRemoveCmd *cobra.Command = &cobra.Command{
+	Use:   "remove <key>",
+	Short: "Remove a key which is not the primary key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateKeyring(args[0], false, (*memberlist.Keyring).RemoveKey)
+	},
+}
+
+var agentKeyringListCmd *cobra.Command = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys, the primary key first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyring, err := gossip.LoadKeyring(keyringPath())
+		if err != nil {
+			return err
+		}
+		for _, key := range gossip.EncodeKeys(keyring) {
+			fmt.Println(key)
+		}
+		return nil
+	},
+}
+
+func init() {
+	agentKeyringCmd.AddCommand(agentKeyringGenerateCmd, agentKeyringInstallCmd, agentKeyringUseCmd, agentKeyringRemoveCmd, agentKeyringListCmd)
+	agentCmd.AddCommand(agentKeyringCmd)
+}
+
+func keyringPath() string {
+	return agentCtx.Value(k("agent.config")).(*gossip.Config).KeyringPath
+}
+
+func updateKeyring(encoded string, create bool, update func(*memberlist.Keyring, []byte) error) error {
+	path := keyringPath()
+	if path == "" {
+		return fmt.Errorf("The keyring path must not be empty!")
+	}
+	key, err := gossip.DecodeGossipKey(encoded)
+	if err != nil {
+		return err
+	}
+	keyring, err := gossip.LoadKeyring(path)
+	if os.IsNotExist(err) && create {
+		keyring, err = memberlist.NewKeyring(nil, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := update(keyring, key); err != nil {
+		return err
+	}
+	return gossip.SaveKeyring(path, keyring)
+}
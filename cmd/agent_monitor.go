@@ -23,7 +23,6 @@ import (
 
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/gossip"
-	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/util"
@@ -60,8 +59,19 @@ var (
 			Help: "Number of errors trying to get incremental proofs by monitors.",
 		},
 	)
+
+	QedMonitorEquivocationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "qed_monitor_equivocations_total",
+			Help: "Number of versions with two different signed snapshots found by monitors.",
+		},
+	)
 )
 
+// equivocationIndexSize is the number of signed snapshots a monitor
+// remembers to detect equivocations.
+const equivocationIndexSize = 1 << 16
+
 var agentMonitorCmd *cobra.Command = &cobra.Command{
 	Use:   "monitor",
 	Short: "Provides access to the QED gossip monitor agent",
@@ -82,9 +92,9 @@ func init() {
 
 type monitorConfig struct {
 	Qed      *client.Config
-	Notifier *gossip.SimpleNotifierConfig
-	Store    *gossip.RestSnapshotStoreConfig
-	Tasks    *gossip.SimpleTasksManagerConfig
+	Notifier *gossip.NotifierConfig
+	Store    *gossip.SnapshotStoreConfig
+	Tasks    *gossip.PriorityTasksManagerConfig
 }
 
 func newMonitorConfig() *monitorConfig {
@@ -94,9 +104,9 @@ func newMonitorConfig() *monitorConfig {
 	conf.MaxRetries = 1
 	return &monitorConfig{
 		Qed:      conf,
-		Notifier: gossip.DefaultSimpleNotifierConfig(),
-		Store:    gossip.DefaultRestSnapshotStoreConfig(),
-		Tasks:    gossip.DefaultSimpleTasksManagerConfig(),
+		Notifier: gossip.DefaultNotifierConfig(),
+		Store:    gossip.DefaultSnapshotStoreConfig(),
+		Tasks:    gossip.DefaultPriorityTasksManagerConfig(),
 	}
 }
 
@@ -118,13 +128,23 @@ func runAgentMonitor(cmd *cobra.Command, args []string) error {
 
 	log.SetLogger("monitor", agentConfig.Log)
 
-	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier)
+	notifier, err := gossip.NewNotifierFromConfig(conf.Notifier)
+	if err != nil {
+		return err
+	}
 	qed, err := client.NewHTTPClientFromConfig(conf.Qed)
 	if err != nil {
 		return err
 	}
-	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks)
-	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
+	tm, err := newTasksManager(agentConfig, conf.Tasks)
+	if err != nil {
+		return err
+	}
+	store, err := gossip.NewSnapshotStoreFromConfig(conf.Store, openLocalStore)
+	if err != nil {
+		return err
+	}
+	defer closeSnapshotStore(store)
 
 	agent, err := gossip.NewDefaultAgent(agentConfig, qed, store, tm, notifier)
 	if err != nil {
@@ -132,12 +152,26 @@ func runAgentMonitor(cmd *cobra.Command, args []string) error {
 	}
 
 	lagf := newLagFactory(1 * time.Second)
+	if checkpoint := agent.Checkpoints.Get(""); checkpoint != nil {
+		lagf.lastVersion = checkpoint.Version
+	}
 	lagf.start()
 	defer lagf.stop()
-	bp := gossip.NewBatchProcessor(agent, []gossip.TaskFactory{gossip.PrinterFactory{}, incrementalFactory{}, lagf})
-	agent.In.Subscribe(gossip.BatchMessageType, bp, 255)
-	defer bp.Stop()
+	equivocationf := &equivocationFactory{
+		index: gossip.NewSignedRootIndex(equivocationIndexSize),
+	}
+	tf := []gossip.TaskFactory{gossip.PrinterFactory{}, incrementalFactory{record: conf.Store.IsLocal()}, lagf, equivocationf}
+	agent.RegisterProcessorFactory("batch", func(a *gossip.Agent) gossip.Processor {
+		return gossip.NewBatchProcessor(a, tf)
+	})
+	if err := startProcessors(agent); err != nil {
+		return err
+	}
 
+	// a local store only has the snapshots the monitor already verified
+	if !conf.Store.IsLocal() {
+		backfill(agent)
+	}
 	agent.Start()
 
 	QedMonitorInstancesCount.Inc()
@@ -146,7 +180,12 @@ func runAgentMonitor(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-type incrementalFactory struct{}
+// incrementalFactory verifies the consistency between the first and the
+// last snapshot of each log in a batch. If record is set, the verified
+// snapshots are kept in the snapshot store of the agent.
+type incrementalFactory struct {
+	record bool
+}
 
 func (i incrementalFactory) Metrics() []prometheus.Collector {
 	return []prometheus.Collector{
@@ -165,26 +204,147 @@ func (i incrementalFactory) New(ctx context.Context) gossip.Task {
 		timer := prometheus.NewTimer(QedMonitorBatchesProcessSeconds)
 		defer timer.ObserveDuration()
 
-		first := b.Snapshots[0].Snapshot
-		last := b.Snapshots[len(b.Snapshots)-1].Snapshot
-
-		resp, err := a.Qed.Incremental(first.Version, last.Version)
+		hasherF, err := a.Qed.HasherF()
 		if err != nil {
-			QedMonitorGetIncrementalProofErrTotal.Inc()
-			a.Notifier.Alert(fmt.Sprintf("Monitor is unable to get incremental proof from QED server: %s", err.Error()))
-			log.Infof("Monitor is unable to get incremental proof from QED server: %s", err.Error())
+			log.Infof("Monitor is unable to get the hasher from QED server: %s", err.Error())
 			return err
 		}
-		ok := a.Qed.VerifyIncremental(resp, first, last, hashing.NewSha256Hasher())
+
+		// a batch may carry snapshots of several logs, whose versions
+		// are independent
+		for _, snaps := range groupByLog(b.Snapshots) {
+			first := snaps[0].Snapshot
+			last := snaps[len(snaps)-1].Snapshot
+
+			resp, err := a.Qed.LogIncremental(first.LogId, first.Version, last.Version)
+			if err != nil {
+				QedMonitorGetIncrementalProofErrTotal.Inc()
+				a.Notifier.Alert(fmt.Sprintf("Monitor is unable to get incremental proof from QED server: %s", err.Error()))
+				log.Infof("Monitor is unable to get incremental proof from QED server: %s", err.Error())
+				return err
+			}
+			ok := a.Qed.VerifyIncremental(resp, first, last, hasherF())
+			if ok {
+				// batches verified concurrently may end out of order
+				if err := a.Checkpoints.Advance(first.Version, snaps[len(snaps)-1]); err != nil {
+					log.Infof("Monitor is unable to save its checkpoint: %v", err)
+				}
+				if i.record {
+					recordSnapshots(a, snaps...)
+				}
+			} else {
+				msg := fmt.Sprintf("Monitor is unable to verify incremental proof from %d to %d of log %q", first.Version, last.Version, first.LogId)
+				a.Notifier.Alert(msg)
+				log.Info(msg)
+				if err := a.RaiseAlert(msg); err != nil {
+					log.Infof("Monitor is unable to gossip the alert: %v", err)
+				}
+			}
+			log.Debugf("Monitor verified a consistency proof between versions %d and %d of log %q: %v\n", first.Version, last.Version, first.LogId, ok)
+		}
+		return nil
+	}
+}
+
+// groupByLog splits the snapshots of a batch by log, keeping their order.
+func groupByLog(snapshots []*protocol.SignedSnapshot) [][]*protocol.SignedSnapshot {
+	var groups [][]*protocol.SignedSnapshot
+	index := make(map[string]int)
+	for _, s := range snapshots {
+		i, ok := index[s.Snapshot.LogId]
 		if !ok {
-			a.Notifier.Alert(fmt.Sprintf("Monitor is unable to verify incremental proof from %d to %d", first.Version, last.Version))
-			log.Infof("Monitor is unable to verify incremental proof from %d to %d", first.Version, last.Version)
+			i = len(groups)
+			index[s.Snapshot.LogId] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], s)
+	}
+	return groups
+}
+
+// equivocationFactory indexes the signed snapshots received by the
+// monitor and compares them with the snapshot store to find servers
+// signing two different snapshots for the same version.
+type equivocationFactory struct {
+	index *gossip.SignedRootIndex
+}
+
+func (e equivocationFactory) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		QedMonitorEquivocationsTotal,
+	}
+}
+
+func (e *equivocationFactory) New(ctx context.Context) gossip.Task {
+	a := ctx.Value("agent").(*gossip.Agent)
+	b := ctx.Value("batch").(*protocol.BatchSnapshots)
+
+	return func() error {
+		// only validly signed snapshots are evidence of an equivocation
+		keys, err := a.ServerKeys()
+		if err != nil {
+			log.Infof("Monitor is unable to get the keys from QED server: %s", err.Error())
+			return err
+		}
+
+		for _, s := range b.Snapshots {
+			if err := s.VerifyKeySet(keys); err != nil {
+				log.Infof("Monitor ignores snapshot with an invalid signature: %v", err)
+				continue
+			}
+			if found := e.index.Add(s); found != nil {
+				e.report(a, found)
+			}
+		}
+
+		// the snapshot store holds the snapshots gossiped to other agents,
+		// but only of the default log
+		for _, snaps := range groupByLog(b.Snapshots) {
+			last := snaps[len(snaps)-1]
+			if last.Snapshot.LogId != "" {
+				continue
+			}
+			indexed, ok := e.index.Get(last.Snapshot.LogId, last.Snapshot.Version)
+			if !ok {
+				continue
+			}
+			stored, err := a.SnapshotStore.GetSnapshot(last.Snapshot.Version)
+			if err != nil {
+				log.Debugf("Monitor is unable to get snapshot %d from the snapshot store: %v", last.Snapshot.Version, err)
+				continue
+			}
+			if err := stored.VerifyKeySet(keys); err != nil {
+				log.Infof("Monitor found a snapshot with an invalid signature in the snapshot store: %v", err)
+				continue
+			}
+			if found := protocol.NewEquivocation(indexed, stored); found != nil {
+				e.report(a, found)
+			}
 		}
-		log.Debugf("Monitor verified a consistency proof between versions %d and %d: %v\n", first.Version, last.Version, ok)
 		return nil
 	}
 }
 
+func (e *equivocationFactory) report(a *gossip.Agent, found *protocol.Equivocation) {
+	QedMonitorEquivocationsTotal.Inc()
+	msg := fmt.Sprintf("CRITICAL: equivocation detected, two snapshots with different history digests signed for version %d of log %q.", found.Version, found.LogId)
+	path, err := a.StoreEvidence(found)
+	if err != nil {
+		log.Infof("Monitor is unable to write the evidence of an equivocation: %v", err)
+		evidence, _ := found.Encode()
+		msg = fmt.Sprintf("%s Evidence: %s", msg, evidence)
+	} else {
+		msg = fmt.Sprintf("%s Evidence in %s", msg, path)
+	}
+	log.Info(msg)
+	if err := a.Notifier.Alert(msg); err != nil {
+		log.Infof("Monitor had an error sending a notification: %v", err)
+	}
+	if err := a.ShareEvidence(found); err != nil {
+		log.Infof("Monitor is unable to gossip the evidence: %v", err)
+	}
+}
+
 type lagFactory struct {
 	lastVersion uint64
 	rate        uint64
@@ -69,16 +69,16 @@ func init() {
 }
 
 type publisherConfig struct {
-	Notifier *gossip.SimpleNotifierConfig
-	Store    *gossip.RestSnapshotStoreConfig
-	Tasks    *gossip.SimpleTasksManagerConfig
+	Notifier *gossip.NotifierConfig
+	Store    *gossip.SnapshotStoreConfig
+	Tasks    *gossip.PriorityTasksManagerConfig
 }
 
 func newPublisherConfig() *publisherConfig {
 	return &publisherConfig{
-		Notifier: gossip.DefaultSimpleNotifierConfig(),
-		Store:    gossip.DefaultRestSnapshotStoreConfig(),
-		Tasks:    gossip.DefaultSimpleTasksManagerConfig(),
+		Notifier: gossip.DefaultNotifierConfig(),
+		Store:    gossip.DefaultSnapshotStoreConfig(),
+		Tasks:    gossip.DefaultPriorityTasksManagerConfig(),
 	}
 }
 
@@ -100,18 +100,32 @@ func runAgentPublisher(cmd *cobra.Command, args []string) error {
 
 	log.SetLogger("publisher", agentConfig.Log)
 
-	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier)
-	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks)
-	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
+	notifier, err := gossip.NewNotifierFromConfig(conf.Notifier)
+	if err != nil {
+		return err
+	}
+	tm, err := newTasksManager(agentConfig, conf.Tasks)
+	if err != nil {
+		return err
+	}
+	store, err := gossip.NewSnapshotStoreFromConfig(conf.Store, openLocalStore)
+	if err != nil {
+		return err
+	}
+	defer closeSnapshotStore(store)
 
 	agent, err := gossip.NewDefaultAgent(agentConfig, nil, store, tm, notifier)
 	if err != nil {
 		return err
 	}
 
-	bp := gossip.NewBatchProcessor(agent, []gossip.TaskFactory{gossip.PrinterFactory{}, publisherFactory{}})
-	agent.In.Subscribe(gossip.BatchMessageType, bp, 255)
-	defer bp.Stop()
+	tf := []gossip.TaskFactory{gossip.PrinterFactory{}, publisherFactory{}}
+	agent.RegisterProcessorFactory("batch", func(a *gossip.Agent) gossip.Processor {
+		return gossip.NewBatchProcessor(a, tf)
+	})
+	if err := startProcessors(agent); err != nil {
+		return err
+	}
 
 	agent.Start()
 	util.AwaitTermSignal(agent.Shutdown)
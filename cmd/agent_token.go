@@ -0,0 +1,78 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/sign"
+	"github.com/spf13/cobra"
+)
+
+var agentTokenCmd *cobra.Command = &cobra.Command{
+	Use:   "token",
+	Short: "Issue a join token for a gossip node",
+	Long: `Issue a token which admits the node given with --node-name in the gossip
+network with the role given with --role. The token is signed with the
+admission private key, whose public key the peers are configured with
+in --admission-keys, and it is bound to the public key given with
+--node-key, whose private key the node signs its messages with.`,
+	Args: cobra.NoArgs,
+	RunE: runAgentToken,
+}
+
+var agentTokenKey string
+var agentTokenNodeKey string
+var agentTokenExpires time.Duration
+
+func init() {
+	agentTokenCmd.Flags().StringVar(&agentTokenKey, "admission-key", "", "Path to the private key to sign the token")
+	agentTokenCmd.Flags().StringVar(&agentTokenNodeKey, "node-key", "", "Path to the public key of the node")
+	agentTokenCmd.Flags().DurationVar(&agentTokenExpires, "expires", 30*24*time.Hour, "Validity of the token")
+	agentCmd.AddCommand(agentTokenCmd)
+}
+
+func runAgentToken(cmd *cobra.Command, args []string) error {
+
+	conf := agentCtx.Value(k("agent.config")).(*gossip.Config)
+	if conf.NodeName == "" || conf.Role == "" {
+		return fmt.Errorf("Node name and role must not be empty!")
+	}
+
+	if agentTokenExpires <= 0 {
+		return fmt.Errorf("The validity of the token must be positive!")
+	}
+
+	signer, err := sign.NewSignerFromFile(agentTokenKey)
+	if err != nil {
+		return err
+	}
+	key, err := sign.NewVerifierFromFile(agentTokenNodeKey)
+	if err != nil {
+		return err
+	}
+
+	token, err := gossip.IssueJoinToken(signer, conf.NodeName, conf.Role, key, time.Now().Add(agentTokenExpires))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/util"
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	QedWitnessInstancesCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "qed_witness_instances_count",
+			Help: "Number of witness agents running.",
+		},
+	)
+
+	QedWitnessCosignaturesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "qed_witness_cosignatures_total",
+			Help: "Number of snapshots cosigned by witnesses.",
+		},
+	)
+
+	QedWitnessInconsistenciesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "qed_witness_inconsistencies_total",
+			Help: "Number of snapshots not cosigned because they were not consistent with the last one cosigned.",
+		},
+	)
+
+	QedWitnessEquivocationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "qed_witness_equivocations_total",
+			Help: "Number of versions with two different signed snapshots found by witnesses.",
+		},
+	)
+)
+
+var agentWitnessCmd *cobra.Command = &cobra.Command{
+	Use:   "witness",
+	Short: "Provides access to the QED gossip witness agent",
+	Long: `Starts a QED witness which cosigns the snapshots received through
+the gossip network. A snapshot is only cosigned if the QED server proves
+it is consistent with the last snapshot the witness cosigned. The
+cosignatures are published to the snapshot store and gossiped to the
+other agents, so clients can require the snapshots they trust to be
+cosigned by several witnesses.`,
+	TraverseChildren: true,
+	RunE:             runAgentWitness,
+}
+
+var agentWitnessCtx context.Context
+
+func init() {
+	agentWitnessCtx = configWitness()
+	agentCmd.AddCommand(agentWitnessCmd)
+}
+
+type witnessConfig struct {
+	Qed      *client.Config
+	Notifier *gossip.NotifierConfig
+	Store    *gossip.SnapshotStoreConfig
+	Tasks    *gossip.PriorityTasksManagerConfig
+}
+
+func newWitnessConfig() *witnessConfig {
+	conf := client.DefaultConfig()
+	conf.AttemptToReviveEndpoints = true
+	conf.ReadPreference = client.Any
+	conf.MaxRetries = 1
+	return &witnessConfig{
+		Qed:      conf,
+		Notifier: gossip.DefaultNotifierConfig(),
+		Store:    gossip.DefaultSnapshotStoreConfig(),
+		Tasks:    gossip.DefaultPriorityTasksManagerConfig(),
+	}
+}
+
+func configWitness() context.Context {
+	conf := newWitnessConfig()
+	err := gpflag.ParseTo(conf, agentWitnessCmd.PersistentFlags())
+	if err != nil {
+		log.Fatalf("err: %v", err)
+	}
+
+	ctx := context.WithValue(agentCtx, k("witness.config"), conf)
+
+	return ctx
+}
+
+func runAgentWitness(cmd *cobra.Command, args []string) error {
+	agentConfig := agentWitnessCtx.Value(k("agent.config")).(*gossip.Config)
+	conf := agentWitnessCtx.Value(k("witness.config")).(*witnessConfig)
+
+	log.SetLogger("witness", agentConfig.Log)
+
+	notifier, err := gossip.NewNotifierFromConfig(conf.Notifier)
+	if err != nil {
+		return err
+	}
+	qed, err := client.NewHTTPClientFromConfig(conf.Qed)
+	if err != nil {
+		return err
+	}
+	tm, err := newTasksManager(agentConfig, conf.Tasks)
+	if err != nil {
+		return err
+	}
+	store, err := gossip.NewSnapshotStoreFromConfig(conf.Store, openLocalStore)
+	if err != nil {
+		return err
+	}
+	defer closeSnapshotStore(store)
+
+	agent, err := gossip.NewDefaultAgent(agentConfig, qed, store, tm, notifier)
+	if err != nil {
+		return err
+	}
+
+	tf := []gossip.TaskFactory{gossip.PrinterFactory{}, &cosignFactory{}}
+	agent.RegisterProcessorFactory("batch", func(a *gossip.Agent) gossip.Processor {
+		return gossip.NewBatchProcessor(a, tf)
+	})
+	if err := startProcessors(agent); err != nil {
+		return err
+	}
+	agent.Start()
+
+	QedWitnessInstancesCount.Inc()
+
+	util.AwaitTermSignal(agent.Shutdown)
+	return nil
+}
+
+// cosignFactory cosigns the last snapshot of each log in a batch. The
+// checkpoint of a log is the last snapshot the witness cosigned, and a
+// newer snapshot is only cosigned if it is consistent with it. The first
+// snapshot of a log is trusted on first use.
+type cosignFactory struct {
+	// the batches are cosigned one at a time, so every cosigned
+	// snapshot is checked against the one cosigned before
+	lock sync.Mutex
+}
+
+func (c *cosignFactory) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		QedWitnessInstancesCount,
+		QedWitnessCosignaturesTotal,
+		QedWitnessInconsistenciesTotal,
+		QedWitnessEquivocationsTotal,
+	}
+}
+
+func (c *cosignFactory) New(ctx context.Context) gossip.Task {
+	a := ctx.Value("agent").(*gossip.Agent)
+	b := ctx.Value("batch").(*protocol.BatchSnapshots)
+
+	return func() error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		keys, err := a.ServerKeys()
+		if err != nil {
+			log.Infof("Witness is unable to get the keys from QED server: %s", err.Error())
+			return err
+		}
+
+		for _, snaps := range groupByLog(b.Snapshots) {
+			last := snaps[len(snaps)-1]
+			if err := last.VerifyKeySet(keys); err != nil {
+				log.Infof("Witness does not cosign snapshot %d with an invalid signature: %v", last.Snapshot.Version, err)
+				continue
+			}
+			if err := c.check(a, last); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// check verifies a snapshot is consistent with the last one cosigned for
+// its log and, if so, cosigns it.
+func (c *cosignFactory) check(a *gossip.Agent, s *protocol.SignedSnapshot) error {
+	checkpoint := a.Checkpoints.Get(s.Snapshot.LogId)
+	if checkpoint != nil {
+		if found := protocol.NewEquivocation(checkpoint.Snapshot, s); found != nil {
+			c.report(a, found)
+			return nil
+		}
+		if s.Snapshot.Version <= checkpoint.Version {
+			return nil
+		}
+
+		hasherF, err := a.Qed.HasherF()
+		if err != nil {
+			log.Infof("Witness is unable to get the hasher from QED server: %s", err.Error())
+			return err
+		}
+		first, last := checkpoint.Snapshot.Snapshot, s.Snapshot
+		resp, err := a.Qed.LogIncremental(first.LogId, first.Version, last.Version)
+		if err != nil {
+			log.Infof("Witness is unable to get incremental proof from QED server: %s", err.Error())
+			return err
+		}
+		if !a.Qed.VerifyIncremental(resp, first, last, hasherF()) {
+			QedWitnessInconsistenciesTotal.Inc()
+			msg := fmt.Sprintf("Witness is unable to verify incremental proof from its last cosigned version %d to %d of log %q", first.Version, last.Version, first.LogId)
+			a.Notifier.Alert(msg)
+			log.Info(msg)
+			if err := a.RaiseAlert(msg); err != nil {
+				log.Infof("Witness is unable to gossip the alert: %v", err)
+			}
+			return nil
+		}
+	}
+
+	cosignature, err := protocol.Cosign(a.Signer, a.Self.Name, s, time.Now())
+	if err != nil {
+		log.Infof("Witness is unable to cosign snapshot %d: %v", s.Snapshot.Version, err)
+		return nil
+	}
+	if err := a.Checkpoints.Save(s); err != nil {
+		log.Infof("Witness is unable to save its checkpoint: %v", err)
+	}
+	QedWitnessCosignaturesTotal.Inc()
+	log.Debugf("Witness cosigned version %d of log %q", s.Snapshot.Version, s.Snapshot.LogId)
+
+	cosigned := &protocol.CosignedSnapshot{Snapshot: s, Cosignatures: []*protocol.Cosignature{cosignature}}
+	// the snapshot store only keeps the snapshots of the default log
+	if store, ok := a.SnapshotStore.(gossip.CosignatureStore); ok && s.Snapshot.LogId == "" {
+		if err := store.PutCosignatures(cosigned); err != nil {
+			log.Infof("Witness is unable to publish its cosignature of version %d: %v", s.Snapshot.Version, err)
+		}
+	}
+	if err := a.PublishCosignature(cosigned); err != nil {
+		log.Infof("Witness is unable to gossip its cosignature of version %d: %v", s.Snapshot.Version, err)
+	}
+	return nil
+}
+
+func (c *cosignFactory) report(a *gossip.Agent, found *protocol.Equivocation) {
+	QedWitnessEquivocationsTotal.Inc()
+	msg := fmt.Sprintf("CRITICAL: equivocation detected, the snapshot cosigned for version %d of log %q has a different history digest.", found.Version, found.LogId)
+	if path, err := a.StoreEvidence(found); err != nil {
+		log.Infof("Witness is unable to write the evidence of an equivocation: %v", err)
+	} else {
+		msg = fmt.Sprintf("%s Evidence in %s", msg, path)
+	}
+	log.Info(msg)
+	if err := a.Notifier.Alert(msg); err != nil {
+		log.Infof("Witness had an error sending a notification: %v", err)
+	}
+	if err := a.ShareEvidence(found); err != nil {
+		log.Infof("Witness is unable to gossip the evidence: %v", err)
+	}
+}
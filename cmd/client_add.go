@@ -17,10 +17,13 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
 	"github.com/spf13/cobra"
 )
 
@@ -31,20 +34,24 @@ var clientAddCmd *cobra.Command = &cobra.Command{
 }
 
 var clientAddEvent string
+var clientAddBulkFile string
 
 func init() {
 
 	clientAddCmd.Flags().StringVar(&clientAddEvent, "event", "", "Event to append to QED")
-	clientAddCmd.MarkFlagRequired("event")
+	clientAddCmd.Flags().StringVar(&clientAddBulkFile, "bulk-file", "", "File with one event per line to append to QED in a single bulk")
 
 	clientCmd.AddCommand(clientAddCmd)
 }
 
 func runClientAdd(cmd *cobra.Command, args []string) error {
 
-	if clientAddEvent == "" {
+	if clientAddEvent == "" && clientAddBulkFile == "" {
 		return fmt.Errorf("Event must not be empty!")
 	}
+	if clientAddEvent != "" && clientAddBulkFile != "" {
+		return fmt.Errorf("Event and bulk file are mutually exclusive!")
+	}
 
 	config := clientCtx.Value(k("client.config")).(*client.Config)
 	log.SetLogger("client", config.Log)
@@ -54,16 +61,65 @@ func runClientAdd(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if clientAddBulkFile != "" {
+		return runClientAddBulk(client)
+	}
+
 	snapshot, err := client.Add(clientAddEvent)
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("\nReceived snapshot with values:\n\n")
+	printSnapshot(snapshot)
+
+	return nil
+}
+
+func runClientAddBulk(c *client.HTTPClient) error {
+
+	events, err := readBulkFile(clientAddBulkFile)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("Bulk file must contain at least one event!")
+	}
+
+	snapshots, err := c.AddBulk(events)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nReceived %d snapshots with values:\n\n", len(snapshots))
+	for _, snapshot := range snapshots {
+		printSnapshot(snapshot)
+	}
+
+	return nil
+}
+
+func printSnapshot(snapshot *protocol.Snapshot) {
 	fmt.Printf(" EventDigest: %x\n", snapshot.EventDigest)
 	fmt.Printf(" HyperDigest: %x\n", snapshot.HyperDigest)
 	fmt.Printf(" HistoryDigest: %x\n", snapshot.HistoryDigest)
 	fmt.Printf(" Version: %d\n\n", snapshot.Version)
+}
 
-	return nil
+// readBulkFile returns the non-empty lines of the given file as events.
+func readBulkFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			events = append(events, line)
+		}
+	}
+	return events, scanner.Err()
 }
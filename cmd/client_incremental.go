@@ -46,14 +46,15 @@ func init() {
 }
 
 type incrementalParams struct {
-	Start  uint64 `desc:"Starting version for the incremental proof"`
-	End    uint64 `desc:"Endind version for the incremental proof"`
-	Verify bool   `desc:"Set to enable proof verification process"`
+	Start      uint64 `desc:"Starting version for the incremental proof"`
+	End        uint64 `desc:"Endind version for the incremental proof"`
+	Verify     bool   `desc:"Set to enable proof verification process"`
+	TreeFormat int    `desc:"Format of the trees of the log, as stated by its signed snapshots"`
 }
 
 func configClientIncremental() context.Context {
 
-	conf := &incrementalParams{}
+	conf := &incrementalParams{TreeFormat: hashing.CurrentTreeFormat}
 
 	err := gpflag.ParseTo(conf, clientIncrementalCmd.PersistentFlags())
 	if err != nil {
@@ -104,14 +105,19 @@ func runClientIncremental(cmd *cobra.Command, args []string) error {
 
 		sdBytes, _ := hex.DecodeString(startDigest)
 		edBytes, _ := hex.DecodeString(endDigest)
-		startSnapshot := &protocol.Snapshot{sdBytes, nil, params.Start, nil}
-		endSnapshot := &protocol.Snapshot{edBytes, nil, params.End, nil}
+		startSnapshot := &protocol.Snapshot{HistoryDigest: sdBytes, Version: params.Start, TreeFormat: params.TreeFormat}
+		endSnapshot := &protocol.Snapshot{HistoryDigest: edBytes, Version: params.End, TreeFormat: params.TreeFormat}
 
 		fmt.Printf("\nVerifying with snapshots: \n")
 		fmt.Printf(" HistoryDigest for start version [ %d ]: %s\n", params.Start, startDigest)
 		fmt.Printf(" HistoryDigest for end version [ %d ]: %s\n", params.End, endDigest)
 
-		if client.VerifyIncremental(proof, startSnapshot, endSnapshot, hashing.NewSha256Hasher()) {
+		hasherF, err := client.HasherF()
+		if err != nil {
+			return err
+		}
+
+		if client.VerifyIncremental(proof, startSnapshot, endSnapshot, hasherF()) {
 			fmt.Printf("\nVerify: OK\n\n")
 		} else {
 			fmt.Printf("\nVerify: KO\n\n")
@@ -18,9 +18,11 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -28,9 +30,11 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/gossip"
 	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
 )
 
 var clientMembershipCmd *cobra.Command = &cobra.Command{
@@ -49,15 +53,20 @@ func init() {
 }
 
 type membershipParams struct {
-	Version     uint64 `desc:"Version for the membership proof"`
-	Verify      bool   `desc:"Set to enable proof verification process"`
-	Event       string `desc:"QED event to build the proof"`
-	EventDigest string `desc:"QED event digest to build the proof"`
+	Version               uint64 `desc:"Version for the membership proof"`
+	Verify                bool   `desc:"Set to enable proof verification process"`
+	Event                 string `desc:"QED event to build the proof"`
+	EventDigest           string `desc:"QED event digest to build the proof"`
+	Value                 string `desc:"Expected value of the event when it is a key stored with put"`
+	Export                string `desc:"File to export a self-contained proof bundle to, verifiable offline with qed verify"`
+	SnapshotStoreEndpoint string `desc:"Snapshot store endpoint to get the signed snapshot of the exported bundle from"`
+	PublicKeyPath         string `desc:"Path to the public key of the server, in PEM or OpenSSH format, for the exported bundle"`
+	TreeFormat            int    `desc:"Format of the trees of the log, as stated by its signed snapshots"`
 }
 
 func configClientMembership() context.Context {
 
-	conf := &membershipParams{}
+	conf := &membershipParams{TreeFormat: hashing.CurrentTreeFormat}
 
 	err := gpflag.ParseTo(conf, clientMembershipCmd.PersistentFlags())
 	if err != nil {
@@ -68,8 +77,6 @@ func configClientMembership() context.Context {
 
 func runClientMembership(cmd *cobra.Command, args []string) error {
 
-	hasherF := hashing.NewSha256Hasher
-
 	var membershipResult *protocol.MembershipResult
 	var digest hashing.Digest
 	var err error
@@ -79,6 +86,18 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 	// SilenceUsage is set to true -> https://github.com/spf13/cobra/issues/340
 	cmd.SilenceUsage = true
 
+	config := clientCtx.Value(k("client.config")).(*client.Config)
+
+	client, err := client.NewHTTPClientFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	hasherF, err := client.HasherF()
+	if err != nil {
+		return err
+	}
+
 	if params.EventDigest == "" {
 		fmt.Printf("\nQuerying key [ %s ] with version [ %d ]\n", params.Event, params.Version)
 		digest = hasherF().Do([]byte(params.Event))
@@ -87,13 +106,6 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 		digest, _ = hex.DecodeString(params.EventDigest)
 	}
 
-	config := clientCtx.Value(k("client.config")).(*client.Config)
-
-	client, err := client.NewHTTPClientFromConfig(config)
-	if err != nil {
-		return err
-	}
-
 	membershipResult, err = client.MembershipDigest(digest, params.Version)
 	if err != nil {
 		return err
@@ -105,7 +117,18 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 	fmt.Printf(" CurrentVersion: %d\n", membershipResult.CurrentVersion)
 	fmt.Printf(" QueryVersion: %d\n", membershipResult.QueryVersion)
 	fmt.Printf(" ActualVersion: %d\n", membershipResult.ActualVersion)
-	fmt.Printf(" KeyDigest: %x\n\n", membershipResult.KeyDigest)
+	fmt.Printf(" KeyDigest: %x\n", membershipResult.KeyDigest)
+	if membershipResult.ValueDigest != nil {
+		fmt.Printf(" ValueDigest: %x\n", membershipResult.ValueDigest)
+	}
+	fmt.Printf("\n")
+
+	if params.Export != "" {
+		if err := exportProofBundle(client, params, membershipResult); err != nil {
+			return err
+		}
+		fmt.Printf("Proof bundle exported to %s\n\n", params.Export)
+	}
 
 	if params.Verify {
 
@@ -131,12 +154,23 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 			HistoryDigest: htdBytes,
 			HyperDigest:   hdBytes,
 			Version:       params.Version,
-			EventDigest:   digest}
+			EventDigest:   digest,
+			TreeFormat:    params.TreeFormat}
 
 		fmt.Printf("\nVerifying with Snapshot: \n\n EventDigest:%x\n HyperDigest: %s\n HistoryDigest: %s\n Version: %d\n",
 			digest, hyperDigest, historyDigest, params.Version)
 
-		if client.DigestVerify(membershipResult, snapshot, hasherF) {
+		var ok bool
+		if params.Value != "" {
+			if params.Event == "" {
+				return fmt.Errorf("Event must not be empty to verify its value!")
+			}
+			ok = client.VerifyValue(membershipResult, snapshot, []byte(params.Event), []byte(params.Value), hasherF)
+		} else {
+			ok = client.DigestVerify(membershipResult, snapshot, hasherF)
+		}
+
+		if ok {
 			fmt.Printf("\nVerify: OK\n\n")
 		} else {
 			fmt.Printf("\nVerify: KO\n\n")
@@ -145,6 +179,75 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// exportProofBundle writes a bundle with the membership proof, the signed
+// snapshot it verifies against and the public key of the server to the
+// export file. The bundle is verified before writing it.
+func exportProofBundle(client *client.HTTPClient, params *membershipParams, result *protocol.MembershipResult) error {
+
+	if !result.Exists {
+		return fmt.Errorf("Unable to export a proof bundle for an event that does not exist")
+	}
+	if params.SnapshotStoreEndpoint == "" || params.PublicKeyPath == "" {
+		return fmt.Errorf("Snapshot store endpoint and public key path are required to export a proof bundle")
+	}
+
+	var err error
+	if result.QueryVersion > result.CurrentVersion {
+		// there is no snapshot of a future version, so the bundle
+		// proves the membership in the last one
+		result, err = client.MembershipDigest(result.KeyDigest, result.CurrentVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	hasher, err := client.HasherID()
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadKeys("server", []string{params.PublicKeyPath})
+	if err != nil {
+		return err
+	}
+	key := keys.Keys[0]
+
+	conf := gossip.DefaultRestSnapshotStoreConfig()
+	store := gossip.NewRestSnapshotStore([]string{params.SnapshotStoreEndpoint}, conf.DialTimeout, conf.ReadTimeout)
+	snapshot, err := store.GetSnapshot(result.QueryVersion)
+	if err != nil {
+		return err
+	}
+
+	bundle := &protocol.ProofBundle{
+		Version:   protocol.ProofBundleVersion,
+		Hasher:    hasher,
+		Proof:     result,
+		Snapshot:  snapshot,
+		PublicKey: key.PublicKey,
+	}
+	if key.Algorithm != sign.DefaultAlgorithm {
+		bundle.Algorithm = key.Algorithm
+	}
+	if params.EventDigest == "" {
+		bundle.Event = []byte(params.Event)
+	}
+	// the cosignatures of the witnesses are optional, the bundle is
+	// exported without them if the store has none
+	if cosigned, err := store.GetCosignatures(result.QueryVersion); err == nil && cosigned.Snapshot != nil && bytes.Equal(cosigned.Snapshot.Signature, snapshot.Signature) {
+		bundle.Cosignatures = cosigned.Cosignatures
+	}
+	if err := bundle.Verify(keys); err != nil {
+		return fmt.Errorf("Unable to export an invalid proof bundle: %v", err)
+	}
+
+	data, err := bundle.Encode()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(params.Export, data, 0644)
+}
+
 func readLine(query string) string {
 	fmt.Print(query)
 	reader := bufio.NewReader(os.Stdin)
@@ -0,0 +1,69 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/log"
+	"github.com/spf13/cobra"
+)
+
+var clientPutCmd *cobra.Command = &cobra.Command{
+	Use:   "put",
+	Short: "Put the value of a key into the QED log",
+	Long: `Put the value of a key into the QED log in authenticated key-value mode.
+Membership proofs of the key will prove its latest value.`,
+	RunE: runClientPut,
+}
+
+var clientPutKey string
+var clientPutValue string
+
+func init() {
+
+	clientPutCmd.Flags().StringVar(&clientPutKey, "key", "", "Key to put into QED")
+	clientPutCmd.Flags().StringVar(&clientPutValue, "value", "", "Value of the key")
+
+	clientCmd.AddCommand(clientPutCmd)
+}
+
+func runClientPut(cmd *cobra.Command, args []string) error {
+
+	if clientPutKey == "" {
+		return fmt.Errorf("Key must not be empty!")
+	}
+
+	config := clientCtx.Value(k("client.config")).(*client.Config)
+	log.SetLogger("client", config.Log)
+
+	client, err := client.NewHTTPClientFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := client.Put(clientPutKey, clientPutValue)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nReceived snapshot with values:\n\n")
+	printSnapshot(snapshot)
+
+	return nil
+}
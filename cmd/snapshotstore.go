@@ -0,0 +1,76 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/snapshotstore"
+	"github.com/bbva/qed/storage/rocks"
+	"github.com/bbva/qed/util"
+)
+
+var snapshotStoreCmd *cobra.Command = &cobra.Command{
+	Use:   "snapshotstore",
+	Short: "Starts the QED snapshot store service",
+	Long: `Start a snapshot store which keeps the snapshots sent by the publisher
+agents in a local database, and serves them to the auditors and monitors.
+Only the snapshots signed by the trusted keys of the servers are stored,
+and the agents need the API key of the store to write or delete them.`,
+	RunE: runSnapshotStore,
+}
+
+var snapshotStoreCtx context.Context
+
+func init() {
+	snapshotStoreCtx = configSnapshotStore()
+	Root.AddCommand(snapshotStoreCmd)
+}
+
+func configSnapshotStore() context.Context {
+	conf := snapshotstore.DefaultConfig()
+	err := gpflag.ParseTo(conf, snapshotStoreCmd.PersistentFlags())
+	if err != nil {
+		log.Fatalf("err: %v", err)
+	}
+	return context.WithValue(Ctx, k("snapshotstore.config"), conf)
+}
+
+func runSnapshotStore(cmd *cobra.Command, args []string) error {
+	conf := snapshotStoreCtx.Value(k("snapshotstore.config")).(*snapshotstore.Config)
+
+	log.SetLogger("snapshotstore", conf.Log)
+
+	db, err := rocks.NewRocksDBStore(conf.DBPath)
+	if err != nil {
+		return err
+	}
+	service, err := snapshotstore.NewService(conf, db)
+	if err != nil {
+		return err
+	}
+	service.Start()
+
+	util.AwaitTermSignal(service.Shutdown)
+
+	log.Debug("Stopping snapshot store, about to exit...")
+	return nil
+}
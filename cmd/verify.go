@@ -0,0 +1,134 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+)
+
+var verifyCmd *cobra.Command = &cobra.Command{
+	Use:   "verify <bundle>",
+	Short: "Verify a proof bundle offline",
+	Long: `Verify a proof bundle exported with qed client membership --export.
+It checks the signature of the snapshot of the bundle with the trusted
+keys of the server and the membership proof against it, without any
+access to the QED cluster. The public key the bundle carries is only
+checked to match the trusted key which signed the snapshot. With witness
+keys, it also requires the snapshot to be cosigned by a minimum number
+of witnesses.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVerify,
+}
+
+var verifyCtx context.Context
+
+func init() {
+	verifyCtx = configVerify()
+	Root.AddCommand(verifyCmd)
+}
+
+type verifyParams struct {
+	ServerKeys      []string `desc:"Public key file list key1.pub,key2.pem... of the servers whose signatures are trusted"`
+	WitnessKeys     []string `desc:"Public key file list key1.pub,key2.pem... of the witnesses whose cosignatures are accepted"`
+	MinCosignatures int      `desc:"Minimum number of witnesses which must have cosigned the snapshot of the bundle"`
+}
+
+func configVerify() context.Context {
+
+	conf := &verifyParams{}
+
+	err := gpflag.ParseTo(conf, verifyCmd.PersistentFlags())
+	if err != nil {
+		log.Fatalf("err: %v", err)
+	}
+	return context.WithValue(Ctx, k("verify.params"), conf)
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+
+	params := verifyCtx.Value(k("verify.params")).(*verifyParams)
+	if len(params.ServerKeys) == 0 {
+		return fmt.Errorf("Server keys are required to verify the signature of the bundle")
+	}
+	keys, err := loadKeys("server", params.ServerKeys)
+	if err != nil {
+		return err
+	}
+	if params.MinCosignatures > 0 && len(params.WitnessKeys) == 0 {
+		return fmt.Errorf("Witness keys are required to verify the cosignatures of the bundle")
+	}
+	witnesses, err := loadKeys("witness", params.WitnessKeys)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var bundle protocol.ProofBundle
+	if err := bundle.Decode(data); err != nil {
+		return fmt.Errorf("Unable to decode the proof bundle: %v", err)
+	}
+
+	fmt.Printf("\nVerifying proof bundle %s:\n\n", args[0])
+	if bundle.Event != nil {
+		fmt.Printf(" Event: %s\n", bundle.Event)
+	}
+	if bundle.Proof != nil {
+		fmt.Printf(" EventDigest: %x\n", bundle.Proof.KeyDigest)
+		fmt.Printf(" ActualVersion: %d\n", bundle.Proof.ActualVersion)
+		fmt.Printf(" QueryVersion: %d\n", bundle.Proof.QueryVersion)
+	}
+	fmt.Printf(" Hasher: %s\n", bundle.Hasher)
+	fmt.Printf(" PublicKey: %x\n", bundle.PublicKey)
+	fmt.Printf(" Cosignatures: %d\n", len(bundle.Cosignatures))
+
+	if err := bundle.Verify(keys); err != nil {
+		fmt.Printf("\nVerify: KO\n\n")
+		return err
+	}
+	if params.MinCosignatures > 0 {
+		if err := bundle.VerifyCosignatures(witnesses, params.MinCosignatures); err != nil {
+			fmt.Printf("\nVerify: KO\n\n")
+			return err
+		}
+	}
+
+	fmt.Printf("\nVerify: OK\n\n")
+	return nil
+}
+
+// loadKeys reads the public keys of the servers or the witnesses from
+// the given files.
+func loadKeys(kind string, paths []string) (*sign.KeySet, error) {
+	keys, err := sign.NewKeySetFromFiles(paths)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load %s key %v", kind, err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,395 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// adminHandler returns the admin API of the agent:
+//
+//	/status -> StatusHandler
+//	/processors -> ProcessorsHandler
+//	/alerts -> AlertsHandler
+//	/tasks/deadletters -> DeadLettersHandler
+//	/tasks/deadletters/replay -> ReplayDeadLetterHandler
+//	/keyring -> KeyringHandler
+func (a *Agent) adminHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", StatusHandler(a))
+	mux.HandleFunc("/processors", ProcessorsHandler(a))
+	mux.HandleFunc("/alerts", AlertsHandler(a))
+	mux.HandleFunc("/tasks/deadletters", DeadLettersHandler(a))
+	mux.HandleFunc("/tasks/deadletters/replay", ReplayDeadLetterHandler(a))
+	mux.HandleFunc("/keyring", KeyringHandler(a))
+	return mux
+}
+
+// AgentStatus is the state of an agent as served by its admin API.
+type AgentStatus struct {
+	Self     *Peer
+	Topology map[string][]*Peer // peers by role
+	Tasks    TasksStatus
+}
+
+// TasksStatus is the state of the tasks manager of an agent. The pending
+// tasks are only split by priority if the tasks manager has priorities.
+type TasksStatus struct {
+	Pending     int
+	ByPriority  map[string]int `json:",omitempty"`
+	DeadLetters int
+}
+
+// ProcessorStatus describes a processor of an agent. A processor may be
+// registered or only have a factory to be registered. Only batch
+// processors have task factories and the last version processed of
+// each log.
+type ProcessorStatus struct {
+	Name          string
+	Registered    bool
+	Kinds         []string          `json:",omitempty"`
+	TaskFactories []string          `json:",omitempty"`
+	LastVersions  map[string]uint64 `json:",omitempty"`
+}
+
+func (a *Agent) status() *AgentStatus {
+	status := &AgentStatus{
+		Self:     a.Self,
+		Topology: a.topology.Roles(),
+	}
+	if a.Tasks == nil {
+		return status
+	}
+	status.Tasks.Pending = a.Tasks.Len()
+	if t, ok := a.Tasks.(interface{ LenByPriority(Priority) int }); ok {
+		status.Tasks.ByPriority = make(map[string]int)
+		for _, p := range []Priority{LowPriority, NormalPriority, HighPriority} {
+			status.Tasks.ByPriority[p.String()] = t.LenByPriority(p)
+		}
+	}
+	if jm, ok := a.Tasks.(JobsManager); ok {
+		status.Tasks.DeadLetters = jm.DeadLetters().Len()
+	}
+	return status
+}
+
+func (a *Agent) processorsStatus() []*ProcessorStatus {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	byName := make(map[string]*ProcessorStatus)
+	for name := range a.processorFactories {
+		byName[name] = &ProcessorStatus{Name: name}
+	}
+	for name, p := range a.processors {
+		s := &ProcessorStatus{Name: name, Registered: true}
+		for _, kind := range p.Kinds() {
+			s.Kinds = append(s.Kinds, kind.String())
+		}
+		if l, ok := p.(interface{ TaskFactories() []string }); ok {
+			s.TaskFactories = l.TaskFactories()
+		}
+		if l, ok := p.(interface{ LastVersions() map[string]uint64 }); ok {
+			s.LastVersions = l.LastVersions()
+		}
+		byName[name] = s
+	}
+
+	processors := make([]*ProcessorStatus, 0, len(byName))
+	for _, s := range byName {
+		processors = append(processors, s)
+	}
+	sort.Slice(processors, func(i, j int) bool {
+		return processors[i].Name < processors[j].Name
+	})
+	return processors
+}
+
+func (a *Agent) isRegistered(name string) bool {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	_, ok := a.processors[name]
+	return ok
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// StatusHandler returns the peer of the agent, the peers it knows by
+// role and the state of its tasks:
+//
+//	GET /status
+func StatusHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, a.status())
+	}
+}
+
+// ProcessorsHandler lists, registers or deregisters the processors of the
+// agent:
+//
+//	GET /processors
+//	POST /processors?name={name}
+//	DELETE /processors?name={name}
+//
+// GET returns the JSON list of processors sorted by name. POST builds the
+// processor with the factory of the same name and registers it, answering
+// with a 404 status if there is no such factory, or a 409 if it is
+// already registered. DELETE stops the processor, or answers with a 404
+// if it is not registered. Both answer with a 204 status otherwise.
+func ProcessorsHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method == "GET" {
+			writeJSON(w, a.processorsStatus())
+			return
+		}
+
+		if r.Method != "POST" && r.Method != "DELETE" {
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Missing processor name", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			if !a.isRegistered(name) {
+				http.Error(w, "Processor not registered", http.StatusNotFound)
+				return
+			}
+			a.DeregisterProcessor(name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		switch err := a.StartProcessor(name); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrProcessorFactoryNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case ErrProcessorRegistered:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	}
+}
+
+// AlertsHandler returns the last alerts raised by the agent or received
+// from other agents, the oldest first:
+//
+//	GET /alerts
+func AlertsHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		alerts := make([]*Alert, 0)
+		if a.alerts != nil {
+			alerts = a.alerts.List()
+		}
+		writeJSON(w, alerts)
+	}
+}
+
+// DeadLettersHandler lists or discards the tasks of the dead letter
+// queue of the agent:
+//
+//	GET /tasks/deadletters
+//	DELETE /tasks/deadletters?id={id}
+//
+// GET returns the JSON list of dead letters, the oldest first. DELETE
+// answers with a 204 status, or a 404 if there is no such dead letter.
+func DeadLettersHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		jm, ok := a.Tasks.(JobsManager)
+		if !ok {
+			http.Error(w, "The tasks manager has no dead letter queue", http.StatusNotImplemented)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			writeJSON(w, jm.DeadLetters().List())
+
+		case "DELETE":
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+				return
+			}
+			err = jm.DeadLetters().Remove(id)
+			if err == ErrDeadLetterNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	}
+}
+
+// ReplayDeadLetterHandler enqueues again a task of the dead letter queue,
+// or all of them if there is no id:
+//
+//	POST /tasks/deadletters/replay?id={id}
+//
+// If everything is alright, the HTTP status is 204. The tasks whose kind
+// cannot be rebuilt are kept in the queue, answering with a 409 status.
+func ReplayDeadLetterHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		jm, ok := a.Tasks.(JobsManager)
+		if !ok {
+			http.Error(w, "The tasks manager has no dead letter queue", http.StatusNotImplemented)
+			return
+		}
+
+		var ids []uint64
+		if q := r.URL.Query().Get("id"); q != "" {
+			id, err := strconv.ParseUint(q, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, id)
+		} else {
+			for _, l := range jm.DeadLetters().List() {
+				ids = append(ids, l.Id)
+			}
+		}
+
+		status := http.StatusNoContent
+		for _, id := range ids {
+			switch err := jm.Replay(id); err {
+			case nil:
+			case ErrDeadLetterNotFound:
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			case ErrNotReplayable:
+				status = http.StatusConflict
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if status == http.StatusConflict {
+			http.Error(w, "Some tasks cannot be replayed", status)
+			return
+		}
+		w.WriteHeader(status)
+
+	}
+}
+
+// KeyringHandler lists or updates the keys which encrypt the gossip
+// traffic of the agent, to rotate them without restarting it:
+//
+//	GET /keyring
+//	POST /keyring
+//	PUT /keyring
+//	DELETE /keyring
+//
+// GET returns the JSON list of keys, the primary key first. POST installs
+// the key in the body of the request, PUT makes it the primary key and
+// DELETE removes it, answering with a 204 status. The key is base64
+// encoded, as generated by GenerateGossipKey. If the key cannot be used
+// or removed, the HTTP status is 409, and it is 501 if the traffic of
+// the agent is not encrypted.
+func KeyringHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var update func(string) error
+		switch r.Method {
+		case "GET":
+			writeJSON(w, a.ListKeys())
+			return
+		case "POST":
+			update = a.InstallKey
+		case "PUT":
+			update = a.UseKey
+		case "DELETE":
+			update = a.RemoveKey
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := strings.TrimSpace(string(body))
+		if _, err := DecodeGossipKey(key); err != nil {
+			http.Error(w, "Invalid key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch err := update(key); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrKeyringDisabled:
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		default:
+			http.Error(w, err.Error(), http.StatusConflict)
+		}
+
+	}
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func adminRequest(t *testing.T, method, url string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestAdminProcessors(t *testing.T) {
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "monitor"
+	conf.BindAddr = "127.0.0.1:12345"
+	conf.InsecureSkipVerify = true
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err)
+	tm := newTestPriorityTasksManager(t, "")
+	tm.Start()
+	defer tm.Stop()
+	a.Tasks = tm
+	a.RegisterProcessorFactory("batch", func(a *Agent) Processor {
+		return NewBatchProcessor(a, []TaskFactory{fakeTaskFactory{}})
+	})
+
+	admin := httptest.NewServer(a.adminHandler())
+	defer admin.Close()
+
+	require.Equal(t, http.StatusNoContent, adminRequest(t, "POST", admin.URL+"/processors?name=batch", nil))
+	require.Equal(t, http.StatusConflict, adminRequest(t, "POST", admin.URL+"/processors?name=batch", nil))
+	require.Equal(t, http.StatusNotFound, adminRequest(t, "POST", admin.URL+"/processors?name=unknown", nil))
+	require.Equal(t, http.StatusBadRequest, adminRequest(t, "POST", admin.URL+"/processors", nil))
+
+	batch := &protocol.BatchSnapshots{
+		Snapshots: []*protocol.SignedSnapshot{
+			{Snapshot: &protocol.Snapshot{Version: 7}},
+			{Snapshot: &protocol.Snapshot{Version: 3, LogId: "other"}},
+		},
+	}
+	buf, err := batch.Encode()
+	require.NoError(t, err)
+	require.NoError(t, a.In.Publish(&Message{Kind: BatchMessageType, Payload: buf}))
+
+	var processors []*ProcessorStatus
+	waitFor(t, time.Second, func() bool {
+		adminRequest(t, "GET", admin.URL+"/processors", &processors)
+		return len(processors) == 5 && len(processors[1].LastVersions) == 2
+	})
+	require.Equal(t, &ProcessorStatus{
+		Name:          "batch",
+		Registered:    true,
+		Kinds:         []string{"batch"},
+		TaskFactories: []string{"gossip.fakeTaskFactory"},
+		LastVersions:  map[string]uint64{"": 7, "other": 3},
+	}, processors[1])
+	require.Equal(t, &ProcessorStatus{Name: "alerts"}, processors[0], "Processors with a factory must be listed")
+
+	require.Equal(t, http.StatusNoContent, adminRequest(t, "DELETE", admin.URL+"/processors?name=batch", nil))
+	require.Equal(t, http.StatusNotFound, adminRequest(t, "DELETE", admin.URL+"/processors?name=batch", nil))
+	require.Equal(t, NoSubscribersFound, a.In.Publish(&Message{Kind: BatchMessageType, Payload: buf}), "Deregistered processors must be unsubscribed")
+
+	// processors can be registered again once deregistered
+	require.Equal(t, http.StatusNoContent, adminRequest(t, "POST", admin.URL+"/processors?name=batch", nil))
+	a.DeregisterProcessor("batch")
+}
+
+func TestAdminStatus(t *testing.T) {
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "monitor"
+	conf.BindAddr = "127.0.0.1:12345"
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err)
+	a.Tasks = newTestPriorityTasksManager(t, "")
+	require.NoError(t, a.Tasks.Add(func() error { return nil }))
+	a.topology.Update(NewPeer("auditor0", "127.0.0.1", 9100, "auditor"))
+	a.topology.Update(NewPeer("publisher0", "127.0.0.1", 9200, "publisher"))
+	a.topology.Update(NewPeer("publisher1", "127.0.0.1", 9201, "publisher"))
+
+	admin := httptest.NewServer(a.adminHandler())
+	defer admin.Close()
+
+	var status AgentStatus
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", admin.URL+"/status", &status))
+	require.Equal(t, "testNode", status.Self.Name)
+	require.Len(t, status.Topology["auditor"], 1)
+	require.Len(t, status.Topology["publisher"], 2)
+	require.Equal(t, 1, status.Tasks.Pending)
+	require.Equal(t, map[string]int{"low": 0, "normal": 1, "high": 0}, status.Tasks.ByPriority)
+
+	// alerts are kept even if the agent cannot sign them
+	require.Error(t, a.RaiseAlert("bad proof"))
+	var alerts []*Alert
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", admin.URL+"/alerts", &alerts))
+	require.Len(t, alerts, 1)
+	require.Equal(t, "bad proof", alerts[0].Message)
+	require.Equal(t, "monitor", alerts[0].Role)
+
+	require.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, "POST", admin.URL+"/status", nil))
+}
+
+func TestAlertLog(t *testing.T) {
+	l := newAlertLog(2)
+	for _, msg := range []string{"a", "b", "c"} {
+		l.Add(&Alert{Message: msg})
+	}
+	alerts := l.List()
+	require.Len(t, alerts, 2, "The oldest alerts must be dropped")
+	require.Equal(t, "b", alerts[0].Message)
+	require.Equal(t, "c", alerts[1].Message)
+}
+
+func TestAdminKeyring(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-admin-keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	old, err := GenerateGossipKey()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["`+old+`"]`), 0600))
+
+	a, err := NewAgent(SetNodeName("auditor0"), SetBindAddr("127.0.0.1:12356"), SetKeyring(path))
+	require.NoError(t, err)
+	admin := httptest.NewServer(a.adminHandler())
+	defer admin.Close()
+
+	keyRequest := func(method, key string) int {
+		req, err := http.NewRequest(method, admin.URL+"/keyring", strings.NewReader(key))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	key, err := GenerateGossipKey()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, keyRequest("PUT", key), "Keys must be installed before being used")
+	require.Equal(t, http.StatusNoContent, keyRequest("POST", key))
+	require.Equal(t, http.StatusNoContent, keyRequest("PUT", key))
+	require.Equal(t, http.StatusConflict, keyRequest("DELETE", key), "The primary key must not be removed")
+	require.Equal(t, http.StatusNoContent, keyRequest("DELETE", old))
+	require.Equal(t, http.StatusBadRequest, keyRequest("POST", "c2hvcnQ="), "Keys must have an AES key size")
+
+	var keys []string
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", admin.URL+"/keyring", &keys))
+	require.Equal(t, []string{key}, keys)
+
+	plain, err := NewAgent(SetNodeName("auditor1"), SetBindAddr("127.0.0.1:12357"))
+	require.NoError(t, err)
+	plainAdmin := httptest.NewServer(plain.adminHandler())
+	defer plainAdmin.Close()
+	req, err := http.NewRequest("POST", plainAdmin.URL+"/keyring", strings.NewReader(key))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotImplemented, resp.StatusCode, "Agents without a keyring must not install keys")
+
+}
@@ -0,0 +1,290 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/sign"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+)
+
+// ServerRole is the role of the gossip agents embedded in the QED
+// servers, the only peers allowed to originate batches of snapshots.
+const ServerRole = "server"
+
+var (
+	ErrInvalidJoinToken = errors.New("invalid join token")
+	ErrExpiredJoinToken = errors.New("expired join token")
+)
+
+// JoinToken admits a node in the gossip network with a role. It is
+// signed with an admission key, whose public key the agents are
+// configured with, and it travels in the metadata of the node.
+//
+// The token is bound to the public key of the node, which signs every
+// message the node originates. As the token is public, only the messages
+// signed with its key are accepted from the node.
+type JoinToken struct {
+	Node    string
+	Role    string
+	Expires int64 // milliseconds since the epoch
+	// PublicKey is the public key of the node, in the form of
+	// sign.NewVerifier for its Algorithm.
+	PublicKey []byte
+	Algorithm string
+	KeyId     string
+	Signature []byte
+}
+
+// joinTokenMessage returns the statement signed by the admission key:
+// the node name, the role, the algorithm and the public key of the node,
+// each prefixed by its 2 bytes big-endian length, and the expiration as
+// 8 bytes big-endian.
+func joinTokenMessage(node, role, algorithm string, publicKey []byte, expires int64) []byte {
+	var buf bytes.Buffer
+	var num [8]byte
+	buf.WriteString("qed join token")
+	for _, field := range [][]byte{[]byte(node), []byte(role), []byte(algorithm), publicKey} {
+		binary.BigEndian.PutUint16(num[:2], uint16(len(field)))
+		buf.Write(num[:2])
+		buf.Write(field)
+	}
+	binary.BigEndian.PutUint64(num[:], uint64(expires))
+	buf.Write(num[:])
+	return buf.Bytes()
+}
+
+// IssueJoinToken signs a token which admits the node with the given
+// role and public key until expires.
+func IssueJoinToken(signer sign.Signer, node, role string, key sign.Verifier, expires time.Time) (*JoinToken, error) {
+	if expires.IsZero() {
+		return nil, fmt.Errorf("%v: it must expire", ErrInvalidJoinToken)
+	}
+	ms := expires.UnixNano() / int64(time.Millisecond)
+	sig, err := signer.Sign(joinTokenMessage(node, role, key.Algorithm(), key.PublicKey(), ms))
+	if err != nil {
+		return nil, err
+	}
+	return &JoinToken{
+		Node:      node,
+		Role:      role,
+		Expires:   ms,
+		PublicKey: key.PublicKey(),
+		Algorithm: key.Algorithm(),
+		KeyId:     signer.KeyID(),
+		Signature: sig,
+	}, nil
+}
+
+// Verify checks the token was signed by one of the admission keys for
+// the node and role given, and that it has not expired.
+func (t *JoinToken) Verify(keys *sign.KeySet, node, role string, now time.Time) error {
+	if t.Node != node || t.Role != role {
+		return fmt.Errorf("%v: issued to %s as %s", ErrInvalidJoinToken, t.Node, t.Role)
+	}
+	if t.Expires == 0 || len(t.PublicKey) == 0 {
+		return fmt.Errorf("%v: it has no expiration or public key", ErrInvalidJoinToken)
+	}
+	if now.UnixNano()/int64(time.Millisecond) >= t.Expires {
+		return ErrExpiredJoinToken
+	}
+	verifier, err := keys.Verifier(t.KeyId)
+	if err != nil {
+		return fmt.Errorf("%v: %v", ErrInvalidJoinToken, err)
+	}
+	ok, err := verifier.Verify(joinTokenMessage(t.Node, t.Role, t.Algorithm, t.PublicKey, t.Expires), t.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidJoinToken
+	}
+	return nil
+}
+
+// Verifier returns a verifier for the key of the node the token admits.
+func (t *JoinToken) Verifier() (sign.Verifier, error) {
+	return sign.NewVerifier(t.Algorithm, t.PublicKey)
+}
+
+func (t *JoinToken) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, msgpackHandle).Encode(t)
+	return buf.Bytes(), err
+}
+
+func (t *JoinToken) Decode(buf []byte) error {
+	return codec.NewDecoder(bytes.NewReader(buf), msgpackHandle).Decode(t)
+}
+
+// String returns the token encoded to be passed in the command line.
+func (t *JoinToken) String() string {
+	buf, err := t.Encode()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseJoinToken decodes a token returned by String.
+func ParseJoinToken(s string) (*JoinToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidJoinToken, err)
+	}
+	t := new(JoinToken)
+	if err := t.Decode(buf); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidJoinToken, err)
+	}
+	return t, nil
+}
+
+// admit checks the join token of a node announced in the gossip network.
+// If the agent has no admission keys, every node is admitted.
+func (a *Agent) admit(n *memberlist.Node) error {
+	if a.AdmissionKeys == nil || n.Name == a.config.NodeName {
+		return nil
+	}
+	var meta Meta
+	if err := meta.Decode(n.Meta); err != nil {
+		return err
+	}
+	_, err := a.verifyToken(n.Name, &meta)
+	return err
+}
+
+// verifyToken checks the join token in the metadata of a node and
+// returns it.
+func (a *Agent) verifyToken(name string, meta *Meta) (*JoinToken, error) {
+	if len(meta.Token) == 0 {
+		return nil, fmt.Errorf("node %s has no join token", name)
+	}
+	token := new(JoinToken)
+	if err := token.Decode(meta.Token); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidJoinToken, err)
+	}
+	if err := token.Verify(a.AdmissionKeys, name, meta.Role, time.Now()); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// messageStatement returns the statement the originator of a message
+// signs: the kind, the name of the originator prefixed by its 2 bytes
+// big-endian length, and the payload. The TTL is left out, as it changes
+// while the message is forwarded.
+func messageStatement(m *Message) []byte {
+	var buf bytes.Buffer
+	var num [2]byte
+	buf.WriteString("qed gossip message")
+	buf.WriteByte(byte(m.Kind))
+	binary.BigEndian.PutUint16(num[:], uint16(len(m.From.Name)))
+	buf.Write(num[:])
+	buf.WriteString(m.From.Name)
+	buf.Write(m.Payload)
+	return buf.Bytes()
+}
+
+// signMessage sets the agent as the origin of a message without one and
+// signs the messages the agent originates, which the peers check against
+// the key of its join token.
+func (a *Agent) signMessage(m *Message) error {
+	if m.From == nil {
+		m.From = a.Self
+	}
+	if m.From != a.Self || m.Signature != nil || a.Signer == nil {
+		return nil
+	}
+	sig, err := a.Signer.Sign(messageStatement(m))
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// originRoles are the roles of the peers allowed to originate each kind
+// of message. The kinds not listed may come from any peer.
+var originRoles = map[MessageType][]string{
+	BatchMessageType: {ServerRole},
+}
+
+// checkOrigin verifies that the peer which originated a message received
+// from the gossip network is a member of it, and that its role allows it
+// to originate that kind of message. The role is the one the peer was
+// admitted with, not the one in the message. If the agent has admission
+// keys, the message must also be signed with the key of the join token
+// of the peer, as the name of the origin is set by the sender. On
+// success, the origin of the message is replaced by the peer in the
+// topology.
+func (a *Agent) checkOrigin(m *Message) error {
+	if m.From == nil {
+		return fmt.Errorf("message without origin")
+	}
+	from := a.topology.Find(m.From.Name)
+	if from == nil {
+		return fmt.Errorf("message from unknown peer %s", m.From.Name)
+	}
+	if roles, ok := originRoles[m.Kind]; ok {
+		allowed := false
+		for _, role := range roles {
+			allowed = allowed || from.Meta.Role == role
+		}
+		if !allowed {
+			return fmt.Errorf("peer %s with role %s is not allowed to originate messages of kind %d", from.Name, from.Meta.Role, m.Kind)
+		}
+	}
+	if a.AdmissionKeys != nil {
+		token, err := a.verifyToken(from.Name, &from.Meta)
+		if err != nil {
+			return err
+		}
+		verifier, err := token.Verifier()
+		if err != nil {
+			return err
+		}
+		ok, err := verifier.Verify(messageStatement(m), m.Signature)
+		if err != nil || !ok {
+			return fmt.Errorf("message of kind %d with an invalid signature of peer %s", m.Kind, from.Name)
+		}
+	}
+	m.From = from
+	return nil
+}
+
+// aliveDelegate rejects the nodes without a valid join token.
+type aliveDelegate struct {
+	agent *Agent
+}
+
+// NotifyAlive is invoked when a message about a live node is received
+// from the network. Returning a non-nil error prevents the node from
+// being considered a peer.
+func (d *aliveDelegate) NotifyAlive(n *memberlist.Node) error {
+	if err := d.agent.admit(n); err != nil {
+		log.Infof("Agent rejected node %s: %v", n.Name, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/sign"
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func admissionKeySet(signer sign.Signer) *sign.KeySet {
+	return &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+	}}}
+}
+
+// writeAgentKey writes a new private key for an agent in the directory
+// and returns its path and a signer for it.
+func writeAgentKey(t *testing.T, dir, name string) (string, sign.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	path := filepath.Join(dir, name+".pem")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	signer, err := sign.ParsePrivateKey(data)
+	require.NoError(t, err)
+	return path, signer
+}
+
+func TestJoinToken(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	keys := admissionKeySet(signer)
+	nodeKey := sign.NewEd25519Signer()
+	now := time.Now()
+
+	token, err := IssueJoinToken(signer, "auditor0", "auditor", nodeKey, now.Add(time.Hour))
+	require.NoError(t, err)
+
+	parsed, err := ParseJoinToken(token.String())
+	require.NoError(t, err)
+	require.Equal(t, token, parsed)
+	require.NoError(t, parsed.Verify(keys, "auditor0", "auditor", now))
+	verifier, err := parsed.Verifier()
+	require.NoError(t, err)
+	require.Equal(t, nodeKey.PublicKey(), verifier.PublicKey(), "Tokens must carry the key of the node")
+
+	require.Error(t, parsed.Verify(keys, "auditor0", ServerRole, now), "Tokens must not admit other roles")
+	require.Error(t, parsed.Verify(keys, "auditor1", "auditor", now), "Tokens must not admit other nodes")
+	require.Equal(t, ErrExpiredJoinToken, parsed.Verify(keys, "auditor0", "auditor", now.Add(2*time.Hour)))
+	require.Error(t, parsed.Verify(admissionKeySet(sign.NewEd25519Signer()), "auditor0", "auditor", now), "Tokens of unknown keys must be rejected")
+
+	parsed.Role = ServerRole
+	require.Equal(t, ErrInvalidJoinToken, parsed.Verify(keys, "auditor0", ServerRole, now), "Tampered tokens must be rejected")
+
+	parsed, err = ParseJoinToken(token.String())
+	require.NoError(t, err)
+	parsed.PublicKey = sign.NewEd25519Signer().PublicKey()
+	require.Equal(t, ErrInvalidJoinToken, parsed.Verify(keys, "auditor0", "auditor", now), "Tokens must not admit other keys")
+
+	_, err = IssueJoinToken(signer, "auditor0", "auditor", nodeKey, time.Time{})
+	require.Error(t, err, "Tokens must expire")
+	parsed, err = ParseJoinToken(token.String())
+	require.NoError(t, err)
+	parsed.Expires = 0
+	require.Error(t, parsed.Verify(keys, "auditor0", "auditor", now), "Tokens which never expire must be rejected")
+
+	_, err = ParseJoinToken("not a token")
+	require.Error(t, err)
+
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	a, err := NewAgent(SetNodeName("auditor0"), SetRole("auditor"), SetBindAddr("127.0.0.1:12350"))
+	require.NoError(t, err)
+	server := NewPeer("server0", "127.0.0.1", 12351, ServerRole)
+	auditor := NewPeer("auditor1", "127.0.0.1", 12352, "auditor")
+	a.topology.Update(server)
+	a.topology.Update(auditor)
+
+	testCases := []struct {
+		kind  MessageType
+		from  *Peer
+		valid bool
+	}{
+		{BatchMessageType, NewPeer("server0", "10.0.0.1", 1, ServerRole), true},
+		{BatchMessageType, NewPeer("auditor1", "127.0.0.1", 12352, ServerRole), false},
+		{BatchMessageType, NewPeer("server1", "127.0.0.1", 12353, ServerRole), false},
+		{BatchMessageType, nil, false},
+		{AlertMessageType, auditor, true},
+		{SnapshotResponseMessageType, auditor, true},
+	}
+
+	for i, c := range testCases {
+		m := &Message{Kind: c.kind, From: c.from}
+		err := a.checkOrigin(m)
+		if !c.valid {
+			require.Errorf(t, err, "The message must be rejected in case %d", i)
+			continue
+		}
+		require.NoErrorf(t, err, "The message must be accepted in case %d", i)
+		require.Equal(t, a.topology.Find(c.from.Name), m.From, "The origin must be the peer in the topology in case %d", i)
+	}
+
+}
+
+func TestCheckOriginSignatures(t *testing.T) {
+
+	admission := sign.NewEd25519Signer()
+	a, err := NewAgent(SetNodeName("auditor0"), SetRole("auditor"), SetBindAddr("127.0.0.1:12350"))
+	require.NoError(t, err)
+	a.AdmissionKeys = admissionKeySet(admission)
+
+	serverKey := sign.NewEd25519Signer()
+	token, err := IssueJoinToken(admission, "server0", ServerRole, serverKey, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	server := NewPeer("server0", "127.0.0.1", 12351, ServerRole)
+	server.Meta.Token, err = token.Encode()
+	require.NoError(t, err)
+	a.topology.Update(server)
+
+	signed := func(signer sign.Signer, payload []byte) *Message {
+		m := &Message{Kind: BatchMessageType, From: NewPeer("server0", "10.0.0.1", 1, ServerRole), Payload: payload}
+		sig, err := signer.Sign(messageStatement(m))
+		require.NoError(t, err)
+		m.Signature = sig
+		return m
+	}
+
+	require.NoError(t, a.checkOrigin(signed(serverKey, []byte("batch"))), "Messages signed with the key of the token must be accepted")
+
+	m := signed(serverKey, []byte("batch"))
+	m.Signature = nil
+	require.Error(t, a.checkOrigin(m), "Messages without signature must be rejected")
+
+	require.Error(t, a.checkOrigin(signed(sign.NewEd25519Signer(), []byte("batch"))), "Messages signed with other keys must be rejected")
+
+	m = signed(serverKey, []byte("batch"))
+	m.Payload = []byte("forged batch")
+	require.Error(t, a.checkOrigin(m), "Messages with a tampered payload must be rejected")
+
+	m = signed(serverKey, []byte("batch"))
+	m.Kind = AlertMessageType
+	require.Error(t, a.checkOrigin(m), "Messages with a tampered kind must be rejected")
+
+}
+
+func TestAdmission(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-admission-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateGossipKey()
+	require.NoError(t, err)
+	keyringPath := filepath.Join(dir, "keyring.json")
+	k, err := DecodeGossipKey(key)
+	require.NoError(t, err)
+	keyring, err := memberlist.NewKeyring(nil, k)
+	require.NoError(t, err)
+	require.NoError(t, SaveKeyring(keyringPath, keyring))
+
+	signer := sign.NewEd25519Signer()
+	newAgent := func(name, role, addr, keyringPath string, withToken bool, join ...string) *Agent {
+		conf := DefaultConfig()
+		conf.NodeName = name
+		conf.Role = role
+		conf.BindAddr = addr
+		conf.StartJoin = join
+		conf.KeyringPath = keyringPath
+		var key sign.Signer
+		conf.PrivateKeyPath, key = writeAgentKey(t, dir, name)
+		if withToken {
+			token, err := IssueJoinToken(signer, name, role, key, time.Now().Add(time.Hour))
+			require.NoError(t, err)
+			conf.JoinToken = token.String()
+		}
+		a, err := NewAgentFromConfig(conf)
+		require.NoError(t, err)
+		a.AdmissionKeys = admissionKeySet(signer)
+		a.Start()
+		return a
+	}
+
+	conf := DefaultConfig()
+	conf.NodeName = "auditor9"
+	conf.Role = "auditor"
+	conf.PrivateKeyPath, _ = writeAgentKey(t, dir, "auditor9")
+	token, err := IssueJoinToken(signer, "auditor9", "auditor", sign.NewEd25519Signer(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	conf.JoinToken = token.String()
+	_, err = NewAgentFromConfig(conf)
+	require.Error(t, err, "Agents must not use a join token issued to another key")
+
+	server := newAgent("server0", ServerRole, "127.0.0.1:12350", keyringPath, true)
+	defer server.Shutdown()
+	auditor := newAgent("auditor0", "auditor", "127.0.0.1:12351", keyringPath, true, "127.0.0.1:12350")
+	defer auditor.Shutdown()
+	intruder := newAgent("intruder", "auditor", "127.0.0.1:12352", keyringPath, false, "127.0.0.1:12350")
+	defer intruder.Shutdown()
+	eavesdropper := newAgent("eavesdropper", "auditor", "127.0.0.1:12353", "", false)
+	defer eavesdropper.Shutdown()
+	_, err = eavesdropper.Join([]string{"127.0.0.1:12350"})
+	require.Error(t, err, "Agents without the gossip keys must not join")
+
+	for i := 0; server.topology.Find("auditor0") == nil || auditor.topology.Find("server0") == nil; i++ {
+		require.True(t, i < 100, "The agents with a join token must be admitted")
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, server.topology.Find("intruder"), "Agents without a join token must be rejected")
+	require.Nil(t, server.topology.Find("eavesdropper"))
+
+}
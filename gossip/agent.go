@@ -16,14 +16,19 @@
 package gossip
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/sign"
 	"github.com/hashicorp/memberlist"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -55,6 +60,10 @@ type Agent struct {
 	// metrics.
 	metrics *metrics.Server
 
+	// admin exposes the admin API of the agent. If nil,
+	// the API is disabled.
+	admin *http.Server
+
 	// gossip gives access to the
 	// memberlist API to interact with the network
 	// and its members
@@ -73,6 +82,18 @@ type Agent struct {
 	// the context for each task to be able to execute.
 	processors map[string]Processor
 
+	// subscriptions holds the subscriptions of each
+	// processor to the In message bus.
+	subscriptions map[string][]subscription
+
+	// processorFactories build the processors which
+	// can be registered by name.
+	processorFactories map[string]ProcessorFactory
+
+	// alerts keeps the last alerts raised by the agent
+	// or received from other agents.
+	alerts *alertLog
+
 	// timeout signals when the default timeout has passed
 	// to end an enqueue operation
 	timeout *time.Ticker
@@ -103,6 +124,48 @@ type Agent struct {
 
 	//Client to a task manager service
 	Tasks TasksManager
+
+	// TrustedKeys are the keys of the servers whose signed
+	// snapshots are accepted. If nil, signatures are not checked.
+	// The keys the servers rotated to are trusted too, as long as
+	// they are cross-signed from one of them.
+	TrustedKeys *sign.KeySet
+
+	// serverKeys caches the keys published by the servers, anchored
+	// in the trusted keys, for serverKeysTTL.
+	serverKeysMu sync.Mutex
+	serverKeys   *sign.KeySet
+	serverKeysAt time.Time
+
+	// Signer signs the alerts and evidence raised by the agent.
+	Signer sign.Signer
+
+	// Checkpoints keeps the last snapshots verified by the agent.
+	Checkpoints *CheckpointStore
+
+	// recent keeps the last snapshots received to serve them
+	// to the peers which lost them.
+	recent *recentSnapshots
+
+	// keyring holds the keys to encrypt the gossip traffic.
+	// If nil, the traffic is not encrypted.
+	keyring *memberlist.Keyring
+
+	// WitnessKeys are the keys of the witnesses whose cosignatures
+	// are accepted. If nil, cosignatures are not checked.
+	WitnessKeys *sign.KeySet
+
+	// AdmissionKeys are the keys which sign the join tokens of
+	// the peers. If nil, any node may join the gossip network.
+	AdmissionKeys *sign.KeySet
+
+	// AgentKeys are the keys of the agents whose alerts and evidence
+	// are accepted when there are no admission keys, which bind the
+	// key of each peer to its name.
+	AgentKeys *sign.KeySet
+
+	// joinToken is the encoded token which admits this agent.
+	joinToken []byte
 }
 
 // Creates new agent from a configuration object
@@ -136,8 +199,25 @@ func NewDefaultAgent(conf *Config, qed *client.HTTPClient, s SnapshotStore, t Ta
 // queues are full, messages will start to be dropped silently.
 func NewAgent(options ...AgentOptionF) (*Agent, error) {
 	agent := &Agent{
-		quitCh:   make(chan bool),
-		topology: NewTopology(),
+		quitCh:        make(chan bool),
+		topology:      NewTopology(),
+		processors:    make(map[string]Processor),
+		subscriptions: make(map[string][]subscription),
+		processorFactories: map[string]ProcessorFactory{
+			"alerts": func(a *Agent) Processor {
+				return NewAlertProcessor(a)
+			},
+			"evidence": func(a *Agent) Processor {
+				return NewEvidenceProcessor(a)
+			},
+			"snapshots": func(a *Agent) Processor {
+				return NewSnapshotRequestProcessor(a)
+			},
+			"cosignatures": func(a *Agent) Processor {
+				return NewCosignatureProcessor(a)
+			},
+		},
+		alerts: newAlertLog(recentAlertsSize),
 	}
 
 	// Run the options on the client
@@ -168,16 +248,77 @@ func NewAgent(options ...AgentOptionF) (*Agent, error) {
 	agent.config.MemberlistConfig.AdvertisePort = advertisePort
 	agent.config.MemberlistConfig.Name = agent.config.NodeName
 	agent.config.MemberlistConfig.Logger = log.GetLogger()
+	agent.config.MemberlistConfig.Keyring = agent.keyring
 
 	// Configure delegates
 	agent.config.MemberlistConfig.Delegate = newAgentDelegate(agent)
 	agent.config.MemberlistConfig.Events = &eventDelegate{agent}
+	agent.config.MemberlistConfig.Alive = &aliveDelegate{agent}
 
 	agent.Self = NewPeer(agent.config.NodeName, advertiseIP, uint16(advertisePort), agent.config.Role)
+	agent.Self.Meta.Token = agent.joinToken
+
+	meta, err := agent.Self.Meta.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) > memberlist.MetaMaxSize {
+		return nil, fmt.Errorf("Agent metadata is %d bytes long, the limit is %d", len(meta), memberlist.MetaMaxSize)
+	}
 
 	return agent, nil
 }
 
+// ErrNoTrustedKeys is returned when an agent has no keys to verify the
+// snapshots it processes.
+var ErrNoTrustedKeys = errors.New("no trusted keys to verify the snapshots")
+
+// CheckTrustedKeys returns ErrNoTrustedKeys if the agent has no trusted
+// keys to verify the snapshots it processes, unless it was configured to
+// skip the verification. Agents which process batches check it on start.
+func (a *Agent) CheckTrustedKeys() error {
+	if a.TrustedKeys == nil && !a.config.InsecureSkipVerify {
+		return ErrNoTrustedKeys
+	}
+	return nil
+}
+
+// serverKeysTTL is how long the keys published by the servers are
+// cached before asking for them again.
+const serverKeysTTL = time.Minute
+
+// ServerKeys returns the keys to verify the snapshots of the QED servers:
+// the trusted keys of the agent and the ones the servers rotated to from
+// them, as published by the servers. Without trusted keys there is
+// nothing to anchor the published keys, so no key is returned.
+func (a *Agent) ServerKeys() (*sign.KeySet, error) {
+	if a.TrustedKeys == nil {
+		return nil, ErrNoTrustedKeys
+	}
+	if a.Qed == nil {
+		return a.TrustedKeys, nil
+	}
+
+	a.serverKeysMu.Lock()
+	defer a.serverKeysMu.Unlock()
+
+	if a.serverKeys != nil && time.Since(a.serverKeysAt) < serverKeysTTL {
+		return a.serverKeys, nil
+	}
+	published, err := a.Qed.Keys(a.TrustedKeys)
+	if err != nil {
+		log.Infof("Agent unable to get the keys published by the servers: %v", err)
+		if a.serverKeys != nil {
+			return a.serverKeys, nil
+		}
+		return a.TrustedKeys, nil
+	}
+	a.serverKeys = sign.MergeKeySets(a.TrustedKeys, published)
+	a.serverKeysAt = time.Now()
+
+	return a.serverKeys, nil
+}
+
 // Enables the processing engines of the
 // agent
 func (a *Agent) Start() {
@@ -188,6 +329,16 @@ func (a *Agent) Start() {
 		a.metrics.Start()
 	}
 
+	if a.admin != nil {
+		log.Infof("Starting agent admin server")
+		a.admin.Handler = a.adminHandler()
+		go func() {
+			if err := a.admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.Infof("Can't start agent admin server: %v", err)
+			}
+		}()
+	}
+
 	if a.Tasks != nil {
 		log.Infof("Starting task mamanger loop")
 		a.Tasks.Start()
@@ -231,23 +382,93 @@ func (a *Agent) Start() {
 	a.sender()
 }
 
+// subscription identifies the subscription of a processor
+// to a kind of messages.
+type subscription struct {
+	kind MessageType
+	id   int
+}
+
 // Register a new processor into the agent, to add some tasks per batch
-// to be executed by the task manager.
-func (a *Agent) RegisterProcessor(name string, p Processor) {
+// to be executed by the task manager. The processor is subscribed
+// to the kinds of messages it reads. It fails if there is
+// already a processor with the same name.
+func (a *Agent) RegisterProcessor(name string, p Processor) error {
 	a.stateLock.Lock()
 	defer a.stateLock.Unlock()
+	if _, ok := a.processors[name]; ok {
+		return ErrProcessorRegistered
+	}
+	if a.metrics != nil {
+		a.RegisterMetrics(p.Metrics())
+	}
 	a.processors[name] = p
-	a.RegisterMetrics(p.Metrics())
+	for _, kind := range p.Kinds() {
+		id := a.In.Subscribe(kind, p, 255)
+		a.subscriptions[name] = append(a.subscriptions[name], subscription{kind, id})
+	}
+	return nil
 }
 
-// Deregister a processor per name. It will not fail if the
+// Deregister a processor per name, stopping it. It will not fail if the
 // processor does not exist.
 func (a *Agent) DeregisterProcessor(name string) {
 	a.stateLock.Lock()
 	defer a.stateLock.Unlock()
+	a.deregisterProcessor(name)
+}
+
+func (a *Agent) deregisterProcessor(name string) {
+	p, ok := a.processors[name]
+	if !ok {
+		return
+	}
+	for _, s := range a.subscriptions[name] {
+		a.In.Unsubscribe(s.kind, s.id)
+	}
+	p.Stop()
+	if a.metrics != nil {
+		for _, c := range p.Metrics() {
+			a.metrics.Unregister(c)
+		}
+	}
+	delete(a.subscriptions, name)
 	delete(a.processors, name)
 }
 
+// RegisterProcessorFactory adds a factory to build the processor of the
+// given name with StartProcessor. The agent has factories for the
+// "alerts", "evidence", "snapshots" and "cosignatures" processors.
+func (a *Agent) RegisterProcessorFactory(name string, f ProcessorFactory) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	a.processorFactories[name] = f
+}
+
+// StartProcessor builds a processor with the factory of the given name
+// and registers it with the same name.
+func (a *Agent) StartProcessor(name string) error {
+	a.stateLock.Lock()
+	f, ok := a.processorFactories[name]
+	a.stateLock.Unlock()
+	if !ok {
+		return ErrProcessorFactoryNotFound
+	}
+	return a.RegisterProcessor(name, f(a))
+}
+
+// ProcessorFactories returns the sorted names of the processor factories.
+func (a *Agent) ProcessorFactories() []string {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	names := make([]string, 0, len(a.processorFactories))
+	for name := range a.processorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Register a slice of collectors in the agent metrics server
 func (a *Agent) RegisterMetrics(cs []prometheus.Collector) {
 	a.metrics.MustRegister(cs...)
@@ -299,13 +520,22 @@ func (a *Agent) Send(msg *Message) {
 	}
 
 	msg.TTL--
+	// the origin of the message is kept when it is forwarded, as the
+	// receivers check it is allowed to originate the message
+	if err := a.signMessage(msg); err != nil {
+		log.Infof("Agent Send unable to sign message: %v", err)
+		return
+	}
 	wire, err := msg.Encode()
 	if err != nil {
 		log.Infof("Agent Send unable to encode message to gossip it")
 		return
 	}
-	msg.From = a.Self
-	for _, dst := range a.route(msg.From) {
+	dsts := a.route(msg.From)
+	if msg.Kind == AlertMessageType || msg.Kind == EvidenceMessageType {
+		dsts = a.broadcastRoute(msg.From)
+	}
+	for _, dst := range dsts {
 		log.Debugf("Sending batch to %+v\n", dst.Name)
 		a.gossip.SendReliable(dst, wire)
 	}
@@ -329,6 +559,23 @@ func (a *Agent) route(src *Peer) []*memberlist.Node {
 	return dst
 }
 
+// Returns the list of all the nodes but the source of the
+// communication. Alerts and evidence must reach every agent.
+func (a *Agent) broadcastRoute(src *Peer) []*memberlist.Node {
+	var excluded PeerList
+
+	dst := make([]*memberlist.Node, 0)
+
+	excluded.L = append(excluded.L, src)
+	excluded.L = append(excluded.L, a.Self)
+
+	peers := a.topology.All(&excluded)
+	for _, p := range peers.L {
+		dst = append(dst, p.Node())
+	}
+	return dst
+}
+
 // Join asks the Agent instance to join
 // the nodes with the give addrs addresses.
 func (a *Agent) Join(addrs []string) (int, error) {
@@ -415,10 +662,20 @@ func (a *Agent) Shutdown() error {
 	}
 	close(a.quitCh)
 
+	for name := range a.processors {
+		a.deregisterProcessor(name)
+	}
+
 	if a.metrics != nil {
 		a.metrics.Shutdown()
 	}
 
+	if a.admin != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = a.admin.Shutdown(ctx)
+		cancel()
+	}
+
 	if a.Tasks != nil {
 		a.Tasks.Stop()
 	}
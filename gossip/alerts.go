@@ -0,0 +1,288 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// Alert is a finding of an agent, like a proof which does not verify,
+// propagated to the rest of the gossip network.
+type Alert struct {
+	Origin    string // node name of the agent which raised the alert
+	Role      string
+	Timestamp int64 // milliseconds since the epoch
+	Message   string
+}
+
+// recentAlertsSize is the number of alerts kept by the agent
+// to be served by its admin API.
+const recentAlertsSize = 100
+
+// alertLog keeps the last alerts in the order they were added.
+type alertLog struct {
+	lock   sync.Mutex
+	alerts []*Alert
+	size   int
+}
+
+func newAlertLog(size int) *alertLog {
+	return &alertLog{
+		alerts: make([]*Alert, 0, size),
+		size:   size,
+	}
+}
+
+// Add appends an alert, dropping the oldest one if the log is full.
+func (l *alertLog) Add(alert *Alert) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.alerts) == l.size {
+		copy(l.alerts, l.alerts[1:])
+		l.alerts = l.alerts[:l.size-1]
+	}
+	l.alerts = append(l.alerts, alert)
+}
+
+// List returns the alerts of the log, the oldest first.
+func (l *alertLog) List() []*Alert {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*Alert{}, l.alerts...)
+}
+
+// Evidence is the proof of a misbehaviour of the QED servers found by an
+// agent. Peers verify it against the keys of the servers on reception
+// instead of trusting the agent which found it.
+type Evidence struct {
+	Origin       string
+	Timestamp    int64
+	Equivocation *protocol.Equivocation
+}
+
+var (
+	ErrInvalidPayloadSignature = errors.New("invalid payload signature")
+	ErrNoEvidencePath          = errors.New("the agent has no evidence path nor data path")
+)
+
+// SignedPayload is the payload of alert and evidence messages. It is
+// signed by the agent which originated it, so the agents relaying it
+// cannot tamper with its contents. The key it carries is not trusted by
+// itself: the receivers check it is the key of the originating peer.
+type SignedPayload struct {
+	Kind      MessageType
+	Payload   []byte
+	Algorithm string
+	PublicKey []byte
+	Signature []byte
+}
+
+// signedPayloadMessage binds the signature to the kind of the payload.
+func signedPayloadMessage(kind MessageType, payload []byte) []byte {
+	return append([]byte{'q', 'e', 'd', 0x00, byte(kind)}, payload...)
+}
+
+// SignPayload encodes v and signs it as a payload of the given kind.
+func SignPayload(signer sign.Signer, kind MessageType, v interface{}) (*SignedPayload, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, msgpackHandle).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(signedPayloadMessage(kind, buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPayload{
+		Kind:      kind,
+		Payload:   buf.Bytes(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+		Signature: sig,
+	}, nil
+}
+
+// Verify checks the payload was signed with the key of the verifier,
+// which must be the key the payload carries.
+func (p *SignedPayload) Verify(verifier sign.Verifier) error {
+	if !bytes.Equal(p.PublicKey, verifier.PublicKey()) {
+		return fmt.Errorf("%v: signed with another key than %s", ErrInvalidPayloadSignature, verifier.KeyID())
+	}
+	ok, err := verifier.Verify(signedPayloadMessage(p.Kind, p.Payload), p.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidPayloadSignature
+	}
+	return nil
+}
+
+// Open decodes the signed contents of the payload into v.
+func (p *SignedPayload) Open(v interface{}) error {
+	return codec.NewDecoder(bytes.NewReader(p.Payload), msgpackHandle).Decode(v)
+}
+
+func (p *SignedPayload) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, msgpackHandle).Encode(p)
+	return buf.Bytes(), err
+}
+
+func (p *SignedPayload) Decode(buf []byte) error {
+	return codec.NewDecoder(bytes.NewReader(buf), msgpackHandle).Decode(p)
+}
+
+// RaiseAlert signs an alert with the key of the agent and gossips it to
+// the rest of the agents.
+func (a *Agent) RaiseAlert(msg string) error {
+	alert := &Alert{
+		Origin:    a.config.NodeName,
+		Role:      a.config.Role,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Message:   msg,
+	}
+	if a.alerts != nil {
+		a.alerts.Add(alert)
+	}
+	return a.publishSigned(AlertMessageType, alert)
+}
+
+// ShareEvidence signs the evidence of an equivocation with the key of the
+// agent and gossips it to the rest of the agents.
+func (a *Agent) ShareEvidence(e *protocol.Equivocation) error {
+	return a.publishSigned(EvidenceMessageType, &Evidence{
+		Origin:       a.config.NodeName,
+		Timestamp:    time.Now().UnixNano() / int64(time.Millisecond),
+		Equivocation: e,
+	})
+}
+
+func (a *Agent) publishSigned(kind MessageType, v interface{}) error {
+	if a.Signer == nil {
+		return errors.New("the agent has no key to sign messages")
+	}
+	payload, err := SignPayload(a.Signer, kind, v)
+	if err != nil {
+		return err
+	}
+	buf, err := payload.Encode()
+	if err != nil {
+		return err
+	}
+	// the message will come back from other agents, and it must not be
+	// processed twice
+	wasSeen(a.Cache, buf)
+	return a.Out.Publish(&Message{
+		Kind:    kind,
+		From:    a.Self,
+		TTL:     a.config.AlertTTL,
+		Payload: buf,
+	})
+}
+
+// evidencePath returns the directory where the agent keeps the alerts and
+// evidence: EvidencePath if set, or the evidence directory of DataPath.
+func (a *Agent) evidencePath() (string, error) {
+	if a.config.EvidencePath != "" {
+		return a.config.EvidencePath, nil
+	}
+	if a.config.DataPath != "" {
+		return filepath.Join(a.config.DataPath, "evidence"), nil
+	}
+	return "", ErrNoEvidencePath
+}
+
+// StoreEvidence writes the evidence of an equivocation in the evidence
+// directory of the agent and returns the path of the file.
+func (a *Agent) StoreEvidence(e *protocol.Equivocation) (string, error) {
+	dir, err := a.evidencePath()
+	if err != nil {
+		return "", err
+	}
+	return WriteEvidence(dir, e)
+}
+
+// storeAlert appends an alert, with the id of the key which signed it,
+// to the alerts log of the evidence directory.
+func (a *Agent) storeAlert(alert *Alert, keyId string) error {
+	dir, err := a.evidencePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "alerts.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(struct {
+		*Alert
+		KeyId string
+	}{alert, keyId})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", line)
+	return err
+}
+
+// alertJobKind identifies the jobs which send a notification.
+const alertJobKind = "alert"
+
+// notify sends a notification. With a jobs manager, it is sent from a
+// high priority job, so it runs before the pending tasks and it is
+// retried if the notifier fails.
+func (a *Agent) notify(msg string) {
+	if a.Notifier == nil {
+		return
+	}
+	jm, ok := a.Tasks.(JobsManager)
+	if !ok {
+		_ = a.Notifier.Alert(msg)
+		return
+	}
+	if err := jm.AddJob(a.alertJob(msg)); err != nil {
+		log.Infof("Agent is unable to enqueue a notification: %v", err)
+		_ = a.Notifier.Alert(msg)
+	}
+}
+
+func (a *Agent) alertJob(msg string) *Job {
+	return &Job{
+		Kind:     alertJobKind,
+		Payload:  []byte(msg),
+		Priority: HighPriority,
+		Run: func(ctx context.Context) error {
+			return a.Notifier.Alert(msg)
+		},
+	}
+}
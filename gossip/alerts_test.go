@@ -0,0 +1,246 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedPayload(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	alert := &Alert{Origin: "auditor0", Role: "auditor", Timestamp: 1, Message: "bad proof"}
+
+	payload, err := SignPayload(signer, AlertMessageType, alert)
+	require.NoError(t, err)
+	buf, err := payload.Encode()
+	require.NoError(t, err)
+
+	a, err := NewAgent(SetNodeName("monitor0"), SetRole("monitor"), SetBindAddr("127.0.0.1:12350"))
+	require.NoError(t, err)
+	from := NewPeer("auditor0", "127.0.0.1", 12351, "auditor")
+	_, err = a.openSignedPayload(&Message{Kind: AlertMessageType, From: from, Payload: buf}, new(SignedPayload))
+	require.Error(t, err, "The payload must not verify without trusted keys")
+
+	a.AgentKeys = admissionKeySet(signer)
+	decoded := new(SignedPayload)
+	keyId, err := a.openSignedPayload(&Message{Kind: AlertMessageType, From: from, Payload: buf}, decoded)
+	require.NoError(t, err, "The payload must verify")
+	require.Equal(t, signer.KeyID(), keyId)
+	opened := new(Alert)
+	require.NoError(t, decoded.Open(opened))
+	require.Equal(t, alert, opened)
+
+	_, err = a.openSignedPayload(&Message{Kind: EvidenceMessageType, From: from, Payload: buf}, new(SignedPayload))
+	require.Error(t, err, "The payload must be of the kind of the message")
+
+	a.AgentKeys = admissionKeySet(sign.NewEd25519Signer())
+	_, err = a.openSignedPayload(&Message{Kind: AlertMessageType, From: from, Payload: buf}, new(SignedPayload))
+	require.Error(t, err, "The payload must be signed with a trusted key")
+
+	// with admission keys, the payload must be signed with the key of
+	// the join token of the peer
+	admission := sign.NewEd25519Signer()
+	a.AdmissionKeys = admissionKeySet(admission)
+	token, err := IssueJoinToken(admission, "auditor0", "auditor", signer, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	from.Meta.Token, err = token.Encode()
+	require.NoError(t, err)
+	_, err = a.openSignedPayload(&Message{Kind: AlertMessageType, From: from, Payload: buf}, new(SignedPayload))
+	require.NoError(t, err, "The payload must verify with the key of the join token")
+	other := NewPeer("auditor1", "127.0.0.1", 12352, "auditor")
+	token, err = IssueJoinToken(admission, "auditor1", "auditor", sign.NewEd25519Signer(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	other.Meta.Token, err = token.Encode()
+	require.NoError(t, err)
+	_, err = a.openSignedPayload(&Message{Kind: AlertMessageType, From: other, Payload: buf}, new(SignedPayload))
+	require.Error(t, err, "The payload must not verify as originated by another peer")
+
+	decoded.Payload[len(decoded.Payload)-1] ^= 0xff
+	require.Equal(t, ErrInvalidPayloadSignature, decoded.Verify(signer), "A tampered payload must not verify")
+}
+
+func newFindingsTestAgent(t *testing.T, dir string) (*Agent, *fakeNotifier) {
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "monitor"
+	conf.BindAddr = "127.0.0.1:12345"
+	conf.EvidencePath = dir
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	notifier := &fakeNotifier{}
+	a.Notifier = notifier
+	return a, notifier
+}
+
+func TestAlertProcessor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-alerts-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, notifier := newFindingsTestAgent(t, dir)
+	ts := &testSubscriber{}
+	a.Out.Subscribe(AlertMessageType, ts, 5)
+
+	p := NewAlertProcessor(a)
+	a.In.Subscribe(AlertMessageType, p, 0)
+	defer p.Stop()
+
+	signer := sign.NewEd25519Signer()
+	a.AgentKeys = admissionKeySet(signer)
+	a.AgentKeys.Keys = append(a.AgentKeys.Keys, admissionKeySet(a.Signer).Keys...)
+
+	// alerts raised by the agent itself are gossiped but not processed
+	require.NoError(t, a.RaiseAlert("own alert"))
+	own := <-ts.ch
+	require.Equal(t, a.config.AlertTTL, own.TTL)
+	a.In.Publish(own)
+
+	from := NewPeer("auditor0", "127.0.0.1", 12351, "auditor")
+	payload, err := SignPayload(signer, AlertMessageType, &Alert{Origin: "auditor0", Role: "auditor", Message: "bad proof"})
+	require.NoError(t, err)
+	buf, err := payload.Encode()
+	require.NoError(t, err)
+	m1 := &Message{Kind: AlertMessageType, From: from, TTL: 2, Payload: buf}
+
+	payload.Signature[0] ^= 0xff
+	buf, err = payload.Encode()
+	require.NoError(t, err)
+	forged := &Message{Kind: AlertMessageType, From: from, TTL: 2, Payload: buf}
+
+	// an alert which claims to come from another agent
+	payload, err = SignPayload(signer, AlertMessageType, &Alert{Origin: "auditor1", Role: "auditor", Message: "bad proof"})
+	require.NoError(t, err)
+	buf, err = payload.Encode()
+	require.NoError(t, err)
+	impersonated := &Message{Kind: AlertMessageType, From: from, TTL: 2, Payload: buf}
+
+	a.In.Publish(forged)
+	a.In.Publish(impersonated)
+	a.In.Publish(m1)
+	select {
+	case m2 := <-ts.ch:
+		require.Equal(t, m1, m2, "The alert must be forwarded")
+	case <-time.After(1 * time.Second):
+		t.Fatal("The alert was not forwarded")
+	}
+
+	a.In.Publish(m1)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, len(ts.ch), "Only new valid alerts must be forwarded")
+	require.Equal(t, 1.0, testutil.ToFloat64(p.received))
+	require.Equal(t, 2.0, testutil.ToFloat64(p.invalid))
+	require.Equal(t, 1, notifier.count())
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "alerts.log"))
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(stored), "\n"), "The alert must be stored once")
+	require.Contains(t, string(stored), "bad proof")
+}
+
+func TestEvidenceProcessor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-evidence-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := sign.NewEd25519Signer()
+	monitor := sign.NewEd25519Signer()
+	a, notifier := newFindingsTestAgent(t, dir)
+	a.AgentKeys = admissionKeySet(monitor)
+	a.TrustedKeys = &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     server.KeyID(),
+		Algorithm: server.Algorithm(),
+		PublicKey: server.PublicKey(),
+	}}}
+	ts := &testSubscriber{}
+	a.Out.Subscribe(EvidenceMessageType, ts, 5)
+
+	p := NewEvidenceProcessor(a)
+	a.In.Subscribe(EvidenceMessageType, p, 0)
+	defer p.Stop()
+
+	newMessage := func(signer sign.Signer, origin string) *Message {
+		first, err := protocol.SignSnapshot(signer, &protocol.Snapshot{HistoryDigest: []byte{0x1}, HyperDigest: []byte{0x0}, Version: 1}, time.Now())
+		require.NoError(t, err)
+		second, err := protocol.SignSnapshot(signer, &protocol.Snapshot{HistoryDigest: []byte{0x2}, HyperDigest: []byte{0x0}, Version: 1}, time.Now())
+		require.NoError(t, err)
+		evidence := &Evidence{Origin: origin, Equivocation: protocol.NewEquivocation(first, second)}
+		payload, err := SignPayload(monitor, EvidenceMessageType, evidence)
+		require.NoError(t, err)
+		buf, err := payload.Encode()
+		require.NoError(t, err)
+		return &Message{Kind: EvidenceMessageType, From: NewPeer("monitor0", "127.0.0.1", 12351, "monitor"), TTL: 2, Payload: buf}
+	}
+
+	// evidence must be signed by the servers, not only by the agent, and
+	// come from the agent which claims to have found it
+	a.In.Publish(newMessage(sign.NewEd25519Signer(), "monitor0"))
+	a.In.Publish(newMessage(server, "monitor1"))
+	valid := newMessage(server, "monitor0")
+	a.In.Publish(valid)
+
+	select {
+	case m := <-ts.ch:
+		require.Equal(t, valid, m, "The evidence must be forwarded")
+	case <-time.After(1 * time.Second):
+		t.Fatal("The evidence was not forwarded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, len(ts.ch), "Evidence which does not verify must be dropped")
+	require.Equal(t, 1.0, testutil.ToFloat64(p.received))
+	require.Equal(t, 2.0, testutil.ToFloat64(p.invalid))
+	require.Equal(t, 1, notifier.count())
+
+	files, err := filepath.Glob(filepath.Join(dir, "equivocation-*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1, "The evidence must be stored")
+}
+
+func TestEvidencePath(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-evidence-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, _ := newFindingsTestAgent(t, "")
+	_, err = a.StoreEvidence(&protocol.Equivocation{Version: 1})
+	require.Equal(t, ErrNoEvidencePath, err, "Evidence must not be stored in an implicit directory")
+
+	a.config.DataPath = dir
+	path, err := a.StoreEvidence(&protocol.Equivocation{Version: 1})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "evidence"), filepath.Dir(path), "Evidence must be stored in the data path")
+
+	a.config.EvidencePath = filepath.Join(dir, "other")
+	path, err = a.StoreEvidence(&protocol.Equivocation{Version: 1})
+	require.NoError(t, err)
+	require.Equal(t, a.config.EvidencePath, filepath.Dir(path))
+}
@@ -0,0 +1,352 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recoveryTimeout is the time to wait for the snapshots requested to a
+// peer before requesting them again.
+const recoveryTimeout = 1 * time.Minute
+
+// AgentState is the summary of the snapshots seen by an agent, exchanged
+// with the other agents in the memberlist push/pull to find the
+// snapshots lost in the gossip network.
+type AgentState struct {
+	Node   string
+	Latest map[string]uint64 // latest version seen of each log
+}
+
+func (s *AgentState) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, msgpackHandle).Encode(s)
+	return buf.Bytes(), err
+}
+
+func (s *AgentState) Decode(buf []byte) error {
+	return codec.NewDecoder(bytes.NewReader(buf), msgpackHandle).Decode(s)
+}
+
+// SnapshotRequest asks a peer for the signed snapshots from Start to End
+// of a log. The peer answers with a batch sent directly to the agent in a
+// snapshot response, as only the servers may originate batch messages.
+type SnapshotRequest struct {
+	LogId      string
+	Start, End uint64
+}
+
+func (r *SnapshotRequest) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, msgpackHandle).Encode(r)
+	return buf.Bytes(), err
+}
+
+func (r *SnapshotRequest) Decode(buf []byte) error {
+	return codec.NewDecoder(bytes.NewReader(buf), msgpackHandle).Decode(r)
+}
+
+// recentSnapshots keeps the last snapshots received of each log, to serve
+// the peers which lost them.
+type recentSnapshots struct {
+	size      int
+	logs      map[string]*logSnapshots
+	requested map[string]recoveryRequest
+	lock      sync.Mutex
+}
+
+type logSnapshots struct {
+	latest    uint64
+	snapshots map[uint64]*protocol.SignedSnapshot
+	order     []uint64
+}
+
+type recoveryRequest struct {
+	end uint64
+	at  time.Time
+}
+
+func newRecentSnapshots(size int) *recentSnapshots {
+	return &recentSnapshots{
+		size:      size,
+		logs:      make(map[string]*logSnapshots),
+		requested: make(map[string]recoveryRequest),
+	}
+}
+
+func (r *recentSnapshots) Add(s *protocol.SignedSnapshot) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l, ok := r.logs[s.Snapshot.LogId]
+	if !ok {
+		l = &logSnapshots{snapshots: make(map[uint64]*protocol.SignedSnapshot)}
+		r.logs[s.Snapshot.LogId] = l
+	}
+	if s.Snapshot.Version > l.latest {
+		l.latest = s.Snapshot.Version
+	}
+	if _, ok := l.snapshots[s.Snapshot.Version]; ok {
+		return
+	}
+	if len(l.order) >= r.size {
+		delete(l.snapshots, l.order[0])
+		l.order = l.order[1:]
+	}
+	l.snapshots[s.Snapshot.Version] = s
+	l.order = append(l.order, s.Snapshot.Version)
+}
+
+// Latest returns the latest version seen of each log.
+func (r *recentSnapshots) Latest() map[string]uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	latest := make(map[string]uint64, len(r.logs))
+	for id, l := range r.logs {
+		latest[id] = l.latest
+	}
+	return latest
+}
+
+// Range returns the snapshots kept of a log from start to end, sorted
+// by version. The range comes from peers, so only the kept snapshots are
+// visited, whatever its size.
+func (r *recentSnapshots) Range(logId string, start, end uint64) []*protocol.SignedSnapshot {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	snapshots := make([]*protocol.SignedSnapshot, 0)
+	l, ok := r.logs[logId]
+	if !ok {
+		return snapshots
+	}
+	for _, v := range l.order {
+		if v >= start && v <= end {
+			snapshots = append(snapshots, l.snapshots[v])
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Snapshot.Version < snapshots[j].Snapshot.Version
+	})
+	return snapshots
+}
+
+// missing returns the range of versions of a log to recover up to the
+// latest version of a peer, and marks it as requested. Logs never seen
+// by the agent are not recovered: it follows them from the first batch
+// it receives.
+func (r *recentSnapshots) missing(logId string, remote uint64) (uint64, uint64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l, ok := r.logs[logId]
+	if !ok || remote <= l.latest {
+		return 0, 0, false
+	}
+	if req, ok := r.requested[logId]; ok && req.end >= remote && time.Since(req.at) < recoveryTimeout {
+		return 0, 0, false
+	}
+	start := l.latest + 1
+	if remote-start >= uint64(r.size) {
+		start = remote - uint64(r.size) + 1
+	}
+	r.requested[logId] = recoveryRequest{remote, time.Now()}
+	return start, remote, true
+}
+
+// LocalState returns the summary of the snapshots seen by the agent.
+func (a *Agent) LocalState() *AgentState {
+	state := &AgentState{Node: a.config.NodeName}
+	if a.recent != nil {
+		state.Latest = a.recent.Latest()
+	}
+	return state
+}
+
+// MergeRemoteState recovers the snapshots the agent is missing compared
+// to a peer. The snapshots of the default log are fetched from the
+// snapshot store, and the ones it does not have are requested to the peer.
+func (a *Agent) MergeRemoteState(remote *AgentState) {
+	if a.recent == nil || remote.Node == a.config.NodeName {
+		return
+	}
+	for logId, latest := range remote.Latest {
+		start, end, ok := a.recent.missing(logId, latest)
+		if !ok {
+			continue
+		}
+		log.Debugf("Agent is missing versions %d to %d of log %q seen by %s", start, end, logId, remote.Node)
+		go a.recover(remote.Node, logId, start, end)
+	}
+}
+
+func (a *Agent) recover(peer, logId string, start, end uint64) {
+	batch := &protocol.BatchSnapshots{Snapshots: make([]*protocol.SignedSnapshot, 0)}
+
+	// the snapshot store only keeps the default log
+	if logId == "" && a.SnapshotStore != nil {
+		for ; start <= end; start++ {
+			s, err := a.SnapshotStore.GetSnapshot(start)
+			if err != nil {
+				break
+			}
+			batch.Snapshots = append(batch.Snapshots, s)
+		}
+	}
+	if len(batch.Snapshots) > 0 {
+		a.publishRecovered(batch)
+	}
+	if start > end {
+		return
+	}
+
+	dst := a.topology.Find(peer)
+	if dst == nil {
+		log.Infof("Agent is unable to request the missing snapshots to unknown peer %s", peer)
+		return
+	}
+	req, err := (&SnapshotRequest{logId, start, end}).Encode()
+	if err != nil {
+		log.Infof("Agent is unable to encode a snapshot request: %v", err)
+		return
+	}
+	a.sendTo(dst, &Message{Kind: SnapshotRequestMessageType, From: a.Self, Payload: req})
+}
+
+// publishRecovered processes a batch of recovered snapshots as if it was
+// gossiped, but without forwarding it to other agents.
+func (a *Agent) publishRecovered(batch *protocol.BatchSnapshots) {
+	buf, err := batch.Encode()
+	if err != nil {
+		log.Infof("Agent is unable to encode the recovered snapshots: %v", err)
+		return
+	}
+	a.In.Publish(&Message{Kind: BatchMessageType, TTL: 0, Payload: buf})
+}
+
+// sendTo sends a message to a single peer.
+func (a *Agent) sendTo(dst *Peer, msg *Message) {
+	if err := a.signMessage(msg); err != nil {
+		log.Infof("Agent is unable to sign message to %s: %v", dst.Name, err)
+		return
+	}
+	wire, err := msg.Encode()
+	if err != nil {
+		log.Infof("Agent is unable to encode message to %s", dst.Name)
+		return
+	}
+	if a.gossip == nil {
+		return
+	}
+	if err := a.gossip.SendReliable(dst.Node(), wire); err != nil {
+		log.Infof("Agent is unable to send message to %s: %v", dst.Name, err)
+	}
+}
+
+// SnapshotRequestProcessor answers the snapshot requests of the peers
+// with the recent snapshots kept by the agent, and processes the
+// responses to its own requests. It must be subscribed to both kinds of
+// messages.
+type SnapshotRequestProcessor struct {
+	a       *Agent
+	metrics []prometheus.Collector
+	quitCh  chan bool
+	id      int
+
+	served prometheus.Counter
+}
+
+func NewSnapshotRequestProcessor(a *Agent) *SnapshotRequestProcessor {
+	p := &SnapshotRequestProcessor{
+		a:      a,
+		quitCh: make(chan bool),
+		served: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_recovered_snapshots_served_total",
+				Help: "Number of snapshots sent to peers missing them.",
+			},
+		),
+	}
+	p.metrics = []prometheus.Collector{p.served}
+	return p
+}
+
+func (p *SnapshotRequestProcessor) Kinds() []MessageType {
+	return []MessageType{SnapshotRequestMessageType, SnapshotResponseMessageType}
+}
+
+func (p *SnapshotRequestProcessor) Stop() {
+	close(p.quitCh)
+}
+
+func (p *SnapshotRequestProcessor) Metrics() []prometheus.Collector {
+	return p.metrics
+}
+
+func (p *SnapshotRequestProcessor) Subscribe(id int, ch <-chan *Message) {
+	p.id = id
+
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				switch msg.Kind {
+				case SnapshotRequestMessageType:
+					p.serve(msg)
+				case SnapshotResponseMessageType:
+					batch := new(protocol.BatchSnapshots)
+					if err := batch.Decode(msg.Payload); err != nil {
+						log.Infof("SnapshotRequestProcessor unable to decode response!. Dropping message.")
+						continue
+					}
+					p.a.publishRecovered(batch)
+				}
+			case <-p.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+func (p *SnapshotRequestProcessor) serve(msg *Message) {
+	if msg.From == nil || p.a.recent == nil {
+		return
+	}
+	req := new(SnapshotRequest)
+	if err := req.Decode(msg.Payload); err != nil {
+		log.Infof("SnapshotRequestProcessor unable to decode request!. Dropping message.")
+		return
+	}
+	snapshots := p.a.recent.Range(req.LogId, req.Start, req.End)
+	if len(snapshots) == 0 {
+		return
+	}
+	buf, err := (&protocol.BatchSnapshots{Snapshots: snapshots}).Encode()
+	if err != nil {
+		log.Infof("SnapshotRequestProcessor unable to encode batch: %v", err)
+		return
+	}
+	log.Debugf("SnapshotRequestProcessor sending %d snapshots to %s", len(snapshots), msg.From.Name)
+	p.served.Add(float64(len(snapshots)))
+	p.a.sendTo(msg.From, &Message{Kind: SnapshotResponseMessageType, From: p.a.Self, TTL: 0, Payload: buf})
+}
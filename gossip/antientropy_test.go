@@ -0,0 +1,156 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package gossip
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentSnapshots(t *testing.T) {
+
+	recent := newRecentSnapshots(4)
+	_, _, ok := recent.missing("", 10)
+	require.False(t, ok, "Logs never seen must not be recovered")
+
+	for _, s := range newTestSnapshots(0, 5) {
+		recent.Add(s)
+	}
+	require.Equal(t, map[string]uint64{"": 5}, recent.Latest())
+	require.Len(t, recent.Range("", 0, 5), 4, "Only the last snapshots must be kept")
+	require.Len(t, recent.Range("", 4, 10), 2)
+	require.Len(t, recent.Range("other", 0, 5), 0)
+	require.Len(t, recent.Range("", 0, math.MaxUint64), 4, "Ranges up to the last version must end")
+	snapshots := recent.Range("", 3, 4)
+	require.Len(t, snapshots, 2)
+	require.Equal(t, uint64(3), snapshots[0].Snapshot.Version, "Snapshots must be sorted by version")
+
+	_, _, ok = recent.missing("", 5)
+	require.False(t, ok, "Agents up to date must not recover snapshots")
+	start, end, ok := recent.missing("", 7)
+	require.True(t, ok)
+	require.Equal(t, []uint64{6, 7}, []uint64{start, end})
+	_, _, ok = recent.missing("", 7)
+	require.False(t, ok, "Requested snapshots must not be requested again")
+	start, end, ok = recent.missing("", 100)
+	require.True(t, ok)
+	require.Equal(t, []uint64{97, 100}, []uint64{start, end}, "Recovery must be bounded by the window")
+
+	state := &AgentState{Node: "node", Latest: recent.Latest()}
+	buf, err := state.Encode()
+	require.NoError(t, err)
+	decoded := new(AgentState)
+	require.NoError(t, decoded.Decode(buf))
+	require.Equal(t, state, decoded)
+}
+
+type versionStore struct {
+	SnapshotStore
+	count uint64
+}
+
+func (s versionStore) GetSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
+	if version >= s.count {
+		return nil, fmt.Errorf("snapshot %d not found", version)
+	}
+	return newTestSnapshots(version, version)[0], nil
+}
+
+func newAntiEntropyTestAgent(t *testing.T, name, addr string, join ...string) *Agent {
+	conf := DefaultConfig()
+	conf.NodeName = name
+	conf.Role = "monitor"
+	conf.BindAddr = addr
+	conf.StartJoin = join
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	return a
+}
+
+func TestMergeRemoteStateFromStore(t *testing.T) {
+
+	a := newAntiEntropyTestAgent(t, "behind", "127.0.0.1:12347")
+	a.SnapshotStore = versionStore{count: 6}
+	for _, s := range newTestSnapshots(0, 2) {
+		a.recent.Add(s)
+	}
+	ts := &testSubscriber{}
+	a.In.Subscribe(BatchMessageType, ts, 1)
+
+	a.MergeRemoteState(&AgentState{Node: "ahead", Latest: map[string]uint64{"": 5}})
+
+	select {
+	case m := <-ts.ch:
+		require.Equal(t, 0, m.TTL, "Recovered snapshots must not be gossiped")
+		batch := new(protocol.BatchSnapshots)
+		require.NoError(t, batch.Decode(m.Payload))
+		require.Len(t, batch.Snapshots, 3)
+		require.Equal(t, uint64(3), batch.Snapshots[0].Snapshot.Version)
+	case <-time.After(1 * time.Second):
+		t.Fatal("The missing snapshots were not recovered from the store")
+	}
+}
+
+func TestMergeRemoteStateFromPeer(t *testing.T) {
+
+	ahead := newAntiEntropyTestAgent(t, "ahead", "127.0.0.1:12348")
+	ahead.Start()
+	defer ahead.Shutdown()
+	for _, s := range newTestSnapshots(0, 5) {
+		ahead.recent.Add(s)
+	}
+	p := NewSnapshotRequestProcessor(ahead)
+	ahead.In.Subscribe(SnapshotRequestMessageType, p, 1)
+	defer p.Stop()
+
+	behind := newAntiEntropyTestAgent(t, "behind", "127.0.0.1:12349", "127.0.0.1:12348")
+	behind.Start()
+	defer behind.Shutdown()
+	for _, s := range newTestSnapshots(0, 2) {
+		behind.recent.Add(s)
+	}
+	ts := &testSubscriber{}
+	behind.In.Subscribe(BatchMessageType, ts, 1)
+	bp := NewSnapshotRequestProcessor(behind)
+	behind.In.Subscribe(SnapshotResponseMessageType, bp, 1)
+	defer bp.Stop()
+
+	// wait for the agents to know each other
+	for i := 0; behind.topology.Find("ahead") == nil || ahead.topology.Find("behind") == nil; i++ {
+		require.True(t, i < 100, "The agents must join")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	behind.MergeRemoteState(ahead.LocalState())
+
+	select {
+	case m := <-ts.ch:
+		batch := new(protocol.BatchSnapshots)
+		require.NoError(t, batch.Decode(m.Payload))
+		require.Len(t, batch.Snapshots, 3, "The peer must send the missing snapshots")
+		require.Equal(t, uint64(5), batch.Snapshots[2].Snapshot.Version)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The missing snapshots were not recovered from the peer")
+	}
+}
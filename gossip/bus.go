@@ -45,6 +45,8 @@ type Subscribers []chan *Message
 // gossip Messages
 type MessageBus struct {
 	pool [MAXMESSAGEID]Subscribers
+	ids  [MAXMESSAGEID][]int
+	last int
 	rm   sync.RWMutex
 }
 
@@ -76,7 +78,7 @@ func (eb *MessageBus) Publish(msg *Message) error {
 
 // Subscribe add a subscriber to the its correspondant pool.
 // Returns the subscription id needed for unsubscribe
-func (eb *MessageBus) Subscribe(t MessageType, s Subscriber, size int) {
+func (eb *MessageBus) Subscribe(t MessageType, s Subscriber, size int) int {
 	eb.rm.Lock()
 	defer eb.rm.Unlock()
 	ch := make(chan *Message, size)
@@ -86,15 +88,25 @@ func (eb *MessageBus) Subscribe(t MessageType, s Subscriber, size int) {
 	} else {
 		eb.pool[t] = append(Subscribers{}, ch)
 	}
+	eb.last++
+	eb.ids[t] = append(eb.ids[t], eb.last)
 
-	s.Subscribe(len(eb.pool[t]), ch)
+	s.Subscribe(eb.last, ch)
+	return eb.last
 }
 
-// Unsubscribe a subscriber by its id
+// Unsubscribe a subscriber by its id. The messages already
+// published to the subscriber are not withdrawn.
 func (eb *MessageBus) Unsubscribe(t MessageType, id int) {
 	eb.rm.Lock()
-	eb.pool[t] = append(eb.pool[t][:id], eb.pool[t][id+1:]...)
-	eb.rm.Unlock()
+	defer eb.rm.Unlock()
+	for i, sid := range eb.ids[t] {
+		if sid == id {
+			eb.pool[t] = append(eb.pool[t][:i], eb.pool[t][i+1:]...)
+			eb.ids[t] = append(eb.ids[t][:i], eb.ids[t][i+1:]...)
+			return
+		}
+	}
 }
 
 // Implements a message queue in which
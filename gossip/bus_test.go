@@ -45,6 +45,17 @@ func TestMessageBus(t *testing.T) {
 	mb.Publish(m1)
 	m2 := <-ts.ch
 	require.Equal(t, m2, m1, "Messages should match")
+
+	var other testSubscriber
+	id := mb.Subscribe(BatchMessageType, &other, 1)
+	mb.Unsubscribe(BatchMessageType, ts.id)
+	mb.Publish(m1)
+	m2 = <-other.ch
+	require.Equal(t, m2, m1, "Messages should match")
+	require.Equal(t, 0, len(ts.ch), "Unsubscribed subscribers must not receive messages")
+
+	mb.Unsubscribe(BatchMessageType, id)
+	require.Equal(t, NoSubscribersFound, mb.Publish(m1))
 }
 
 type testProducer struct {
@@ -0,0 +1,276 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/snapshotstore"
+)
+
+// ErrInconsistentCheckpoint is returned by Backfill when the snapshots of
+// the snapshot store are not consistent with the checkpoint of the agent.
+var ErrInconsistentCheckpoint = errors.New("snapshot store inconsistent with the checkpoint")
+
+// Checkpoint is the last snapshot of a log verified by an agent. It is
+// persisted so the agent resumes the verification where it stopped
+// after a restart.
+type Checkpoint struct {
+	Version   uint64
+	Snapshot  *protocol.SignedSnapshot
+	Timestamp int64 // milliseconds since the epoch of the last update
+}
+
+// CheckpointStore keeps the checkpoint of each log in a local file, or
+// only in memory if it has no path.
+type CheckpointStore struct {
+	path        string
+	checkpoints map[string]*Checkpoint
+	// pending keeps the ranges of versions of each log processed past a
+	// gap after the checkpoint, sorted and merged.
+	pending map[string][]processedRange
+	lock    sync.Mutex
+}
+
+// processedRange is a range of processed versions [start, end], along
+// with the snapshot of its end.
+type processedRange struct {
+	start, end uint64
+	last       *protocol.SignedSnapshot
+}
+
+// OpenCheckpointStore loads the checkpoints of the file at path. The file
+// is created with the first checkpoint saved. An empty path keeps the
+// checkpoints in memory only.
+func OpenCheckpointStore(path string) (*CheckpointStore, error) {
+	c := &CheckpointStore{
+		path:        path,
+		checkpoints: make(map[string]*Checkpoint),
+		pending:     make(map[string][]processedRange),
+	}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.checkpoints); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Get returns the checkpoint of a log, or nil if there is none.
+func (c *CheckpointStore) Get(logId string) *Checkpoint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.checkpoints[logId]
+}
+
+// Save makes a verified snapshot the checkpoint of its log, if it is
+// newer than the current checkpoint.
+func (c *CheckpointStore) Save(s *protocol.SignedSnapshot) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	last, ok := c.checkpoints[s.Snapshot.LogId]
+	if ok && last.Version >= s.Snapshot.Version {
+		return nil
+	}
+	return c.save(s)
+}
+
+// Advance records that the versions from the given one up to the
+// version of s were processed, and moves the checkpoint of the log of s
+// to the highest version processed with no gap since the checkpoint.
+// Without a checkpoint, s becomes the checkpoint.
+//
+// The versions processed past a gap are kept in memory until the gap is
+// processed, so the checkpoint never skips the versions still being
+// processed or left out by sampling, which are backfilled again after a
+// restart.
+func (c *CheckpointStore) Advance(from uint64, s *protocol.SignedSnapshot) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	logId, to := s.Snapshot.LogId, s.Snapshot.Version
+	if from > to {
+		from = to
+	}
+	last, ok := c.checkpoints[logId]
+	if ok && from > last.Version+1 {
+		c.pending[logId] = addProcessedRange(c.pending[logId], processedRange{from, to, s})
+		return nil
+	}
+	if ok && last.Version >= to {
+		return nil
+	}
+
+	// the ranges processed past the gap may follow the new checkpoint
+	ranges := c.pending[logId]
+	for len(ranges) > 0 && ranges[0].start <= to+1 {
+		if ranges[0].end > to {
+			to, s = ranges[0].end, ranges[0].last
+		}
+		ranges = ranges[1:]
+	}
+	if len(ranges) == 0 {
+		delete(c.pending, logId)
+	} else {
+		c.pending[logId] = ranges
+	}
+	return c.save(s)
+}
+
+// addProcessedRange adds a range to the sorted ranges, merging the ones
+// which overlap or are adjacent.
+func addProcessedRange(ranges []processedRange, r processedRange) []processedRange {
+	merged := make([]processedRange, 0, len(ranges)+1)
+	for _, p := range ranges {
+		switch {
+		case p.end+1 < r.start:
+			merged = append(merged, p)
+		case r.end+1 < p.start:
+			merged = append(merged, r)
+			r = p
+		default:
+			if p.start < r.start {
+				r.start = p.start
+			}
+			if p.end > r.end {
+				r.end, r.last = p.end, p.last
+			}
+		}
+	}
+	return append(merged, r)
+}
+
+// save makes s the checkpoint of its log and persists the checkpoints.
+func (c *CheckpointStore) save(s *protocol.SignedSnapshot) error {
+	c.checkpoints[s.Snapshot.LogId] = &Checkpoint{
+		Version:   s.Snapshot.Version,
+		Snapshot:  s,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Backfill recovers the snapshots of the default log published while the
+// agent was down. It verifies a single consistency proof from the
+// checkpoint to the latest snapshot of the snapshot store and returns the
+// missed snapshots, up to the backfill limit, to be processed as a batch.
+// It returns nil if there is no checkpoint or nothing was missed.
+//
+// The checkpoint is not moved: the processors of the agent save it once
+// they processed the snapshots, so the ones past the backfill limit or
+// lost before being processed are backfilled again on the next start.
+//
+// The snapshot store only keeps the snapshots of the default log, so the
+// other logs are not backfilled.
+func (a *Agent) Backfill() (*protocol.BatchSnapshots, error) {
+	if a.Checkpoints == nil {
+		return nil, nil
+	}
+	checkpoint := a.Checkpoints.Get("")
+	if checkpoint == nil {
+		return nil, nil
+	}
+
+	latest, err := a.SnapshotStore.Latest()
+	if err == snapshotstore.ErrSnapshotNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if latest.Snapshot.Version <= checkpoint.Version {
+		return nil, nil
+	}
+
+	keys, err := a.ServerKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := latest.VerifyKeySet(keys); err != nil {
+		return nil, err
+	}
+
+	hasherF, err := a.Qed.HasherF()
+	if err != nil {
+		return nil, err
+	}
+	first, last := checkpoint.Snapshot.Snapshot, latest.Snapshot
+	proof, err := a.Qed.LogIncremental(first.LogId, first.Version, last.Version)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Qed.VerifyIncremental(proof, first, last, hasherF()) {
+		log.Infof("Agent is unable to verify the consistency between the checkpoint %d and the snapshot %d", first.Version, last.Version)
+		return nil, ErrInconsistentCheckpoint
+	}
+	log.Infof("Agent verified the consistency of the %d versions missed since the checkpoint %d", last.Version-first.Version, first.Version)
+
+	end := last.Version
+	if limit := uint64(a.config.BackfillLimit); end-first.Version > limit {
+		end = first.Version + limit
+		log.Infof("Agent backfills versions up to %d, %d versions will not be processed", end, last.Version-end)
+	}
+
+	batch := &protocol.BatchSnapshots{Snapshots: make([]*protocol.SignedSnapshot, 0)}
+	for v := first.Version + 1; v <= end; v++ {
+		s := latest
+		if v != last.Version {
+			s, err = a.SnapshotStore.GetSnapshot(v)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.VerifyKeySet(keys); err != nil {
+				return nil, err
+			}
+		}
+		batch.Snapshots = append(batch.Snapshots, s)
+	}
+
+	return batch, nil
+}
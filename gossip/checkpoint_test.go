@@ -0,0 +1,146 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package gossip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-checkpoint-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent", "checkpoint.json")
+
+	checkpoints, err := OpenCheckpointStore(path)
+	require.NoError(t, err, "A missing checkpoint file must be created on save")
+	require.Nil(t, checkpoints.Get(""))
+
+	snapshots := newTestSnapshots(0, 5)
+	require.NoError(t, checkpoints.Save(snapshots[5]))
+	require.NoError(t, checkpoints.Save(snapshots[3]))
+	require.NoError(t, checkpoints.Save(&protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: 1, LogId: "other"}}))
+
+	checkpoints, err = OpenCheckpointStore(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), checkpoints.Get("").Version, "Checkpoints must only move forward")
+	require.Equal(t, uint64(5), checkpoints.Get("").Snapshot.Snapshot.Version)
+	require.Equal(t, uint64(1), checkpoints.Get("other").Version, "Each log has its own checkpoint")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = OpenCheckpointStore(path)
+	require.Error(t, err, "Corrupted checkpoint files must be rejected")
+}
+
+type latestStore struct {
+	SnapshotStore
+	latest uint64
+}
+
+func (s latestStore) Latest() (*protocol.SignedSnapshot, error) {
+	return newTestSnapshots(s.latest, s.latest)[0], nil
+}
+
+func (s latestStore) GetSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
+	return nil, fmt.Errorf("snapshot %d not found", version)
+}
+
+func TestMemoryCheckpointStore(t *testing.T) {
+
+	checkpoints, err := OpenCheckpointStore("")
+	require.NoError(t, err)
+	require.NoError(t, checkpoints.Save(newTestSnapshots(3, 3)[0]))
+	require.Equal(t, uint64(3), checkpoints.Get("").Version, "Checkpoints without path must be kept in memory")
+}
+
+func TestBackfill(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-checkpoint-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "monitor"
+	conf.BindAddr = "127.0.0.1:12345"
+	conf.DataPath = dir
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	a.SnapshotStore = latestStore{latest: 9}
+
+	batch, err := a.Backfill()
+	require.NoError(t, err)
+	require.Nil(t, batch, "Agents without checkpoint have nothing to backfill")
+
+	require.NoError(t, a.Checkpoints.Save(newTestSnapshots(9, 9)[0]))
+	_, err = os.Stat(filepath.Join(dir, "checkpoints.json"))
+	require.NoError(t, err, "Checkpoints must be kept in the data path")
+	batch, err = a.Backfill()
+	require.NoError(t, err)
+	require.Nil(t, batch, "Agents up to date have nothing to backfill")
+
+	a.SnapshotStore = latestStore{latest: 20}
+	_, err = a.Backfill()
+	require.Error(t, err, "Missed snapshots cannot be verified without the server keys")
+	require.Equal(t, uint64(9), a.Checkpoints.Get("").Version, "The checkpoint must not move on errors")
+}
+
+func TestCheckpointAdvance(t *testing.T) {
+
+	checkpoints, err := OpenCheckpointStore("")
+	require.NoError(t, err)
+	snapshots := newTestSnapshots(0, 20)
+
+	require.NoError(t, checkpoints.Advance(0, snapshots[2]))
+	require.Equal(t, uint64(2), checkpoints.Get("").Version, "The first versions processed must be the checkpoint")
+
+	require.NoError(t, checkpoints.Advance(5, snapshots[5]))
+	require.NoError(t, checkpoints.Advance(9, snapshots[10]))
+	require.NoError(t, checkpoints.Advance(7, snapshots[7]))
+	require.Equal(t, uint64(2), checkpoints.Get("").Version, "The checkpoint must not skip unprocessed versions")
+
+	require.NoError(t, checkpoints.Advance(3, snapshots[4]))
+	require.Equal(t, uint64(5), checkpoints.Get("").Version, "The checkpoint must reach the processed versions which follow")
+	require.NoError(t, checkpoints.Advance(6, snapshots[6]))
+	require.Equal(t, uint64(7), checkpoints.Get("").Version)
+	require.NoError(t, checkpoints.Advance(8, snapshots[8]))
+	require.Equal(t, uint64(10), checkpoints.Get("").Version)
+	require.Equal(t, uint64(10), checkpoints.Get("").Snapshot.Snapshot.Version)
+
+	require.NoError(t, checkpoints.Advance(4, snapshots[9]))
+	require.Equal(t, uint64(10), checkpoints.Get("").Version, "Checkpoints must only move forward")
+	require.Empty(t, checkpoints.pending[""])
+}
+
+func TestAddProcessedRange(t *testing.T) {
+
+	var ranges []processedRange
+	for _, r := range [][2]uint64{{10, 12}, {2, 3}, {20, 20}, {5, 6}, {13, 15}, {4, 4}} {
+		ranges = addProcessedRange(ranges, processedRange{start: r[0], end: r[1]})
+	}
+	require.Equal(t, []processedRange{{start: 2, end: 6}, {start: 10, end: 15}, {start: 20, end: 20}}, ranges)
+}
@@ -38,6 +38,9 @@ func DefaultConfig() *Config {
 		ProcessInterval:     1 * time.Second,
 		CacheSize:           1 << 20,
 		MaxSenders:          10,
+		AlertTTL:            3,
+		BackfillLimit:       1000,
+		AntiEntropyWindow:   1024,
 	}
 }
 
@@ -66,6 +69,10 @@ type Config struct {
 	// API to enable mterics collectors retrieve them
 	MetricsAddr string `desc:"Address ip:port to expose metrics"`
 
+	// AdminAddr is the address where the agent exposes its admin API,
+	// see adminHandler. If empty, the API is disabled.
+	AdminAddr string `desc:"Address ip:port to expose the admin API, empty to disable it"`
+
 	// LeaveOnTerm controls if the agent does a graceful leave when receiving
 	// the TERM signal. Defaults false. This can be changed on reload.
 	LeaveOnTerm bool `desc:"Controls if the agent does a graceful leave when receiving the TERM signal"`
@@ -118,6 +125,75 @@ type Config struct {
 	// Cache size in bytes to store agent temporal objects.
 	// This cache will evict old objects by default
 	CacheSize int `desc:"Cache size in bytes to store agent temporal objects"`
+
+	// TrustedKeys is the list of public key files, in PEM or OpenSSH
+	// format, of the servers whose snapshots the agent trusts. Batches
+	// with snapshots not signed by any of them are dropped.
+	TrustedKeys []string `desc:"Public key file list key1.pub,key2.pem... of the servers whose snapshots are trusted"`
+
+	// InsecureSkipVerify makes the agent process the snapshots without
+	// verifying their signatures when it has no TrustedKeys. Otherwise,
+	// agents which process snapshots refuse to start without them.
+	InsecureSkipVerify bool `desc:"Process the snapshots without verifying their signatures if there are no trusted keys. Insecure, for testing only"`
+
+	// PrivateKeyPath is the private key the agent signs its alerts,
+	// evidence and gossip messages with. If empty, a new key is generated
+	// on every start, so the agent cannot have a join token.
+	PrivateKeyPath string `desc:"Path to the private key to sign the alerts, evidence and messages of this agent"`
+
+	// AlertTTL is the number of hops alerts and evidence are forwarded
+	// through the gossip network.
+	AlertTTL int `desc:"Number of hops alerts and evidence are forwarded through the gossip network"`
+
+	// EvidencePath is the directory where the alerts and evidence raised
+	// by the agents are stored. If empty, the evidence directory of
+	// DataPath is used.
+	EvidencePath string `desc:"Directory where the alerts and evidence received are stored, evidence in the data path if empty"`
+
+	// DataPath is the directory where the agent keeps its state, like its
+	// checkpoints, unless their own paths are set. Without it, the state
+	// is only kept in memory.
+	DataPath string `desc:"Directory where the agent keeps its state, only kept in memory if empty"`
+
+	// CheckpointPath is the file where the agent keeps the last snapshot
+	// it verified. If empty, checkpoints.json in DataPath is used, and
+	// without DataPath the checkpoints are only kept in memory.
+	CheckpointPath string `desc:"File where the agent keeps the last snapshot verified, checkpoints.json in the data path if empty"`
+
+	// BackfillLimit is the maximum number of snapshots missed while the
+	// agent was down it processes on startup.
+	BackfillLimit int `desc:"Maximum number of missed snapshots processed on startup"`
+
+	// AntiEntropyWindow is the number of recent snapshots of each log the
+	// agent keeps to send to the peers which lost them. Agents compare the
+	// latest version they have seen in the memberlist push/pull and
+	// recover the missing snapshots. Zero disables the recovery.
+	AntiEntropyWindow int `desc:"Number of recent snapshots per log kept to recover the ones lost by peers, 0 to disable"`
+
+	// KeyringPath is the file with the keys to encrypt the gossip
+	// traffic, see LoadKeyring. If empty, the traffic is not encrypted.
+	KeyringPath string `desc:"File with the keys to encrypt the gossip traffic, the primary key first"`
+
+	// JoinToken is the token, issued with one of the admission keys,
+	// which admits this agent with its role and the public key of
+	// PrivateKeyPath in the gossip network.
+	JoinToken string `desc:"Token which admits this agent with its role in the gossip network"`
+
+	// AdmissionKeys is the list of public key files, in PEM or OpenSSH
+	// format, whose join tokens are accepted. If empty, any node may join
+	// the gossip network with any role.
+	AdmissionKeys []string `desc:"Public key file list key1.pub,key2.pem... of the keys issuing the join tokens of the peers"`
+
+	// WitnessKeys is the list of public key files, in PEM or OpenSSH
+	// format, of the witnesses whose cosignatures the agent accepts. If
+	// empty, the cosignatures gossiped are forwarded without checking.
+	WitnessKeys []string `desc:"Public key file list key1.pub,key2.pem... of the witnesses whose cosignatures are accepted"`
+
+	// AgentKeys is the list of public key files, in PEM or OpenSSH
+	// format, of the agents whose alerts and evidence are accepted. It is
+	// only used without AdmissionKeys, as the join tokens carry the key
+	// of each agent. If both are empty, alerts and evidence are dropped.
+	AgentKeys []string `desc:"Public key file list key1.pub,key2.pem... of the agents whose alerts and evidence are accepted"`
 }
 
 // AddrParts returns the parts of the BindAddr that should be
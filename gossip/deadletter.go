@@ -0,0 +1,166 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned when the dead letter queue has no
+// task with the requested id.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a task which exhausted its retries. The kind and payload
+// of the job are kept so the task can be rebuilt and replayed.
+type DeadLetter struct {
+	Id        uint64
+	Kind      string `json:",omitempty"`
+	Payload   []byte `json:",omitempty"`
+	Priority  Priority
+	Attempts  int
+	Error     string
+	Timestamp int64 // milliseconds since the epoch of the last attempt
+}
+
+// DeadLetterQueue keeps the failed tasks in a local file, up to a limit
+// after which the oldest ones are dropped. Without a path, the tasks are
+// only kept in memory.
+type DeadLetterQueue struct {
+	path    string
+	limit   int
+	letters []*DeadLetter
+	nextId  uint64
+	lock    sync.Mutex
+}
+
+// OpenDeadLetterQueue loads the dead letters of the file at path. The
+// file is created with the first dead letter.
+func OpenDeadLetterQueue(path string, limit int) (*DeadLetterQueue, error) {
+	q := &DeadLetterQueue{
+		path:    path,
+		limit:   limit,
+		letters: make([]*DeadLetter, 0),
+		nextId:  1,
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.letters); err != nil {
+		return nil, fmt.Errorf("invalid dead letter file %s: %v", path, err)
+	}
+	for _, l := range q.letters {
+		if l.Id >= q.nextId {
+			q.nextId = l.Id + 1
+		}
+	}
+	return q, nil
+}
+
+// Push adds a failed job to the queue.
+func (q *DeadLetterQueue) Push(j *Job, cause error) (*DeadLetter, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	l := &DeadLetter{
+		Id:        q.nextId,
+		Kind:      j.Kind,
+		Payload:   j.Payload,
+		Priority:  j.Priority,
+		Attempts:  j.attempts,
+		Error:     cause.Error(),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	q.nextId++
+	q.letters = append(q.letters, l)
+	if q.limit > 0 && len(q.letters) > q.limit {
+		q.letters = q.letters[len(q.letters)-q.limit:]
+	}
+	return l, q.save()
+}
+
+// List returns the dead letters, the oldest first.
+func (q *DeadLetterQueue) List() []*DeadLetter {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	letters := make([]*DeadLetter, len(q.letters))
+	copy(letters, q.letters)
+	return letters
+}
+
+// Get returns the dead letter with the given id.
+func (q *DeadLetterQueue) Get(id uint64) (*DeadLetter, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, l := range q.letters {
+		if l.Id == id {
+			return l, nil
+		}
+	}
+	return nil, ErrDeadLetterNotFound
+}
+
+// Remove deletes the dead letter with the given id.
+func (q *DeadLetterQueue) Remove(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, l := range q.letters {
+		if l.Id == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return q.save()
+		}
+	}
+	return ErrDeadLetterNotFound
+}
+
+// Len returns the number of dead letters.
+func (q *DeadLetterQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.letters)
+}
+
+func (q *DeadLetterQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(q.letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
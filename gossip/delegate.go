@@ -82,6 +82,11 @@ func (d *agentDelegate) NotifyMsg(msg []byte) {
 	err := m.Decode(msg)
 	if err != nil {
 		log.Infof("Agent Deletage unable to decode gossip message!: %v", err)
+		return
+	}
+	if err := d.agent.checkOrigin(m); err != nil {
+		log.Infof("Agent Delegate dropping gossip message: %v", err)
+		return
 	}
 	d.agent.In.Publish(m)
 }
@@ -101,11 +106,26 @@ func (d *agentDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 // data can be sent here. See MergeRemoteState as well. The `join`
 // boolean indicates this is for a join instead of a push/pull.
 func (d *agentDelegate) LocalState(join bool) []byte {
-	return []byte{}
+	state, err := d.agent.LocalState().Encode()
+	if err != nil {
+		log.Infof("Agent Delegate unable to encode local state: %v", err)
+		return []byte{}
+	}
+	return state
 }
 
 // MergeRemoteState is invoked after a TCP Push/Pull. This is the
 // state received from the remote side and is the result of the
 // remote side's LocalState call. The 'join'
 // boolean indicates this is for a join instead of a push/pull.
-func (d *agentDelegate) MergeRemoteState(buf []byte, join bool) {}
+func (d *agentDelegate) MergeRemoteState(buf []byte, join bool) {
+	if len(buf) == 0 {
+		return
+	}
+	state := new(AgentState)
+	if err := state.Decode(buf); err != nil {
+		log.Infof("Agent Delegate unable to decode remote state: %v", err)
+		return
+	}
+	d.agent.MergeRemoteState(state)
+}
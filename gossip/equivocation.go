@@ -0,0 +1,100 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+)
+
+type rootKey struct {
+	logId   string
+	version uint64
+}
+
+// SignedRootIndex remembers the last signed snapshots seen by an agent
+// for each log and version, to detect servers signing different roots
+// for the same version.
+//
+// The index holds at most size snapshots, evicting the oldest ones.
+type SignedRootIndex struct {
+	size  int
+	roots map[rootKey]*protocol.SignedSnapshot
+	order []rootKey
+	lock  sync.Mutex
+}
+
+func NewSignedRootIndex(size int) *SignedRootIndex {
+	return &SignedRootIndex{
+		size:  size,
+		roots: make(map[rootKey]*protocol.SignedSnapshot),
+	}
+}
+
+// Add indexes a signed snapshot. If another snapshot with a different
+// history digest was indexed for the same version, it returns the
+// evidence of the equivocation and keeps the first snapshot indexed.
+//
+// The caller must verify the signature of the snapshot before adding it.
+func (i *SignedRootIndex) Add(s *protocol.SignedSnapshot) *protocol.Equivocation {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	key := rootKey{s.Snapshot.LogId, s.Snapshot.Version}
+	if seen, ok := i.roots[key]; ok {
+		return protocol.NewEquivocation(seen, s)
+	}
+
+	if i.size > 0 && len(i.order) >= i.size {
+		delete(i.roots, i.order[0])
+		i.order = i.order[1:]
+	}
+	i.roots[key] = s
+	i.order = append(i.order, key)
+	return nil
+}
+
+// Get returns the indexed snapshot of a version of a log, if any.
+func (i *SignedRootIndex) Get(logId string, version uint64) (*protocol.SignedSnapshot, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	s, ok := i.roots[rootKey{logId, version}]
+	return s, ok
+}
+
+// WriteEvidence stores the evidence of an equivocation in a new file of
+// the directory dir, creating it if needed, and returns its path.
+func WriteEvidence(dir string, e *protocol.Equivocation) (string, error) {
+	data, err := e.Encode()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("equivocation-%d-%d.json", e.Version, time.Now().UnixNano())
+	if e.LogId != "" {
+		name = fmt.Sprintf("equivocation-%s-%d-%d.json", e.LogId, e.Version, time.Now().UnixNano())
+	}
+	path := filepath.Join(dir, name)
+	return path, ioutil.WriteFile(path, data, 0644)
+}
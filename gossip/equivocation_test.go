@@ -0,0 +1,65 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedRootIndex(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	signed := func(version uint64, history byte) *protocol.SignedSnapshot {
+		s, err := protocol.SignSnapshot(signer, &protocol.Snapshot{HistoryDigest: []byte{history}, HyperDigest: []byte{0x0}, Version: version}, time.Now())
+		require.NoError(t, err)
+		return s
+	}
+
+	index := NewSignedRootIndex(2)
+	require.Nil(t, index.Add(signed(0, 0x0)))
+	require.Nil(t, index.Add(signed(0, 0x0)), "The same root must not be an equivocation")
+	require.Nil(t, index.Add(signed(1, 0x1)))
+
+	found := index.Add(signed(1, 0x2))
+	require.NotNil(t, found, "A different root for the same version must be an equivocation")
+	require.Equal(t, []byte{0x1}, []byte(found.First.Snapshot.HistoryDigest), "The first seen snapshot must be kept")
+	require.Equal(t, []byte{0x2}, []byte(found.Second.Snapshot.HistoryDigest))
+
+	require.Nil(t, index.Add(signed(2, 0x2)))
+	_, ok := index.Get("", 0)
+	require.False(t, ok, "The oldest root must be evicted")
+	require.Nil(t, index.Add(signed(0, 0x3)), "Evicted roots are not compared")
+
+	dir, err := ioutil.TempDir("", "qed-evidence-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path, err := WriteEvidence(dir, found)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	evidence := new(protocol.Equivocation)
+	require.NoError(t, evidence.Decode(data))
+	require.Equal(t, found.Version, evidence.Version)
+
+}
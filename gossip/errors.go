@@ -19,3 +19,5 @@ import "errors"
 
 var ChTimedOut error = errors.New("Timeout sending data to channel")
 var NoSubscribersFound error = errors.New("No subscribers found")
+var ErrProcessorRegistered error = errors.New("A processor with the same name is already registered")
+var ErrProcessorFactoryNotFound error = errors.New("No processor factory found")
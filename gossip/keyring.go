@@ -0,0 +1,157 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// GossipKeySize is the size of the keys generated to encrypt the gossip
+// traffic, which selects AES-256.
+const GossipKeySize = 32
+
+var ErrKeyringDisabled = errors.New("the gossip traffic is not encrypted")
+
+// GenerateGossipKey returns a new random key to encrypt the gossip
+// traffic, base64 encoded.
+func GenerateGossipKey() (string, error) {
+	key := make([]byte, GossipKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// DecodeGossipKey decodes a base64 encoded key and checks its size is
+// one of the AES key sizes.
+func DecodeGossipKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := memberlist.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadKeyring reads the keys to encrypt the gossip traffic from a file
+// with a JSON list of base64 encoded keys. The first one is the primary
+// key, used to encrypt the messages, and the rest are only used to
+// decrypt them while the keys are rotated.
+func LoadKeyring(path string) (*memberlist.Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, errors.New("the keyring has no keys")
+	}
+	keys := make([][]byte, 0, len(encoded))
+	for _, s := range encoded {
+		key, err := DecodeGossipKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+// SaveKeyring writes the keys of the keyring to a file in the format read
+// by LoadKeyring.
+func SaveKeyring(path string, keyring *memberlist.Keyring) error {
+	data, err := json.MarshalIndent(EncodeKeys(keyring), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// EncodeKeys returns the keys of the keyring base64 encoded, the primary
+// key first.
+func EncodeKeys(keyring *memberlist.Keyring) []string {
+	keys := keyring.GetKeys()
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(key))
+	}
+	return encoded
+}
+
+// The keys of a running agent are rotated in three steps through its
+// admin API, see KeyringHandler, each of them run on every agent before
+// the next one: the new key is installed, then it is used as primary key
+// and, at last, the old key is removed.
+
+// InstallKey adds a key to the keyring of the agent, to decrypt the
+// messages encrypted with it.
+func (a *Agent) InstallKey(key string) error {
+	return a.updateKeyring(key, (*memberlist.Keyring).AddKey)
+}
+
+// UseKey makes an installed key the primary key of the agent, to encrypt
+// the messages it sends.
+func (a *Agent) UseKey(key string) error {
+	return a.updateKeyring(key, (*memberlist.Keyring).UseKey)
+}
+
+// RemoveKey removes a key, which must not be the primary one, from the
+// keyring of the agent.
+func (a *Agent) RemoveKey(key string) error {
+	return a.updateKeyring(key, (*memberlist.Keyring).RemoveKey)
+}
+
+// ListKeys returns the keys of the agent, the primary key first.
+func (a *Agent) ListKeys() []string {
+	if a.keyring == nil {
+		return []string{}
+	}
+	return EncodeKeys(a.keyring)
+}
+
+func (a *Agent) updateKeyring(key string, update func(*memberlist.Keyring, []byte) error) error {
+	if a.keyring == nil {
+		return ErrKeyringDisabled
+	}
+	k, err := DecodeGossipKey(key)
+	if err != nil {
+		return err
+	}
+	if err := update(a.keyring, k); err != nil {
+		return err
+	}
+	return SaveKeyring(a.config.KeyringPath, a.keyring)
+}
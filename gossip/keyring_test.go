@@ -0,0 +1,63 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyringRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	old, err := GenerateGossipKey()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["`+old+`"]`), 0600))
+
+	a, err := NewAgent(SetNodeName("auditor0"), SetBindAddr("127.0.0.1:12354"), SetKeyring(path))
+	require.NoError(t, err)
+	require.Equal(t, []string{old}, a.ListKeys())
+
+	key, err := GenerateGossipKey()
+	require.NoError(t, err)
+	require.Error(t, a.UseKey(key), "Keys must be installed before being used")
+	require.NoError(t, a.InstallKey(key))
+	require.NoError(t, a.UseKey(key))
+	require.Error(t, a.RemoveKey(key), "The primary key must not be removed")
+	require.NoError(t, a.RemoveKey(old))
+	require.Equal(t, []string{key}, a.ListKeys())
+
+	keyring, err := LoadKeyring(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{key}, EncodeKeys(keyring), "The keyring must be saved on every change")
+
+	require.Error(t, a.InstallKey("c2hvcnQ="), "Keys must have an AES key size")
+
+	plain, err := NewAgent(SetNodeName("auditor1"), SetBindAddr("127.0.0.1:12355"))
+	require.NoError(t, err)
+	require.Empty(t, plain.ListKeys())
+	require.Error(t, plain.InstallKey(key), "Agents without a keyring must not install keys")
+
+}
@@ -18,6 +18,7 @@ package gossip
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/hashicorp/go-msgpack/codec"
 )
@@ -32,15 +33,42 @@ const (
 type MessageType uint8
 
 const (
-	BatchMessageType MessageType = iota // Contains a protocol.BatchSnapshots
+	BatchMessageType            MessageType = iota // Contains a protocol.BatchSnapshots
+	AlertMessageType                               // Contains a SignedPayload of an Alert
+	EvidenceMessageType                            // Contains a SignedPayload of an Evidence
+	SnapshotRequestMessageType                     // Contains a SnapshotRequest
+	SnapshotResponseMessageType                    // Contains a protocol.BatchSnapshots recovered by a peer
+	CosignatureMessageType                         // Contains a protocol.CosignedSnapshot
 )
 
+func (t MessageType) String() string {
+	switch t {
+	case BatchMessageType:
+		return "batch"
+	case AlertMessageType:
+		return "alert"
+	case EvidenceMessageType:
+		return "evidence"
+	case SnapshotRequestMessageType:
+		return "snapshot_request"
+	case SnapshotResponseMessageType:
+		return "snapshot_response"
+	case CosignatureMessageType:
+		return "cosignature"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
 // Gossip message code. Up to 255 different messages.
 type Message struct {
 	Kind    MessageType
 	From    *Peer
 	TTL     int
 	Payload []byte
+	// Signature is the signature of the originator of the message
+	// over its kind, origin and payload.
+	Signature []byte
 }
 
 /*
@@ -25,6 +25,9 @@ import (
 // Agent metadata
 type Meta struct {
 	Role string
+	// Token is the encoded JoinToken which admits the agent
+	// with its role.
+	Token []byte
 }
 
 func (a *Meta) Encode() ([]byte, error) {
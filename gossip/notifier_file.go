@@ -0,0 +1,87 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileNotifierConfig is the configuration of the file backend, which
+// appends the alerts to a local file.
+type FileNotifierConfig struct {
+	Path string `desc:"File the alerts are appended to"`
+	DeliveryConfig
+}
+
+// Returns the default configuration of the file backend.
+func DefaultFileNotifierConfig() *FileNotifierConfig {
+	return &FileNotifierConfig{
+		DeliveryConfig: DefaultDeliveryConfig(),
+	}
+}
+
+// FileBackend appends the alerts to a file, one JSON document per line.
+// The file is never truncated nor rewritten.
+type FileBackend struct {
+	path string
+}
+
+func NewFileBackend(c *FileNotifierConfig) (*FileBackend, error) {
+	if c.Path == "" {
+		return nil, errors.New("the file notifier needs a path")
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return nil, err
+	}
+	return &FileBackend{c.Path}, nil
+}
+
+func (b *FileBackend) Name() string {
+	return "file"
+}
+
+func (b *FileBackend) Send(batch []*Notification) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, n := range batch {
+		line := struct {
+			Timestamp string
+			Message   string
+		}{n.Timestamp.UTC().Format(time.RFC3339Nano), n.Message}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
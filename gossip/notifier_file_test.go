@@ -0,0 +1,52 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileBackend(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-file-notifier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := DefaultFileNotifierConfig()
+	conf.Path = filepath.Join(dir, "alerts", "alerts.log")
+	b, err := NewFileBackend(conf)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Send([]*Notification{{time.Unix(0, 0), "proof 1 failed"}}))
+	require.NoError(t, b.Send([]*Notification{{time.Unix(1, 0), "proof 2 failed"}}))
+
+	data, err := ioutil.ReadFile(conf.Path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Equal(t, []string{
+		`{"Timestamp":"1970-01-01T00:00:00Z","Message":"proof 1 failed"}`,
+		`{"Timestamp":"1970-01-01T00:00:01Z","Message":"proof 2 failed"}`,
+	}, lines, "Alerts must be appended to the file")
+
+}
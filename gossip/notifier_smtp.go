@@ -0,0 +1,104 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifierConfig is the configuration of the SMTP backend, which
+// emails the alerts.
+type SMTPNotifierConfig struct {
+	Addr     string   `desc:"SMTP server address host:port"`
+	From     string   `desc:"Sender address of the alert emails"`
+	To       []string `desc:"Recipient address list of the alert emails"`
+	Subject  string   `desc:"Subject of the alert emails"`
+	Username string   `desc:"User name to authenticate with the SMTP server, if any"`
+	Password string   `desc:"Password to authenticate with the SMTP server"`
+	DeliveryConfig
+}
+
+// Returns the default configuration of the SMTP backend.
+func DefaultSMTPNotifierConfig() *SMTPNotifierConfig {
+	return &SMTPNotifierConfig{
+		Subject:        "QED alert",
+		DeliveryConfig: DefaultDeliveryConfig(),
+	}
+}
+
+// SMTPBackend emails each batch of alerts in a single plain text message.
+// The server must support STARTTLS to authenticate, unless it is local.
+type SMTPBackend struct {
+	addr    string
+	from    string
+	to      []string
+	subject string
+	auth    smtp.Auth
+}
+
+func NewSMTPBackend(c *SMTPNotifierConfig) (*SMTPBackend, error) {
+	if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+		return nil, errors.New("the smtp notifier needs a server address, a sender and recipients")
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return &SMTPBackend{
+		addr:    c.Addr,
+		from:    c.From,
+		to:      c.To,
+		subject: c.Subject,
+		auth:    auth,
+	}, nil
+}
+
+func (b *SMTPBackend) Name() string {
+	return "smtp"
+}
+
+// Message returns the email of a batch of alerts.
+func (b *SMTPBackend) Message(batch []*Notification) []byte {
+	var buf bytes.Buffer
+	subject := b.subject
+	if len(batch) > 1 {
+		subject = fmt.Sprintf("%s (%d)", b.subject, len(batch))
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", b.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(b.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, n := range batch {
+		fmt.Fprintf(&buf, "%s %s\r\n", n.Timestamp.UTC().Format(time.RFC3339), strings.Replace(n.Message, "\n", "\r\n", -1))
+	}
+	return buf.Bytes()
+}
+
+func (b *SMTPBackend) Send(batch []*Notification) error {
+	return smtp.SendMail(b.addr, b.auth, b.from, b.to, b.Message(batch))
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer is a minimal SMTP server which keeps the messages it
+// receives.
+type fakeSMTPServer struct {
+	l        net.Listener
+	messages chan string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeSMTPServer{l, make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.messages <- strings.Join(data, "\n")
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPBackend(t *testing.T) {
+
+	server := newFakeSMTPServer(t)
+	defer server.l.Close()
+
+	conf := DefaultSMTPNotifierConfig()
+	conf.Addr = server.l.Addr().String()
+	conf.From = "qed@example.com"
+	conf.To = []string{"ops@example.com", "sec@example.com"}
+	b, err := NewSMTPBackend(conf)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Send([]*Notification{
+		{time.Unix(0, 0), "proof 1 failed"},
+		{time.Unix(1, 0), "proof 2 failed"},
+	}))
+
+	select {
+	case msg := <-server.messages:
+		headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg + "\n"))).ReadMIMEHeader()
+		require.NoError(t, err)
+		require.Equal(t, "qed@example.com", headers.Get("From"))
+		require.Equal(t, "ops@example.com, sec@example.com", headers.Get("To"))
+		require.Equal(t, "QED alert (2)", headers.Get("Subject"))
+		require.Contains(t, msg, "1970-01-01T00:00:00Z proof 1 failed")
+		require.Contains(t, msg, "1970-01-01T00:00:01Z proof 2 failed")
+	case <-time.After(2 * time.Second):
+		t.Fatal("The email was not received")
+	}
+
+	_, err = NewSMTPBackend(DefaultSMTPNotifierConfig())
+	require.Error(t, err, "The server and the addresses are required")
+
+}
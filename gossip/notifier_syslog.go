@@ -0,0 +1,123 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// SyslogNotifierConfig is the configuration of the syslog backend, which
+// sends the alerts as RFC 5424 messages.
+type SyslogNotifierConfig struct {
+	Network  string        `desc:"Network of the syslog server: udp, tcp or unix"`
+	Addr     string        `desc:"Syslog server address host:port, or socket path"`
+	Facility int           `desc:"Syslog facility code of the alerts, 1 for user-level messages"`
+	AppName  string        `desc:"Application name of the syslog messages"`
+	Timeout  time.Duration `desc:"Timeout connecting and writing to the syslog server"`
+	DeliveryConfig
+}
+
+// Returns the default configuration of the syslog backend.
+func DefaultSyslogNotifierConfig() *SyslogNotifierConfig {
+	return &SyslogNotifierConfig{
+		Network:        "udp",
+		Facility:       1,
+		AppName:        "qed",
+		Timeout:        2 * time.Second,
+		DeliveryConfig: DefaultDeliveryConfig(),
+	}
+}
+
+// syslogSeverityAlert is the severity of the alerts: action must be
+// taken immediately.
+const syslogSeverityAlert = 1
+
+// SyslogBackend sends every alert as an RFC 5424 message. Over TCP,
+// messages are framed by octet counting, as in RFC 6587.
+type SyslogBackend struct {
+	network  string
+	addr     string
+	priority int
+	hostname string
+	appName  string
+	timeout  time.Duration
+}
+
+func NewSyslogBackend(c *SyslogNotifierConfig) (*SyslogBackend, error) {
+	if c.Addr == "" {
+		return nil, errors.New("the syslog notifier needs a server address")
+	}
+	if c.Facility < 0 || c.Facility > 23 {
+		return nil, fmt.Errorf("invalid syslog facility %d", c.Facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogBackend{
+		network:  c.Network,
+		addr:     c.Addr,
+		priority: c.Facility*8 + syslogSeverityAlert,
+		hostname: hostname,
+		appName:  c.AppName,
+		timeout:  c.Timeout,
+	}, nil
+}
+
+func (b *SyslogBackend) Name() string {
+	return "syslog"
+}
+
+// Message formats an alert as an RFC 5424 message without structured
+// data: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+func (b *SyslogBackend) Message(n *Notification) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d alert - %s",
+		b.priority,
+		n.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		b.hostname,
+		b.appName,
+		os.Getpid(),
+		n.Message,
+	))
+}
+
+func (b *SyslogBackend) Send(batch []*Notification) error {
+	conn, err := net.DialTimeout(b.network, b.addr, b.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(b.timeout))
+
+	for _, n := range batch {
+		msg := b.Message(n)
+		if b.network == "tcp" {
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "%d ", len(msg))
+			buf.Write(msg)
+			msg = buf.Bytes()
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogBackend(t *testing.T) {
+
+	n := &Notification{time.Date(2019, 3, 1, 10, 20, 30, 123456000, time.UTC), "proof 1 failed"}
+	format := regexp.MustCompile(fmt.Sprintf(`^<9>1 2019-03-01T10:20:30\.123456Z \S+ qed %d alert - proof 1 failed$`, os.Getpid()))
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+
+	conf := DefaultSyslogNotifierConfig()
+	conf.Addr = udp.LocalAddr().String()
+	b, err := NewSyslogBackend(conf)
+	require.NoError(t, err)
+	require.NoError(t, b.Send([]*Notification{n}))
+
+	buf := make([]byte, 1024)
+	udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	size, _, err := udp.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Regexp(t, format, string(buf[:size]), "Alerts must be RFC 5424 messages")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+
+	conf.Network = "tcp"
+	conf.Addr = tcp.Addr().String()
+	b, err = NewSyslogBackend(conf)
+	require.NoError(t, err)
+	require.NoError(t, b.Send([]*Notification{n, n}))
+
+	conn, err := tcp.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		var length int
+		_, err := fmt.Fscanf(reader, "%d ", &length)
+		require.NoError(t, err, "Messages over TCP must be framed by octet counting")
+		msg := make([]byte, length)
+		_, err = reader.Read(msg)
+		require.NoError(t, err)
+		require.Regexp(t, format, string(msg))
+	}
+
+	conf.Facility = 24
+	_, err = NewSyslogBackend(conf)
+	require.Error(t, err, "Facilities must be in range")
+
+}
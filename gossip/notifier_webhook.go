@@ -0,0 +1,158 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookTemplates are the predefined payloads of the webhook backend.
+var webhookTemplates = map[string]string{
+	"slack": `{"text": {{ .Text | json }}}`,
+	"teams": `{"@type": "MessageCard", "@context": "http://schema.org/extensions", "summary": "QED alert", "title": {{ printf "QED alerts (%d)" .Count | json }}, "text": {{ .Text | json }}}`,
+	"json":  `{"timestamp": {{ .Timestamp | json }}, "alerts": {{ .Alerts | json }}}`,
+}
+
+// WebhookNotifierConfig is the configuration of the webhook backend,
+// which posts a JSON payload built from a template.
+type WebhookNotifierConfig struct {
+	URL      string        `desc:"Webhook URL to post the alerts to"`
+	Template string        `desc:"Payload of the webhook: slack, teams, json or a Go template of a JSON document"`
+	Headers  []string      `desc:"HTTP header list 'Name: value',... added to the webhook requests"`
+	Timeout  time.Duration `desc:"Timeout of the webhook requests"`
+	DeliveryConfig
+}
+
+// Returns the default configuration of the webhook backend.
+func DefaultWebhookNotifierConfig() *WebhookNotifierConfig {
+	return &WebhookNotifierConfig{
+		Template:       "slack",
+		Timeout:        2 * time.Second,
+		DeliveryConfig: DefaultDeliveryConfig(),
+	}
+}
+
+// webhookData is the data available to the payload templates.
+type webhookData struct {
+	Alerts    []string
+	Text      string // the alerts, one per line
+	Count     int
+	Timestamp string // of the first alert, in RFC 3339 format
+}
+
+// WebhookBackend posts the alerts to a webhook. The payload is a JSON
+// document built with a Go template, which can use the json function
+// to quote the values.
+type WebhookBackend struct {
+	url      string
+	template *template.Template
+	headers  http.Header
+	client   *http.Client
+}
+
+func NewWebhookBackend(c *WebhookNotifierConfig) (*WebhookBackend, error) {
+	if c.URL == "" {
+		return nil, errors.New("the webhook notifier needs an URL")
+	}
+	text, ok := webhookTemplates[c.Template]
+	if !ok {
+		text = c.Template
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			buf, err := json.Marshal(v)
+			return string(buf), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(http.Header)
+	for _, h := range c.Headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid webhook header %q", h)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return &WebhookBackend{
+		url:      c.URL,
+		template: tmpl,
+		headers:  headers,
+		client:   &http.Client{Timeout: c.Timeout},
+	}, nil
+}
+
+func (b *WebhookBackend) Name() string {
+	return "webhook"
+}
+
+// Payload renders the payload of a batch and checks it is valid JSON.
+func (b *WebhookBackend) Payload(batch []*Notification) ([]byte, error) {
+	data := webhookData{
+		Alerts:    make([]string, 0, len(batch)),
+		Count:     len(batch),
+		Timestamp: batch[0].Timestamp.UTC().Format(time.RFC3339),
+	}
+	for _, n := range batch {
+		data.Alerts = append(data.Alerts, n.Message)
+	}
+	data.Text = strings.Join(data.Alerts, "\n")
+
+	var buf bytes.Buffer
+	if err := b.template.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("the webhook template does not render a JSON document")
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *WebhookBackend) Send(batch []*Notification) error {
+	payload, err := b.Payload(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", b.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for name, values := range b.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookBackend(t *testing.T) {
+
+	var body []byte
+	var header http.Header
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	batch := []*Notification{
+		{time.Unix(0, 0), `proof "1" failed`},
+		{time.Unix(1, 0), "proof 2 failed"},
+	}
+
+	conf := DefaultWebhookNotifierConfig()
+	conf.URL = server.URL
+	conf.Headers = []string{"Authorization: Bearer token"}
+	b, err := NewWebhookBackend(conf)
+	require.NoError(t, err)
+	require.NoError(t, b.Send(batch))
+	require.Equal(t, "application/json", header.Get("Content-Type"))
+	require.Equal(t, "Bearer token", header.Get("Authorization"))
+	require.JSONEq(t, `{"text": "proof \"1\" failed\nproof 2 failed"}`, string(body))
+
+	conf.Template = "teams"
+	b, err = NewWebhookBackend(conf)
+	require.NoError(t, err)
+	require.NoError(t, b.Send(batch))
+	var card map[string]string
+	require.NoError(t, json.Unmarshal(body, &card))
+	require.Equal(t, "MessageCard", card["@type"])
+	require.Equal(t, "QED alerts (2)", card["title"])
+
+	conf.Template = `{"alerts": {{ .Alerts | json }}, "since": {{ .Timestamp | json }}}`
+	b, err = NewWebhookBackend(conf)
+	require.NoError(t, err)
+	require.NoError(t, b.Send(batch))
+	require.JSONEq(t, `{"alerts": ["proof \"1\" failed", "proof 2 failed"], "since": "1970-01-01T00:00:00Z"}`, string(body))
+
+	conf.Template = `{"text": {{ .Text }}}`
+	b, err = NewWebhookBackend(conf)
+	require.NoError(t, err)
+	require.Error(t, b.Send(batch), "Templates must render JSON documents")
+
+	conf.Template = "slack"
+	b, err = NewWebhookBackend(conf)
+	require.NoError(t, err)
+	status = http.StatusServiceUnavailable
+	require.Error(t, b.Send(batch), "Failed requests must be retried")
+
+}
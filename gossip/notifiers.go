@@ -0,0 +1,320 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/log"
+)
+
+var ErrNotifierQueueFull = errors.New("notifications queue full")
+
+// NotifierConfig selects the notifier backends an alert is sent to, and
+// holds the configuration of each of them.
+type NotifierConfig struct {
+	Backends []string `desc:"Notifier backend list http,webhook,smtp,syslog,file to send every alert to"`
+
+	// Configuration of the http backend, a SimpleNotifier
+	SimpleNotifierConfig
+
+	Webhook *WebhookNotifierConfig
+	SMTP    *SMTPNotifierConfig
+	Syslog  *SyslogNotifierConfig
+	File    *FileNotifierConfig
+}
+
+// Returns the default configuration of the notifier backends. Without
+// backends, alerts are sent to the http backend if it has endpoints.
+func DefaultNotifierConfig() *NotifierConfig {
+	return &NotifierConfig{
+		SimpleNotifierConfig: *DefaultSimpleNotifierConfig(),
+		Webhook:              DefaultWebhookNotifierConfig(),
+		SMTP:                 DefaultSMTPNotifierConfig(),
+		Syslog:               DefaultSyslogNotifierConfig(),
+		File:                 DefaultFileNotifierConfig(),
+	}
+}
+
+// NotifierFactory builds a notifier from the configuration.
+type NotifierFactory func(c *NotifierConfig) (Notifier, error)
+
+var (
+	notifierFactoriesLock sync.Mutex
+	notifierFactories     = make(map[string]NotifierFactory)
+)
+
+// RegisterNotifier makes a notifier backend selectable by name in the
+// notifier configuration.
+func RegisterNotifier(name string, f NotifierFactory) {
+	notifierFactoriesLock.Lock()
+	defer notifierFactoriesLock.Unlock()
+	notifierFactories[name] = f
+}
+
+// Notifiers returns the names of the registered notifier backends.
+func Notifiers() []string {
+	notifierFactoriesLock.Lock()
+	defer notifierFactoriesLock.Unlock()
+	names := make([]string, 0, len(notifierFactories))
+	for name := range notifierFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterNotifier("http", func(c *NotifierConfig) (Notifier, error) {
+		if len(c.Endpoint) == 0 {
+			return nil, errors.New("the http notifier needs at least an endpoint")
+		}
+		return NewSimpleNotifierFromConfig(&c.SimpleNotifierConfig), nil
+	})
+	RegisterNotifier("webhook", func(c *NotifierConfig) (Notifier, error) {
+		b, err := NewWebhookBackend(c.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		return NewBatchingNotifier(b, &c.Webhook.DeliveryConfig), nil
+	})
+	RegisterNotifier("smtp", func(c *NotifierConfig) (Notifier, error) {
+		b, err := NewSMTPBackend(c.SMTP)
+		if err != nil {
+			return nil, err
+		}
+		return NewBatchingNotifier(b, &c.SMTP.DeliveryConfig), nil
+	})
+	RegisterNotifier("syslog", func(c *NotifierConfig) (Notifier, error) {
+		b, err := NewSyslogBackend(c.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		return NewBatchingNotifier(b, &c.Syslog.DeliveryConfig), nil
+	})
+	RegisterNotifier("file", func(c *NotifierConfig) (Notifier, error) {
+		b, err := NewFileBackend(c.File)
+		if err != nil {
+			return nil, err
+		}
+		return NewBatchingNotifier(b, &c.File.DeliveryConfig), nil
+	})
+}
+
+// NewNotifierFromConfig returns a notifier which fans out every alert
+// to the backends of the configuration.
+func NewNotifierFromConfig(c *NotifierConfig) (Notifier, error) {
+	backends := c.Backends
+	if len(backends) == 0 && len(c.Endpoint) > 0 {
+		backends = []string{"http"}
+	}
+
+	notifiers := make(MultiNotifier, 0, len(backends))
+	for _, name := range backends {
+		notifierFactoriesLock.Lock()
+		factory, ok := notifierFactories[name]
+		notifierFactoriesLock.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier backend %q, use one of %v", name, Notifiers())
+		}
+		n, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the %s notifier: %v", name, err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// MultiNotifier sends every alert to all its notifiers. Without
+// notifiers, alerts are discarded.
+type MultiNotifier []Notifier
+
+// Alert sends the message to every notifier, and returns the first
+// error found.
+func (m MultiNotifier) Alert(msg string) error {
+	var first error
+	for _, n := range m {
+		if err := n.Alert(msg); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m MultiNotifier) Start() {
+	for _, n := range m {
+		n.Start()
+	}
+}
+
+func (m MultiNotifier) Stop() {
+	for _, n := range m {
+		n.Stop()
+	}
+}
+
+// Notification is an alert waiting to be delivered by a notifier backend.
+type Notification struct {
+	Timestamp time.Time
+	Message   string
+}
+
+// NotifierBackend delivers batches of notifications to an external
+// service. BatchingNotifier takes care of queueing, batching and
+// retrying the deliveries.
+type NotifierBackend interface {
+	Name() string
+	Send(batch []*Notification) error
+}
+
+// DeliveryConfig is the queueing, batching and retry configuration of a
+// notifier backend.
+type DeliveryConfig struct {
+	QueueSize        int           `desc:"Notifications queue size"`
+	BatchSize        int           `desc:"Maximum number of notifications sent together"`
+	BatchInterval    time.Duration `desc:"Time to wait for more notifications to complete a batch"`
+	MaxRetries       int           `desc:"Number of retries of a failed delivery before dropping it"`
+	RetryInterval    time.Duration `desc:"Time to wait before the first retry, doubled on every retry"`
+	MaxRetryInterval time.Duration `desc:"Maximum time to wait between retries"`
+}
+
+// Returns the default delivery configuration of the notifier backends.
+func DefaultDeliveryConfig() DeliveryConfig {
+	return DeliveryConfig{
+		QueueSize:        100,
+		BatchSize:        10,
+		BatchInterval:    1 * time.Second,
+		MaxRetries:       3,
+		RetryInterval:    500 * time.Millisecond,
+		MaxRetryInterval: 30 * time.Second,
+	}
+}
+
+// BatchingNotifier queues the alerts and delivers them in batches
+// through a notifier backend, retrying the failed deliveries with
+// an exponential backoff.
+type BatchingNotifier struct {
+	backend       NotifierBackend
+	config        DeliveryConfig
+	backoff       client.Backoff
+	notifications chan *Notification
+	quitCh        chan bool
+	done          chan bool
+	started       bool
+}
+
+func NewBatchingNotifier(b NotifierBackend, c *DeliveryConfig) *BatchingNotifier {
+	config := *c
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	return &BatchingNotifier{
+		backend:       b,
+		config:        config,
+		backoff:       client.NewExponentialBackoff(config.RetryInterval, config.MaxRetryInterval),
+		notifications: make(chan *Notification, config.QueueSize),
+		quitCh:        make(chan bool),
+		done:          make(chan bool),
+	}
+}
+
+// Alert enqueues a message to be delivered. It does not block: if
+// the queue is full, the message is dropped.
+func (n *BatchingNotifier) Alert(msg string) error {
+	select {
+	case n.notifications <- &Notification{time.Now(), msg}:
+		return nil
+	default:
+		log.Infof("Notifier %s dropped the alert %v: %v", n.backend.Name(), msg, ErrNotifierQueueFull)
+		return ErrNotifierQueueFull
+	}
+}
+
+// Starts the process which delivers the notifications in batches of
+// up to BatchSize, waiting at most BatchInterval since the first
+// notification of a batch to deliver it.
+func (n *BatchingNotifier) Start() {
+	n.started = true
+	go func() {
+		defer close(n.done)
+		batch := make([]*Notification, 0, n.config.BatchSize)
+		var timeout <-chan time.Time
+		for {
+			select {
+			case notification := <-n.notifications:
+				if len(batch) == 0 {
+					timeout = time.After(n.config.BatchInterval)
+				}
+				batch = append(batch, notification)
+				if len(batch) < n.config.BatchSize {
+					continue
+				}
+			case <-timeout:
+			case <-n.quitCh:
+				// deliver what is left once, without retries
+				for len(n.notifications) > 0 {
+					batch = append(batch, <-n.notifications)
+				}
+				if len(batch) > 0 {
+					if err := n.backend.Send(batch); err != nil {
+						log.Infof("Notifier %s dropped %d alerts on stop: %v", n.backend.Name(), len(batch), err)
+					}
+				}
+				return
+			}
+			n.deliver(batch)
+			batch = make([]*Notification, 0, n.config.BatchSize)
+			timeout = nil
+		}
+	}()
+}
+
+// deliver sends a batch, retrying up to MaxRetries times.
+func (n *BatchingNotifier) deliver(batch []*Notification) {
+	for attempt := 0; ; attempt++ {
+		err := n.backend.Send(batch)
+		if err == nil {
+			return
+		}
+		wait, ok := n.backoff.Next(attempt)
+		if attempt >= n.config.MaxRetries || !ok {
+			log.Infof("Notifier %s dropped %d alerts after %d attempts: %v", n.backend.Name(), len(batch), attempt+1, err)
+			return
+		}
+		log.Debugf("Notifier %s failed to send %d alerts, retrying in %v: %v", n.backend.Name(), len(batch), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-n.quitCh:
+			log.Infof("Notifier %s dropped %d alerts on stop: %v", n.backend.Name(), len(batch), err)
+			return
+		}
+	}
+}
+
+// Stops the delivery process, after delivering the notifications
+// queued.
+func (n *BatchingNotifier) Stop() {
+	close(n.quitCh)
+	if n.started {
+		<-n.done
+	}
+}
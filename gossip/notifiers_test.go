@@ -0,0 +1,168 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend records the batches sent, failing the first deliveries.
+type fakeBackend struct {
+	sync.Mutex
+	failures int
+	attempts int
+	batches  [][]*Notification
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Send(batch []*Notification) error {
+	b.Lock()
+	defer b.Unlock()
+	b.attempts++
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("unavailable")
+	}
+	b.batches = append(b.batches, batch)
+	return nil
+}
+
+func (b *fakeBackend) sent() [][]*Notification {
+	b.Lock()
+	defer b.Unlock()
+	return b.batches
+}
+
+func testDeliveryConfig() *DeliveryConfig {
+	c := DefaultDeliveryConfig()
+	c.BatchSize = 3
+	c.BatchInterval = 50 * time.Millisecond
+	c.RetryInterval = 10 * time.Millisecond
+	c.MaxRetryInterval = 100 * time.Millisecond
+	return &c
+}
+
+func TestBatchingNotifier(t *testing.T) {
+
+	backend := &fakeBackend{}
+	n := NewBatchingNotifier(backend, testDeliveryConfig())
+	n.Start()
+
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, n.Alert(msg))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	batches := backend.sent()
+	require.Len(t, batches, 2, "Alerts must be sent in batches")
+	require.Len(t, batches[0], 3, "Full batches must be sent at once")
+	require.Len(t, batches[1], 2, "Incomplete batches must be sent after the interval")
+	require.Equal(t, "e", batches[1][1].Message)
+
+	require.NoError(t, n.Alert("f"))
+	n.Stop()
+	require.Len(t, backend.sent(), 3, "Queued alerts must be sent on stop")
+
+}
+
+func TestBatchingNotifierRetries(t *testing.T) {
+
+	backend := &fakeBackend{failures: 2}
+	n := NewBatchingNotifier(backend, testDeliveryConfig())
+	n.Start()
+	require.NoError(t, n.Alert("a"))
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, backend.sent(), 1, "Failed deliveries must be retried")
+	require.Equal(t, 3, backend.attempts)
+	n.Stop()
+
+	backend = &fakeBackend{failures: 10}
+	n = NewBatchingNotifier(backend, testDeliveryConfig())
+	n.Start()
+	require.NoError(t, n.Alert("a"))
+	time.Sleep(300 * time.Millisecond)
+	require.Empty(t, backend.sent())
+	require.Equal(t, 4, backend.attempts, "Deliveries must be dropped after the retries")
+	n.Stop()
+
+	c := testDeliveryConfig()
+	c.QueueSize = 1
+	n = NewBatchingNotifier(&fakeBackend{}, c)
+	require.NoError(t, n.Alert("a"))
+	require.Equal(t, ErrNotifierQueueFull, n.Alert("b"), "Alerts must not block when the queue is full")
+
+}
+
+func TestNewNotifierFromConfig(t *testing.T) {
+
+	n, err := NewNotifierFromConfig(DefaultNotifierConfig())
+	require.NoError(t, err)
+	require.Empty(t, n, "Without backends nor endpoints, alerts must be discarded")
+	require.NoError(t, n.Alert("discarded"))
+
+	conf := DefaultNotifierConfig()
+	conf.Endpoint = []string{"http://127.0.0.1:8888/alert"}
+	n, err = NewNotifierFromConfig(conf)
+	require.NoError(t, err)
+	require.Len(t, n, 1)
+	require.IsType(t, &SimpleNotifier{}, n.(MultiNotifier)[0], "Endpoints must select the http backend")
+
+	conf = DefaultNotifierConfig()
+	conf.Backends = []string{"pager"}
+	_, err = NewNotifierFromConfig(conf)
+	require.Error(t, err, "Unknown backends must be rejected")
+
+	conf = DefaultNotifierConfig()
+	conf.Backends = []string{"webhook"}
+	_, err = NewNotifierFromConfig(conf)
+	require.Error(t, err, "Backends must be configured")
+
+	dir, err := ioutil.TempDir("", "qed-notifier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend := &fakeBackend{}
+	RegisterNotifier("fake", func(c *NotifierConfig) (Notifier, error) {
+		return NewBatchingNotifier(backend, testDeliveryConfig()), nil
+	})
+	conf = DefaultNotifierConfig()
+	conf.Backends = []string{"file", "fake"}
+	conf.File.Path = filepath.Join(dir, "alerts.log")
+	conf.File.BatchInterval = 10 * time.Millisecond
+	n, err = NewNotifierFromConfig(conf)
+	require.NoError(t, err)
+	n.Start()
+	require.NoError(t, n.Alert("fan out"))
+	n.Stop()
+
+	require.Len(t, backend.sent(), 1, "Alerts must be sent to every backend")
+	data, err := ioutil.ReadFile(conf.File.Path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "fan out", "Alerts must be sent to every backend")
+
+}
@@ -16,10 +16,16 @@
 package gossip
 
 import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
 	"time"
 
 	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/sign"
 	"github.com/coocood/freecache"
 )
 
@@ -45,8 +51,23 @@ func configToOptions(conf *Config) ([]AgentOptionF, error) {
 		SetTimeoutQueues(conf.TimeoutQueues),
 		SetProcessInterval(conf.ProcessInterval),
 		SetMetricsServer(conf.MetricsAddr),
+		SetAdminServer(conf.AdminAddr),
 		SetCache(conf.CacheSize),
 		SetTimeoutQueues(conf.TimeoutQueues),
+		SetTrustedKeys(conf.TrustedKeys),
+		SetInsecureSkipVerify(conf.InsecureSkipVerify),
+		SetSigner(conf.PrivateKeyPath),
+		SetAlertTTL(conf.AlertTTL),
+		SetEvidencePath(conf.EvidencePath),
+		SetBackfillLimit(conf.BackfillLimit),
+		SetDataPath(conf.DataPath),
+		SetCheckpoints(conf.CheckpointPath),
+		SetAntiEntropyWindow(conf.AntiEntropyWindow),
+		SetKeyring(conf.KeyringPath),
+		SetJoinToken(conf.JoinToken),
+		SetAdmissionKeys(conf.AdmissionKeys),
+		SetWitnessKeys(conf.WitnessKeys),
+		SetAgentKeys(conf.AgentKeys),
 	}
 
 	return options, nil
@@ -137,9 +158,24 @@ func SetMetricsServer(addr string) AgentOptionF {
 	}
 }
 
+func SetAdminServer(addr string) AgentOptionF {
+	return func(a *Agent) error {
+		a.admin = nil
+		if addr != "" {
+			a.admin = &http.Server{Addr: addr}
+		}
+		return nil
+	}
+}
+
 func SetTasksManager(tm TasksManager) AgentOptionF {
 	return func(a *Agent) error {
 		a.Tasks = tm
+		if jm, ok := tm.(JobsManager); ok {
+			jm.RegisterReplayer(alertJobKind, func(payload []byte) (*Job, error) {
+				return a.alertJob(string(payload)), nil
+			})
+		}
 		return nil
 	}
 }
@@ -165,6 +201,196 @@ func SetNotifier(n Notifier) AgentOptionF {
 	}
 }
 
+// SetTrustedKeys loads the public keys of the servers whose snapshots
+// the agent trusts from the given files.
+func SetTrustedKeys(paths []string) AgentOptionF {
+	return func(a *Agent) error {
+		if len(paths) == 0 {
+			return nil
+		}
+		keys, err := sign.NewKeySetFromFiles(paths)
+		if err != nil {
+			return fmt.Errorf("unable to load trusted key %v", err)
+		}
+		a.TrustedKeys = keys
+		return nil
+	}
+}
+
+// SetInsecureSkipVerify makes the agent process the snapshots without
+// verifying their signatures when it has no trusted keys.
+func SetInsecureSkipVerify(skip bool) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.InsecureSkipVerify = skip
+		return nil
+	}
+}
+
+// SetAdmissionKeys loads the public keys whose join tokens admit the
+// peers in the gossip network.
+func SetAdmissionKeys(paths []string) AgentOptionF {
+	return func(a *Agent) error {
+		if len(paths) == 0 {
+			return nil
+		}
+		keys, err := sign.NewKeySetFromFiles(paths)
+		if err != nil {
+			return fmt.Errorf("unable to load admission key %v", err)
+		}
+		a.AdmissionKeys = keys
+		return nil
+	}
+}
+
+// SetWitnessKeys loads the public keys of the witnesses whose
+// cosignatures the agent accepts.
+func SetWitnessKeys(paths []string) AgentOptionF {
+	return func(a *Agent) error {
+		if len(paths) == 0 {
+			return nil
+		}
+		keys, err := sign.NewKeySetFromFiles(paths)
+		if err != nil {
+			return fmt.Errorf("unable to load witness key %v", err)
+		}
+		a.WitnessKeys = keys
+		return nil
+	}
+}
+
+// SetAgentKeys loads the public keys of the agents whose alerts and
+// evidence the agent accepts without admission keys.
+func SetAgentKeys(paths []string) AgentOptionF {
+	return func(a *Agent) error {
+		if len(paths) == 0 {
+			return nil
+		}
+		keys, err := sign.NewKeySetFromFiles(paths)
+		if err != nil {
+			return fmt.Errorf("unable to load agent key %v", err)
+		}
+		a.AgentKeys = keys
+		return nil
+	}
+}
+
+// SetSigner loads the private key the agent signs its alerts and evidence
+// with. Without a key file, the agent generates a new ed25519 key.
+func SetSigner(privateKeyPath string) AgentOptionF {
+	return func(a *Agent) error {
+		if privateKeyPath == "" {
+			a.Signer = sign.NewEd25519Signer()
+			return nil
+		}
+		signer, err := sign.NewSignerFromFile(privateKeyPath)
+		if err != nil {
+			return fmt.Errorf("unable to load private key %s: %v", privateKeyPath, err)
+		}
+		a.Signer = signer
+		return nil
+	}
+}
+
+func SetAlertTTL(ttl int) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.AlertTTL = ttl
+		return nil
+	}
+}
+
+func SetEvidencePath(path string) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.EvidencePath = path
+		return nil
+	}
+}
+
+func SetBackfillLimit(limit int) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.BackfillLimit = limit
+		return nil
+	}
+}
+
+// SetDataPath sets the directory where the agent keeps its state.
+func SetDataPath(path string) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.DataPath = path
+		return nil
+	}
+}
+
+// SetCheckpoints opens the checkpoint file of the agent. It must be set
+// after the data path, which holds the default file. Without both, the
+// checkpoints are only kept in memory.
+func SetCheckpoints(path string) AgentOptionF {
+	return func(a *Agent) error {
+		if path == "" && a.config.DataPath != "" {
+			path = filepath.Join(a.config.DataPath, "checkpoints.json")
+		}
+		if path == "" {
+			log.Infof("Agent has no data path, its checkpoints will not survive a restart")
+		}
+		checkpoints, err := OpenCheckpointStore(path)
+		if err != nil {
+			return err
+		}
+		a.Checkpoints = checkpoints
+		return nil
+	}
+}
+
+func SetAntiEntropyWindow(size int) AgentOptionF {
+	return func(a *Agent) error {
+		a.recent = nil
+		if size > 0 {
+			a.recent = newRecentSnapshots(size)
+		}
+		return nil
+	}
+}
+
+// SetKeyring loads the keys to encrypt the gossip traffic.
+func SetKeyring(path string) AgentOptionF {
+	return func(a *Agent) error {
+		a.config.KeyringPath = path
+		a.keyring = nil
+		if path == "" {
+			return nil
+		}
+		keyring, err := LoadKeyring(path)
+		if err != nil {
+			return fmt.Errorf("unable to load gossip keyring %s: %v", path, err)
+		}
+		a.keyring = keyring
+		return nil
+	}
+}
+
+// SetJoinToken sets the token which admits the agent in the gossip
+// network. It must be set after the node name, the role and the signer,
+// which the token must be issued for.
+func SetJoinToken(token string) AgentOptionF {
+	return func(a *Agent) error {
+		a.joinToken = nil
+		if token == "" {
+			return nil
+		}
+		t, err := ParseJoinToken(token)
+		if err != nil {
+			return err
+		}
+		if t.Node != a.config.NodeName || t.Role != a.config.Role {
+			return fmt.Errorf("the join token is issued to %s as %s", t.Node, t.Role)
+		}
+		if a.Signer == nil || !bytes.Equal(t.PublicKey, a.Signer.PublicKey()) {
+			return fmt.Errorf("the join token is issued to another key than the private key of the agent")
+		}
+		a.joinToken, err = t.Encode()
+		return err
+	}
+}
+
 // export GOGC variable to make GC to collect memory
 // adecuately if the cache is too big
 func SetCache(size int) AgentOptionF {
@@ -176,10 +402,11 @@ func SetCache(size int) AgentOptionF {
 
 func SetProcessors(p map[string]Processor) AgentOptionF {
 	return func(a *Agent) error {
-		for _, p := range p {
-			a.RegisterMetrics(p.Metrics())
+		for name, p := range p {
+			if err := a.RegisterProcessor(name, p); err != nil {
+				return err
+			}
 		}
-		a.processors = p
 		return nil
 	}
 }
@@ -18,10 +18,14 @@ package gossip
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -32,12 +36,22 @@ import (
 //
 // Also it should enqueue tasks in the agent task
 // manager.
+//
+// The agent subscribes the processors to the kinds
+// of messages they read when they are registered,
+// and registers their metrics.
 type Processor interface {
-	Start()
+	Subscriber
+	Kinds() []MessageType
 	Stop()
 	Metrics() []prometheus.Collector
 }
 
+// A ProcessorFactory builds a processor of the agent. The
+// factories make possible to register the processors while
+// the agent is running.
+type ProcessorFactory func(a *Agent) Processor
+
 // Reads agents in queue, and generates a
 // *protocol.BatchSnapshots queue.
 // It also calls the tasks factories and enqueue
@@ -50,15 +64,49 @@ type BatchProcessor struct {
 	quitCh  chan bool
 	ctx     context.Context
 	id      int
+
+	// versions holds the last version processed
+	// of each log
+	versions     map[string]uint64
+	versionsLock sync.Mutex
+
+	invalidSignatures prometheus.Counter
 }
 
 func NewBatchProcessor(a *Agent, tf []TaskFactory) *BatchProcessor {
 	b := &BatchProcessor{
-		mh:     &codec.MsgpackHandle{},
-		a:      a,
-		tf:     tf,
-		quitCh: make(chan bool),
-		ctx:    context.WithValue(context.Background(), "agent", a),
+		mh:       &codec.MsgpackHandle{},
+		a:        a,
+		tf:       tf,
+		quitCh:   make(chan bool),
+		ctx:      context.WithValue(context.Background(), "agent", a),
+		versions: make(map[string]uint64),
+		invalidSignatures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_batches_invalid_signature_total",
+				Help: "Number of batches dropped because of an untrusted snapshot signature.",
+			},
+		),
+	}
+
+	if a.TrustedKeys == nil && a.config.InsecureSkipVerify {
+		log.Infof("BatchProcessor has no trusted keys, snapshot signatures will not be verified")
+	}
+
+	b.metrics = append(b.metrics, b.invalidSignatures)
+
+	// the tasks of a batch are rebuilt from the batch to replay them
+	if jm, ok := a.Tasks.(JobsManager); ok {
+		for _, t := range tf {
+			t := t
+			jm.RegisterReplayer(batchJobKind(t), func(payload []byte) (*Job, error) {
+				batch := new(protocol.BatchSnapshots)
+				if err := batch.Decode(payload); err != nil {
+					return nil, err
+				}
+				return b.job(context.WithValue(b.ctx, "batch", batch), t, payload), nil
+			})
+		}
 	}
 
 	// register all tasks metrics
@@ -69,6 +117,31 @@ func NewBatchProcessor(a *Agent, tf []TaskFactory) *BatchProcessor {
 	return b
 }
 
+// job builds the job of the task of a factory for a batch, whose encoded
+// form is kept as payload to replay it.
+func (d *BatchProcessor) job(ctx context.Context, t TaskFactory, payload []byte) *Job {
+	task := t.New(ctx)
+	priority := NormalPriority
+	if p, ok := t.(TaskPrioritizer); ok {
+		priority = p.Priority()
+	}
+	return NewTaskJob(batchJobKind(t), payload, priority, task)
+}
+
+// batchJobKind identifies the jobs of the tasks of a factory.
+func batchJobKind(t TaskFactory) string {
+	return "batch/" + taskFactoryName(t)
+}
+
+// taskFactoryName returns the name of the type of a task factory.
+func taskFactoryName(t TaskFactory) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", t), "*")
+}
+
+func (d *BatchProcessor) Kinds() []MessageType {
+	return []MessageType{BatchMessageType}
+}
+
 func (d *BatchProcessor) Stop() {
 	close(d.quitCh)
 }
@@ -77,37 +150,94 @@ func (d *BatchProcessor) Metrics() []prometheus.Collector {
 	return d.metrics
 }
 
+// TaskFactories returns the names of the factories of the tasks
+// enqueued per batch.
+func (d *BatchProcessor) TaskFactories() []string {
+	names := make([]string, 0, len(d.tf))
+	for _, t := range d.tf {
+		names = append(names, taskFactoryName(t))
+	}
+	return names
+}
+
+// LastVersions returns the last version processed of each log,
+// keyed by the log id.
+func (d *BatchProcessor) LastVersions() map[string]uint64 {
+	d.versionsLock.Lock()
+	defer d.versionsLock.Unlock()
+	versions := make(map[string]uint64, len(d.versions))
+	for logId, v := range d.versions {
+		versions[logId] = v
+	}
+	return versions
+}
+
+func (d *BatchProcessor) processed(b *protocol.BatchSnapshots) {
+	d.versionsLock.Lock()
+	defer d.versionsLock.Unlock()
+	for _, s := range b.Snapshots {
+		if s == nil || s.Snapshot == nil {
+			continue
+		}
+		if v, ok := d.versions[s.Snapshot.LogId]; !ok || s.Snapshot.Version > v {
+			d.versions[s.Snapshot.LogId] = s.Snapshot.Version
+		}
+	}
+}
+
 // This function requires the cache of the agent to be defined, and will return
 // false if the cache is not present in the agent
 func (d *BatchProcessor) wasProcessed(b *protocol.BatchSnapshots) bool {
-	if d.a.Cache == nil {
-		return false
-	}
-
 	var buf bytes.Buffer
 	err := codec.NewEncoder(&buf, d.mh).Encode(b.Snapshots)
 	if err != nil {
 		log.Infof("Error encoding batchsnapshots to calculate its digest. Dropping batch.")
 		return false
 	}
-	bb := buf.Bytes()
-	digest := hashing.NewSha256Hasher().Do(bb)
-	// batch already processed, discard it
-	_, err = d.a.Cache.Get(digest)
+	return wasSeen(d.a.Cache, buf.Bytes())
+}
+
+// wasSeen returns true if the digest of buf is in the cache, and adds it
+// otherwise. Without a cache, every message is new.
+func wasSeen(cache Cache, buf []byte) bool {
+	if cache == nil {
+		return false
+	}
+	digest := hashing.NewSha256Hasher().Do(buf)
+	// message already processed, discard it
+	_, err := cache.Get(digest)
 	if err == nil {
 		return true
 	}
-	d.a.Cache.Set(digest, []byte{0x1}, 0)
+	cache.Set(digest, []byte{0x1}, 0)
 	return false
 }
 
+// verify checks every snapshot of the batch was signed by one of the
+// keys of the servers. Without trusted keys, batches are only accepted
+// if the agent was configured to skip the verification.
+func (d *BatchProcessor) verify(b *protocol.BatchSnapshots) error {
+	if d.a.TrustedKeys == nil && d.a.config.InsecureSkipVerify {
+		return nil
+	}
+	keys, err := d.a.ServerKeys()
+	if err != nil {
+		return err
+	}
+	for _, s := range b.Snapshots {
+		if s == nil || s.Snapshot == nil {
+			return protocol.ErrMissingTreeHead
+		}
+		if err := s.VerifyKeySet(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *BatchProcessor) Subscribe(id int, ch <-chan *Message) {
 	d.id = id
 
-	if d.a.metrics != nil {
-		d.a.metrics.MustRegister(d.metrics...)
-	}
-
 	go func() {
 		for {
 			select {
@@ -125,19 +255,42 @@ func (d *BatchProcessor) Subscribe(id int, ch <-chan *Message) {
 					continue
 				}
 
+				if err := d.verify(batch); err != nil {
+					log.Infof("BatchProcessor got a batch with an invalid signature: %v. Dropping message.", err)
+					d.invalidSignatures.Inc()
+					from := "unknown peer"
+					if msg.From != nil {
+						from = msg.From.Name
+					}
+					d.a.notify(fmt.Sprintf("Invalid batch signature from %s: %v", from, err))
+					continue
+				}
+
 				if d.wasProcessed(batch) {
 					log.Debugf("BatchProcessor got an already processed message from agent")
 					continue
 				}
 
+				if d.a.recent != nil {
+					for _, s := range batch.Snapshots {
+						d.a.recent.Add(s)
+					}
+				}
+
 				ctx := context.WithValue(d.ctx, "batch", batch)
 				for _, t := range d.tf {
 					log.Debugf("Batch processor creating a new task")
-					err := d.a.Tasks.Add(t.New(ctx))
+					var err error
+					if jm, ok := d.a.Tasks.(JobsManager); ok {
+						err = jm.AddJob(d.job(ctx, t, msg.Payload))
+					} else {
+						err = d.a.Tasks.Add(t.New(ctx))
+					}
 					if err != nil {
 						log.Infof("BatchProcessor was unable to enqueue new task becasue %v", err)
 					}
 				}
+				d.processed(batch)
 
 				d.a.Out.Publish(msg)
 			case <-d.quitCh:
@@ -146,3 +299,254 @@ func (d *BatchProcessor) Subscribe(id int, ch <-chan *Message) {
 		}
 	}()
 }
+
+// AlertProcessor reads the signed alerts raised by other agents. It stores
+// and notifies the new ones and forwards them to the rest of the agents.
+type AlertProcessor struct {
+	a       *Agent
+	metrics []prometheus.Collector
+	quitCh  chan bool
+	id      int
+
+	received prometheus.Counter
+	invalid  prometheus.Counter
+}
+
+func NewAlertProcessor(a *Agent) *AlertProcessor {
+	p := &AlertProcessor{
+		a:      a,
+		quitCh: make(chan bool),
+		received: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_alerts_received_total",
+				Help: "Number of alerts received from other agents.",
+			},
+		),
+		invalid: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_alerts_invalid_total",
+				Help: "Number of alerts dropped because of an invalid signature.",
+			},
+		),
+	}
+	p.metrics = []prometheus.Collector{p.received, p.invalid}
+	return p
+}
+
+func (p *AlertProcessor) Kinds() []MessageType {
+	return []MessageType{AlertMessageType}
+}
+
+func (p *AlertProcessor) Stop() {
+	close(p.quitCh)
+}
+
+func (p *AlertProcessor) Metrics() []prometheus.Collector {
+	return p.metrics
+}
+
+func (p *AlertProcessor) Subscribe(id int, ch <-chan *Message) {
+	p.id = id
+
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				if msg.Kind != AlertMessageType {
+					log.Debugf("AlertProcessor got an unknown message from agent")
+					continue
+				}
+
+				payload := new(SignedPayload)
+				keyId, err := p.a.openSignedPayload(msg, payload)
+				if err != nil {
+					log.Infof("AlertProcessor got an invalid alert: %v. Dropping message.", err)
+					p.invalid.Inc()
+					continue
+				}
+
+				if wasSeen(p.a.Cache, msg.Payload) {
+					log.Debugf("AlertProcessor got an already processed alert from agent")
+					continue
+				}
+
+				alert := new(Alert)
+				if err := payload.Open(alert); err != nil {
+					log.Infof("AlertProcessor unable to decode alert!. Dropping message.")
+					continue
+				}
+				if alert.Origin != msg.From.Name || alert.Role != msg.From.Meta.Role {
+					log.Infof("AlertProcessor got an alert of %s as %s from peer %s. Dropping message.", alert.Origin, alert.Role, msg.From.Name)
+					p.invalid.Inc()
+					continue
+				}
+				p.received.Inc()
+				if p.a.alerts != nil {
+					p.a.alerts.Add(alert)
+				}
+
+				if err := p.a.storeAlert(alert, keyId); err != nil {
+					log.Infof("AlertProcessor unable to store alert: %v", err)
+				}
+				p.a.notify(fmt.Sprintf("Alert from %s agent %s: %s", alert.Role, alert.Origin, alert.Message))
+
+				p.a.Out.Publish(msg)
+			case <-p.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// EvidenceProcessor reads the evidence found by other agents. It verifies
+// the evidence against the keys of the QED servers, and stores, notifies
+// and forwards the valid one.
+type EvidenceProcessor struct {
+	a       *Agent
+	metrics []prometheus.Collector
+	quitCh  chan bool
+	id      int
+
+	received prometheus.Counter
+	invalid  prometheus.Counter
+}
+
+func NewEvidenceProcessor(a *Agent) *EvidenceProcessor {
+	p := &EvidenceProcessor{
+		a:      a,
+		quitCh: make(chan bool),
+		received: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_evidence_received_total",
+				Help: "Number of verified evidence received from other agents.",
+			},
+		),
+		invalid: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_evidence_invalid_total",
+				Help: "Number of evidence dropped because it did not verify.",
+			},
+		),
+	}
+	p.metrics = []prometheus.Collector{p.received, p.invalid}
+	return p
+}
+
+func (p *EvidenceProcessor) Kinds() []MessageType {
+	return []MessageType{EvidenceMessageType}
+}
+
+func (p *EvidenceProcessor) Stop() {
+	close(p.quitCh)
+}
+
+func (p *EvidenceProcessor) Metrics() []prometheus.Collector {
+	return p.metrics
+}
+
+func (p *EvidenceProcessor) Subscribe(id int, ch <-chan *Message) {
+	p.id = id
+
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				if msg.Kind != EvidenceMessageType {
+					log.Debugf("EvidenceProcessor got an unknown message from agent")
+					continue
+				}
+
+				payload := new(SignedPayload)
+				_, err := p.a.openSignedPayload(msg, payload)
+				if err != nil {
+					log.Infof("EvidenceProcessor got an invalid evidence: %v. Dropping message.", err)
+					p.invalid.Inc()
+					continue
+				}
+
+				if wasSeen(p.a.Cache, msg.Payload) {
+					log.Debugf("EvidenceProcessor got an already processed evidence from agent")
+					continue
+				}
+
+				evidence := new(Evidence)
+				if err := payload.Open(evidence); err != nil || evidence.Equivocation == nil {
+					log.Infof("EvidenceProcessor unable to decode evidence!. Dropping message.")
+					p.invalid.Inc()
+					continue
+				}
+				if evidence.Origin != msg.From.Name {
+					log.Infof("EvidenceProcessor got an evidence of %s from peer %s. Dropping message.", evidence.Origin, msg.From.Name)
+					p.invalid.Inc()
+					continue
+				}
+
+				keys, err := p.a.ServerKeys()
+				if err != nil {
+					log.Infof("EvidenceProcessor unable to verify evidence: %v. Dropping message.", err)
+					continue
+				}
+				if err := evidence.Equivocation.Verify(keys); err != nil {
+					log.Infof("EvidenceProcessor got an evidence from %s which does not verify: %v. Dropping message.", evidence.Origin, err)
+					p.invalid.Inc()
+					continue
+				}
+				p.received.Inc()
+
+				path, err := p.a.StoreEvidence(evidence.Equivocation)
+				if err != nil {
+					log.Infof("EvidenceProcessor unable to store evidence: %v", err)
+				}
+				p.a.notify(fmt.Sprintf("CRITICAL: agent %s found an equivocation for version %d of log %q. Evidence in %s", evidence.Origin, evidence.Equivocation.Version, evidence.Equivocation.LogId, path))
+
+				p.a.Out.Publish(msg)
+			case <-p.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// openSignedPayload decodes the signed payload of a message and verifies
+// it is of the kind of the message and signed by the key of the peer
+// which originated the message. It returns the id of the key.
+func (a *Agent) openSignedPayload(msg *Message, payload *SignedPayload) (string, error) {
+	if err := payload.Decode(msg.Payload); err != nil {
+		return "", err
+	}
+	if payload.Kind != msg.Kind {
+		return "", fmt.Errorf("payload of kind %d in a message of kind %d", payload.Kind, msg.Kind)
+	}
+	if msg.From == nil {
+		return "", fmt.Errorf("payload without origin")
+	}
+	verifier, err := a.peerKey(msg.From, payload)
+	if err != nil {
+		return "", err
+	}
+	if err := payload.Verify(verifier); err != nil {
+		return "", err
+	}
+	return verifier.KeyID(), nil
+}
+
+// peerKey returns the key the payloads originated by a peer must be
+// signed with: the key of its join token if the agent has admission keys,
+// or one of the agent keys otherwise.
+func (a *Agent) peerKey(from *Peer, payload *SignedPayload) (sign.Verifier, error) {
+	if a.AdmissionKeys != nil {
+		token, err := a.verifyToken(from.Name, &from.Meta)
+		if err != nil {
+			return nil, err
+		}
+		return token.Verifier()
+	}
+	if a.AgentKeys != nil {
+		verifier, err := a.AgentKeys.Verifier(sign.KeyID(payload.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("payload of peer %s signed with an unknown key", from.Name)
+		}
+		return verifier, nil
+	}
+	return nil, fmt.Errorf("no keys to verify the payloads of the peers")
+}
@@ -20,14 +20,20 @@ import (
 	"context"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestBatchProcessorLoop(t *testing.T) {
@@ -38,6 +44,7 @@ func TestBatchProcessorLoop(t *testing.T) {
 	conf.NodeName = "testNode"
 	conf.Role = "auditor"
 	conf.BindAddr = "127.0.0.1:12345"
+	conf.InsecureSkipVerify = true
 
 	a, err := NewAgentFromConfig(conf)
 	require.NoError(t, err, "Error creating agent!")
@@ -81,6 +88,7 @@ func TestBatchProcessorWasProcessed(t *testing.T) {
 	conf.NodeName = "testNode"
 	conf.Role = "auditor"
 	conf.BindAddr = "127.0.0.1:12345"
+	conf.InsecureSkipVerify = true
 
 	a, err := NewAgentFromConfig(conf)
 	require.NoError(t, err, "Error creating agent!")
@@ -129,6 +137,7 @@ func TestBatchProcessorRegisterMetrics(t *testing.T) {
 	conf.NodeName = "testNode"
 	conf.Role = "auditor"
 	conf.BindAddr = "127.0.0.1:12345"
+	conf.InsecureSkipVerify = true
 	conf.MetricsAddr = "127.0.0.1:12346"
 
 	a, err := NewAgentFromConfig(conf)
@@ -140,8 +149,7 @@ func TestBatchProcessorRegisterMetrics(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	p := NewBatchProcessor(a, []TaskFactory{&fakeTaskFactory{}})
-	a.In.Subscribe(BatchMessageType, p, 0)
-	defer p.Stop()
+	require.NoError(t, a.RegisterProcessor("batch", p))
 
 	resp, err := http.Get("http://" + conf.MetricsAddr + "/metrics")
 	if err != nil {
@@ -153,3 +161,126 @@ func TestBatchProcessorRegisterMetrics(t *testing.T) {
 
 	require.True(t, found > 0, "Metric not found!")
 }
+
+type fakeNotifier struct {
+	alerts []string
+	sync.Mutex
+}
+
+func (n *fakeNotifier) Alert(msg string) error {
+	n.Lock()
+	defer n.Unlock()
+	n.alerts = append(n.alerts, msg)
+	return nil
+}
+
+func (n *fakeNotifier) count() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.alerts)
+}
+
+func (n *fakeNotifier) Start() {}
+func (n *fakeNotifier) Stop()  {}
+
+func TestBatchProcessorVerifySignatures(t *testing.T) {
+
+	trusted := sign.NewEd25519Signer()
+	untrusted := sign.NewEd25519Signer()
+
+	dir, err := ioutil.TempDir("", "qed-processor-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sshKey, err := ssh.NewPublicKey(ed25519.PublicKey(trusted.PublicKey()))
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "trusted.pub")
+	require.NoError(t, ioutil.WriteFile(keyPath, ssh.MarshalAuthorizedKey(sshKey), 0644))
+
+	ts := &testSubscriber{}
+	notifier := &fakeNotifier{}
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "auditor"
+	conf.BindAddr = "127.0.0.1:12345"
+	conf.TrustedKeys = []string{keyPath}
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	a.Notifier = notifier
+	require.NotNil(t, a.TrustedKeys, "Trusted keys must be loaded")
+
+	p := NewBatchProcessor(a, nil)
+	a.In.Subscribe(BatchMessageType, p, 0)
+	defer p.Stop()
+
+	a.Out.Subscribe(BatchMessageType, ts, 5)
+
+	snapshot := &protocol.Snapshot{
+		HistoryDigest: []byte{0x0},
+		HyperDigest:   []byte{0x1},
+		Version:       0,
+		EventDigest:   []byte{0x0},
+	}
+	newMessage := func(signer sign.Signer) *Message {
+		signed, err := protocol.SignSnapshot(signer, snapshot, time.Now())
+		require.NoError(t, err)
+		batch := &protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{signed}}
+		buf, err := batch.Encode()
+		require.NoError(t, err)
+		return &Message{Kind: BatchMessageType, Payload: buf}
+	}
+
+	// the bus does not keep the order of the messages, so the forged
+	// batch must be dropped before publishing the valid one
+	a.In.Publish(newMessage(untrusted))
+	for i := 0; testutil.ToFloat64(p.invalidSignatures) == 0; i++ {
+		require.True(t, i < 100, "The forged batch must be counted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	valid := newMessage(trusted)
+	a.In.Publish(valid)
+
+	select {
+	case m := <-ts.ch:
+		require.Equal(t, valid, m, "Only the batch signed with a trusted key must be forwarded")
+	case <-time.After(1 * time.Second):
+		t.Fatal("The valid batch was not forwarded")
+	}
+	require.Equal(t, 0, len(ts.ch), "The forged batch must be dropped")
+	require.Equal(t, 1.0, testutil.ToFloat64(p.invalidSignatures), "Only the forged batch must be counted")
+	require.Equal(t, 1, notifier.count(), "The forged batch must be notified")
+}
+
+func TestBatchProcessorRequiresTrustedKeys(t *testing.T) {
+
+	ts := &testSubscriber{}
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "auditor"
+	conf.BindAddr = "127.0.0.1:12345"
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	require.Equal(t, ErrNoTrustedKeys, a.CheckTrustedKeys(), "Agents must not process snapshots without trusted keys")
+
+	p := NewBatchProcessor(a, nil)
+	a.In.Subscribe(BatchMessageType, p, 0)
+	defer p.Stop()
+	a.Out.Subscribe(BatchMessageType, ts, 5)
+
+	batch := &protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{{Snapshot: &protocol.Snapshot{Version: 1}}}}
+	buf, _ := batch.Encode()
+	a.In.Publish(&Message{Kind: BatchMessageType, Payload: buf})
+	for i := 0; testutil.ToFloat64(p.invalidSignatures) == 0; i++ {
+		require.True(t, i < 100, "The unverified batch must be counted")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, len(ts.ch), "Batches must not be forwarded without trusted keys")
+
+	conf.InsecureSkipVerify = true
+	a, err = NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	require.NoError(t, a.CheckTrustedKeys(), "Insecure agents may process snapshots without trusted keys")
+}
@@ -0,0 +1,301 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/bbva/qed/protocol"
+)
+
+// Strategies to choose the snapshots audited by an auditor.
+const (
+	// SampleAll audits every snapshot received.
+	SampleAll = "all"
+	// SampleRate audits each snapshot received with a fixed probability.
+	SampleRate = "rate"
+	// SampleReservoir keeps a uniform sample of all the snapshots ever
+	// received and audits some of them with every batch, so old events
+	// keep being checked.
+	SampleReservoir = "reservoir"
+)
+
+// A Sampler chooses the snapshots to audit out of the batches received.
+type Sampler interface {
+	Sample(snapshots []*protocol.SignedSnapshot) []*protocol.SignedSnapshot
+	Strategy() string
+}
+
+//Sampler configuration object used to parse
+//cli options and to build the Sampler instance
+type SamplerConfig struct {
+	Strategy      string  `desc:"Snapshots to audit: all, rate or reservoir"`
+	Rate          float64 `desc:"Probability of auditing each snapshot with the rate strategy"`
+	ReservoirSize int     `desc:"Number of historical snapshots kept by the reservoir strategy"`
+	SampleSize    int     `desc:"Number of snapshots audited per batch by the reservoir strategy"`
+}
+
+// Returns the default configuration for the Sampler
+func DefaultSamplerConfig() *SamplerConfig {
+	return &SamplerConfig{
+		Strategy:      SampleAll,
+		Rate:          0.1,
+		ReservoirSize: 1024,
+		SampleSize:    10,
+	}
+}
+
+// Returns the Sampler of the strategy of the configuration c.
+func NewSamplerFromConfig(c *SamplerConfig) (Sampler, error) {
+	switch c.Strategy {
+	case SampleAll:
+		return allSampler{}, nil
+	case SampleRate:
+		if c.Rate < 0 || c.Rate > 1 {
+			return nil, fmt.Errorf("sample rate %v out of range [0, 1]", c.Rate)
+		}
+		return &rateSampler{rate: c.Rate}, nil
+	case SampleReservoir:
+		if c.ReservoirSize < 1 || c.SampleSize < 1 {
+			return nil, fmt.Errorf("reservoir and sample sizes must be positive")
+		}
+		return NewReservoirSampler(c.ReservoirSize, c.SampleSize), nil
+	default:
+		return nil, fmt.Errorf("unknown sampling strategy %q", c.Strategy)
+	}
+}
+
+type allSampler struct{}
+
+func (s allSampler) Sample(snapshots []*protocol.SignedSnapshot) []*protocol.SignedSnapshot {
+	return snapshots
+}
+
+func (s allSampler) Strategy() string {
+	return SampleAll
+}
+
+type rateSampler struct {
+	rate float64
+}
+
+func (s *rateSampler) Sample(snapshots []*protocol.SignedSnapshot) []*protocol.SignedSnapshot {
+	sample := make([]*protocol.SignedSnapshot, 0)
+	for _, snap := range snapshots {
+		if rand.Float64() < s.rate {
+			sample = append(sample, snap)
+		}
+	}
+	return sample
+}
+
+func (s *rateSampler) Strategy() string {
+	return SampleRate
+}
+
+// ReservoirSampler keeps a uniform random sample of size snapshots of
+// all the snapshots it has seen, using reservoir sampling, and audits
+// sampleSize of them with every batch.
+type ReservoirSampler struct {
+	size       int
+	sampleSize int
+	seen       int64
+	reservoir  []*protocol.SignedSnapshot
+	lock       sync.Mutex
+}
+
+func NewReservoirSampler(size, sampleSize int) *ReservoirSampler {
+	return &ReservoirSampler{
+		size:       size,
+		sampleSize: sampleSize,
+		reservoir:  make([]*protocol.SignedSnapshot, 0, size),
+	}
+}
+
+func (s *ReservoirSampler) Sample(snapshots []*protocol.SignedSnapshot) []*protocol.SignedSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, snap := range snapshots {
+		s.seen++
+		if len(s.reservoir) < s.size {
+			s.reservoir = append(s.reservoir, snap)
+			continue
+		}
+		if j := rand.Int63n(s.seen); j < int64(s.size) {
+			s.reservoir[j] = snap
+		}
+	}
+
+	n := s.sampleSize
+	if n > len(s.reservoir) {
+		n = len(s.reservoir)
+	}
+	sample := make([]*protocol.SignedSnapshot, 0, n)
+	for _, i := range rand.Perm(len(s.reservoir))[:n] {
+		sample = append(sample, s.reservoir[i])
+	}
+	return sample
+}
+
+func (s *ReservoirSampler) Strategy() string {
+	return SampleReservoir
+}
+
+// AuditCoverage tracks which versions of each log have been audited,
+// out of the versions seen in the gossip network.
+type AuditCoverage struct {
+	logs map[string]*logCoverage
+	lock sync.Mutex
+}
+
+type logCoverage struct {
+	audited []versionRange // sorted and disjoint ranges of audited versions
+	count   uint64
+	first   uint64 // lowest version seen
+	seen    uint64 // highest version seen plus one
+}
+
+// versionRange is a range of consecutive versions, both ends included.
+type versionRange struct {
+	start, end uint64
+}
+
+func NewAuditCoverage() *AuditCoverage {
+	return &AuditCoverage{
+		logs: make(map[string]*logCoverage),
+	}
+}
+
+func (c *AuditCoverage) log(logId string) *logCoverage {
+	l, ok := c.logs[logId]
+	if !ok {
+		l = &logCoverage{}
+		c.logs[logId] = l
+	}
+	return l
+}
+
+// see widens the versions seen of the log to include the given one.
+// Agents join the network at any version, so the coverage is measured
+// from the first version they see.
+func (l *logCoverage) see(version uint64) {
+	if l.seen == 0 {
+		l.first, l.seen = version, version+1
+		return
+	}
+	if version < l.first {
+		l.first = version
+	}
+	if version >= l.seen {
+		l.seen = version + 1
+	}
+}
+
+// search returns the index of the first range that ends at or after the
+// version.
+func (l *logCoverage) search(version uint64) int {
+	return sort.Search(len(l.audited), func(i int) bool {
+		return l.audited[i].end >= version
+	})
+}
+
+// add records a version as audited, merging it with the adjacent ranges,
+// so the memory used depends on the gaps between the audited versions
+// and not on their value. It returns false if the version was already
+// audited.
+func (l *logCoverage) add(version uint64) bool {
+	i := l.search(version)
+	if i < len(l.audited) && l.audited[i].start <= version {
+		return false
+	}
+	joinsPrev := i > 0 && l.audited[i-1].end+1 == version
+	joinsNext := i < len(l.audited) && l.audited[i].start == version+1
+	switch {
+	case joinsPrev && joinsNext:
+		l.audited[i-1].end = l.audited[i].end
+		l.audited = append(l.audited[:i], l.audited[i+1:]...)
+	case joinsPrev:
+		l.audited[i-1].end = version
+	case joinsNext:
+		l.audited[i].start = version
+	default:
+		l.audited = append(l.audited, versionRange{})
+		copy(l.audited[i+1:], l.audited[i:])
+		l.audited[i] = versionRange{version, version}
+	}
+	l.count++
+	return true
+}
+
+// Seen records a version as received, whether audited or not.
+func (c *AuditCoverage) Seen(s *protocol.Snapshot) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.log(s.LogId).see(s.Version)
+}
+
+// Audited records a version as audited. It returns false if the version
+// had already been audited.
+func (c *AuditCoverage) Audited(s *protocol.Snapshot) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	l := c.log(s.LogId)
+	l.see(s.Version)
+	return l.add(s.Version)
+}
+
+// IsAudited returns if a version of a log has been audited.
+func (c *AuditCoverage) IsAudited(logId string, version uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	l, ok := c.logs[logId]
+	if !ok {
+		return false
+	}
+	i := l.search(version)
+	return i < len(l.audited) && l.audited[i].start <= version
+}
+
+// Versions returns the number of distinct versions audited.
+func (c *AuditCoverage) Versions() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var count uint64
+	for _, l := range c.logs {
+		count += l.count
+	}
+	return count
+}
+
+// Ratio returns the fraction of the versions between the lowest and the
+// highest one seen of each log which have been audited.
+func (c *AuditCoverage) Ratio() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var count, seen uint64
+	for _, l := range c.logs {
+		count += l.count
+		seen += l.seen - l.first
+	}
+	if seen == 0 {
+		return 0
+	}
+	return float64(count) / float64(seen)
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package gossip
+
+import (
+	"testing"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSnapshots(from, to uint64) []*protocol.SignedSnapshot {
+	snapshots := make([]*protocol.SignedSnapshot, 0)
+	for v := from; v <= to; v++ {
+		snapshots = append(snapshots, &protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: v}})
+	}
+	return snapshots
+}
+
+func TestSamplers(t *testing.T) {
+
+	batch := newTestSnapshots(0, 999)
+
+	conf := DefaultSamplerConfig()
+	sampler, err := NewSamplerFromConfig(conf)
+	require.NoError(t, err)
+	require.Equal(t, SampleAll, sampler.Strategy())
+	require.Len(t, sampler.Sample(batch), len(batch), "All the snapshots must be sampled")
+
+	conf.Strategy = SampleRate
+	conf.Rate = 0
+	sampler, err = NewSamplerFromConfig(conf)
+	require.NoError(t, err)
+	require.Len(t, sampler.Sample(batch), 0, "No snapshot must be sampled with rate 0")
+	conf.Rate = 0.5
+	sampler, err = NewSamplerFromConfig(conf)
+	require.NoError(t, err)
+	n := len(sampler.Sample(batch))
+	require.True(t, n > 350 && n < 650, "About half the snapshots must be sampled, got %d", n)
+
+	conf.Rate = 1.5
+	_, err = NewSamplerFromConfig(conf)
+	require.Error(t, err, "Rates must be probabilities")
+	conf.Strategy = "random"
+	_, err = NewSamplerFromConfig(conf)
+	require.Error(t, err, "Unknown strategies must be rejected")
+}
+
+func TestReservoirSampler(t *testing.T) {
+
+	sampler := NewReservoirSampler(100, 10)
+
+	sample := sampler.Sample(newTestSnapshots(0, 4))
+	require.Len(t, sample, 5, "The sample is limited by the snapshots seen")
+
+	// after many batches, old versions must still be sampled
+	old := 0
+	for i := uint64(1); i < 100; i++ {
+		sample = sampler.Sample(newTestSnapshots(i*100, i*100+99))
+		require.Len(t, sample, 10)
+		for _, s := range sample {
+			if s.Snapshot.Version < i*100 {
+				old++
+			}
+		}
+	}
+	require.True(t, old > 0, "Historical versions must be sampled")
+	require.Len(t, sampler.reservoir, 100, "The reservoir must be bounded")
+}
+
+func TestAuditCoverage(t *testing.T) {
+
+	coverage := NewAuditCoverage()
+	require.Equal(t, 0.0, coverage.Ratio())
+
+	for _, s := range newTestSnapshots(0, 9) {
+		coverage.Seen(s.Snapshot)
+	}
+	require.True(t, coverage.Audited(&protocol.Snapshot{Version: 2}))
+	require.False(t, coverage.Audited(&protocol.Snapshot{Version: 2}), "Versions are audited once")
+	require.True(t, coverage.Audited(&protocol.Snapshot{Version: 130}))
+	require.True(t, coverage.Audited(&protocol.Snapshot{Version: 2, LogId: "other"}))
+
+	require.True(t, coverage.IsAudited("", 130))
+	require.False(t, coverage.IsAudited("", 3))
+	require.False(t, coverage.IsAudited("unknown", 2))
+	require.Equal(t, uint64(3), coverage.Versions())
+	require.InDelta(t, 3.0/(131+1), coverage.Ratio(), 1e-9, "The coverage is measured from the first version seen")
+}
+
+func TestAuditCoverageRanges(t *testing.T) {
+
+	coverage := NewAuditCoverage()
+	first := uint64(1) << 62
+	for _, v := range []uint64{5, 3, 7, 4, 6, 10} {
+		require.True(t, coverage.Audited(&protocol.Snapshot{Version: first + v}))
+	}
+	require.False(t, coverage.Audited(&protocol.Snapshot{Version: first + 5}), "Versions are audited once")
+
+	l := coverage.logs[""]
+	require.Equal(t, []versionRange{{first + 3, first + 7}, {first + 10, first + 10}}, l.audited, "Consecutive versions must be merged")
+	for v := uint64(3); v <= 10; v++ {
+		require.Equalf(t, v <= 7 || v == 10, coverage.IsAudited("", first+v), "Wrong coverage of version %d", v)
+	}
+	require.Equal(t, uint64(6), coverage.Versions())
+	require.InDelta(t, 6.0/8, coverage.Ratio(), 1e-9)
+}
@@ -2,8 +2,8 @@ package gossip
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -11,11 +11,10 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
-
-	"github.com/bbva/qed/util"
-	"github.com/google/btree"
+	"github.com/bbva/qed/snapshotstore"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bplus"
 )
 
 type SnapshotStore interface {
@@ -25,6 +24,17 @@ type SnapshotStore interface {
 	GetSnapshot(version uint64) (*protocol.SignedSnapshot, error)
 	DeleteRange(start, end uint64) error
 	Count() (uint64, error)
+	// Latest returns the snapshot with the greatest version, or
+	// snapshotstore.ErrSnapshotNotFound if the store is empty.
+	Latest() (*protocol.SignedSnapshot, error)
+}
+
+// A CosignatureStore keeps the cosignatures of the witnesses along with
+// the snapshots they cosigned. Both the REST and the local snapshot
+// stores are cosignature stores.
+type CosignatureStore interface {
+	PutCosignatures(c *protocol.CosignedSnapshot) error
+	GetCosignatures(version uint64) (*protocol.CosignedSnapshot, error)
 }
 
 // Implements access to a snapshot store
@@ -33,6 +43,7 @@ type SnapshotStore interface {
 // asynchronous, so a start and stop method is
 type RestSnapshotStore struct {
 	endpoint []string
+	apiKey   string
 	client   *http.Client
 }
 
@@ -42,10 +53,13 @@ type RestSnapshotStoreConfig struct {
 	Endpoint    []string      `desc:"REST snapshot store service endpoint list http://ip1:port1/path1,http://ip2:port2/path2... "`
 	DialTimeout time.Duration `desc:"Timeout dialing the REST snapshot store service"`
 	ReadTimeout time.Duration `desc:"Timeout reading the REST snapshot store service response"`
+	APIKey      string        `desc:"Key to write or delete snapshots in the REST snapshot store service"`
 }
 
 func NewRestSnapshotStoreFromConfig(c *RestSnapshotStoreConfig) *RestSnapshotStore {
-	return NewRestSnapshotStore(c.Endpoint, c.DialTimeout, c.ReadTimeout)
+	store := NewRestSnapshotStore(c.Endpoint, c.DialTimeout, c.ReadTimeout)
+	store.apiKey = c.APIKey
+	return store
 }
 
 func DefaultRestSnapshotStoreConfig() *RestSnapshotStoreConfig {
@@ -84,147 +98,325 @@ func (r *RestSnapshotStore) PutBatch(b *protocol.BatchSnapshots) error {
 	if err != nil {
 		return err
 	}
-	n := len(r.endpoint)
-	if n == 0 {
-		log.Errorf("No endpoint configured for snapshot store!")
-	}
-	url := r.endpoint[0]
-	if n > 1 {
-		url = r.endpoint[rand.Intn(n)]
-	}
-	resp, err := r.client.Post(url+"/batch", "application/json", bytes.NewBuffer(buf))
+	url, err := r.pickEndpoint()
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp, err := r.write("POST", url+"/batch", buf)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return checkStoreResponse(resp)
 }
 
+// PutSnapshot stores a snapshot under the given version.
 func (r *RestSnapshotStore) PutSnapshot(version uint64, snapshot *protocol.SignedSnapshot) error {
-	panic("not implemented")
+	buf, err := snapshot.Encode()
+	if err != nil {
+		return err
+	}
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return err
+	}
+	resp, err := r.write("POST", fmt.Sprintf("%s/snapshot?v=%d", url, version), buf)
+	if err != nil {
+		return fmt.Errorf("Error storing snapshot %d because %v", version, err)
+	}
+	return checkStoreResponse(resp)
 }
 
+// GetRange returns the snapshots with a version in the range [start, end],
+// following the pages served by the store.
 func (r *RestSnapshotStore) GetRange(start uint64, end uint64) ([]protocol.SignedSnapshot, error) {
-	panic("not implemented")
+	result := make([]protocol.SignedSnapshot, 0)
+	if start > end {
+		return result, nil
+	}
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := r.client.Get(fmt.Sprintf("%s/snapshots?start=%d&end=%d", url, start, end))
+		if err != nil {
+			return nil, fmt.Errorf("Error getting snapshots [%d, %d] from store because %v", start, end, err)
+		}
+		buf, err := readStoreResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		var page protocol.BatchSnapshots
+		if err := page.Decode(buf); err != nil {
+			return nil, fmt.Errorf("Error decoding snapshots [%d, %d]: %v", start, end, err)
+		}
+		for _, s := range page.Snapshots {
+			result = append(result, *s)
+		}
+
+		header := resp.Header.Get(snapshotstore.NextVersionHeader)
+		if header == "" {
+			return result, nil
+		}
+		next, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the next version of the range: %v", err)
+		}
+		// a next version which does not move forward within the range
+		// would make the client loop forever
+		if next <= start || next > end {
+			return nil, fmt.Errorf("Invalid next version %d of the range [%d, %d]", next, start, end)
+		}
+		start = next
+	}
 }
 
 func (r *RestSnapshotStore) GetSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
-	n := len(r.endpoint)
-	url := r.endpoint[0]
-	if n > 1 {
-		url = r.endpoint[rand.Intn(n)]
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return nil, err
 	}
-	resp, err := r.client.Get(fmt.Sprintf("%s/snapshot?v=%d", url, version))
+	return r.getSnapshot(fmt.Sprintf("%s/snapshot?v=%d", url, version))
+}
+
+// GetSnapshotBySignature returns the snapshot with the given signature.
+func (r *RestSnapshotStore) GetSnapshotBySignature(signature []byte) (*protocol.SignedSnapshot, error) {
+	url, err := r.pickEndpoint()
 	if err != nil {
-		return nil, fmt.Errorf("Error getting snapshot %d from store because %v", version, err)
+		return nil, err
 	}
+	return r.getSnapshot(fmt.Sprintf("%s/snapshot?signature=%x", url, signature))
+}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error getting snapshot from the store. Status: %d", resp.StatusCode)
+func (r *RestSnapshotStore) getSnapshot(url string) (*protocol.SignedSnapshot, error) {
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting snapshot from store because %v", err)
 	}
-	buf, err := ioutil.ReadAll(resp.Body)
+	buf, err := readStoreResponse(resp)
 	if err != nil {
 		return nil, err
 	}
 	var s protocol.SignedSnapshot
 	err = s.Decode(buf)
 	if err != nil {
-		return nil, fmt.Errorf("Error decoding signed snapshot %d codec", s.Snapshot.Version)
+		return nil, fmt.Errorf("Error decoding signed snapshot: %v", err)
 	}
 	return &s, nil
 }
 
+// DeleteRange deletes the snapshots with a version in the range [start, end].
 func (r *RestSnapshotStore) DeleteRange(start uint64, end uint64) error {
-	panic("not implemented")
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return err
+	}
+	resp, err := r.write("DELETE", fmt.Sprintf("%s/snapshots?start=%d&end=%d", url, start, end), nil)
+	if err != nil {
+		return fmt.Errorf("Error deleting snapshots [%d, %d] from store because %v", start, end, err)
+	}
+	return checkStoreResponse(resp)
 }
 
 func (r *RestSnapshotStore) Count() (uint64, error) {
-	n := len(r.endpoint)
-	url := r.endpoint[0]
-	if n > 1 {
-		url = r.endpoint[rand.Intn(n)]
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return 0, err
 	}
 	resp, err := r.client.Get(url + "/count")
 	if err != nil {
 		return 0, err
 	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Error getting snapshot from the store. Status: %d", resp.StatusCode)
-	}
-	buf, err := ioutil.ReadAll(resp.Body)
+	buf, err := readStoreResponse(resp)
 	if err != nil {
 		return 0, err
 	}
 	count, err := strconv.ParseUint(string(buf), 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("Error parsin store response: got %d", resp.StatusCode)
+		return 0, fmt.Errorf("Error parsing store response: %v", err)
 	}
 
 	return count, nil
 }
 
-type BPlusTreeStore struct {
-	db *btree.BTree
+// Latest returns the snapshot with the greatest version, or
+// snapshotstore.ErrSnapshotNotFound if the store is empty.
+func (r *RestSnapshotStore) Latest() (*protocol.SignedSnapshot, error) {
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Get(url + "/latest")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the latest snapshot from store because %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, snapshotstore.ErrSnapshotNotFound
+	}
+	buf, err := readStoreResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	var s protocol.SignedSnapshot
+	if err := s.Decode(buf); err != nil {
+		return nil, fmt.Errorf("Error decoding signed snapshot: %v", err)
+	}
+	return &s, nil
 }
 
-type StoreItem struct {
-	Key, Value []byte
+// PutCosignatures stores the cosignatures of a snapshot of the default
+// log, along with the snapshot.
+func (r *RestSnapshotStore) PutCosignatures(c *protocol.CosignedSnapshot) error {
+	buf, err := c.Encode()
+	if err != nil {
+		return err
+	}
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return err
+	}
+	resp, err := r.write("POST", url+"/cosignatures", buf)
+	if err != nil {
+		return fmt.Errorf("Error storing cosignatures because %v", err)
+	}
+	return checkStoreResponse(resp)
+}
+
+// GetCosignatures returns the snapshot of the given version along with
+// its cosignatures.
+func (r *RestSnapshotStore) GetCosignatures(version uint64) (*protocol.CosignedSnapshot, error) {
+	url, err := r.pickEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Get(fmt.Sprintf("%s/cosignatures?v=%d", url, version))
+	if err != nil {
+		return nil, fmt.Errorf("Error getting cosignatures from store because %v", err)
+	}
+	buf, err := readStoreResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	var c protocol.CosignedSnapshot
+	if err := c.Decode(buf); err != nil {
+		return nil, fmt.Errorf("Error decoding cosigned snapshot: %v", err)
+	}
+	return &c, nil
 }
 
-func (p StoreItem) Less(b btree.Item) bool {
-	return bytes.Compare(p.Key, b.(StoreItem).Key) < 0
+// write sends a request which writes or deletes snapshots, along with
+// the API key which authorizes it.
+func (r *RestSnapshotStore) write(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(snapshotstore.APIKeyHeader, r.apiKey)
+	return r.client.Do(req)
 }
 
-func (s *BPlusTreeStore) Count() (uint64, error) {
-	panic("not implemented")
+// pickEndpoint returns one of the configured endpoints at random.
+func (r *RestSnapshotStore) pickEndpoint() (string, error) {
+	n := len(r.endpoint)
+	switch n {
+	case 0:
+		return "", errors.New("No endpoint configured for snapshot store")
+	case 1:
+		return r.endpoint[0], nil
+	}
+	return r.endpoint[rand.Intn(n)], nil
 }
 
-func (s *BPlusTreeStore) PutSnapshot(version uint64, snapshot protocol.Snapshot) error {
-	encoded, err := snapshot.Encode()
+// readStoreResponse reads the body of a response of the store, which
+// must have a successful status.
+func readStoreResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s.db.ReplaceOrInsert(StoreItem{util.Uint64AsBytes(version), encoded})
-	return nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Error in the snapshot store request. Status: %d", resp.StatusCode)
+	}
+	return buf, nil
 }
 
-func (s BPlusTreeStore) GetRange(start, end uint64) ([]protocol.Snapshot, error) {
-	result := make([]protocol.Snapshot, 0)
-	startKey := util.Uint64AsBytes(start)
-	endKey := util.Uint64AsBytes(end)
-	s.db.AscendGreaterOrEqual(StoreItem{startKey, nil}, func(i btree.Item) bool {
-		key := i.(StoreItem).Key
-		if bytes.Compare(key, endKey) > 0 {
-			return false
-		}
-		var snapshot protocol.Snapshot
-		if err := snapshot.Decode(i.(StoreItem).Value); err != nil {
-			return false
-		}
-		result = append(result, snapshot)
-		return true
-	})
-	return result, nil
-}
-
-func (s *BPlusTreeStore) DeleteRange(start, end uint64) error {
-	startKey := util.Uint64AsBytes(start)
-	endKey := util.Uint64AsBytes(end)
-	s.db.AscendGreaterOrEqual(StoreItem{startKey, nil}, func(i btree.Item) bool {
-		key := i.(StoreItem).Key
-		if bytes.Compare(key, endKey) > 0 {
-			return false
-		}
-		s.db.Delete(i)
-		return true
-	})
-	return nil
+func checkStoreResponse(resp *http.Response) error {
+	_, err := readStoreResponse(resp)
+	return err
+}
+
+// SnapshotStoreConfig selects the snapshot store of an agent: the REST
+// service shared by the agents, or a local one kept in memory or in a
+// directory. Local stores let an agent keep the history of the snapshots
+// it verified without any external service.
+type SnapshotStoreConfig struct {
+	Type string `desc:"Snapshot store type: rest, memory or local"`
+	RestSnapshotStoreConfig
+	Path string `desc:"Directory of the local snapshot store"`
+}
+
+func DefaultSnapshotStoreConfig() *SnapshotStoreConfig {
+	return &SnapshotStoreConfig{
+		Type:                    "rest",
+		RestSnapshotStoreConfig: *DefaultRestSnapshotStoreConfig(),
+	}
+}
+
+// IsLocal tells if the configured store is kept by the agent itself.
+func (c *SnapshotStoreConfig) IsLocal() bool {
+	return c.Type == "memory" || c.Type == "local"
+}
+
+// StoreOpener opens the database kept in a directory by a local
+// snapshot store. It is injected by the caller, so the gossip package
+// does not depend on any storage engine.
+type StoreOpener func(path string) (storage.Store, error)
+
+// NewSnapshotStoreFromConfig returns the configured snapshot store,
+// opening the database of local stores with the given opener.
+func NewSnapshotStoreFromConfig(c *SnapshotStoreConfig, open StoreOpener) (SnapshotStore, error) {
+	switch c.Type {
+	case "", "rest":
+		return NewRestSnapshotStoreFromConfig(&c.RestSnapshotStoreConfig), nil
+	case "memory":
+		return NewMemorySnapshotStore(), nil
+	case "local":
+		return NewLocalSnapshotStore(c.Path, open)
+	default:
+		return nil, fmt.Errorf("unknown snapshot store type %q", c.Type)
+	}
+}
+
+// NewMemorySnapshotStore returns a snapshot store kept in memory, which
+// is lost when the agent stops.
+func NewMemorySnapshotStore() *snapshotstore.Store {
+	// a store over an empty database has nothing to count, so it cannot fail
+	store, _ := snapshotstore.NewStore(bplus.NewBPlusTreeStore())
+	return store
+}
+
+// NewLocalSnapshotStore returns a snapshot store persisted in the given
+// directory, in a database opened with the given opener.
+func NewLocalSnapshotStore(path string, open StoreOpener) (*snapshotstore.Store, error) {
+	if path == "" {
+		return nil, errors.New("the local snapshot store needs a path")
+	}
+	if open == nil {
+		return nil, errors.New("the local snapshot store needs a database")
+	}
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := snapshotstore.NewStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
 }
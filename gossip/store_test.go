@@ -23,6 +23,9 @@ import (
 	"time"
 
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/snapshotstore"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bplus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -49,3 +52,73 @@ func TestDefaultStore(t *testing.T) {
 
 	require.True(t, called, "Server must be called from store")
 }
+
+func TestSnapshotStoreFromConfig(t *testing.T) {
+	conf := DefaultSnapshotStoreConfig()
+	store, err := NewSnapshotStoreFromConfig(conf, nil)
+	require.NoError(t, err)
+	require.IsType(t, &RestSnapshotStore{}, store)
+	require.False(t, conf.IsLocal())
+
+	conf.Type = "memory"
+	store, err = NewSnapshotStoreFromConfig(conf, nil)
+	require.NoError(t, err)
+	require.True(t, conf.IsLocal())
+
+	for v := uint64(0); v < 5; v++ {
+		s := &protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: v}, Signature: []byte{byte(v)}}
+		require.NoError(t, store.PutSnapshot(v, s))
+	}
+	require.NoError(t, store.PutBatch(&protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{
+		{Snapshot: &protocol.Snapshot{Version: 5}, Signature: []byte{5}},
+	}}))
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), count)
+	s, err := store.GetSnapshot(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5}, s.Signature)
+	snapshots, err := store.GetRange(1, 3)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 3)
+	require.NoError(t, store.DeleteRange(0, 4))
+	count, _ = store.Count()
+	require.Equal(t, uint64(1), count)
+
+	conf.Type = "local"
+	_, err = NewSnapshotStoreFromConfig(conf, nil)
+	require.Error(t, err, "A local store needs a path")
+
+	conf.Path = "snapshots"
+	_, err = NewSnapshotStoreFromConfig(conf, nil)
+	require.Error(t, err, "A local store needs a database opener")
+
+	var opened string
+	store, err = NewSnapshotStoreFromConfig(conf, func(path string) (storage.Store, error) {
+		opened = path
+		return bplus.NewBPlusTreeStore(), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "snapshots", opened, "The database should be opened in the path of the store")
+	require.NoError(t, store.PutSnapshot(0, &protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: 0}, Signature: []byte{0}}))
+
+	conf.Type = "unknown"
+	_, err = NewSnapshotStoreFromConfig(conf, nil)
+	require.Error(t, err)
+}
+
+func TestRestSnapshotStoreInvalidNextVersion(t *testing.T) {
+	var next string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, _ := (&protocol.BatchSnapshots{}).Encode()
+		w.Header().Set(snapshotstore.NextVersionHeader, next)
+		w.Write(out)
+	}))
+	defer server.Close()
+	store := NewRestSnapshotStore([]string{server.URL}, time.Second, time.Second)
+
+	for _, next = range []string{"5", "3", "11", "x"} {
+		_, err := store.GetRange(5, 10)
+		require.Errorf(t, err, "The next version %s should be rejected", next)
+	}
+}
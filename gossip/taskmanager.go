@@ -180,6 +180,11 @@ func (p PrinterFactory) Metrics() []prometheus.Collector {
 	return nil
 }
 
+// Priority of the printing tasks, which run after any other task.
+func (p PrinterFactory) Priority() Priority {
+	return LowPriority
+}
+
 func (p PrinterFactory) New(ctx context.Context) Task {
 	// a := ctx.Value("agent").(Agent)
 	fmt.Println("PrinterFactory creating new Task!")
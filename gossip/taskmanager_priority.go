@@ -0,0 +1,395 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/log"
+)
+
+var (
+	ErrTasksManagerStopped = errors.New("tasks manager stopped")
+	ErrTaskTimeout         = errors.New("task deadline exceeded")
+	ErrNotReplayable       = errors.New("task kind not replayable")
+)
+
+// Priority of a job. Jobs of a higher priority are always run before the
+// pending jobs of lower ones.
+type Priority int
+
+const (
+	LowPriority Priority = iota
+	NormalPriority
+	HighPriority
+)
+
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// Job is a task with the information to schedule it. The context given
+// to Run is cancelled when the deadline of the attempt is exceeded.
+//
+// Jobs with a kind can be replayed from the dead letter queue: the
+// replayer registered for the kind rebuilds the job from its payload.
+type Job struct {
+	Kind     string
+	Payload  []byte
+	Priority Priority
+	// Timeout of each attempt. Zero uses the one of the tasks manager.
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+
+	attempts int
+	// ignoresContext is set for the jobs of tasks without a context, as
+	// the ones built by NewTaskJob, which keep running past their
+	// deadline.
+	ignoresContext bool
+}
+
+// NewTaskJob returns a job which runs a task without a context. As the
+// task cannot be cancelled, the job is never retried once an attempt
+// times out, so no retry runs along with the abandoned attempt.
+func NewTaskJob(kind string, payload []byte, priority Priority, task Task) *Job {
+	return &Job{
+		Kind:     kind,
+		Payload:  payload,
+		Priority: priority,
+		Run: func(ctx context.Context) error {
+			return task()
+		},
+		ignoresContext: true,
+	}
+}
+
+// Replayer rebuilds a job of its kind from the payload kept in the dead
+// letter queue.
+type Replayer func(payload []byte) (*Job, error)
+
+// JobsManager is a TasksManager which schedules jobs by priority, with
+// deadlines and retries, and keeps the ones which exhaust their retries in
+// a dead letter queue.
+type JobsManager interface {
+	TasksManager
+	AddJob(j *Job) error
+	RegisterReplayer(kind string, r Replayer)
+	DeadLetters() *DeadLetterQueue
+	Replay(id uint64) error
+}
+
+// TaskPrioritizer is implemented by the task factories whose tasks do not
+// run with the normal priority.
+type TaskPrioritizer interface {
+	Priority() Priority
+}
+
+// PriorityTasksManager configuration object used to parse
+// cli options and to build the PriorityTasksManager instance
+type PriorityTasksManagerConfig struct {
+	MaxTasks         int           `desc:"Maximum number of concurrent tasks"`
+	QueueSize        int           `desc:"Maximum number of tasks waiting in each priority lane"`
+	Timeout          time.Duration `desc:"Deadline of each attempt to run a task"`
+	MaxRetries       int           `desc:"Number of retries of a failed task before moving it to the dead letter queue"`
+	RetryInterval    time.Duration `desc:"Initial interval between retries of a failed task"`
+	MaxRetryInterval time.Duration `desc:"Maximum interval between retries of a failed task"`
+	DeadLetterPath   string        `desc:"File where the tasks which exhausted their retries are kept"`
+	MaxDeadLetters   int           `desc:"Maximum number of tasks kept in the dead letter queue"`
+}
+
+// Returns the default configuration for the PriorityTasksManager
+func DefaultPriorityTasksManagerConfig() *PriorityTasksManagerConfig {
+	return &PriorityTasksManagerConfig{
+		MaxTasks:         10,
+		QueueSize:        1000,
+		Timeout:          30 * time.Second,
+		MaxRetries:       3,
+		RetryInterval:    500 * time.Millisecond,
+		MaxRetryInterval: 30 * time.Second,
+		MaxDeadLetters:   1000,
+	}
+}
+
+// NewPriorityTasksManagerFromConfig returns a tasks manager whose dead
+// letter queue is kept in DeadLetterPath, or only in memory if it is empty.
+func NewPriorityTasksManagerFromConfig(c *PriorityTasksManagerConfig) (*PriorityTasksManager, error) {
+	dlq, err := OpenDeadLetterQueue(c.DeadLetterPath, c.MaxDeadLetters)
+	if err != nil {
+		return nil, err
+	}
+	return NewPriorityTasksManager(c, client.NewExponentialBackoff(c.RetryInterval, c.MaxRetryInterval), dlq), nil
+}
+
+// PriorityTasksManager runs up to MaxTasks jobs at a time, taking them
+// from the highest priority lane with pending jobs. A failed or timed out
+// job is retried after the interval of the backoff, up to MaxRetries
+// times, and then moved to the dead letter queue.
+//
+// A job past its deadline keeps its slot of MaxTasks until it returns, so
+// jobs which ignore their context cannot pile up in the background. Tasks
+// added through Add run with the normal priority and, as they do not take
+// a context, are moved to the dead letter queue without retries when they
+// exceed their deadline.
+type PriorityTasksManager struct {
+	config    PriorityTasksManagerConfig
+	backoff   client.Backoff
+	dlq       *DeadLetterQueue
+	lanes     []chan *Job
+	slots     chan struct{} // one per running job, timed out or not
+	replayers map[string]Replayer
+	lock      sync.RWMutex
+	quitCh    chan bool
+	wg        sync.WaitGroup
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func NewPriorityTasksManager(c *PriorityTasksManagerConfig, backoff client.Backoff, dlq *DeadLetterQueue) *PriorityTasksManager {
+	t := &PriorityTasksManager{
+		config:    *c,
+		backoff:   backoff,
+		dlq:       dlq,
+		lanes:     make([]chan *Job, HighPriority+1),
+		replayers: make(map[string]Replayer),
+		quitCh:    make(chan bool),
+	}
+	if t.config.MaxTasks < 1 {
+		t.config.MaxTasks = 1
+	}
+	for i := range t.lanes {
+		t.lanes[i] = make(chan *Job, c.QueueSize)
+	}
+	t.slots = make(chan struct{}, t.config.MaxTasks)
+	return t
+}
+
+// Start launches the workers which run the jobs.
+func (t *PriorityTasksManager) Start() {
+	t.startOnce.Do(func() {
+		t.wg.Add(t.config.MaxTasks)
+		for i := 0; i < t.config.MaxTasks; i++ {
+			go t.work()
+		}
+	})
+}
+
+// Stop waits for the running jobs to end. The pending ones are discarded.
+func (t *PriorityTasksManager) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.quitCh)
+	})
+	t.wg.Wait()
+}
+
+// Add enqueues a task with the normal priority. It blocks until there is
+// room in the lane.
+func (t *PriorityTasksManager) Add(task Task) error {
+	return t.AddJob(NewTaskJob("", nil, NormalPriority, task))
+}
+
+// AddJob enqueues a job in the lane of its priority. It blocks until there
+// is room in the lane.
+func (t *PriorityTasksManager) AddJob(j *Job) error {
+	if j.Priority < LowPriority || j.Priority > HighPriority {
+		return fmt.Errorf("invalid task priority %d", j.Priority)
+	}
+	select {
+	case <-t.quitCh:
+		return ErrTasksManagerStopped
+	default:
+	}
+	select {
+	case t.lanes[j.Priority] <- j:
+		return nil
+	case <-t.quitCh:
+		return ErrTasksManagerStopped
+	}
+}
+
+// Len returns the number of pending jobs of every priority.
+func (t *PriorityTasksManager) Len() int {
+	n := 0
+	for _, lane := range t.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// LenByPriority returns the number of pending jobs of a priority.
+func (t *PriorityTasksManager) LenByPriority(p Priority) int {
+	return len(t.lanes[p])
+}
+
+// RegisterReplayer sets the function which rebuilds the jobs of a kind
+// to replay them from the dead letter queue.
+func (t *PriorityTasksManager) RegisterReplayer(kind string, r Replayer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.replayers[kind] = r
+}
+
+// DeadLetters returns the queue of the jobs which exhausted their retries.
+func (t *PriorityTasksManager) DeadLetters() *DeadLetterQueue {
+	return t.dlq
+}
+
+// Replay rebuilds a job of the dead letter queue and enqueues it again,
+// removing it from the queue.
+func (t *PriorityTasksManager) Replay(id uint64) error {
+	l, err := t.dlq.Get(id)
+	if err != nil {
+		return err
+	}
+	t.lock.RLock()
+	replayer, ok := t.replayers[l.Kind]
+	t.lock.RUnlock()
+	if !ok || l.Kind == "" {
+		return ErrNotReplayable
+	}
+	j, err := replayer(l.Payload)
+	if err != nil {
+		return err
+	}
+	j.Kind, j.Payload, j.Priority = l.Kind, l.Payload, l.Priority
+	if err := t.AddJob(j); err != nil {
+		return err
+	}
+	return t.dlq.Remove(id)
+}
+
+// next returns the pending job of the highest priority, waiting for one
+// if there is none.
+func (t *PriorityTasksManager) next() (*Job, bool) {
+	select {
+	case j := <-t.lanes[HighPriority]:
+		return j, true
+	default:
+	}
+	select {
+	case j := <-t.lanes[HighPriority]:
+		return j, true
+	case j := <-t.lanes[NormalPriority]:
+		return j, true
+	default:
+	}
+	select {
+	case j := <-t.lanes[HighPriority]:
+		return j, true
+	case j := <-t.lanes[NormalPriority]:
+		return j, true
+	case j := <-t.lanes[LowPriority]:
+		return j, true
+	case <-t.quitCh:
+		return nil, false
+	}
+}
+
+func (t *PriorityTasksManager) work() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.quitCh:
+			return
+		default:
+		}
+		j, ok := t.next()
+		if !ok {
+			return
+		}
+		// wait for the jobs abandoned at their deadline to return
+		select {
+		case t.slots <- struct{}{}:
+		case <-t.quitCh:
+			return
+		}
+		if err := t.run(j); err != nil {
+			t.fail(j, err)
+		}
+	}
+}
+
+// run makes an attempt to run the job within its deadline, in the slot
+// taken by the worker. The slot is released when the job returns, even
+// if it is after its deadline.
+func (t *PriorityTasksManager) run(j *Job) error {
+	timeout := j.Timeout
+	if timeout == 0 {
+		timeout = t.config.Timeout
+	}
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	j.attempts++
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-t.slots }()
+		done <- j.Run(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrTaskTimeout
+	}
+}
+
+// fail schedules the retry of a failed job, or moves it to the dead
+// letter queue if it exhausted its retries.
+func (t *PriorityTasksManager) fail(j *Job, err error) {
+	wait, ok := t.backoff.Next(j.attempts - 1)
+	// a retry could run along with the attempt still in the background
+	if err == ErrTaskTimeout && j.ignoresContext {
+		ok = false
+	}
+	if j.attempts > t.config.MaxRetries || !ok {
+		log.Infof("Task manager moves a %s task to the dead letter queue after %d attempts: %v", describeJob(j), j.attempts, err)
+		if _, err := t.dlq.Push(j, err); err != nil {
+			log.Infof("Task manager is unable to save the dead letter queue: %v", err)
+		}
+		return
+	}
+	log.Infof("Task manager got an error from a %s task, retrying in %v: %v", describeJob(j), wait, err)
+	time.AfterFunc(wait, func() {
+		if err := t.AddJob(j); err != nil {
+			log.Debugf("Task manager dropped the retry of a %s task: %v", describeJob(j), err)
+		}
+	})
+}
+
+func describeJob(j *Job) string {
+	if j.Kind == "" {
+		return j.Priority.String() + " priority"
+	}
+	return fmt.Sprintf("%s priority %s", j.Priority, j.Kind)
+}
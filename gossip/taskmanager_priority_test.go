@@ -0,0 +1,367 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/protocol"
+)
+
+func newTestPriorityTasksManager(t *testing.T, path string) *PriorityTasksManager {
+	conf := DefaultPriorityTasksManagerConfig()
+	conf.MaxTasks = 1
+	conf.Timeout = time.Second
+	conf.MaxRetries = 2
+	dlq, err := OpenDeadLetterQueue(path, 10)
+	require.NoError(t, err)
+	return NewPriorityTasksManager(conf, client.NewConstantBackoff(10*time.Millisecond), dlq)
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met before the timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPriorityTasksManagerPriorities(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+
+	var lock sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	for _, p := range []Priority{LowPriority, NormalPriority, HighPriority, LowPriority, HighPriority} {
+		p := p
+		wg.Add(1)
+		require.NoError(t, tm.AddJob(&Job{Priority: p, Run: func(ctx context.Context) error {
+			defer wg.Done()
+			lock.Lock()
+			order = append(order, p)
+			lock.Unlock()
+			return nil
+		}}))
+	}
+	require.Equal(t, 5, tm.Len())
+	require.Equal(t, 2, tm.LenByPriority(HighPriority))
+
+	tm.Start()
+	wg.Wait()
+	tm.Stop()
+
+	require.Equal(t, []Priority{HighPriority, HighPriority, NormalPriority, LowPriority, LowPriority}, order, "Jobs must run by priority")
+	require.Equal(t, ErrTasksManagerStopped, tm.Add(func() error { return nil }))
+}
+
+func TestPriorityTasksManagerRetries(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+	tm.Start()
+	defer tm.Stop()
+
+	var lock sync.Mutex
+	attempts := 0
+	done := make(chan bool)
+	require.NoError(t, tm.Add(func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient error")
+		}
+		close(done)
+		return nil
+	}))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The task must succeed after its retries")
+	}
+	require.Equal(t, 0, tm.DeadLetters().Len())
+
+	require.NoError(t, tm.AddJob(&Job{Kind: "failing", Payload: []byte("data"), Priority: HighPriority, Run: func(ctx context.Context) error {
+		return errors.New("permanent error")
+	}}))
+	waitFor(t, 2*time.Second, func() bool { return tm.DeadLetters().Len() == 1 })
+
+	letter := tm.DeadLetters().List()[0]
+	require.Equal(t, "failing", letter.Kind)
+	require.Equal(t, []byte("data"), letter.Payload)
+	require.Equal(t, HighPriority, letter.Priority)
+	require.Equal(t, 3, letter.Attempts, "The task must run once and be retried twice")
+	require.Equal(t, "permanent error", letter.Error)
+}
+
+func TestPriorityTasksManagerTimeout(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+	tm.config.MaxRetries = 0
+	tm.Start()
+	defer tm.Stop()
+
+	cancelled := make(chan bool, 1)
+	require.NoError(t, tm.AddJob(&Job{Timeout: 50 * time.Millisecond, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- true
+		return ctx.Err()
+	}}))
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The context of the task must be cancelled at its deadline")
+	}
+	waitFor(t, time.Second, func() bool { return tm.DeadLetters().Len() == 1 })
+	require.Equal(t, ErrTaskTimeout.Error(), tm.DeadLetters().List()[0].Error)
+}
+
+func TestPriorityTasksManagerAbandonedTasks(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+	tm.config.Timeout = 50 * time.Millisecond
+	tm.Start()
+	defer tm.Stop()
+
+	release := make(chan bool)
+	var lock sync.Mutex
+	attempts := 0
+	require.NoError(t, tm.Add(func() error {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		<-release
+		return nil
+	}))
+	waitFor(t, time.Second, func() bool { return tm.DeadLetters().Len() == 1 })
+	require.Equal(t, 1, tm.DeadLetters().List()[0].Attempts, "Tasks without a context must not be retried after their deadline")
+
+	ran := make(chan bool, 1)
+	require.NoError(t, tm.Add(func() error {
+		ran <- true
+		return nil
+	}))
+	select {
+	case <-ran:
+		t.Fatal("A task past its deadline must keep its slot until it returns")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-ran:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The next task must run once the abandoned one returns")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 1, attempts)
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-deadletters-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.json")
+
+	tm := newTestPriorityTasksManager(t, path)
+	tm.config.MaxRetries = 0
+	tm.Start()
+	fail := func(ctx context.Context) error { return errors.New("failed") }
+	require.NoError(t, tm.AddJob(&Job{Kind: "replayable", Payload: []byte("a"), Run: fail}))
+	require.NoError(t, tm.Add(func() error { return errors.New("failed") }))
+	waitFor(t, time.Second, func() bool { return tm.DeadLetters().Len() == 2 })
+	tm.Stop()
+
+	// the dead letters survive a restart
+	tm = newTestPriorityTasksManager(t, path)
+	tm.Start()
+	defer tm.Stop()
+	letters := tm.DeadLetters().List()
+	require.Len(t, letters, 2)
+
+	replayed := make(chan string, 1)
+	tm.RegisterReplayer("replayable", func(payload []byte) (*Job, error) {
+		return &Job{Run: func(ctx context.Context) error {
+			replayed <- string(payload)
+			return nil
+		}}, nil
+	})
+
+	a := &Agent{Tasks: tm}
+	admin := httptest.NewServer(a.adminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/tasks/deadletters")
+	require.NoError(t, err)
+	var listed []*DeadLetter
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	resp.Body.Close()
+	require.Equal(t, letters, listed)
+
+	resp, err = http.Post(admin.URL+"/tasks/deadletters/replay", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode, "Tasks without a replayer must be kept")
+	select {
+	case payload := <-replayed:
+		require.Equal(t, "a", payload)
+	case <-time.After(time.Second):
+		t.Fatal("The dead letter must be replayed")
+	}
+	require.Len(t, tm.DeadLetters().List(), 1)
+
+	id := tm.DeadLetters().List()[0].Id
+	require.Equal(t, ErrNotReplayable, tm.Replay(id))
+	req, err := http.NewRequest("DELETE", admin.URL+"/tasks/deadletters?id="+strconv.FormatUint(id, 10), nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, 0, tm.DeadLetters().Len())
+
+	resp, err = http.Post(admin.URL+"/tasks/deadletters/replay?id=100", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeadLetterQueueLimit(t *testing.T) {
+	q, err := OpenDeadLetterQueue("", 2)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := q.Push(&Job{attempts: i}, errors.New("failed"))
+		require.NoError(t, err)
+	}
+	letters := q.List()
+	require.Len(t, letters, 2, "The oldest dead letters must be dropped")
+	require.Equal(t, uint64(2), letters[0].Id)
+	require.Equal(t, uint64(3), letters[1].Id)
+}
+
+type flakyFactory struct {
+	fail    bool
+	batches chan *protocol.BatchSnapshots
+}
+
+func (f *flakyFactory) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (f *flakyFactory) New(ctx context.Context) Task {
+	b := ctx.Value("batch").(*protocol.BatchSnapshots)
+	return func() error {
+		if f.fail {
+			return errors.New("failed")
+		}
+		f.batches <- b
+		return nil
+	}
+}
+
+func TestBatchJobReplay(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+	tm.config.MaxRetries = 0
+	tm.Start()
+	defer tm.Stop()
+
+	factory := &flakyFactory{fail: true, batches: make(chan *protocol.BatchSnapshots, 1)}
+	a := &Agent{Tasks: tm}
+	a.config.InsecureSkipVerify = true
+	bp := NewBatchProcessor(a, []TaskFactory{factory})
+
+	batch := &protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{
+		{Snapshot: &protocol.Snapshot{Version: 7}},
+	}}
+	payload, err := batch.Encode()
+	require.NoError(t, err)
+	ctx := context.WithValue(bp.ctx, "batch", batch)
+	require.NoError(t, tm.AddJob(bp.job(ctx, factory, payload)))
+
+	waitFor(t, time.Second, func() bool { return tm.DeadLetters().Len() == 1 })
+	letter := tm.DeadLetters().List()[0]
+	require.Equal(t, "batch/gossip.flakyFactory", letter.Kind)
+
+	factory.fail = false
+	require.NoError(t, tm.Replay(letter.Id))
+	select {
+	case b := <-factory.batches:
+		require.Equal(t, uint64(7), b.Snapshots[0].Snapshot.Version, "The task must be rebuilt from the batch")
+	case <-time.After(time.Second):
+		t.Fatal("The task of the batch must be replayed")
+	}
+}
+
+type blockingFactory struct {
+	release  chan bool
+	attempts chan bool
+}
+
+func (f *blockingFactory) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (f *blockingFactory) New(ctx context.Context) Task {
+	return func() error {
+		f.attempts <- true
+		<-f.release
+		return nil
+	}
+}
+
+func TestBatchJobTimeout(t *testing.T) {
+	tm := newTestPriorityTasksManager(t, "")
+	tm.config.Timeout = 50 * time.Millisecond
+	tm.Start()
+	defer tm.Stop()
+
+	factory := &blockingFactory{release: make(chan bool), attempts: make(chan bool, 3)}
+	defer close(factory.release)
+	a := &Agent{Tasks: tm}
+	a.config.InsecureSkipVerify = true
+	bp := NewBatchProcessor(a, []TaskFactory{factory})
+
+	batch := &protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{
+		{Snapshot: &protocol.Snapshot{Version: 7}},
+	}}
+	payload, err := batch.Encode()
+	require.NoError(t, err)
+	ctx := context.WithValue(bp.ctx, "batch", batch)
+	require.NoError(t, tm.AddJob(bp.job(ctx, factory, payload)))
+
+	waitFor(t, time.Second, func() bool { return tm.DeadLetters().Len() == 1 })
+	letter := tm.DeadLetters().List()[0]
+	require.Equal(t, ErrTaskTimeout.Error(), letter.Error)
+	require.Equal(t, 1, letter.Attempts, "The tasks of a batch must not be retried while the timed out attempt runs")
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, factory.attempts, 1)
+}
@@ -77,3 +77,42 @@ func (t *Topology) Each(n int, l *PeerList) *PeerList {
 	}
 	return &p
 }
+
+// Returns a peer list with all the peers of every kind,
+// excluding all the nodes in the list l.
+func (t *Topology) All(l *PeerList) *PeerList {
+	t.Lock()
+	defer t.Unlock()
+	var p PeerList
+
+	for _, list := range t.m {
+		p.Append(list.Exclude(l))
+	}
+	return &p
+}
+
+// Returns the peer with the given name, or nil
+// if it is not in the topology
+func (t *Topology) Find(name string) *Peer {
+	t.Lock()
+	defer t.Unlock()
+	for _, list := range t.m {
+		for _, p := range list.L {
+			if p.Name == name {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the peers of each role
+func (t *Topology) Roles() map[string][]*Peer {
+	t.Lock()
+	defer t.Unlock()
+	roles := make(map[string][]*Peer, len(t.m))
+	for role, list := range t.m {
+		roles[role] = append([]*Peer{}, list.L...)
+	}
+	return roles
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cosignedRootsSize is the number of cosigned snapshots the cosignature
+// processor remembers to find witnesses shown different views of a log.
+const cosignedRootsSize = 1 << 12
+
+// PublishCosignature gossips a snapshot cosigned by the agent to the rest
+// of the agents.
+func (a *Agent) PublishCosignature(c *protocol.CosignedSnapshot) error {
+	if c.Snapshot == nil || c.Snapshot.Snapshot == nil || len(c.Cosignatures) == 0 {
+		return errors.New("nothing to publish without a snapshot and its cosignatures")
+	}
+	buf, err := c.Encode()
+	if err != nil {
+		return err
+	}
+	// the message will come back from other agents, and it must not be
+	// processed twice
+	wasSeen(a.Cache, buf)
+	return a.Out.Publish(&Message{
+		Kind:    CosignatureMessageType,
+		From:    a.Self,
+		TTL:     a.config.AlertTTL,
+		Payload: buf,
+	})
+}
+
+// CosignatureProcessor reads the snapshots cosigned by the witnesses. It
+// drops the ones without a cosignature of the witness keys of the agent
+// and forwards the rest. With the trusted keys of the servers, it
+// also compares the snapshots cosigned by the different witnesses: two
+// of them cosigning different tree heads for the same version is the
+// evidence of a split view.
+type CosignatureProcessor struct {
+	a       *Agent
+	metrics []prometheus.Collector
+	quitCh  chan bool
+	id      int
+	index   *SignedRootIndex
+
+	received prometheus.Counter
+	invalid  prometheus.Counter
+}
+
+func NewCosignatureProcessor(a *Agent) *CosignatureProcessor {
+	p := &CosignatureProcessor{
+		a:      a,
+		quitCh: make(chan bool),
+		index:  NewSignedRootIndex(cosignedRootsSize),
+		received: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_cosignatures_received_total",
+				Help: "Number of cosigned snapshots received from witnesses.",
+			},
+		),
+		invalid: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_cosignatures_invalid_total",
+				Help: "Number of cosigned snapshots dropped because they did not verify.",
+			},
+		),
+	}
+	p.metrics = []prometheus.Collector{p.received, p.invalid}
+	return p
+}
+
+func (p *CosignatureProcessor) Kinds() []MessageType {
+	return []MessageType{CosignatureMessageType}
+}
+
+func (p *CosignatureProcessor) Stop() {
+	close(p.quitCh)
+}
+
+func (p *CosignatureProcessor) Metrics() []prometheus.Collector {
+	return p.metrics
+}
+
+func (p *CosignatureProcessor) Subscribe(id int, ch <-chan *Message) {
+	p.id = id
+
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				if msg.Kind != CosignatureMessageType {
+					log.Debugf("CosignatureProcessor got an unknown message from agent")
+					continue
+				}
+
+				if wasSeen(p.a.Cache, msg.Payload) {
+					log.Debugf("CosignatureProcessor got an already processed cosignature from agent")
+					continue
+				}
+
+				cosigned := new(protocol.CosignedSnapshot)
+				if err := cosigned.Decode(msg.Payload); err != nil {
+					log.Infof("CosignatureProcessor unable to decode cosignature!. Dropping message.")
+					p.invalid.Inc()
+					continue
+				}
+				if err := p.verify(cosigned); err != nil {
+					log.Infof("CosignatureProcessor got a cosignature which does not verify: %v. Dropping message.", err)
+					p.invalid.Inc()
+					continue
+				}
+				p.received.Inc()
+
+				if p.a.TrustedKeys != nil {
+					if found := p.index.Add(cosigned.Snapshot); found != nil {
+						p.report(found)
+					}
+				}
+
+				p.a.Out.Publish(msg)
+			case <-p.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// verify checks the snapshot was signed by one of the trusted keys of the
+// agent, and it carries at least one cosignature of its witness keys.
+// Without keys, the signatures are not checked.
+func (p *CosignatureProcessor) verify(c *protocol.CosignedSnapshot) error {
+	if c.Snapshot == nil || c.Snapshot.Snapshot == nil {
+		return protocol.ErrMissingTreeHead
+	}
+	if p.a.TrustedKeys != nil {
+		if err := c.Snapshot.VerifyKeySet(p.a.TrustedKeys); err != nil {
+			return err
+		}
+	}
+	if p.a.WitnessKeys != nil {
+		return c.VerifyCosignatures(p.a.WitnessKeys, 1)
+	}
+	return nil
+}
+
+func (p *CosignatureProcessor) report(found *protocol.Equivocation) {
+	path, err := p.a.StoreEvidence(found)
+	if err != nil {
+		log.Infof("CosignatureProcessor unable to store evidence: %v", err)
+	}
+	msg := fmt.Sprintf("CRITICAL: witnesses cosigned two different snapshots for version %d of log %q. Evidence in %s", found.Version, found.LogId, path)
+	log.Info(msg)
+	p.a.notify(msg)
+	if err := p.a.ShareEvidence(found); err != nil {
+		log.Infof("CosignatureProcessor unable to gossip the evidence: %v", err)
+	}
+}
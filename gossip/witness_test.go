@@ -0,0 +1,106 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCosignatureProcessor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-cosignatures-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := sign.NewEd25519Signer()
+	witness := sign.NewEd25519Signer()
+	a, notifier := newFindingsTestAgent(t, dir)
+	a.TrustedKeys = &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     server.KeyID(),
+		Algorithm: server.Algorithm(),
+		PublicKey: server.PublicKey(),
+	}}}
+	a.WitnessKeys = &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     witness.KeyID(),
+		Algorithm: witness.Algorithm(),
+		PublicKey: witness.PublicKey(),
+	}}}
+	ts := &testSubscriber{}
+	a.Out.Subscribe(CosignatureMessageType, ts, 5)
+
+	p := NewCosignatureProcessor(a)
+	a.In.Subscribe(CosignatureMessageType, p, 0)
+	defer p.Stop()
+
+	cosign := func(signer sign.Signer, version uint64, digest byte) *protocol.CosignedSnapshot {
+		s, err := protocol.SignSnapshot(server, &protocol.Snapshot{HistoryDigest: []byte{digest}, HyperDigest: []byte{0x0}, Version: version}, time.Now())
+		require.NoError(t, err)
+		c, err := protocol.Cosign(signer, "witness0", s, time.Now())
+		require.NoError(t, err)
+		return &protocol.CosignedSnapshot{Snapshot: s, Cosignatures: []*protocol.Cosignature{c}}
+	}
+	newMessage := func(c *protocol.CosignedSnapshot) *Message {
+		buf, err := c.Encode()
+		require.NoError(t, err)
+		return &Message{Kind: CosignatureMessageType, TTL: 2, Payload: buf}
+	}
+
+	// cosignatures published by the agent itself are gossiped but not processed
+	require.NoError(t, a.PublishCosignature(cosign(witness, 2, 0x1)))
+	own := <-ts.ch
+	require.Equal(t, a.config.AlertTTL, own.TTL)
+	a.In.Publish(own)
+
+	// cosignatures must be made by the witness keys
+	a.In.Publish(newMessage(cosign(sign.NewEd25519Signer(), 1, 0x1)))
+	valid := newMessage(cosign(witness, 1, 0x1))
+	a.In.Publish(valid)
+	select {
+	case m := <-ts.ch:
+		require.Equal(t, valid, m, "The cosignature must be forwarded")
+	case <-time.After(1 * time.Second):
+		t.Fatal("The cosignature was not forwarded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, len(ts.ch), "Cosignatures which do not verify must be dropped")
+	require.Equal(t, 0, notifier.count())
+
+	// the same version cosigned with another history is a split view
+	a.In.Publish(newMessage(cosign(witness, 1, 0x2)))
+	select {
+	case <-ts.ch:
+	case <-time.After(1 * time.Second):
+		t.Fatal("The cosignature was not forwarded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 2.0, testutil.ToFloat64(p.received))
+	require.Equal(t, 1.0, testutil.ToFloat64(p.invalid))
+	require.Equal(t, 1, notifier.count())
+
+	files, err := filepath.Glob(filepath.Join(dir, "equivocation-*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1, "The evidence of the split view must be stored")
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hashing
+
+import "fmt"
+
+// Versions of the format of the trees, which define how their nodes
+// are hashed.
+const (
+	// TreeFormatV1 hashes leaves and interior nodes alike.
+	TreeFormatV1 = 1
+	// TreeFormatV2 prefixes the data of leaves with LeafPrefix and the
+	// data of interior nodes with InteriorPrefix, as RFC 6962 does, so a
+	// leaf hash can never be taken for an interior one. The leaves of the
+	// hyper tree also hash the key they hold. Otherwise a leaf is bound to
+	// its key just by its position, which the keys sharing its path have
+	// too.
+	TreeFormatV2 = 2
+
+	// CurrentTreeFormat is the format of new trees.
+	CurrentTreeFormat = TreeFormatV2
+)
+
+// Domain separation prefixes of TreeFormatV2.
+const (
+	LeafPrefix     byte = 0x00
+	InteriorPrefix byte = 0x01
+)
+
+// domainSeparatedHasher marks a hasher whose trees follow TreeFormatV2.
+// Digests computed with Do and Salted are the ones of the underlying
+// hasher.
+type domainSeparatedHasher struct {
+	Hasher
+}
+
+// NewTreeHasherF returns a constructor of hashers that build trees in
+// the given format. The zero format stands for TreeFormatV1.
+func NewTreeHasherF(hasherF func() Hasher, format int) (func() Hasher, error) {
+	if _, err := NewTreeHasher(nil, format); err != nil {
+		return nil, err
+	}
+	return func() Hasher {
+		h, _ := NewTreeHasher(hasherF(), format)
+		return h
+	}, nil
+}
+
+// NewTreeHasher returns a hasher that builds trees in the given format
+// with the digests of h.
+func NewTreeHasher(h Hasher, format int) (Hasher, error) {
+	switch format {
+	case 0, TreeFormatV1:
+		if d, ok := h.(*domainSeparatedHasher); ok {
+			return d.Hasher, nil
+		}
+		return h, nil
+	case TreeFormatV2:
+		if _, ok := h.(*domainSeparatedHasher); ok {
+			return h, nil
+		}
+		return &domainSeparatedHasher{h}, nil
+	default:
+		return nil, fmt.Errorf("unknown tree format %d", format)
+	}
+}
+
+// TreeFormat returns the format of the trees built with the given hasher.
+func TreeFormat(h Hasher) int {
+	if _, ok := h.(*domainSeparatedHasher); ok {
+		return TreeFormatV2
+	}
+	return TreeFormatV1
+}
+
+// BindsLeafKeys returns true if the leaves of the hyper trees built with
+// the given hasher hash the key they hold, as in TreeFormatV2.
+func BindsLeafKeys(h Hasher) bool {
+	return TreeFormat(h) >= TreeFormatV2
+}
+
+// LeafHash returns the hash of a leaf of a tree with the given data.
+func LeafHash(h Hasher, salt []byte, data ...[]byte) Digest {
+	if _, ok := h.(*domainSeparatedHasher); ok {
+		return h.Salted(salt, append([][]byte{{LeafPrefix}}, data...)...)
+	}
+	return h.Salted(salt, data...)
+}
+
+// InteriorHash returns the hash of an interior node of a tree with the
+// hashes of its children.
+func InteriorHash(h Hasher, salt []byte, children ...[]byte) Digest {
+	if _, ok := h.(*domainSeparatedHasher); ok {
+		return h.Salted(salt, append([][]byte{{InteriorPrefix}}, children...)...)
+	}
+	return h.Salted(salt, children...)
+}
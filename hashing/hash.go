@@ -18,7 +18,12 @@ package hashing
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
 	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
 )
 
 type Digest []byte
@@ -76,6 +81,111 @@ func (s *Sha256Hasher) Do(data ...[]byte) Digest {
 
 func (s Sha256Hasher) Len() uint16 { return uint16(256) }
 
+// Sha512_256Hasher implements the Hasher interface and computes the
+// SHA-512/256 digest of the data, that is, SHA-512 truncated to 256 bits.
+type Sha512_256Hasher struct {
+	underlying hash.Hash
+}
+
+func NewSha512_256Hasher() Hasher {
+	return &Sha512_256Hasher{underlying: sha512.New512_256()}
+}
+
+func (s *Sha512_256Hasher) Salted(salt []byte, data ...[]byte) Digest {
+	data = append(data, salt)
+	return s.Do(data...)
+}
+
+func (s *Sha512_256Hasher) Do(data ...[]byte) Digest {
+	return sum(s.underlying, data...)
+}
+
+func (s Sha512_256Hasher) Len() uint16 { return uint16(256) }
+
+// Sha3_256Hasher implements the Hasher interface and computes the
+// SHA3-256 digest of the data.
+type Sha3_256Hasher struct {
+	underlying hash.Hash
+}
+
+func NewSha3_256Hasher() Hasher {
+	return &Sha3_256Hasher{underlying: sha3.New256()}
+}
+
+func (s *Sha3_256Hasher) Salted(salt []byte, data ...[]byte) Digest {
+	data = append(data, salt)
+	return s.Do(data...)
+}
+
+func (s *Sha3_256Hasher) Do(data ...[]byte) Digest {
+	return sum(s.underlying, data...)
+}
+
+func (s Sha3_256Hasher) Len() uint16 { return uint16(256) }
+
+// Blake2b256Hasher implements the Hasher interface and computes the
+// unkeyed BLAKE2b-256 digest of the data.
+type Blake2b256Hasher struct {
+	underlying hash.Hash
+}
+
+func NewBlake2b256Hasher() Hasher {
+	// it only fails with keys longer than 64 bytes
+	underlying, _ := blake2b.New256(nil)
+	return &Blake2b256Hasher{underlying: underlying}
+}
+
+func (s *Blake2b256Hasher) Salted(salt []byte, data ...[]byte) Digest {
+	data = append(data, salt)
+	return s.Do(data...)
+}
+
+func (s *Blake2b256Hasher) Do(data ...[]byte) Digest {
+	return sum(s.underlying, data...)
+}
+
+func (s Blake2b256Hasher) Len() uint16 { return uint16(256) }
+
+func sum(h hash.Hash, data ...[]byte) Digest {
+	h.Reset()
+	for i := 0; i < len(data); i++ {
+		h.Write(data[i])
+	}
+	return h.Sum(nil)[:]
+}
+
+// Identifiers of the hashers that can be used to build the trees.
+const (
+	SHA256     = "sha256"
+	SHA512_256 = "sha512-256"
+	SHA3_256   = "sha3-256"
+	BLAKE2B256 = "blake2b-256"
+)
+
+// DefaultHasher is the hasher used by stores that do not record which
+// one they were built with.
+const DefaultHasher = SHA256
+
+var hashers = map[string]func() Hasher{
+	SHA256:     NewSha256Hasher,
+	SHA512_256: NewSha512_256Hasher,
+	SHA3_256:   NewSha3_256Hasher,
+	BLAKE2B256: NewBlake2b256Hasher,
+}
+
+// NewHasherF returns the constructor of the hasher with the given
+// identifier. An empty identifier refers to the default hasher.
+func NewHasherF(id string) (func() Hasher, error) {
+	if id == "" {
+		id = DefaultHasher
+	}
+	hasherF, ok := hashers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown hasher %q", id)
+	}
+	return hasherF, nil
+}
+
 // PearsonHasher implements the Hasher interface and computes a 8 bit hash
 // function. Handy for testing hash tree implementations.
 type PearsonHasher struct{}
@@ -17,6 +17,7 @@
 package hashing
 
 import (
+	"encoding/hex"
 	"strconv"
 	"testing"
 
@@ -173,3 +174,64 @@ func TestFakePearsonHasher(t *testing.T) {
 		assert.Equal(t, hashDo, hashSalt, "Do and Salted hashes should NOT match in test: %s", testname)
 	}
 }
+
+func TestStandardHashers(t *testing.T) {
+	tests := map[string]struct {
+		hasherF  func() Hasher
+		expected string
+	}{
+		SHA256:     {NewSha256Hasher, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		SHA512_256: {NewSha512_256Hasher, "53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23"},
+		SHA3_256:   {NewSha3_256Hasher, "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		BLAKE2B256: {NewBlake2b256Hasher, "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+	}
+
+	for id, test := range tests {
+		hasherF, err := NewHasherF(id)
+		assert.NoErrorf(t, err, "The hasher should be registered in test: %s", id)
+
+		hasher := hasherF()
+		digest := hasher.Do([]byte("a"), []byte("bc"))
+		assert.Equalf(t, test.expected, hex.EncodeToString(digest), "Hash Do don't match in test: %s", id)
+		assert.Equalf(t, digest, test.hasherF().Do([]byte("abc")), "Hash Do should concatenate the data in test: %s", id)
+		assert.Equalf(t, uint16(len(digest)*8), hasher.Len(), "Hash Len don't match in test: %s", id)
+	}
+
+	_, err := NewHasherF("md5")
+	assert.Error(t, err, "Unknown hashers should not be created")
+}
+
+func TestTreeHasher(t *testing.T) {
+	salt := []byte{0x1}
+	data := []byte("data")
+
+	v1, err := NewTreeHasher(NewSha256Hasher(), TreeFormatV1)
+	assert.NoError(t, err)
+	assert.Equal(t, TreeFormatV1, TreeFormat(v1))
+	assert.Equal(t, v1.Salted(salt, data), LeafHash(v1, salt, data), "Leaves of the first format should not be prefixed")
+	assert.Equal(t, LeafHash(v1, salt, data), InteriorHash(v1, salt, data), "Leaves and interior nodes of the first format should be hashed alike")
+
+	v2, err := NewTreeHasher(NewSha256Hasher(), TreeFormatV2)
+	assert.NoError(t, err)
+	assert.Equal(t, TreeFormatV2, TreeFormat(v2))
+	assert.Equal(t, v1.Do(data), v2.Do(data), "Digests should not depend on the format")
+	assert.Equal(t, v1.Salted(salt, []byte{LeafPrefix}, data), LeafHash(v2, salt, data), "Leaves should be prefixed")
+	assert.Equal(t, v1.Salted(salt, []byte{InteriorPrefix}, data), InteriorHash(v2, salt, data), "Interior nodes should be prefixed")
+	assert.NotEqual(t, LeafHash(v2, salt, data), InteriorHash(v2, salt, data), "Leaves and interior nodes should be told apart")
+
+	again, err := NewTreeHasher(v2, TreeFormatV2)
+	assert.NoError(t, err)
+	assert.Equal(t, LeafHash(v2, salt, data), LeafHash(again, salt, data), "Hashers should not be prefixed twice")
+
+	back, err := NewTreeHasher(v2, TreeFormatV1)
+	assert.NoError(t, err)
+	assert.Equal(t, TreeFormatV1, TreeFormat(back))
+
+	assert.True(t, BindsLeafKeys(v2))
+	assert.False(t, BindsLeafKeys(v1), "Only the second format binds the keys to the leaves")
+
+	_, err = NewTreeHasher(NewSha256Hasher(), 3)
+	assert.Error(t, err, "Unknown formats should not be accepted")
+	_, err = NewTreeHasherF(NewSha256Hasher, 3)
+	assert.Error(t, err, "Unknown formats should not be accepted")
+}
@@ -100,3 +100,10 @@ func (m Server) Register(collector prometheus.Collector) error {
 func (m Server) MustRegister(collectors ...prometheus.Collector) {
 	m.registry.MustRegister(collectors...)
 }
+
+// Unregister unregisters a prometheus collector from the prometheus registry
+// used by the metrics server. It returns false if the collector was not
+// registered.
+func (m Server) Unregister(collector prometheus.Collector) bool {
+	return m.registry.Unregister(collector)
+}
@@ -0,0 +1,606 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bbva/qed/balloon/history"
+	"github.com/bbva/qed/balloon/hyper"
+	"github.com/bbva/qed/hashing"
+)
+
+// BinaryProofMediaType is the media type of the compact binary encoding
+// of proofs. Clients ask for it with the Accept header of the proof
+// requests and servers that support it answer with it as Content-Type.
+// Otherwise proofs are encoded in JSON.
+const BinaryProofMediaType = "application/vnd.qed.proof+binary"
+
+// BinaryProofVersion is the version of the binary encoding of proofs,
+// written as the first byte of every encoded proof.
+const BinaryProofVersion = 1
+
+const (
+	membershipProofKind      byte = 1
+	incrementalProofKind     byte = 2
+	batchMembershipProofKind byte = 3
+)
+
+const (
+	existsFlag byte = 1 << iota
+	keyFlag
+	shortcutFlag
+	valueDigestFlag
+)
+
+// ErrUnsupportedProofVersion is returned when decoding a binary proof of
+// a version this package does not understand.
+var ErrUnsupportedProofVersion = errors.New("unsupported binary proof version")
+
+// AcceptsBinaryProof returns true if the given Accept header value lists
+// the binary proof media type.
+func AcceptsBinaryProof(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == BinaryProofMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBinaryProof returns true if the given Content-Type header value is
+// the binary proof media type.
+func IsBinaryProof(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == BinaryProofMediaType
+}
+
+// EncodeMembershipResult encodes a membership result in the binary proof
+// format. The positions of the audit paths are implicit in the key and
+// versions of the proof, and the hyper siblings that are hashes of empty
+// subtrees are replaced by a bitmap. The hasher must be the one the
+// proof was built with.
+func EncodeMembershipResult(mr *MembershipResult, hasher hashing.Hasher) ([]byte, error) {
+
+	var flags byte
+	if mr.Exists {
+		flags |= existsFlag
+	}
+	if mr.Key != nil {
+		flags |= keyFlag
+	}
+	if mr.ShortcutKey != nil {
+		flags |= shortcutFlag
+	}
+	if mr.ValueDigest != nil {
+		flags |= valueDigestFlag
+	}
+
+	defaults, hyperSiblings, err := hyper.AuditPath(mr.Hyper).CompactSiblings(mr.KeyDigest, hasher)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode hyper audit path: %v", err)
+	}
+
+	var historySiblings []hashing.Digest
+	if mr.Exists && len(mr.History) > 0 {
+		historySiblings, err = history.ParseAuditPath(mr.History).MembershipSiblings(mr.ActualVersion, historyVersion(mr))
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode history audit path: %v", err)
+		}
+	}
+
+	e := newProofEncoder(membershipProofKind)
+	e.writeByte(flags)
+	e.writeUvarint(mr.CurrentVersion)
+	e.writeUvarint(mr.QueryVersion)
+	e.writeUvarint(mr.ActualVersion)
+	e.writeUvarint(uint64(mr.TreeFormat))
+	e.writeBytes(mr.KeyDigest)
+	if flags&keyFlag != 0 {
+		e.writeBytes(mr.Key)
+	}
+	if flags&shortcutFlag != 0 {
+		e.writeBytes(mr.ShortcutKey)
+		e.writeBytes(mr.ShortcutValue)
+	}
+	if flags&valueDigestFlag != 0 {
+		e.writeBytes(mr.ValueDigest)
+	}
+	e.writeUvarint(uint64(len(mr.Hyper)))
+	e.buf.Write(defaults)
+	if err := e.writeDigests(hyperSiblings); err != nil {
+		return nil, err
+	}
+	if err := e.writeDigests(historySiblings); err != nil {
+		return nil, err
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// DecodeMembershipResult decodes a membership result encoded with
+// EncodeMembershipResult. The hasher must be the one of the server,
+// and it is used to recompute the hashes of the empty subtrees.
+func DecodeMembershipResult(data []byte, hasher hashing.Hasher) (*MembershipResult, error) {
+
+	d, err := newProofDecoder(data, membershipProofKind)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := new(MembershipResult)
+	flags := d.readByte()
+	mr.Exists = flags&existsFlag != 0
+	mr.CurrentVersion = d.readUvarint()
+	mr.QueryVersion = d.readUvarint()
+	mr.ActualVersion = d.readUvarint()
+	mr.TreeFormat = int(d.readUvarint())
+	mr.KeyDigest = d.readBytes()
+	if flags&keyFlag != 0 {
+		mr.Key = d.readBytes()
+	}
+	if flags&shortcutFlag != 0 {
+		mr.ShortcutKey = d.readBytes()
+		mr.ShortcutValue = d.readBytes()
+	}
+	if flags&valueDigestFlag != 0 {
+		mr.ValueDigest = d.readBytes()
+	}
+	numHyper := d.readUvarint()
+	if numHyper > uint64(len(mr.KeyDigest))*8 {
+		return nil, errors.New("malformed binary proof: hyper audit path too long")
+	}
+	defaults := d.readN(int(numHyper+7) / 8)
+	hyperSiblings := d.readDigests()
+	historySiblings := d.readDigests()
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	auditPath, err := hyper.NewAuditPathFromSiblings(mr.KeyDigest, int(numHyper), defaults, hyperSiblings, hasher)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode hyper audit path: %v", err)
+	}
+	mr.Hyper = auditPath
+
+	if mr.Exists {
+		historyPath, err := history.NewMembershipAuditPath(mr.ActualVersion, historyVersion(mr), historySiblings)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode history audit path: %v", err)
+		}
+		mr.History = historyPath.Serialize()
+	} else if len(historySiblings) > 0 {
+		return nil, errors.New("unexpected history audit path in non-membership proof")
+	}
+
+	return mr, nil
+}
+
+// historyVersion returns the version of the history tree the server
+// proves the membership of a key in: the query version, unless it is
+// beyond the current version of the server.
+func historyVersion(mr *MembershipResult) uint64 {
+	if mr.QueryVersion > mr.CurrentVersion {
+		return mr.CurrentVersion
+	}
+	return mr.QueryVersion
+}
+
+// EncodeIncrementalResponse encodes an incremental proof in the binary
+// proof format. The positions of the audit path are implicit in the
+// versions of the proof.
+func EncodeIncrementalResponse(ir *IncrementalResponse) ([]byte, error) {
+
+	siblings, err := history.ParseAuditPath(ir.AuditPath).IncrementalSiblings(ir.Start, ir.End)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode history audit path: %v", err)
+	}
+
+	e := newProofEncoder(incrementalProofKind)
+	e.writeUvarint(ir.Start)
+	e.writeUvarint(ir.End)
+	e.writeUvarint(uint64(ir.TreeFormat))
+	if err := e.writeDigests(siblings); err != nil {
+		return nil, err
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// DecodeIncrementalResponse decodes an incremental proof encoded with
+// EncodeIncrementalResponse.
+func DecodeIncrementalResponse(data []byte) (*IncrementalResponse, error) {
+
+	d, err := newProofDecoder(data, incrementalProofKind)
+	if err != nil {
+		return nil, err
+	}
+
+	ir := new(IncrementalResponse)
+	ir.Start = d.readUvarint()
+	ir.End = d.readUvarint()
+	ir.TreeFormat = int(d.readUvarint())
+	siblings := d.readDigests()
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	if ir.Start > ir.End {
+		return nil, errors.New("invalid incremental proof range")
+	}
+
+	auditPath, err := history.NewIncrementalAuditPath(ir.Start, ir.End, siblings)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode history audit path: %v", err)
+	}
+	ir.AuditPath = auditPath.Serialize()
+
+	return ir, nil
+}
+
+// EncodeBatchMembershipResult encodes a batch membership result in the
+// binary proof format. The audit paths of a batch are shared by all its
+// keys, so their positions are written along with the digests instead of
+// being derived from the keys. The indexes of the hyper positions are
+// written without their trailing zeros.
+func EncodeBatchMembershipResult(br *BatchMembershipResult) ([]byte, error) {
+
+	e := newProofEncoder(batchMembershipProofKind)
+	e.writeUvarint(br.CurrentVersion)
+	e.writeUvarint(br.QueryVersion)
+	e.writeUvarint(uint64(br.TreeFormat))
+	e.writeUvarint(uint64(len(br.Entries)))
+	for _, entry := range br.Entries {
+		var flags byte
+		if entry.Exists {
+			flags |= existsFlag
+		}
+		if entry.ShortcutKey != nil {
+			flags |= shortcutFlag
+		}
+		if entry.ValueDigest != nil {
+			flags |= valueDigestFlag
+		}
+		e.writeByte(flags)
+		e.writeBytes(entry.KeyDigest)
+		e.writeUvarint(entry.ActualVersion)
+		e.writeUvarint(uint64(entry.Height))
+		if flags&shortcutFlag != 0 {
+			e.writeBytes(entry.ShortcutKey)
+			e.writeBytes(entry.ShortcutValue)
+		}
+		if flags&valueDigestFlag != 0 {
+			e.writeBytes(entry.ValueDigest)
+		}
+	}
+	if err := e.writeAuditPath(br.Hyper, e.writeHyperPosition); err != nil {
+		return nil, fmt.Errorf("unable to encode hyper audit path: %v", err)
+	}
+	if err := e.writeAuditPath(br.History, e.writeHistoryPosition); err != nil {
+		return nil, fmt.Errorf("unable to encode history audit path: %v", err)
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// DecodeBatchMembershipResult decodes a batch membership result encoded
+// with EncodeBatchMembershipResult.
+func DecodeBatchMembershipResult(data []byte) (*BatchMembershipResult, error) {
+
+	d, err := newProofDecoder(data, batchMembershipProofKind)
+	if err != nil {
+		return nil, err
+	}
+
+	br := new(BatchMembershipResult)
+	br.CurrentVersion = d.readUvarint()
+	br.QueryVersion = d.readUvarint()
+	br.TreeFormat = int(d.readUvarint())
+	count := d.readUvarint()
+	// every entry takes at least four bytes
+	if count > uint64(d.r.Len())/4 {
+		return nil, errors.New("malformed binary proof: too many entries")
+	}
+	br.Entries = make([]*BatchMembershipEntry, count)
+	for i := range br.Entries {
+		entry := new(BatchMembershipEntry)
+		flags := d.readByte()
+		entry.Exists = flags&existsFlag != 0
+		entry.KeyDigest = d.readBytes()
+		entry.ActualVersion = d.readUvarint()
+		entry.Height = uint16(d.readUvarint())
+		if flags&shortcutFlag != 0 {
+			entry.ShortcutKey = d.readBytes()
+			entry.ShortcutValue = d.readBytes()
+		}
+		if flags&valueDigestFlag != 0 {
+			entry.ValueDigest = d.readBytes()
+		}
+		br.Entries[i] = entry
+	}
+	br.Hyper = d.readAuditPath(d.readHyperPosition)
+	br.History = d.readAuditPath(d.readHistoryPosition)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+type proofEncoder struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newProofEncoder(kind byte) *proofEncoder {
+	e := new(proofEncoder)
+	e.buf.WriteByte(BinaryProofVersion)
+	e.buf.WriteByte(kind)
+	return e
+}
+
+func (e *proofEncoder) writeByte(b byte) {
+	e.buf.WriteByte(b)
+}
+
+func (e *proofEncoder) writeUvarint(x uint64) {
+	n := binary.PutUvarint(e.tmp[:], x)
+	e.buf.Write(e.tmp[:n])
+}
+
+func (e *proofEncoder) writeBytes(b []byte) {
+	e.writeUvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+// writeDigests writes the number of digests and their common length
+// followed by the digests themselves.
+func (e *proofEncoder) writeDigests(digests []hashing.Digest) error {
+	e.writeUvarint(uint64(len(digests)))
+	if len(digests) == 0 {
+		return nil
+	}
+	size := len(digests[0])
+	e.writeUvarint(uint64(size))
+	for _, digest := range digests {
+		if len(digest) != size {
+			return errors.New("unable to encode digests of different lengths")
+		}
+		e.buf.Write(digest)
+	}
+	return nil
+}
+
+// writeAuditPath writes the positions of an audit path, sorted, followed
+// by their digests.
+func (e *proofEncoder) writeAuditPath(path map[string]hashing.Digest, writePosition func(string) error) error {
+	positions := make([]string, 0, len(path))
+	for position := range path {
+		positions = append(positions, position)
+	}
+	sort.Strings(positions)
+	digests := make([]hashing.Digest, len(positions))
+	e.writeUvarint(uint64(len(positions)))
+	for i, position := range positions {
+		if err := writePosition(position); err != nil {
+			return err
+		}
+		digests[i] = path[position]
+	}
+	return e.writeDigests(digests)
+}
+
+// writeHyperPosition writes a position of a hyper audit path, formatted
+// as hex index|height, as the length of the index, the index without its
+// trailing zeros and the height.
+func (e *proofEncoder) writeHyperPosition(position string) error {
+	tokens := strings.Split(position, "|")
+	if len(tokens) != 2 || !strings.HasPrefix(tokens[0], "0x") {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	index, err := hex.DecodeString(tokens[0][2:])
+	if err != nil {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	height, err := strconv.ParseUint(tokens[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	e.writeUvarint(uint64(len(index)))
+	e.writeBytes(bytes.TrimRight(index, "\x00"))
+	e.writeUvarint(height)
+	return nil
+}
+
+// writeHistoryPosition writes a position of a history audit path,
+// formatted as index|height.
+func (e *proofEncoder) writeHistoryPosition(position string) error {
+	tokens := strings.Split(position, "|")
+	if len(tokens) != 2 {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	index, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	height, err := strconv.ParseUint(tokens[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid position %q", position)
+	}
+	e.writeUvarint(index)
+	e.writeUvarint(height)
+	return nil
+}
+
+// proofDecoder reads the fields written by a proofEncoder. The first
+// error is kept and every later read returns zero values.
+type proofDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newProofDecoder(data []byte, kind byte) (*proofDecoder, error) {
+	if len(data) < 2 {
+		return nil, errors.New("binary proof too short")
+	}
+	if data[0] != BinaryProofVersion {
+		return nil, ErrUnsupportedProofVersion
+	}
+	if data[1] != kind {
+		return nil, fmt.Errorf("unexpected binary proof kind %d", data[1])
+	}
+	return &proofDecoder{r: bytes.NewReader(data[2:])}, nil
+}
+
+func (d *proofDecoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	d.err = err
+	return b
+}
+
+func (d *proofDecoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(d.r)
+	d.err = err
+	return x
+}
+
+func (d *proofDecoder) readN(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > d.r.Len() {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *proofDecoder) readBytes() []byte {
+	n := d.readUvarint()
+	if n > uint64(d.r.Len()) {
+		n = uint64(d.r.Len()) + 1 // fail with an unexpected EOF
+	}
+	return d.readN(int(n))
+}
+
+func (d *proofDecoder) readDigests() []hashing.Digest {
+	count := d.readUvarint()
+	if count == 0 || d.err != nil {
+		return nil
+	}
+	size := d.readUvarint()
+	if size == 0 || count > uint64(d.r.Len())/size {
+		if d.err == nil {
+			d.err = io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	digests := make([]hashing.Digest, count)
+	for i := range digests {
+		digests[i] = d.readN(int(size))
+	}
+	return digests
+}
+
+func (d *proofDecoder) readAuditPath(readPosition func() string) map[string]hashing.Digest {
+	count := d.readUvarint()
+	if count == 0 {
+		return nil
+	}
+	// every position takes at least one byte
+	if count > uint64(d.r.Len()) {
+		if d.err == nil {
+			d.err = io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	positions := make([]string, count)
+	for i := range positions {
+		positions[i] = readPosition()
+	}
+	digests := d.readDigests()
+	if d.err != nil {
+		return nil
+	}
+	if len(digests) != len(positions) {
+		d.err = errors.New("audit path with a different number of positions and digests")
+		return nil
+	}
+	path := make(map[string]hashing.Digest, count)
+	for i, position := range positions {
+		path[position] = digests[i]
+	}
+	return path
+}
+
+func (d *proofDecoder) readHyperPosition() string {
+	size := d.readUvarint()
+	trimmed := d.readBytes()
+	height := d.readUvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(trimmed)) > size || size > math.MaxUint8 || height > math.MaxUint16 {
+		d.err = errors.New("invalid position")
+		return ""
+	}
+	index := make([]byte, size)
+	copy(index, trimmed)
+	return fmt.Sprintf("%#x|%d", index, height)
+}
+
+func (d *proofDecoder) readHistoryPosition() string {
+	index := d.readUvarint()
+	height := d.readUvarint()
+	if d.err != nil {
+		return ""
+	}
+	if height > math.MaxUint16 {
+		d.err = errors.New("invalid position")
+		return ""
+	}
+	return fmt.Sprintf("%d|%d", index, height)
+}
+
+// finish returns the first error found while decoding, if any, or an
+// error if there are bytes left.
+func (d *proofDecoder) finish() error {
+	if d.err != nil {
+		return fmt.Errorf("malformed binary proof: %v", d.err)
+	}
+	if d.r.Len() > 0 {
+		return errors.New("malformed binary proof: trailing bytes")
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+)
+
+func TestBinaryMembershipResult(t *testing.T) {
+
+	log.SetLogger("TestBinaryMembershipResult", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	snapshots := make([]*balloon.Snapshot, 0)
+	for i := 0; i < 10; i++ {
+		snapshot, mutations, err := tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		snapshots = append(snapshots, snapshot)
+	}
+	snapshot, mutations, err := tree.Put([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations))
+	snapshots = append(snapshots, snapshot)
+	last := snapshots[len(snapshots)-1]
+
+	testCases := []struct {
+		key     []byte
+		version uint64
+	}{
+		{[]byte("event 0"), last.Version},
+		{[]byte("event 3"), 5},
+		{[]byte("event 9"), last.Version},
+		{[]byte("key"), last.Version},
+		{[]byte("missing"), last.Version},
+	}
+
+	for i, c := range testCases {
+		proof, err := tree.QueryMembership(c.key, c.version)
+		require.NoError(t, err)
+		result := ToMembershipResult(c.key, proof)
+
+		encoded, err := EncodeMembershipResult(result, proof.Hasher)
+		require.NoErrorf(t, err, "Encoding should not fail for case %d", i)
+
+		decoded, err := DecodeMembershipResult(encoded, hashing.NewSha256Hasher())
+		require.NoErrorf(t, err, "Decoding should not fail for case %d", i)
+		assert.Equalf(t, result, decoded, "The decoded result should match for case %d", i)
+
+		jsonEncoded, _ := json.Marshal(result)
+		assert.Truef(t, len(encoded) < len(jsonEncoded)/2, "The binary proof should be smaller than the JSON one for case %d", i)
+
+		decodedProof, err := ToBalloonProof(decoded, hashing.NewSha256Hasher, tree.TreeFormat())
+		require.NoError(t, err)
+		verified := decodedProof.Verify(c.key, snapshots[c.version])
+		assert.Truef(t, verified, "The decoded proof should verify for case %d", i)
+
+		_, err = ToBalloonProof(decoded, hashing.NewSha256Hasher, 3)
+		assert.Errorf(t, err, "Proofs of unknown tree formats should not be translated for case %d", i)
+	}
+
+}
+
+func TestBinaryIncrementalResponse(t *testing.T) {
+
+	log.SetLogger("TestBinaryIncrementalResponse", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	snapshots := make([]*balloon.Snapshot, 0)
+	for i := 0; i < 20; i++ {
+		snapshot, mutations, err := tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		snapshots = append(snapshots, snapshot)
+	}
+
+	for _, r := range [][2]uint64{{0, 0}, {2, 9}, {7, 19}, {19, 19}} {
+		proof, err := tree.QueryConsistency(r[0], r[1])
+		require.NoError(t, err)
+		response := ToIncrementalResponse(proof)
+
+		encoded, err := EncodeIncrementalResponse(response)
+		require.NoErrorf(t, err, "Encoding should not fail for range %v", r)
+
+		decoded, err := DecodeIncrementalResponse(encoded)
+		require.NoErrorf(t, err, "Decoding should not fail for range %v", r)
+		assert.Equalf(t, response, decoded, "The decoded response should match for range %v", r)
+
+		decodedProof, err := ToIncrementalProof(decoded, hashing.NewSha256Hasher(), tree.TreeFormat())
+		require.NoError(t, err)
+		verified := decodedProof.Verify(snapshots[r[0]], snapshots[r[1]])
+		assert.Truef(t, verified, "The decoded proof should verify for range %v", r)
+	}
+
+}
+
+func TestBinaryBatchMembershipResult(t *testing.T) {
+
+	log.SetLogger("TestBinaryBatchMembershipResult", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	keyDigests := make([]hashing.Digest, 0)
+	var snapshot *balloon.Snapshot
+	for i := 0; i < 20; i++ {
+		var mutations []*storage.Mutation
+		snapshot, mutations, err = tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		if i%3 == 0 {
+			keyDigests = append(keyDigests, hasher.Do([]byte(fmt.Sprintf("event %d", i))))
+		}
+	}
+	keyDigests = append(keyDigests, hasher.Do([]byte("missing")))
+
+	proof, err := tree.QueryBatchMembership(keyDigests, snapshot.Version)
+	require.NoError(t, err)
+	result := ToBatchMembershipResult(proof)
+
+	encoded, err := EncodeBatchMembershipResult(result)
+	require.NoError(t, err)
+
+	decoded, err := DecodeBatchMembershipResult(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, result, decoded, "The decoded result should match")
+
+	jsonEncoded, _ := json.Marshal(result)
+	assert.True(t, len(encoded) < len(jsonEncoded)/2, "The binary proof should be smaller than the JSON one")
+
+	batchProof, err := ToBalloonBatchProof(decoded, hashing.NewSha256Hasher, tree.TreeFormat())
+	require.NoError(t, err)
+	verified := batchProof.DigestVerify(keyDigests, snapshot)
+	assert.True(t, verified, "The decoded proof should verify")
+
+	// every truncation must fail without panicking
+	for i := 0; i < len(encoded); i++ {
+		_, err := DecodeBatchMembershipResult(encoded[:i])
+		assert.Errorf(t, err, "Decoding a proof truncated to %d bytes should fail", i)
+	}
+	_, err = DecodeBatchMembershipResult(append(encoded, 0x0))
+	assert.Error(t, err, "Trailing bytes should not be accepted")
+
+}
+
+func TestDecodeMalformedBinaryProof(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, mutations, err := tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+	}
+	proof, err := tree.QueryMembership([]byte("event 1"), 4)
+	require.NoError(t, err)
+	encoded, err := EncodeMembershipResult(ToMembershipResult(nil, proof), proof.Hasher)
+	require.NoError(t, err)
+
+	// every truncation must fail without panicking
+	for i := 0; i < len(encoded); i++ {
+		_, err := DecodeMembershipResult(encoded[:i], hashing.NewSha256Hasher())
+		assert.Errorf(t, err, "Decoding a proof truncated to %d bytes should fail", i)
+	}
+
+	_, err = DecodeMembershipResult(append(encoded, 0x0), hashing.NewSha256Hasher())
+	assert.Error(t, err, "Trailing bytes should not be accepted")
+
+	other := append([]byte{BinaryProofVersion + 1}, encoded[1:]...)
+	_, err = DecodeMembershipResult(other, hashing.NewSha256Hasher())
+	assert.Equal(t, ErrUnsupportedProofVersion, err)
+
+	_, err = DecodeIncrementalResponse(encoded)
+	assert.Error(t, err, "A membership proof is not an incremental one")
+
+}
+
+func TestAcceptsBinaryProof(t *testing.T) {
+	assert.True(t, AcceptsBinaryProof(BinaryProofMediaType))
+	assert.True(t, AcceptsBinaryProof("application/json;q=0.5, "+BinaryProofMediaType+";q=1"))
+	assert.False(t, AcceptsBinaryProof("application/json"))
+	assert.False(t, AcceptsBinaryProof(""))
+	assert.True(t, IsBinaryProof(BinaryProofMediaType))
+	assert.False(t, IsBinaryProof("application/json"))
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/sign"
+)
+
+// ProofBundleVersion is the version of the proof bundle format.
+const ProofBundleVersion = 1
+
+// ProofBundle is a self-contained receipt of the membership of an event.
+// It carries everything needed to verify the membership without access
+// to the QED cluster but the trusted keys of the server: the proof, the
+// snapshot it verifies against, signed by the server, and the public key
+// of the signer as a hint.
+type ProofBundle struct {
+	Version int
+	// Event is the original event. It may be omitted to disclose only
+	// its digest, which is always in Proof.KeyDigest.
+	Event []byte `json:",omitempty"`
+	// Hasher is the identifier of the hasher of the log, as in
+	// hashing.NewHasherF.
+	Hasher string
+	Proof  *MembershipResult
+	// Snapshot is the signed snapshot of the query version of the proof.
+	Snapshot *SignedSnapshot
+	// PublicKey is the public key of the signer, in the form of
+	// sign.NewVerifier for its Algorithm. It is only a hint: the snapshot
+	// is verified with the trusted keys of the server, and the bundle is
+	// rejected if the hint does not match the key which signed it.
+	PublicKey []byte
+	Algorithm string `json:",omitempty"` // empty for sign.DefaultAlgorithm
+	// Cosignatures are the cosignatures of the tree head of the snapshot
+	// made by the witnesses, if any.
+	Cosignatures []*Cosignature `json:",omitempty"`
+}
+
+var (
+	ErrUnsupportedBundleVersion = errors.New("unsupported proof bundle version")
+	ErrInvalidBundleProof       = errors.New("invalid membership proof")
+)
+
+func (b *ProofBundle) Encode() ([]byte, error) {
+	return json.MarshalIndent(b, "", "  ")
+}
+
+func (b *ProofBundle) Decode(msg []byte) error {
+	return json.Unmarshal(msg, b)
+}
+
+// Verify checks the signature of the snapshot of the bundle with the
+// trusted keys of the server and the membership proof against it. It
+// returns nil if the event belongs to the log, or an error explaining
+// why the bundle does not prove it.
+func (b *ProofBundle) Verify(keys *sign.KeySet) error {
+
+	if b.Version != ProofBundleVersion {
+		return ErrUnsupportedBundleVersion
+	}
+	if keys == nil || len(keys.Keys) == 0 {
+		return errors.New("no trusted keys to verify the proof bundle")
+	}
+	if b.Proof == nil || b.Snapshot == nil || b.Snapshot.Snapshot == nil {
+		return errors.New("incomplete proof bundle")
+	}
+	if !b.Proof.Exists {
+		return fmt.Errorf("the bundle proves the event %x does not exist", b.Proof.KeyDigest)
+	}
+
+	hasherF, err := hashing.NewHasherF(b.Hasher)
+	if err != nil {
+		return err
+	}
+	if b.Event != nil && !bytes.Equal(hasherF().Do(b.Event), b.Proof.KeyDigest) {
+		return errors.New("the event does not match the digest of the proof")
+	}
+
+	snapshot := b.Snapshot.Snapshot
+	if snapshot.Version != b.Proof.QueryVersion || snapshot.Version > b.Proof.CurrentVersion {
+		return fmt.Errorf("snapshot version %d does not match the query version %d of the proof", snapshot.Version, b.Proof.QueryVersion)
+	}
+	if err := b.Snapshot.VerifyKeySet(keys); err != nil {
+		return err
+	}
+	if b.PublicKey != nil {
+		key, _ := keys.Key(b.Snapshot.TreeHead.KeyId)
+		if !bytes.Equal(key.PublicKey, b.PublicKey) || b.algorithm() != b.Snapshot.algorithm() {
+			return fmt.Errorf("the public key of the bundle does not match the trusted key %q", key.KeyId)
+		}
+	}
+
+	proof, err := ToBalloonProof(b.Proof, hasherF, snapshot.TreeFormat)
+	if err != nil {
+		return err
+	}
+	ok := proof.DigestVerify(b.Proof.KeyDigest, &balloon.Snapshot{
+		EventDigest:   b.Proof.KeyDigest,
+		HistoryDigest: snapshot.HistoryDigest,
+		HyperDigest:   snapshot.HyperDigest,
+		Version:       snapshot.Version,
+	})
+	if !ok {
+		return ErrInvalidBundleProof
+	}
+
+	return nil
+}
+
+func (b *ProofBundle) algorithm() string {
+	if b.Algorithm == "" {
+		return sign.DefaultAlgorithm
+	}
+	return b.Algorithm
+}
+
+// VerifyCosignatures checks the tree head of the snapshot of the bundle
+// was cosigned by at least n different keys of the witnesses. It must be
+// called along with Verify.
+func (b *ProofBundle) VerifyCosignatures(witnesses *sign.KeySet, n int) error {
+	cosigned := &CosignedSnapshot{Snapshot: b.Snapshot, Cosignatures: b.Cosignatures}
+	return cosigned.VerifyCosignatures(witnesses, n)
+}
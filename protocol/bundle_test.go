@@ -0,0 +1,143 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/sign"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+)
+
+func TestProofBundle(t *testing.T) {
+
+	log.SetLogger("TestProofBundle", log.SILENT)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree, err := balloon.NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	signer := sign.NewEd25519Signer().(*sign.Ed25519Signer)
+	signed := make([]*SignedSnapshot, 0)
+	for i := 0; i < 10; i++ {
+		snapshot, mutations, err := tree.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations))
+		s := &Snapshot{
+			HistoryDigest: snapshot.HistoryDigest,
+			HyperDigest:   snapshot.HyperDigest,
+			Version:       snapshot.Version,
+			EventDigest:   snapshot.EventDigest,
+			TreeFormat:    snapshot.TreeFormat,
+		}
+		signedSnapshot, err := SignSnapshot(signer, s, time.Now())
+		require.NoError(t, err)
+		signed = append(signed, signedSnapshot)
+	}
+
+	keys := keySetOf(signer)
+
+	newBundle := func(event []byte, version uint64) *ProofBundle {
+		proof, err := tree.QueryMembership(event, version)
+		require.NoError(t, err)
+		bundle := &ProofBundle{
+			Version:   ProofBundleVersion,
+			Event:     event,
+			Hasher:    hashing.SHA256,
+			Proof:     ToMembershipResult(event, proof),
+			Snapshot:  signed[version],
+			PublicKey: signer.PublicKey(),
+		}
+		// the bundle must survive its encoding
+		encoded, err := bundle.Encode()
+		require.NoError(t, err)
+		decoded := new(ProofBundle)
+		require.NoError(t, decoded.Decode(encoded))
+		return decoded
+	}
+
+	assert.NoError(t, newBundle([]byte("event 3"), 9).Verify(keys), "A bundle for the last version should verify")
+	assert.NoError(t, newBundle([]byte("event 3"), 5).Verify(keys), "A bundle for a past version should verify")
+
+	bundle := newBundle([]byte("event 3"), 5)
+	bundle.Event = nil
+	assert.NoError(t, bundle.Verify(keys), "A bundle with only the event digest should verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Event = []byte("event 4")
+	assert.Error(t, bundle.Verify(keys), "A bundle for another event should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Snapshot = signed[6]
+	assert.Error(t, bundle.Verify(keys), "A bundle with the snapshot of another version should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Snapshot.Signature[0] ^= 0xff
+	assert.Equal(t, ErrInvalidSignature, bundle.Verify(keys), "A bundle with a wrong signature should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.PublicKey = sign.NewEd25519Signer().(*sign.Ed25519Signer).PublicKey()
+	assert.Error(t, bundle.Verify(keys), "A bundle with another signer key should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.PublicKey = nil
+	assert.NoError(t, bundle.Verify(keys), "A bundle without the hint of the signer key should verify")
+
+	// a bundle signed by an untrusted key which carries its own key
+	other := sign.NewEd25519Signer().(*sign.Ed25519Signer)
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Snapshot, err = SignSnapshot(other, bundle.Snapshot.Snapshot, time.Now())
+	require.NoError(t, err)
+	bundle.PublicKey = other.PublicKey()
+	assert.Error(t, bundle.Verify(keys), "A bundle signed by an untrusted key should not verify")
+	assert.Error(t, bundle.Verify(nil), "A bundle should not verify without trusted keys")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Snapshot.Snapshot.HyperDigest[0] ^= 0xff
+	bundle.Snapshot, err = SignSnapshot(signer, bundle.Snapshot.Snapshot, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, ErrInvalidBundleProof, bundle.Verify(keys), "A bundle with a wrong snapshot should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Hasher = "unknown"
+	assert.Error(t, bundle.Verify(keys), "A bundle with an unknown hasher should not verify")
+
+	bundle = newBundle([]byte("event 3"), 5)
+	bundle.Version = ProofBundleVersion + 1
+	assert.Equal(t, ErrUnsupportedBundleVersion, bundle.Verify(keys), "A bundle of an unknown format should not verify")
+
+	assert.Error(t, newBundle([]byte("missing"), 9).Verify(keys), "A bundle of a missing event should not verify")
+
+	witness := sign.NewEd25519Signer()
+	bundle = newBundle([]byte("event 3"), 5)
+	cosignature, err := Cosign(witness, "witness0", bundle.Snapshot, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, ErrNotEnoughCosignatures, bundle.VerifyCosignatures(keySetOf(witness), 1), "A bundle without cosignatures should not be cosigned")
+	bundle.Cosignatures = []*Cosignature{cosignature}
+	assert.NoError(t, bundle.VerifyCosignatures(keySetOf(witness), 1), "A bundle with the cosignature of a witness should be cosigned")
+	assert.Equal(t, ErrNotEnoughCosignatures, bundle.VerifyCosignatures(keySetOf(sign.NewEd25519Signer()), 1), "Cosignatures of other witnesses should not count")
+
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bbva/qed/sign"
+)
+
+// cosignaturePrefix starts the statements of the witnesses, so they
+// cannot be mistaken for the tree heads signed by the servers.
+const cosignaturePrefix = "qed cosignature v1"
+
+var (
+	ErrInvalidCosignature    = errors.New("invalid cosignature")
+	ErrNotEnoughCosignatures = errors.New("not enough witness cosignatures")
+)
+
+// Cosignature is the statement of a witness that the tree head of a
+// snapshot is consistent with every tree head of the log it cosigned
+// before. The witness signs the statement returned by cosignatureMessage:
+//
+//	prefix          the ASCII bytes of "qed cosignature v1"
+//	timestamp       8 bytes big-endian, milliseconds since the Unix epoch
+//	tree head       the canonical bytes of the tree head, see TreeHead
+//
+// A client which requires the cosignatures of several independent
+// witnesses is not served a view of the log the witnesses have not seen.
+type Cosignature struct {
+	Witness   string // node name of the witness
+	KeyId     string
+	Algorithm string `json:",omitempty"` // empty for sign.DefaultAlgorithm
+	Timestamp int64  // milliseconds since the epoch
+	Signature []byte
+}
+
+// CosignedSnapshot is a signed snapshot along with the cosignatures of
+// its tree head.
+type CosignedSnapshot struct {
+	Snapshot     *SignedSnapshot
+	Cosignatures []*Cosignature
+}
+
+func (c *CosignedSnapshot) Encode() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *CosignedSnapshot) Decode(msg []byte) error {
+	return json.Unmarshal(msg, c)
+}
+
+func cosignatureMessage(head *TreeHead, timestamp int64) ([]byte, error) {
+	encoded, err := head.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	var num [8]byte
+	buf.WriteString(cosignaturePrefix)
+	binary.BigEndian.PutUint64(num[:], uint64(timestamp))
+	buf.Write(num[:])
+	buf.Write(encoded)
+	return buf.Bytes(), nil
+}
+
+// Cosign signs the tree head of a snapshot on behalf of a witness. The
+// caller is responsible for checking the snapshot first: its signature
+// and its consistency with the last snapshot cosigned by the witness.
+func Cosign(signer sign.Signer, witness string, s *SignedSnapshot, timestamp time.Time) (*Cosignature, error) {
+	if s.Snapshot == nil || s.TreeHead == nil {
+		return nil, ErrMissingTreeHead
+	}
+	// a keyring can rotate between naming the key and signing
+	if keyring, ok := signer.(*sign.Keyring); ok {
+		signer = keyring.Active()
+	}
+	c := &Cosignature{
+		Witness:   witness,
+		KeyId:     signer.KeyID(),
+		Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+	}
+	if signer.Algorithm() != sign.DefaultAlgorithm {
+		c.Algorithm = signer.Algorithm()
+	}
+	message, err := cosignatureMessage(s.TreeHead, c.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if c.Signature, err = signer.Sign(message); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Verify checks the cosignature of a tree head was made by the key of
+// the verifier.
+func (c *Cosignature) Verify(head *TreeHead, verifier sign.Verifier) error {
+	if c.KeyId != verifier.KeyID() {
+		return fmt.Errorf("cosignature made with unknown key %q", c.KeyId)
+	}
+	algorithm := c.Algorithm
+	if algorithm == "" {
+		algorithm = sign.DefaultAlgorithm
+	}
+	if algorithm != verifier.Algorithm() {
+		return fmt.Errorf("cosignature made with %s, not %s", algorithm, verifier.Algorithm())
+	}
+	message, err := cosignatureMessage(head, c.Timestamp)
+	if err != nil {
+		return err
+	}
+	ok, err := verifier.Verify(message, c.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCosignature
+	}
+	return nil
+}
+
+// VerifyKeySet is like Verify with the key of the set the cosignature
+// names, which must have been valid when the tree head was cosigned.
+func (c *Cosignature) VerifyKeySet(head *TreeHead, keys *sign.KeySet) error {
+	key, err := keys.Key(c.KeyId)
+	if err != nil {
+		return fmt.Errorf("cosignature made with unknown key %q", c.KeyId)
+	}
+	if !key.ValidAt(c.Timestamp) {
+		return fmt.Errorf("cosignature made out of the validity window of key %q", key.KeyId)
+	}
+	verifier, err := sign.NewVerifier(key.Algorithm, key.PublicKey)
+	if err != nil {
+		return err
+	}
+	return c.Verify(head, verifier)
+}
+
+// VerifyCosignatures checks the tree head of the snapshot was cosigned
+// by at least n different keys of the witnesses. Cosignatures which do
+// not verify are ignored. It does not verify the signature of the
+// server.
+func (c *CosignedSnapshot) VerifyCosignatures(witnesses *sign.KeySet, n int) error {
+	if c.Snapshot == nil || c.Snapshot.Snapshot == nil || c.Snapshot.TreeHead == nil {
+		return ErrMissingTreeHead
+	}
+	if !c.Snapshot.TreeHead.Matches(c.Snapshot.Snapshot) {
+		return fmt.Errorf("the tree head of snapshot %d does not match the snapshot", c.Snapshot.Snapshot.Version)
+	}
+	valid := make(map[string]bool)
+	for _, cosignature := range c.Cosignatures {
+		if cosignature == nil || valid[cosignature.KeyId] {
+			continue
+		}
+		if cosignature.VerifyKeySet(c.Snapshot.TreeHead, witnesses) == nil {
+			valid[cosignature.KeyId] = true
+		}
+	}
+	if len(valid) < n {
+		return ErrNotEnoughCosignatures
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/sign"
+)
+
+func keySetOf(signers ...sign.Signer) *sign.KeySet {
+	keys := &sign.KeySet{}
+	for _, s := range signers {
+		keys.Keys = append(keys.Keys, &sign.KeyInfo{
+			KeyId:     s.KeyID(),
+			Algorithm: s.Algorithm(),
+			PublicKey: s.PublicKey(),
+		})
+	}
+	return keys
+}
+
+func TestCosignature(t *testing.T) {
+
+	server := sign.NewEd25519Signer()
+	witness0 := sign.NewEd25519Signer()
+	witness1 := sign.NewECDSASigner()
+	stranger := sign.NewEd25519Signer()
+	witnesses := keySetOf(witness0, witness1)
+	now := time.Now()
+
+	signed, err := SignSnapshot(server, &Snapshot{HistoryDigest: []byte{0x01}, HyperDigest: []byte{0x02}, Version: 5}, now)
+	require.NoError(t, err)
+
+	c0, err := Cosign(witness0, "witness0", signed, now)
+	require.NoError(t, err)
+	c1, err := Cosign(witness1, "witness1", signed, now)
+	require.NoError(t, err)
+	assert.Equal(t, sign.ECDSAP256SHA256, c1.Algorithm)
+	forged, err := Cosign(stranger, "witness0", signed, now)
+	require.NoError(t, err)
+
+	assert.NoError(t, c0.VerifyKeySet(signed.TreeHead, witnesses))
+	assert.NoError(t, c1.VerifyKeySet(signed.TreeHead, witnesses))
+	assert.Error(t, forged.VerifyKeySet(signed.TreeHead, witnesses), "Cosignatures of unknown keys must not verify")
+
+	// the server signature is not a valid cosignature of its own tree head
+	serverKeys := keySetOf(server)
+	assert.Error(t, (&Cosignature{KeyId: server.KeyID(), Timestamp: signed.TreeHead.Timestamp, Signature: signed.Signature}).VerifyKeySet(signed.TreeHead, serverKeys))
+
+	cosigned := &CosignedSnapshot{Snapshot: signed, Cosignatures: []*Cosignature{c0, c0, forged}}
+	assert.NoError(t, cosigned.VerifyCosignatures(witnesses, 1))
+	assert.Equal(t, ErrNotEnoughCosignatures, cosigned.VerifyCosignatures(witnesses, 2), "Cosignatures of the same key must be counted once")
+
+	cosigned.Cosignatures = append(cosigned.Cosignatures, c1)
+	encoded, err := cosigned.Encode()
+	require.NoError(t, err)
+	decoded := new(CosignedSnapshot)
+	require.NoError(t, decoded.Decode(encoded))
+	assert.NoError(t, decoded.VerifyCosignatures(witnesses, 2), "The cosignatures must verify after decoding")
+
+	// a split view: the cosignatures do not verify for another history
+	other, err := SignSnapshot(server, &Snapshot{HistoryDigest: []byte{0x03}, HyperDigest: []byte{0x02}, Version: 5}, now)
+	require.NoError(t, err)
+	decoded.Snapshot = other
+	assert.Equal(t, ErrNotEnoughCosignatures, decoded.VerifyCosignatures(witnesses, 1))
+
+	c0.Timestamp++
+	assert.Equal(t, ErrInvalidCosignature, c0.VerifyKeySet(signed.TreeHead, witnesses), "The timestamp must be signed")
+
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/bbva/qed/sign"
+)
+
+var ErrNoEquivocation = errors.New("snapshots do not equivocate")
+
+// Equivocation is the evidence of a server signing two snapshots with
+// different history digests for the same version of a log. Both signed
+// snapshots are kept so the evidence can be checked by third parties
+// with only the public keys of the server.
+type Equivocation struct {
+	LogId   string `json:",omitempty"` // empty for the default log
+	Version uint64
+	First   *SignedSnapshot
+	Second  *SignedSnapshot
+}
+
+// NewEquivocation returns the evidence of an equivocation between two
+// signed snapshots, or nil if they do not conflict. Signatures are not
+// verified.
+func NewEquivocation(first, second *SignedSnapshot) *Equivocation {
+	if first == nil || second == nil || first.Snapshot == nil || second.Snapshot == nil {
+		return nil
+	}
+	a, b := first.Snapshot, second.Snapshot
+	if a.LogId != b.LogId || a.Version != b.Version || bytes.Equal(a.HistoryDigest, b.HistoryDigest) {
+		return nil
+	}
+	return &Equivocation{
+		LogId:   a.LogId,
+		Version: a.Version,
+		First:   first,
+		Second:  second,
+	}
+}
+
+func (e *Equivocation) Encode() ([]byte, error) {
+	return json.MarshalIndent(e, "", "  ")
+}
+
+func (e *Equivocation) Decode(msg []byte) error {
+	return json.Unmarshal(msg, e)
+}
+
+// Verify checks both snapshots are validly signed with keys of the set
+// and conflict with each other, as described by the evidence.
+func (e *Equivocation) Verify(keys *sign.KeySet) error {
+	found := NewEquivocation(e.First, e.Second)
+	if found == nil || found.LogId != e.LogId || found.Version != e.Version {
+		return ErrNoEquivocation
+	}
+	if err := e.First.VerifyKeySet(keys); err != nil {
+		return err
+	}
+	return e.Second.VerifyKeySet(keys)
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/sign"
+)
+
+func TestEquivocation(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	keys := &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+	}}}
+	now := time.Now()
+
+	first, err := SignSnapshot(signer, &Snapshot{HistoryDigest: []byte{0x01}, HyperDigest: []byte{0x02}, Version: 5}, now)
+	require.NoError(t, err)
+	second, err := SignSnapshot(signer, &Snapshot{HistoryDigest: []byte{0x03}, HyperDigest: []byte{0x02}, Version: 5}, now)
+	require.NoError(t, err)
+	other, err := SignSnapshot(signer, &Snapshot{HistoryDigest: []byte{0x03}, HyperDigest: []byte{0x02}, Version: 6}, now)
+	require.NoError(t, err)
+
+	assert.Nil(t, NewEquivocation(first, first), "The same snapshot does not equivocate")
+	assert.Nil(t, NewEquivocation(first, other), "Snapshots of different versions do not equivocate")
+
+	found := NewEquivocation(first, second)
+	require.NotNil(t, found, "Different history digests for the same version must equivocate")
+	assert.Equal(t, uint64(5), found.Version)
+	assert.NoError(t, found.Verify(keys))
+
+	encoded, err := found.Encode()
+	require.NoError(t, err)
+	decoded := new(Equivocation)
+	require.NoError(t, decoded.Decode(encoded))
+	assert.NoError(t, decoded.Verify(keys), "The evidence must verify after decoding")
+
+	decoded.Version = 6
+	assert.Equal(t, ErrNoEquivocation, decoded.Verify(keys), "The evidence must describe the snapshots")
+
+	forged, _ := SignSnapshot(sign.NewEd25519Signer(), second.Snapshot, now)
+	assert.Error(t, NewEquivocation(first, forged).Verify(keys), "The evidence must be signed with trusted keys")
+
+}
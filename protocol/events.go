@@ -24,7 +24,6 @@ import (
 	"github.com/bbva/qed/balloon/history"
 	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/hashing"
-	"github.com/bbva/qed/util"
 )
 
 // Event is the public struct that Add handler function uses to
@@ -33,6 +32,19 @@ type Event struct {
 	Event []byte
 }
 
+// EventsBulk is the public struct that AddBulk handler function uses to
+// parse the post params.
+type EventsBulk struct {
+	Events [][]byte
+}
+
+// KeyValue is the public struct that Put handler function uses to
+// parse the post params.
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
 // MembershipQuery is the public struct that apihttp.Membership
 // Handler uses to parse the post params.
 type MembershipQuery struct {
@@ -47,16 +59,34 @@ type MembershipDigest struct {
 	Version   uint64
 }
 
+// BatchMembershipQuery is the public struct that apihttp.BatchMembership
+// Handler uses to parse the post params.
+type BatchMembershipQuery struct {
+	KeyDigests []hashing.Digest
+	Version    uint64
+}
+
 // Snapshot is the public struct that apihttp.Add Handler call returns.
 type Snapshot struct {
 	HistoryDigest hashing.Digest
 	HyperDigest   hashing.Digest
 	Version       uint64
 	EventDigest   hashing.Digest
+	LogId         string `json:",omitempty"` // empty for the default log
+	// TreeFormat is the format of the trees of the log, which verifiers
+	// must take from a signed snapshot. Snapshots that omit it follow
+	// hashing.TreeFormatV1.
+	TreeFormat int `json:",omitempty"`
 }
 
+// SignedSnapshot is a snapshot along with its tree head, signed by the
+// server. See SignSnapshot and Verify.
 type SignedSnapshot struct {
-	Snapshot  *Snapshot
+	Snapshot *Snapshot
+	TreeHead *TreeHead
+	// Algorithm is the signature algorithm, one of the identifiers of
+	// the sign package. It is omitted for sign.DefaultAlgorithm.
+	Algorithm string `json:",omitempty"`
 	Signature []byte
 }
 
@@ -106,6 +136,44 @@ type MembershipResult struct {
 	ActualVersion  uint64
 	KeyDigest      hashing.Digest
 	Key            []byte
+	// ShortcutKey and ShortcutValue prove non-membership when the
+	// path of the key ends in a leaf of another key.
+	ShortcutKey   []byte `json:",omitempty"`
+	ShortcutValue []byte `json:",omitempty"`
+	// ValueDigest is the digest of the value of a key stored
+	// in key-value mode, so the proof proves that value.
+	ValueDigest hashing.Digest `json:",omitempty"`
+	// TreeFormat is the format of the trees the proof belongs to.
+	// It is omitted for hashing.TreeFormatV1.
+	TreeFormat int `json:",omitempty"`
+}
+
+// BatchMembershipEntry is the answer for one of the keys of a
+// BatchMembershipResult.
+type BatchMembershipEntry struct {
+	KeyDigest     hashing.Digest
+	Exists        bool
+	ActualVersion uint64
+	// Height is the height of the hyper tree node where the path
+	// of the key ends.
+	Height        uint16
+	ValueDigest   hashing.Digest `json:",omitempty"`
+	ShortcutKey   []byte         `json:",omitempty"`
+	ShortcutValue []byte         `json:",omitempty"`
+}
+
+// BatchMembershipResult is the public struct that apihttp.BatchMembership
+// Handler returns. The hyper and history audit paths are shared by all
+// the entries.
+type BatchMembershipResult struct {
+	Entries        []*BatchMembershipEntry
+	Hyper          map[string]hashing.Digest
+	History        map[string]hashing.Digest
+	CurrentVersion uint64
+	QueryVersion   uint64
+	// TreeFormat is the format of the trees the proof belongs to.
+	// It is omitted for hashing.TreeFormatV1.
+	TreeFormat int `json:",omitempty"`
 }
 
 type IncrementalRequest struct {
@@ -117,6 +185,21 @@ type IncrementalResponse struct {
 	Start     uint64
 	End       uint64
 	AuditPath map[string]hashing.Digest
+	// TreeFormat is the format of the history tree the proof belongs
+	// to. It is omitted for hashing.TreeFormatV1.
+	TreeFormat int `json:",omitempty"`
+}
+
+// treeFormat returns the format to advertise for the trees built with
+// the given hasher.
+func treeFormat(hasher hashing.Hasher) int {
+	if hasher == nil {
+		return 0
+	}
+	if format := hashing.TreeFormat(hasher); format != hashing.TreeFormatV1 {
+		return format
+	}
+	return 0
 }
 
 // ToMembershipProof translates internal api balloon.MembershipProof to the
@@ -129,20 +212,32 @@ func ToMembershipResult(key []byte, mp *balloon.MembershipProof) *MembershipResu
 	}
 
 	return &MembershipResult{
-		mp.Exists,
-		mp.HyperProof.AuditPath,
-		serialized,
-		mp.CurrentVersion,
-		mp.QueryVersion,
-		mp.ActualVersion,
-		mp.KeyDigest,
-		key,
+		Exists:         mp.Exists,
+		Hyper:          mp.HyperProof.AuditPath,
+		History:        serialized,
+		CurrentVersion: mp.CurrentVersion,
+		QueryVersion:   mp.QueryVersion,
+		ActualVersion:  mp.ActualVersion,
+		KeyDigest:      mp.KeyDigest,
+		Key:            key,
+		ShortcutKey:    mp.HyperProof.ShortcutKey,
+		ShortcutValue:  mp.HyperProof.ShortcutValue,
+		ValueDigest:    mp.ValueDigest,
+		TreeFormat:     treeFormat(mp.Hasher),
 	}
 }
 
 // ToBaloonProof translate public protocol.MembershipResult to internal
-// balloon.Proof.
-func ToBalloonProof(mr *MembershipResult, hasherF func() hashing.Hasher) *balloon.MembershipProof {
+// balloon.Proof. The tree format must come from a trusted source, such as
+// the signed snapshot the proof is verified against, and not from the
+// format the server advertises in the result. It fails if the format is
+// unknown.
+func ToBalloonProof(mr *MembershipResult, hasherF func() hashing.Hasher, treeFormat int) (*balloon.MembershipProof, error) {
+
+	hasherF, err := hashing.NewTreeHasherF(hasherF, treeFormat)
+	if err != nil {
+		return nil, err
+	}
 
 	historyProof := history.NewMembershipProof(
 		mr.ActualVersion,
@@ -152,14 +247,23 @@ func ToBalloonProof(mr *MembershipResult, hasherF func() hashing.Hasher) *balloo
 	)
 
 	hasher := hasherF()
+	var value []byte
+	if mr.Exists {
+		if mr.ValueDigest != nil {
+			value = hyper.KeyValue(mr.ValueDigest, mr.ActualVersion)
+		} else {
+			value = hyper.EventValue(hasher, mr.ActualVersion)
+		}
+	}
 	hyperProof := hyper.NewQueryProof(
 		mr.KeyDigest,
-		util.Uint64AsPaddedBytes(mr.ActualVersion, int(hasher.Len())),
+		value,
 		mr.Hyper,
 		hasher,
 	)
+	hyperProof.ShortcutKey, hyperProof.ShortcutValue = mr.ShortcutKey, mr.ShortcutValue
 
-	return balloon.NewMembershipProof(
+	proof := balloon.NewMembershipProof(
 		mr.Exists,
 		hyperProof,
 		historyProof,
@@ -169,17 +273,126 @@ func ToBalloonProof(mr *MembershipResult, hasherF func() hashing.Hasher) *balloo
 		mr.KeyDigest,
 		hasherF(),
 	)
+	proof.ValueDigest = mr.ValueDigest
 
+	return proof, nil
+
+}
+
+// ToBatchMembershipResult translates internal api balloon.BatchMembershipProof
+// to the public struct protocol.BatchMembershipResult.
+func ToBatchMembershipResult(bp *balloon.BatchMembershipProof) *BatchMembershipResult {
+
+	var serialized map[string]hashing.Digest
+	if bp.HistoryProof != nil && bp.HistoryProof.AuditPath != nil {
+		serialized = bp.HistoryProof.AuditPath.Serialize()
+	}
+
+	entries := make([]*BatchMembershipEntry, len(bp.KeyDigests))
+	for i, keyDigest := range bp.KeyDigests {
+		hyperEntry := bp.HyperProof.Entries[i]
+		entries[i] = &BatchMembershipEntry{
+			KeyDigest:     keyDigest,
+			Exists:        bp.Exists[i],
+			ActualVersion: bp.ActualVersions[i],
+			Height:        hyperEntry.Height,
+			ValueDigest:   bp.ValueDigests[i],
+			ShortcutKey:   hyperEntry.ShortcutKey,
+			ShortcutValue: hyperEntry.ShortcutValue,
+		}
+	}
+
+	return &BatchMembershipResult{
+		Entries:        entries,
+		Hyper:          bp.HyperProof.AuditPath,
+		History:        serialized,
+		CurrentVersion: bp.CurrentVersion,
+		QueryVersion:   bp.QueryVersion,
+		TreeFormat:     treeFormat(bp.Hasher),
+	}
+}
+
+// ToBalloonBatchProof translates public protocol.BatchMembershipResult to
+// internal balloon.BatchMembershipProof. As in ToBalloonProof, the tree
+// format must come from a trusted source and must be known.
+func ToBalloonBatchProof(br *BatchMembershipResult, hasherF func() hashing.Hasher, treeFormat int) (*balloon.BatchMembershipProof, error) {
+
+	hasherF, err := hashing.NewTreeHasherF(hasherF, treeFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := hasherF()
+	n := len(br.Entries)
+	proof := &balloon.BatchMembershipProof{
+		Exists:         make([]bool, n),
+		CurrentVersion: br.CurrentVersion,
+		QueryVersion:   br.QueryVersion,
+		ActualVersions: make([]uint64, n),
+		KeyDigests:     make([]hashing.Digest, n),
+		ValueDigests:   make([]hashing.Digest, n),
+		Hasher:         hasherF(),
+	}
+
+	hyperEntries := make([]*hyper.BatchQueryEntry, n)
+	var indexes []uint64
+	for i, entry := range br.Entries {
+		var value []byte
+		if entry.Exists {
+			if entry.ValueDigest != nil {
+				value = hyper.KeyValue(entry.ValueDigest, entry.ActualVersion)
+			} else {
+				value = hyper.EventValue(hasher, entry.ActualVersion)
+			}
+			indexes = append(indexes, entry.ActualVersion)
+		}
+		hyperEntries[i] = &hyper.BatchQueryEntry{
+			Key:           entry.KeyDigest,
+			Value:         value,
+			Height:        entry.Height,
+			ShortcutKey:   entry.ShortcutKey,
+			ShortcutValue: entry.ShortcutValue,
+		}
+		proof.Exists[i] = entry.Exists
+		proof.ActualVersions[i] = entry.ActualVersion
+		proof.KeyDigests[i] = entry.KeyDigest
+		proof.ValueDigests[i] = entry.ValueDigest
+	}
+
+	proof.HyperProof = hyper.NewBatchQueryProof(hyperEntries, br.Hyper, hasher)
+	if len(indexes) > 0 {
+		// the server proves queries beyond its current version against it
+		version := br.QueryVersion
+		if version > br.CurrentVersion {
+			version = br.CurrentVersion
+		}
+		proof.HistoryProof = history.NewBatchMembershipProof(
+			indexes,
+			version,
+			history.ParseAuditPath(br.History),
+			hasherF(),
+		)
+	}
+
+	return proof, nil
 }
 
 func ToIncrementalResponse(proof *balloon.IncrementalProof) *IncrementalResponse {
 	return &IncrementalResponse{
-		proof.Start,
-		proof.End,
-		proof.AuditPath.Serialize(),
+		Start:      proof.Start,
+		End:        proof.End,
+		AuditPath:  proof.AuditPath.Serialize(),
+		TreeFormat: treeFormat(proof.Hasher),
 	}
 }
 
-func ToIncrementalProof(ir *IncrementalResponse, hasher hashing.Hasher) *balloon.IncrementalProof {
-	return balloon.NewIncrementalProof(ir.Start, ir.End, history.ParseAuditPath(ir.AuditPath), hasher)
+// ToIncrementalProof translates public protocol.IncrementalResponse to
+// internal balloon.IncrementalProof. As in ToBalloonProof, the tree
+// format must come from a trusted source and must be known.
+func ToIncrementalProof(ir *IncrementalResponse, hasher hashing.Hasher, treeFormat int) (*balloon.IncrementalProof, error) {
+	hasher, err := hashing.NewTreeHasher(hasher, treeFormat)
+	if err != nil {
+		return nil, err
+	}
+	return balloon.NewIncrementalProof(ir.Start, ir.End, history.ParseAuditPath(ir.AuditPath), hasher), nil
 }
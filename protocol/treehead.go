@@ -0,0 +1,275 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/sign"
+)
+
+// TreeHeadFormatV1 is the first format of the signed tree heads.
+const TreeHeadFormatV1 = 1
+
+// TreeHead is the statement the server signs for every snapshot. It is
+// signed in the canonical byte format returned by Bytes, so verifiers in
+// any language can rebuild the signed message:
+//
+//	format          1 byte
+//	tree format     1 byte
+//	log id          2 bytes big-endian length, then the UTF-8 bytes
+//	tree size       8 bytes big-endian
+//	history digest  1 byte length, then the digest
+//	hyper digest    1 byte length, then the digest
+//	timestamp       8 bytes big-endian, milliseconds since the Unix epoch
+//	key id          1 byte length, then the ASCII bytes
+//
+// The tree size is the number of events of the log, one more than the
+// version of the snapshot. The tree format is signed so verifiers do not
+// have to trust the format the server advertises along with a proof.
+type TreeHead struct {
+	Format        uint8
+	TreeFormat    uint8
+	LogId         string `json:",omitempty"` // empty for the default log
+	TreeSize      uint64
+	HistoryDigest []byte
+	HyperDigest   []byte
+	Timestamp     int64
+	KeyId         string
+}
+
+var (
+	ErrUnsupportedTreeHeadFormat = errors.New("unsupported tree head format")
+	ErrMalformedTreeHead         = errors.New("malformed tree head")
+	ErrMissingTreeHead           = errors.New("snapshot without a signed tree head")
+	ErrInvalidSignature          = errors.New("invalid snapshot signature")
+)
+
+// NewTreeHead returns the tree head of a snapshot at the given time,
+// to be signed with the key with the given id.
+func NewTreeHead(snapshot *Snapshot, timestamp time.Time, keyID string) *TreeHead {
+	return &TreeHead{
+		Format:        TreeHeadFormatV1,
+		TreeFormat:    uint8(normalizeTreeFormat(snapshot.TreeFormat)),
+		LogId:         snapshot.LogId,
+		TreeSize:      snapshot.Version + 1,
+		HistoryDigest: snapshot.HistoryDigest,
+		HyperDigest:   snapshot.HyperDigest,
+		Timestamp:     timestamp.UnixNano() / int64(time.Millisecond),
+		KeyId:         keyID,
+	}
+}
+
+// normalizeTreeFormat returns the format of the trees of a snapshot,
+// which is hashing.TreeFormatV1 when omitted.
+func normalizeTreeFormat(format int) int {
+	if format == 0 {
+		return hashing.TreeFormatV1
+	}
+	return format
+}
+
+// Bytes returns the canonical encoding of the tree head.
+func (h *TreeHead) Bytes() ([]byte, error) {
+	if h.Format != TreeHeadFormatV1 {
+		return nil, ErrUnsupportedTreeHeadFormat
+	}
+	if h.TreeFormat == 0 || len(h.LogId) > math.MaxUint16 || len(h.HistoryDigest) > math.MaxUint8 ||
+		len(h.HyperDigest) > math.MaxUint8 || len(h.KeyId) > math.MaxUint8 {
+		return nil, ErrMalformedTreeHead
+	}
+
+	var buf bytes.Buffer
+	var num [8]byte
+	buf.WriteByte(h.Format)
+	buf.WriteByte(h.TreeFormat)
+	binary.BigEndian.PutUint16(num[:2], uint16(len(h.LogId)))
+	buf.Write(num[:2])
+	buf.WriteString(h.LogId)
+	binary.BigEndian.PutUint64(num[:], h.TreeSize)
+	buf.Write(num[:])
+	buf.WriteByte(uint8(len(h.HistoryDigest)))
+	buf.Write(h.HistoryDigest)
+	buf.WriteByte(uint8(len(h.HyperDigest)))
+	buf.Write(h.HyperDigest)
+	binary.BigEndian.PutUint64(num[:], uint64(h.Timestamp))
+	buf.Write(num[:])
+	buf.WriteByte(uint8(len(h.KeyId)))
+	buf.WriteString(h.KeyId)
+
+	return buf.Bytes(), nil
+}
+
+// ParseTreeHead decodes a tree head from its canonical encoding.
+func ParseTreeHead(data []byte) (*TreeHead, error) {
+	if len(data) == 0 {
+		return nil, ErrMalformedTreeHead
+	}
+	if data[0] != TreeHeadFormatV1 {
+		return nil, ErrUnsupportedTreeHeadFormat
+	}
+
+	r := bytes.NewReader(data[1:])
+	next := func(n int) ([]byte, error) {
+		if n > r.Len() {
+			return nil, ErrMalformedTreeHead
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return b, nil
+	}
+	short := func() ([]byte, error) {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrMalformedTreeHead
+		}
+		return next(int(n))
+	}
+
+	h := &TreeHead{Format: data[0]}
+	b, err := next(1)
+	if err != nil || b[0] == 0 {
+		return nil, ErrMalformedTreeHead
+	}
+	h.TreeFormat = b[0]
+	if b, err = next(2); err != nil {
+		return nil, err
+	}
+	if b, err = next(int(binary.BigEndian.Uint16(b))); err != nil {
+		return nil, err
+	}
+	h.LogId = string(b)
+	if b, err = next(8); err != nil {
+		return nil, err
+	}
+	h.TreeSize = binary.BigEndian.Uint64(b)
+	if h.HistoryDigest, err = short(); err != nil {
+		return nil, err
+	}
+	if h.HyperDigest, err = short(); err != nil {
+		return nil, err
+	}
+	if b, err = next(8); err != nil {
+		return nil, err
+	}
+	h.Timestamp = int64(binary.BigEndian.Uint64(b))
+	if b, err = short(); err != nil {
+		return nil, err
+	}
+	h.KeyId = string(b)
+	if r.Len() != 0 {
+		return nil, ErrMalformedTreeHead
+	}
+
+	return h, nil
+}
+
+// Matches returns true if the tree head states the same log, version,
+// digests and tree format as the snapshot.
+func (h *TreeHead) Matches(snapshot *Snapshot) bool {
+	return int(h.TreeFormat) == normalizeTreeFormat(snapshot.TreeFormat) &&
+		h.LogId == snapshot.LogId &&
+		h.TreeSize == snapshot.Version+1 &&
+		bytes.Equal(h.HistoryDigest, snapshot.HistoryDigest) &&
+		bytes.Equal(h.HyperDigest, snapshot.HyperDigest)
+}
+
+// SignSnapshot builds the tree head of a snapshot and signs it.
+func SignSnapshot(signer sign.Signer, snapshot *Snapshot, timestamp time.Time) (*SignedSnapshot, error) {
+	// a keyring can rotate between naming the key and signing
+	if keyring, ok := signer.(*sign.Keyring); ok {
+		signer = keyring.Active()
+	}
+	head := NewTreeHead(snapshot, timestamp, signer.KeyID())
+	message, err := head.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.Sign(message)
+	if err != nil {
+		return nil, err
+	}
+	signed := &SignedSnapshot{Snapshot: snapshot, TreeHead: head, Signature: signature}
+	if signer.Algorithm() != sign.DefaultAlgorithm {
+		signed.Algorithm = signer.Algorithm()
+	}
+	return signed, nil
+}
+
+// Verify checks that the signed tree head of the snapshot states the
+// same as the snapshot and that its signature was made by the key of the
+// verifier. It is the check every consumer of signed snapshots must run
+// before trusting them.
+func (b *SignedSnapshot) Verify(verifier sign.Verifier) error {
+	if b.Snapshot == nil || b.TreeHead == nil {
+		return ErrMissingTreeHead
+	}
+	if !b.TreeHead.Matches(b.Snapshot) {
+		return fmt.Errorf("the tree head of snapshot %d does not match the snapshot", b.Snapshot.Version)
+	}
+	if b.TreeHead.KeyId != verifier.KeyID() {
+		return fmt.Errorf("snapshot %d signed with unknown key %q", b.Snapshot.Version, b.TreeHead.KeyId)
+	}
+	if b.algorithm() != verifier.Algorithm() {
+		return fmt.Errorf("snapshot %d signed with %s, not %s", b.Snapshot.Version, b.algorithm(), verifier.Algorithm())
+	}
+	message, err := b.TreeHead.Bytes()
+	if err != nil {
+		return err
+	}
+	ok, err := verifier.Verify(message, b.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (b *SignedSnapshot) algorithm() string {
+	if b.Algorithm == "" {
+		return sign.DefaultAlgorithm
+	}
+	return b.Algorithm
+}
+
+// VerifyKeySet is like Verify with the key of the set the tree head names,
+// which must have been valid when the tree head was signed.
+func (b *SignedSnapshot) VerifyKeySet(keys *sign.KeySet) error {
+	if b.Snapshot == nil || b.TreeHead == nil {
+		return ErrMissingTreeHead
+	}
+	key, err := keys.Key(b.TreeHead.KeyId)
+	if err != nil {
+		return fmt.Errorf("snapshot %d signed with unknown key %q", b.Snapshot.Version, b.TreeHead.KeyId)
+	}
+	if !key.ValidAt(b.TreeHead.Timestamp) {
+		return fmt.Errorf("snapshot %d signed out of the validity window of key %q", b.Snapshot.Version, key.KeyId)
+	}
+	verifier, err := sign.NewVerifier(key.Algorithm, key.PublicKey)
+	if err != nil {
+		return err
+	}
+	return b.Verify(verifier)
+}
@@ -0,0 +1,196 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/sign"
+)
+
+func TestTreeHeadBytes(t *testing.T) {
+
+	head := &TreeHead{
+		Format:        TreeHeadFormatV1,
+		TreeFormat:    hashing.TreeFormatV2,
+		LogId:         "tenant",
+		TreeSize:      10,
+		HistoryDigest: []byte{0x01, 0x02},
+		HyperDigest:   []byte{0x03},
+		Timestamp:     1546300800000,
+		KeyId:         "ab",
+	}
+
+	expected := "01" + "02" + "0006" + hex.EncodeToString([]byte("tenant")) +
+		"000000000000000a" + "020102" + "0103" + "0000016806b5bc00" +
+		"02" + hex.EncodeToString([]byte("ab"))
+
+	encoded, err := head.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, expected, hex.EncodeToString(encoded), "The encoding should be canonical")
+
+	decoded, err := ParseTreeHead(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, head, decoded, "The decoded tree head should match")
+
+	_, err = ParseTreeHead(encoded[:len(encoded)-1])
+	assert.Equal(t, ErrMalformedTreeHead, err, "A truncated tree head should not decode")
+
+	_, err = ParseTreeHead(append(encoded, 0x00))
+	assert.Equal(t, ErrMalformedTreeHead, err, "A tree head with trailing bytes should not decode")
+
+	head.Format = TreeHeadFormatV1 + 1
+	_, err = head.Bytes()
+	assert.Equal(t, ErrUnsupportedTreeHeadFormat, err, "Unknown formats should not encode")
+
+	head.Format, head.TreeFormat = TreeHeadFormatV1, 0
+	_, err = head.Bytes()
+	assert.Equal(t, ErrMalformedTreeHead, err, "Tree heads without a tree format should not encode")
+
+}
+
+func TestTreeHeadTreeFormat(t *testing.T) {
+
+	snapshot := &Snapshot{
+		HistoryDigest: []byte{0x01},
+		HyperDigest:   []byte{0x02},
+		Version:       9,
+	}
+	timestamp := time.Unix(1546300800, 0)
+
+	// snapshots without a tree format belong to trees of the first one
+	for _, format := range []int{0, hashing.TreeFormatV1} {
+		snapshot.TreeFormat = format
+		head := NewTreeHead(snapshot, timestamp, "ab")
+		assert.Equalf(t, uint8(hashing.TreeFormatV1), head.TreeFormat, "Wrong tree format for format %d", format)
+		assert.Truef(t, head.Matches(snapshot), "The tree head should match the snapshot in format %d", format)
+	}
+
+	snapshot.TreeFormat = hashing.TreeFormatV2
+	head := NewTreeHead(snapshot, timestamp, "ab")
+	assert.Equal(t, uint8(TreeHeadFormatV1), head.Format)
+	assert.Equal(t, uint8(hashing.TreeFormatV2), head.TreeFormat)
+
+	encoded, err := head.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "0102", hex.EncodeToString(encoded[:2]), "The tree format should follow the tree head format")
+	decoded, err := ParseTreeHead(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, head, decoded, "The decoded tree head should match")
+	assert.True(t, decoded.Matches(snapshot))
+
+	snapshot.TreeFormat = hashing.TreeFormatV1
+	assert.False(t, decoded.Matches(snapshot), "The tree head should not match a snapshot in another tree format")
+
+	encoded[1] = 0
+	_, err = ParseTreeHead(encoded)
+	assert.Equal(t, ErrMalformedTreeHead, err, "Tree heads without a tree format should not decode")
+
+}
+
+func TestSignedSnapshotVerify(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	verifier, err := sign.NewEd25519Verifier(signer.(*sign.Ed25519Signer).PublicKey())
+	require.NoError(t, err)
+
+	newSnapshot := func() *Snapshot {
+		return &Snapshot{
+			HistoryDigest: []byte{0x01},
+			HyperDigest:   []byte{0x02},
+			Version:       5,
+			EventDigest:   []byte{0x03},
+			LogId:         "tenant",
+		}
+	}
+
+	signed, err := SignSnapshot(signer, newSnapshot(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), signed.TreeHead.TreeSize, "The tree size should be the number of events")
+	assert.Equal(t, signer.KeyID(), signed.TreeHead.KeyId, "The tree head should carry the key id")
+
+	// the signed snapshot must survive its encoding
+	batch := &BatchSnapshots{Snapshots: []*SignedSnapshot{signed}}
+	encoded, err := batch.Encode()
+	require.NoError(t, err)
+	decoded := new(BatchSnapshots)
+	require.NoError(t, decoded.Decode(encoded))
+	assert.NoError(t, decoded.Snapshots[0].Verify(verifier), "The signed snapshot should verify")
+
+	signed, _ = SignSnapshot(signer, newSnapshot(), time.Now())
+	signed.Snapshot.Version = 6
+	assert.Error(t, signed.Verify(verifier), "A snapshot that does not match its tree head should not verify")
+
+	signed, _ = SignSnapshot(signer, newSnapshot(), time.Now())
+	signed.TreeHead.Timestamp++
+	assert.Equal(t, ErrInvalidSignature, signed.Verify(verifier), "A modified tree head should not verify")
+
+	signed, _ = SignSnapshot(sign.NewEd25519Signer(), newSnapshot(), time.Now())
+	assert.Error(t, signed.Verify(verifier), "A snapshot signed with another key should not verify")
+
+	signed, _ = SignSnapshot(signer, newSnapshot(), time.Now())
+	signed.TreeHead = nil
+	assert.Equal(t, ErrMissingTreeHead, signed.Verify(verifier), "A snapshot without tree head should not verify")
+
+	ecdsaSigner := sign.NewECDSASigner()
+	signed, err = SignSnapshot(ecdsaSigner, newSnapshot(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, sign.ECDSAP256SHA256, signed.Algorithm, "The signed snapshot should carry its algorithm")
+	ecdsaVerifier, err := sign.NewVerifier(signed.Algorithm, ecdsaSigner.PublicKey())
+	require.NoError(t, err)
+	assert.NoError(t, signed.Verify(ecdsaVerifier), "An ECDSA signed snapshot should verify")
+	signed.Algorithm = sign.RSAPSSSHA256
+	assert.Error(t, signed.Verify(ecdsaVerifier), "A snapshot of another algorithm should not verify")
+
+}
+
+func TestSignedSnapshotVerifyKeySet(t *testing.T) {
+
+	signer := sign.NewEd25519Signer()
+	now := time.Now()
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	keys := &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+		NotBefore: nowMillis - 1000,
+		NotAfter:  nowMillis + 1000,
+	}}}
+
+	snapshot := &Snapshot{
+		HistoryDigest: []byte{0x01},
+		HyperDigest:   []byte{0x02},
+		Version:       5,
+	}
+
+	signed, err := SignSnapshot(signer, snapshot, now)
+	require.NoError(t, err)
+	assert.NoError(t, signed.VerifyKeySet(keys), "A snapshot signed within the key window should verify")
+
+	signed, _ = SignSnapshot(signer, snapshot, now.Add(time.Hour))
+	assert.Error(t, signed.VerifyKeySet(keys), "A snapshot signed out of the key window should not verify")
+
+	signed, _ = SignSnapshot(sign.NewEd25519Signer(), snapshot, now)
+	assert.Error(t, signed.VerifyKeySet(keys), "A snapshot signed with an unknown key should not verify")
+
+}
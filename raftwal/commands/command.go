@@ -30,12 +30,39 @@ const (
 	AddEventCommandType       CommandType = 0 // Commands which modify the database.
 	MetadataSetCommandType    CommandType = 1
 	MetadataDeleteCommandType CommandType = 2
+	AddBulkCommandType        CommandType = 3
+	PutCommandType            CommandType = 4
+	CreateLogCommandType      CommandType = 5
+	DeleteLogCommandType      CommandType = 6
 )
 
+// Commands that modify a log carry its id. An empty id
+// refers to the default log.
+
 type AddEventCommand struct {
+	LogId string
 	Event []byte
 }
 
+type AddBulkCommand struct {
+	LogId  string
+	Events [][]byte
+}
+
+type PutCommand struct {
+	LogId string
+	Key   []byte
+	Value []byte
+}
+
+type CreateLogCommand struct {
+	LogId string
+}
+
+type DeleteLogCommand struct {
+	LogId string
+}
+
 type MetadataSetCommand struct {
 	Id   string
 	Data map[string]string
@@ -42,13 +42,21 @@ type fsmAddResponse struct {
 	error    error
 }
 
+type fsmAddBulkResponse struct {
+	snapshotBulk []*balloon.Snapshot
+	error        error
+}
+
 type BalloonFSM struct {
 	hasherF func() hashing.Hasher
 
 	store   storage.ManagedStore
-	balloon *balloon.Balloon
+	balloon *balloon.Balloon // default log
 	state   *fsmState
 
+	logsMu sync.RWMutex
+	logs   map[string]*balloonLog // logs apart from the default one
+
 	metaMu sync.RWMutex
 	meta   map[string]map[string]string
 
@@ -82,25 +90,53 @@ func NewBalloonFSM(store storage.ManagedStore, hasherF func() hashing.Hasher) (*
 		return nil, err
 	}
 
-	return &BalloonFSM{
+	fsm := &BalloonFSM{
 		hasherF: hasherF,
 		store:   store,
 		balloon: b,
 		state:   state,
+		logs:    make(map[string]*balloonLog),
 		meta:    make(map[string]map[string]string),
-	}, nil
+	}
+
+	if err := fsm.loadLogs(); err != nil {
+		log.Infof("There was an error opening the logs!!")
+		return nil, err
+	}
+
+	return fsm, nil
+}
+
+func (fsm *BalloonFSM) QueryDigestMembership(logID string, keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	l, err := fsm.log(logID)
+	if err != nil {
+		return nil, err
+	}
+	return l.balloon.QueryDigestMembership(keyDigest, version)
 }
 
-func (fsm *BalloonFSM) QueryDigestMembership(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
-	return fsm.balloon.QueryDigestMembership(keyDigest, version)
+func (fsm *BalloonFSM) QueryBatchMembership(logID string, keyDigests []hashing.Digest, version uint64) (*balloon.BatchMembershipProof, error) {
+	l, err := fsm.log(logID)
+	if err != nil {
+		return nil, err
+	}
+	return l.balloon.QueryBatchMembership(keyDigests, version)
 }
 
-func (fsm *BalloonFSM) QueryMembership(event []byte, version uint64) (*balloon.MembershipProof, error) {
-	return fsm.balloon.QueryMembership(event, version)
+func (fsm *BalloonFSM) QueryMembership(logID string, event []byte, version uint64) (*balloon.MembershipProof, error) {
+	l, err := fsm.log(logID)
+	if err != nil {
+		return nil, err
+	}
+	return l.balloon.QueryMembership(event, version)
 }
 
-func (fsm *BalloonFSM) QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error) {
-	return fsm.balloon.QueryConsistency(start, end)
+func (fsm *BalloonFSM) QueryConsistency(logID string, start, end uint64) (*balloon.IncrementalProof, error) {
+	l, err := fsm.log(logID)
+	if err != nil {
+		return nil, err
+	}
+	return l.balloon.QueryConsistency(start, end)
 }
 
 type fsmState struct {
@@ -122,6 +158,16 @@ func (s fsmState) shouldApply(f *fsmState) bool {
 	return true
 }
 
+// newState returns the state that applying the Raft log entry to the
+// given log leads to. Only the default log is checked against the balloon
+// version of the state, the rest of logs keep their own versions.
+func (fsm *BalloonFSM) newState(l *raft.Log, logID string) *fsmState {
+	if isDefaultLog(logID) {
+		return &fsmState{l.Index, l.Term, fsm.balloon.Version()}
+	}
+	return &fsmState{Index: l.Index, Term: l.Term}
+}
+
 // Apply applies a Raft log entry to the database.
 func (fsm *BalloonFSM) Apply(l *raft.Log) interface{} {
 	// TODO should i use a restore mutex?
@@ -135,12 +181,68 @@ func (fsm *BalloonFSM) Apply(l *raft.Log) interface{} {
 		if err := commands.Decode(buf[1:], &cmd); err != nil {
 			return &fsmAddResponse{error: err}
 		}
-		newState := &fsmState{l.Index, l.Term, fsm.balloon.Version()}
+		bl, err := fsm.log(cmd.LogId)
+		if err != nil {
+			return &fsmAddResponse{error: err}
+		}
+		newState := fsm.newState(l, cmd.LogId)
 		if fsm.state.shouldApply(newState) {
-			return fsm.applyAdd(cmd.Event, newState)
+			return fsm.applyAdd(bl, cmd.Event, newState)
 		}
 		return &fsmAddResponse{error: fmt.Errorf("state already applied!: %+v -> %+v", fsm.state, newState)}
 
+	case commands.AddBulkCommandType:
+		var cmd commands.AddBulkCommand
+		if err := commands.Decode(buf[1:], &cmd); err != nil {
+			return &fsmAddBulkResponse{error: err}
+		}
+		bl, err := fsm.log(cmd.LogId)
+		if err != nil {
+			return &fsmAddBulkResponse{error: err}
+		}
+		newState := fsm.newState(l, cmd.LogId)
+		if fsm.state.shouldApply(newState) {
+			return fsm.applyAddBulk(bl, cmd.Events, newState)
+		}
+		return &fsmAddBulkResponse{error: fmt.Errorf("state already applied!: %+v -> %+v", fsm.state, newState)}
+
+	case commands.PutCommandType:
+		var cmd commands.PutCommand
+		if err := commands.Decode(buf[1:], &cmd); err != nil {
+			return &fsmAddResponse{error: err}
+		}
+		bl, err := fsm.log(cmd.LogId)
+		if err != nil {
+			return &fsmAddResponse{error: err}
+		}
+		newState := fsm.newState(l, cmd.LogId)
+		if fsm.state.shouldApply(newState) {
+			return fsm.applyPut(bl, cmd.Key, cmd.Value, newState)
+		}
+		return &fsmAddResponse{error: fmt.Errorf("state already applied!: %+v -> %+v", fsm.state, newState)}
+
+	case commands.CreateLogCommandType:
+		var cmd commands.CreateLogCommand
+		if err := commands.Decode(buf[1:], &cmd); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		newState := fsm.newState(l, cmd.LogId)
+		if fsm.state.shouldApply(newState) {
+			return fsm.applyCreateLog(cmd.LogId, newState)
+		}
+		return &fsmGenericResponse{error: fmt.Errorf("state already applied!: %+v -> %+v", fsm.state, newState)}
+
+	case commands.DeleteLogCommandType:
+		var cmd commands.DeleteLogCommand
+		if err := commands.Decode(buf[1:], &cmd); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		newState := fsm.newState(l, cmd.LogId)
+		if fsm.state.shouldApply(newState) {
+			return fsm.applyDeleteLog(cmd.LogId, newState)
+		}
+		return &fsmGenericResponse{error: fmt.Errorf("state already applied!: %+v -> %+v", fsm.state, newState)}
+
 	case commands.MetadataSetCommandType:
 		var cmd commands.MetadataSetCommand
 		if err := commands.Decode(buf[1:], &cmd); err != nil {
@@ -230,34 +332,101 @@ func (fsm *BalloonFSM) Restore(rc io.ReadCloser) error {
 	// 	return json.Unmarshal(meta, &fsm.meta)
 	// }()
 
-	return fsm.balloon.RefreshVersion()
+	if err = fsm.loadLogs(); err != nil {
+		return err
+	}
+
+	// the trees of the snapshot may follow another format
+	b, err := balloon.NewBalloon(fsm.store, fsm.hasherF)
+	if err != nil {
+		return err
+	}
+	fsm.balloon.Close()
+	fsm.balloon = b
+
+	return nil
 }
 
 func (fsm *BalloonFSM) Close() error {
 	fsm.balloon.Close()
+	fsm.logsMu.Lock()
+	defer fsm.logsMu.Unlock()
+	for _, l := range fsm.logs {
+		l.balloon.Close()
+	}
 	return nil
 }
 
-func (fsm *BalloonFSM) applyAdd(event []byte, state *fsmState) *fsmAddResponse {
+func (fsm *BalloonFSM) applyAdd(l *balloonLog, event []byte, state *fsmState) *fsmAddResponse {
 
-	snapshot, mutations, err := fsm.balloon.Add(event)
+	snapshot, mutations, err := l.balloon.Add(event)
 	if err != nil {
 		return &fsmAddResponse{error: err}
 	}
 
-	stateBuff, err := encodeMsgPack(state)
+	err = fsm.commit(l.id, state, l.mutations(mutations))
+	if err != nil {
+		return &fsmAddResponse{error: err}
+	}
+
+	return &fsmAddResponse{snapshot: snapshot}
+}
+
+func (fsm *BalloonFSM) applyPut(l *balloonLog, key, value []byte, state *fsmState) *fsmAddResponse {
+
+	snapshot, mutations, err := l.balloon.Put(key, value)
+	if err != nil {
+		return &fsmAddResponse{error: err}
+	}
+
+	err = fsm.commit(l.id, state, l.mutations(mutations))
 	if err != nil {
 		return &fsmAddResponse{error: err}
 	}
 
+	return &fsmAddResponse{snapshot: snapshot}
+}
+
+func (fsm *BalloonFSM) applyAddBulk(l *balloonLog, events [][]byte, state *fsmState) *fsmAddBulkResponse {
+
+	snapshotBulk, mutations, err := l.balloon.AddBulk(events)
+	if err != nil {
+		return &fsmAddBulkResponse{error: err}
+	}
+
+	// the state must point to the last version of the bulk
+	state.BalloonVersion = snapshotBulk[len(snapshotBulk)-1].Version
+
+	err = fsm.commit(l.id, state, l.mutations(mutations))
+	if err != nil {
+		return &fsmAddBulkResponse{error: err}
+	}
+
+	return &fsmAddBulkResponse{snapshotBulk: snapshotBulk}
+}
+
+// commit persists the mutations of an applied entry along with the new
+// state of the FSM, which keeps the balloon version of the default log
+// when the entry was applied to another log.
+func (fsm *BalloonFSM) commit(logID string, state *fsmState, mutations []*storage.Mutation) error {
+
+	if !isDefaultLog(logID) {
+		state.BalloonVersion = fsm.state.BalloonVersion
+	}
+
+	stateBuff, err := encodeMsgPack(state)
+	if err != nil {
+		return err
+	}
+
 	mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff.Bytes()))
 	err = fsm.store.Mutate(mutations)
 	if err != nil {
-		return &fsmAddResponse{error: err}
+		return err
 	}
 	fsm.state = state
 
-	return &fsmAddResponse{snapshot: snapshot}
+	return nil
 }
 
 // Decode reverses the encode operation on a byte slice input
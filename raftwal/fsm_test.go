@@ -42,6 +42,172 @@ func TestApply(t *testing.T) {
 
 }
 
+func TestApplyBulk(t *testing.T) {
+
+	log.SetLogger("TestApplyBulk", log.SILENT)
+
+	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.db")
+	defer closeF()
+
+	fsm, err := NewBalloonFSM(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	// happy path
+	r := fsm.Apply(newRaftLogBulk(1, 1, 10)).(*fsmAddBulkResponse)
+	require.Nil(t, r.error)
+	require.Len(t, r.snapshotBulk, 10)
+	require.Equal(t, uint64(9), fsm.state.BalloonVersion)
+
+	// Error: Command already applied
+	r = fsm.Apply(newRaftLogBulk(1, 1, 10)).(*fsmAddBulkResponse)
+	require.Error(t, r.error)
+
+	// happy path: single adds continue after the bulk
+	ra := fsm.Apply(newRaftLog(2, 1)).(*fsmAddResponse)
+	require.Nil(t, ra.error)
+	require.Equal(t, uint64(10), ra.snapshot.Version)
+
+}
+
+func TestApplyPut(t *testing.T) {
+
+	log.SetLogger("TestApplyPut", log.SILENT)
+
+	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.db")
+	defer closeF()
+
+	fsm, err := NewBalloonFSM(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	// happy path
+	r := fsm.Apply(newRaftLogPut(1, 1, []byte("key"), []byte("value"))).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(0), r.snapshot.Version)
+
+	// Error: Command already applied
+	r = fsm.Apply(newRaftLogPut(1, 1, []byte("key"), []byte("value"))).(*fsmAddResponse)
+	require.Error(t, r.error)
+
+	// happy path: update the value of the key
+	r = fsm.Apply(newRaftLogPut(2, 1, []byte("key"), []byte("other value"))).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(1), r.snapshot.Version)
+
+}
+
+func TestApplyCreateDeleteLog(t *testing.T) {
+
+	log.SetLogger("TestApplyCreateDeleteLog", log.SILENT)
+
+	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.db")
+	defer closeF()
+
+	fsm, err := NewBalloonFSM(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	// happy path
+	g := fsm.Apply(newRaftLogCreate(1, 1, "tenant")).(*fsmGenericResponse)
+	require.Nil(t, g.error)
+
+	// Error: log already exists
+	g = fsm.Apply(newRaftLogCreate(2, 1, "tenant")).(*fsmGenericResponse)
+	require.Equal(t, ErrLogExists, g.error)
+
+	// each log has its own versions
+	r := fsm.Apply(newRaftLogIn(3, 1, "tenant")).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(0), r.snapshot.Version)
+
+	r = fsm.Apply(newRaftLogIn(4, 1, DefaultLogID)).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(0), r.snapshot.Version)
+
+	r = fsm.Apply(newRaftLogIn(5, 1, "tenant")).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(1), r.snapshot.Version)
+	require.Equal(t, uint64(0), fsm.state.BalloonVersion, "The state should keep the version of the default log")
+
+	require.Equal(t, []string{DefaultLogID, "tenant"}, fsm.Logs())
+
+	// logs are reopened along with the FSM
+	fsm, err = NewBalloonFSM(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultLogID, "tenant"}, fsm.Logs())
+
+	// Error: the default log cannot be deleted
+	g = fsm.Apply(newRaftLogDelete(6, 1, DefaultLogID)).(*fsmGenericResponse)
+	require.Error(t, g.error)
+
+	// happy path
+	g = fsm.Apply(newRaftLogDelete(7, 1, "tenant")).(*fsmGenericResponse)
+	require.Nil(t, g.error)
+
+	// Error: log not found
+	r = fsm.Apply(newRaftLogIn(8, 1, "tenant")).(*fsmAddResponse)
+	require.Equal(t, ErrLogNotFound, r.error)
+
+	// a new log with the same id starts from scratch
+	g = fsm.Apply(newRaftLogCreate(9, 1, "tenant")).(*fsmGenericResponse)
+	require.Nil(t, g.error)
+	r = fsm.Apply(newRaftLogIn(10, 1, "tenant")).(*fsmAddResponse)
+	require.Nil(t, r.error)
+	require.Equal(t, uint64(0), r.snapshot.Version)
+
+	// the hyper cache shared by the logs keeps nothing of the deleted one
+	proof, err := fsm.QueryDigestMembership("tenant", r.snapshot.EventDigest, 0)
+	require.NoError(t, err)
+	require.True(t, proof.DigestVerify(r.snapshot.EventDigest, r.snapshot), "The proof of the new log should verify")
+
+}
+
+func TestOpenHasher(t *testing.T) {
+
+	log.SetLogger("TestOpenHasher", log.SILENT)
+
+	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.db")
+	defer closeF()
+
+	// the first time, the hasher is recorded in the store
+	id, hasherF, err := openHasher(store, hashing.SHA3_256)
+	require.NoError(t, err)
+	require.Equal(t, hashing.SHA3_256, id)
+	require.Equal(t, hashing.NewSha3_256Hasher().Do([]byte("test")), hasherF().Do([]byte("test")))
+
+	_, _, err = openHasher(store, hashing.SHA3_256)
+	require.NoError(t, err)
+
+	// Error: the hasher does not match the recorded one
+	_, _, err = openHasher(store, hashing.SHA256)
+	require.Error(t, err)
+
+	// Error: unknown hasher
+	_, _, err = openHasher(store, "md5")
+	require.Error(t, err)
+
+}
+
+func TestOpenHasherWithoutRecord(t *testing.T) {
+
+	log.SetLogger("TestOpenHasherWithoutRecord", log.SILENT)
+
+	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.db")
+	defer closeF()
+
+	// stores with data and no hasher were built with the default one
+	fsm, err := NewBalloonFSM(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	r := fsm.Apply(newRaftLog(1, 1)).(*fsmAddResponse)
+	require.Nil(t, r.error)
+
+	_, _, err = openHasher(store, hashing.BLAKE2B256)
+	require.Error(t, err)
+
+	id, _, err := openHasher(store, "")
+	require.NoError(t, err)
+	require.Equal(t, hashing.DefaultHasher, id)
+
+}
+
 func TestSnapshot(t *testing.T) {
 
 	log.SetLogger("TestSnapshot", log.SILENT)
@@ -159,6 +325,36 @@ func newRaftLog(index, term uint64) *raft.Log {
 	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
 }
 
+func newRaftLogBulk(index, term uint64, size int) *raft.Log {
+	events := make([][]byte, size)
+	for i := range events {
+		events[i] = rand.Bytes(128)
+	}
+	data, _ := commands.Encode(commands.AddBulkCommandType, &commands.AddBulkCommand{Events: events})
+	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
+}
+
+func newRaftLogPut(index, term uint64, key, value []byte) *raft.Log {
+	data, _ := commands.Encode(commands.PutCommandType, &commands.PutCommand{Key: key, Value: value})
+	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
+}
+
+func newRaftLogIn(index, term uint64, logID string) *raft.Log {
+	event := rand.Bytes(128)
+	data, _ := commands.Encode(commands.AddEventCommandType, &commands.AddEventCommand{LogId: logID, Event: event})
+	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
+}
+
+func newRaftLogCreate(index, term uint64, logID string) *raft.Log {
+	data, _ := commands.Encode(commands.CreateLogCommandType, &commands.CreateLogCommand{LogId: logID})
+	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
+}
+
+func newRaftLogDelete(index, term uint64, logID string) *raft.Log {
+	data, _ := commands.Encode(commands.DeleteLogCommandType, &commands.DeleteLogCommand{LogId: logID})
+	return &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: data}
+}
+
 func newRandomRaftLog(index, term uint64) *raft.Log {
 	event := rand.Bytes(128)
 	data, _ := commands.Encode(commands.AddEventCommandType, &commands.AddEventCommand{Event: event})
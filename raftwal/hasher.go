@@ -0,0 +1,67 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftwal
+
+import (
+	"fmt"
+
+	"github.com/bbva/qed/hashing"
+	"github.com/bbva/qed/storage"
+)
+
+// openHasher returns the id and the constructor of the hasher the trees
+// of the store are built with. The first time a store is opened, the
+// given hasher is recorded in it. Afterwards, it fails if the given
+// hasher does not match the recorded one. Stores with data that do
+// not record any hasher were built with the default one.
+func openHasher(store storage.Store, id string) (string, func() hashing.Hasher, error) {
+	if id == "" {
+		id = hashing.DefaultHasher
+	}
+	if _, err := hashing.NewHasherF(id); err != nil {
+		return "", nil, err
+	}
+
+	kv, err := store.Get(storage.FSMStateTable, storage.FSMHasherTableKey)
+	switch err {
+	case nil:
+		if string(kv.Value) != id {
+			return "", nil, fmt.Errorf("the store was built with hasher %q, it cannot be opened with %q", kv.Value, id)
+		}
+
+	case storage.ErrKeyNotFound:
+		recorded := id
+		if _, err := store.Get(storage.FSMStateTable, storage.FSMStateTableKey); err == nil {
+			recorded = hashing.DefaultHasher
+		}
+		if recorded != id {
+			return "", nil, fmt.Errorf("the store was built with hasher %q, it cannot be opened with %q", recorded, id)
+		}
+		err = store.Mutate([]*storage.Mutation{
+			storage.NewMutation(storage.FSMStateTable, storage.FSMHasherTableKey, []byte(id)),
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+	default:
+		return "", nil, err
+	}
+
+	hasherF, _ := hashing.NewHasherF(id)
+	return id, hasherF, nil
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftwal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/storage"
+)
+
+// DefaultLogID is the id of the log that every server hosts. It keeps
+// the tables of the store that existed before multi-tenancy, so
+// requests without a log id are served by it.
+const DefaultLogID = "default"
+
+var (
+	// ErrLogNotFound is returned when a request refers to a log that
+	// has not been created.
+	ErrLogNotFound = errors.New("log not found")
+
+	// ErrLogExists is returned when trying to create a log that
+	// already exists.
+	ErrLogExists = errors.New("log already exists")
+
+	validLogID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// ValidateLogID returns an error if the given id cannot name a log.
+func ValidateLogID(id string) error {
+	if !validLogID.MatchString(id) {
+		return fmt.Errorf("invalid log id %q: it must have between 1 and 64 letters, digits, '_' or '-'", id)
+	}
+	return nil
+}
+
+func isDefaultLog(id string) bool {
+	return id == "" || id == DefaultLogID
+}
+
+// logNamespace returns the namespace of the tables of a log. Valid ids
+// never contain a zero byte, so no namespace is a prefix of another.
+func logNamespace(id string) []byte {
+	return append([]byte(id), 0x0)
+}
+
+// balloonLog is a log hosted by the FSM, with its own history tree,
+// hyper tree and version.
+type balloonLog struct {
+	id      string
+	balloon *balloon.Balloon
+	store   *storage.NamespacedStore // nil for the default log
+}
+
+// mutations returns the mutations of the balloon of the log translated
+// to the tables of the underlying store.
+func (l *balloonLog) mutations(mutations []*storage.Mutation) []*storage.Mutation {
+	if l.store == nil {
+		return mutations
+	}
+	return l.store.Mutations(mutations)
+}
+
+func (fsm *BalloonFSM) openLog(id string) (*balloonLog, error) {
+	store := storage.NewNamespacedStore(fsm.store, logNamespace(id))
+	b, err := balloon.NewBalloon(store, fsm.hasherF)
+	if err != nil {
+		return nil, err
+	}
+	return &balloonLog{id: id, balloon: b, store: store}, nil
+}
+
+// loadLogs opens every log created apart from the default one.
+func (fsm *BalloonFSM) loadLogs() error {
+	ids := make([]string, 0)
+	kv, err := fsm.store.Get(storage.FSMStateTable, storage.FSMLogsTableKey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	if err == nil {
+		if err := decodeMsgPack(kv.Value, &ids); err != nil {
+			return err
+		}
+	}
+
+	fsm.logsMu.Lock()
+	defer fsm.logsMu.Unlock()
+	for _, l := range fsm.logs {
+		l.balloon.Close()
+	}
+	fsm.logs = make(map[string]*balloonLog)
+	for _, id := range ids {
+		l, err := fsm.openLog(id)
+		if err != nil {
+			return err
+		}
+		fsm.logs[id] = l
+	}
+	return nil
+}
+
+// log returns the log with the given id.
+func (fsm *BalloonFSM) log(id string) (*balloonLog, error) {
+	if isDefaultLog(id) {
+		return &balloonLog{id: DefaultLogID, balloon: fsm.balloon}, nil
+	}
+	fsm.logsMu.RLock()
+	defer fsm.logsMu.RUnlock()
+	l, ok := fsm.logs[id]
+	if !ok {
+		return nil, ErrLogNotFound
+	}
+	return l, nil
+}
+
+// Logs returns the ids of the hosted logs, including the default one.
+func (fsm *BalloonFSM) Logs() []string {
+	fsm.logsMu.RLock()
+	defer fsm.logsMu.RUnlock()
+	return append([]string{DefaultLogID}, fsm.logIDs()...)
+}
+
+// logIDs returns the sorted ids of the logs apart from the default one.
+// The caller must hold the logs lock.
+func (fsm *BalloonFSM) logIDs() []string {
+	ids := make([]string, 0, len(fsm.logs))
+	for id := range fsm.logs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// logsMutation returns the mutation that persists the ids of the logs.
+// The caller must hold the logs lock.
+func (fsm *BalloonFSM) logsMutation() (*storage.Mutation, error) {
+	buf, err := encodeMsgPack(fsm.logIDs())
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewMutation(storage.FSMStateTable, storage.FSMLogsTableKey, buf.Bytes()), nil
+}
+
+func (fsm *BalloonFSM) applyCreateLog(id string, state *fsmState) *fsmGenericResponse {
+	if isDefaultLog(id) {
+		return &fsmGenericResponse{error: ErrLogExists}
+	}
+	if err := ValidateLogID(id); err != nil {
+		return &fsmGenericResponse{error: err}
+	}
+
+	fsm.logsMu.Lock()
+	defer fsm.logsMu.Unlock()
+
+	if _, ok := fsm.logs[id]; ok {
+		return &fsmGenericResponse{error: ErrLogExists}
+	}
+	l, err := fsm.openLog(id)
+	if err != nil {
+		return &fsmGenericResponse{error: err}
+	}
+	fsm.logs[id] = l
+
+	mutation, err := fsm.logsMutation()
+	if err == nil {
+		err = fsm.commit(id, state, []*storage.Mutation{mutation})
+	}
+	if err != nil {
+		delete(fsm.logs, id)
+		l.balloon.Close()
+		return &fsmGenericResponse{error: err}
+	}
+	return &fsmGenericResponse{}
+}
+
+func (fsm *BalloonFSM) applyDeleteLog(id string, state *fsmState) *fsmGenericResponse {
+	if isDefaultLog(id) {
+		return &fsmGenericResponse{error: errors.New("the default log cannot be deleted")}
+	}
+
+	fsm.logsMu.Lock()
+	defer fsm.logsMu.Unlock()
+
+	l, ok := fsm.logs[id]
+	if !ok {
+		return &fsmGenericResponse{error: ErrLogNotFound}
+	}
+	delete(fsm.logs, id)
+
+	mutation, err := fsm.logsMutation()
+	if err == nil {
+		err = fsm.commit(id, state, []*storage.Mutation{mutation})
+	}
+	if err != nil {
+		fsm.logs[id] = l
+		return &fsmGenericResponse{error: err}
+	}
+
+	l.balloon.Close()
+	if err := l.store.Drop(); err != nil {
+		return &fsmGenericResponse{error: err}
+	}
+	return &fsmGenericResponse{}
+}
@@ -29,6 +29,7 @@ type raftBalloonMetrics struct {
 	Adds                    prometheus.Counter
 	MembershipQueries       prometheus.Counter
 	DigestMembershipQueries prometheus.Counter
+	BatchMembershipQueries  prometheus.Counter
 	IncrementalQueries      prometheus.Counter
 }
 
@@ -69,6 +70,14 @@ func newRaftBalloonMetrics(b *RaftBalloon) *raftBalloonMetrics {
 				Help:      "Number of membership by digest queries.",
 			},
 		),
+		BatchMembershipQueries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "batch_membership_queries",
+				Help:      "Number of batch membership queries.",
+			},
+		),
 		IncrementalQueries: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -87,6 +96,7 @@ func (m *raftBalloonMetrics) collectors() []prometheus.Collector {
 		m.Adds,
 		m.MembershipQueries,
 		m.DigestMembershipQueries,
+		m.BatchMembershipQueries,
 		m.IncrementalQueries,
 	}
 }
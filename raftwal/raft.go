@@ -48,14 +48,32 @@ var (
 	// ErrNotLeader is returned when a node attempts to execute a leader-only
 	// operation.
 	ErrNotLeader = errors.New("not leader")
+
+	// ErrHasherMismatch is returned when a node attempts to join a cluster
+	// whose trees are built with a different hasher.
+	ErrHasherMismatch = errors.New("hasher does not match the one of the cluster")
 )
 
+// HasherMetadataKey is the metadata key under which nodes advertise the
+// id of the hasher their trees are built with. Nodes that do not
+// advertise it are assumed to use the default one.
+const HasherMetadataKey = "Hasher"
+
 // RaftBalloon is the interface Raft-backed balloons must implement.
 type RaftBalloonApi interface {
-	Add(event []byte) (*balloon.Snapshot, error)
-	QueryDigestMembership(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error)
-	QueryMembership(event []byte, version uint64) (*balloon.MembershipProof, error)
-	QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error)
+	Add(logID string, event []byte) (*balloon.Snapshot, error)
+	AddBulk(logID string, bulk [][]byte) ([]*balloon.Snapshot, error)
+	Put(logID string, key, value []byte) (*balloon.Snapshot, error)
+	QueryDigestMembership(logID string, keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error)
+	QueryMembership(logID string, event []byte, version uint64) (*balloon.MembershipProof, error)
+	QueryBatchMembership(logID string, keyDigests []hashing.Digest, version uint64) (*balloon.BatchMembershipProof, error)
+	QueryConsistency(logID string, start, end uint64) (*balloon.IncrementalProof, error)
+	// CreateLog creates a new log, identified by id, with its own trees
+	CreateLog(id string) error
+	// DeleteLog deletes the log identified by id along with all its data
+	DeleteLog(id string) error
+	// Logs returns the ids of the logs hosted by the cluster
+	Logs() []string
 	// Join joins the node, identified by nodeID and reachable at addr, to the cluster
 	Join(nodeID, addr string, metadata map[string]string) error
 	Info() map[string]interface{}
@@ -88,14 +106,21 @@ type RaftBalloon struct {
 	wg     sync.WaitGroup
 	done   chan struct{}
 
+	hasher      string                  // id of the hasher of the trees
 	fsm         *BalloonFSM             // balloon's finite state machine
 	snapshotsCh chan *protocol.Snapshot // channel to publish snapshots
 
 	metrics *raftBalloonMetrics
 }
 
-// NewRaftBalloon returns a new RaftBalloon.
-func NewRaftBalloon(path, addr, id string, store storage.ManagedStore, snapshotsCh chan *protocol.Snapshot) (*RaftBalloon, error) {
+// NewRaftBalloon returns a new RaftBalloon whose trees are built with
+// the hasher identified by hasher, or the default one if empty.
+func NewRaftBalloon(path, addr, id string, store storage.ManagedStore, hasher string, snapshotsCh chan *protocol.Snapshot) (*RaftBalloon, error) {
+
+	hasherID, hasherF, err := openHasher(store, hasher)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the log store and stable store
 	rocksStore, err := raftrocks.New(raftrocks.Options{Path: path + "/wal", NoSync: true, EnableStatistics: true})
@@ -113,7 +138,7 @@ func NewRaftBalloon(path, addr, id string, store storage.ManagedStore, snapshots
 	// }
 
 	// Instantiate balloon FSM
-	fsm, err := NewBalloonFSM(store, hashing.NewSha256Hasher)
+	fsm, err := NewBalloonFSM(store, hasherF)
 	if err != nil {
 		return nil, fmt.Errorf("new balloon fsm: %s", err)
 	}
@@ -123,6 +148,7 @@ func NewRaftBalloon(path, addr, id string, store storage.ManagedStore, snapshots
 		addr:        addr,
 		id:          id,
 		done:        make(chan struct{}),
+		hasher:      hasherID,
 		fsm:         fsm,
 		snapshotsCh: snapshotsCh,
 	}
@@ -368,48 +394,150 @@ func (b *RaftBalloon) raftApply(t commands.CommandType, cmd interface{}) (interf
 
 */
 
-func (b *RaftBalloon) Add(event []byte) (*balloon.Snapshot, error) {
-	cmd := &commands.AddEventCommand{Event: event}
+func (b *RaftBalloon) Add(logID string, event []byte) (*balloon.Snapshot, error) {
+	cmd := &commands.AddEventCommand{LogId: logID, Event: event}
 	resp, err := b.raftApply(commands.AddEventCommandType, cmd)
 	if err != nil {
 		return nil, err
 	}
+	addResp := resp.(*fsmAddResponse)
+	if addResp.error != nil {
+		return nil, addResp.error
+	}
 	b.metrics.Adds.Inc()
-	snapshot := resp.(*fsmAddResponse).snapshot
+	snapshot := addResp.snapshot
 
 	//Send snapshot to the snapshot channel
-	b.snapshotsCh <- &protocol.Snapshot{ // TODO move this to an upper layer (shard manager?)
-		HistoryDigest: snapshot.HistoryDigest,
-		HyperDigest:   snapshot.HyperDigest,
-		Version:       snapshot.Version,
-		EventDigest:   snapshot.EventDigest,
+	b.snapshotsCh <- newProtocolSnapshot(logID, snapshot) // TODO move this to an upper layer (shard manager?)
+
+	return snapshot, nil
+}
+
+// AddBulk appends a bulk of events through a single Raft log entry and
+// returns one snapshot per event, in order.
+func (b *RaftBalloon) AddBulk(logID string, bulk [][]byte) ([]*balloon.Snapshot, error) {
+	cmd := &commands.AddBulkCommand{LogId: logID, Events: bulk}
+	resp, err := b.raftApply(commands.AddBulkCommandType, cmd)
+	if err != nil {
+		return nil, err
 	}
+	bulkResp := resp.(*fsmAddBulkResponse)
+	if bulkResp.error != nil {
+		return nil, bulkResp.error
+	}
+	b.metrics.Adds.Add(float64(len(bulk)))
+
+	//Send snapshots to the snapshot channel
+	for _, snapshot := range bulkResp.snapshotBulk {
+		b.snapshotsCh <- newProtocolSnapshot(logID, snapshot)
+	}
+
+	return bulkResp.snapshotBulk, nil
+}
+
+// Put stores the value of a key in authenticated key-value mode,
+// replacing its previous value if any.
+func (b *RaftBalloon) Put(logID string, key, value []byte) (*balloon.Snapshot, error) {
+	cmd := &commands.PutCommand{LogId: logID, Key: key, Value: value}
+	resp, err := b.raftApply(commands.PutCommandType, cmd)
+	if err != nil {
+		return nil, err
+	}
+	putResp := resp.(*fsmAddResponse)
+	if putResp.error != nil {
+		return nil, putResp.error
+	}
+	b.metrics.Adds.Inc()
+	snapshot := putResp.snapshot
+
+	//Send snapshot to the snapshot channel
+	b.snapshotsCh <- newProtocolSnapshot(logID, snapshot)
 
 	return snapshot, nil
 }
 
-func (b *RaftBalloon) QueryDigestMembership(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+func (b *RaftBalloon) QueryDigestMembership(logID string, keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
 	b.metrics.DigestMembershipQueries.Inc()
-	return b.fsm.QueryDigestMembership(keyDigest, version)
+	return b.fsm.QueryDigestMembership(logID, keyDigest, version)
 }
 
-func (b *RaftBalloon) QueryMembership(event []byte, version uint64) (*balloon.MembershipProof, error) {
+func (b *RaftBalloon) QueryBatchMembership(logID string, keyDigests []hashing.Digest, version uint64) (*balloon.BatchMembershipProof, error) {
+	b.metrics.BatchMembershipQueries.Inc()
+	return b.fsm.QueryBatchMembership(logID, keyDigests, version)
+}
+
+func (b *RaftBalloon) QueryMembership(logID string, event []byte, version uint64) (*balloon.MembershipProof, error) {
 	b.metrics.MembershipQueries.Inc()
-	return b.fsm.QueryMembership(event, version)
+	return b.fsm.QueryMembership(logID, event, version)
 }
 
-func (b *RaftBalloon) QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error) {
+func (b *RaftBalloon) QueryConsistency(logID string, start, end uint64) (*balloon.IncrementalProof, error) {
 	b.metrics.IncrementalQueries.Inc()
-	return b.fsm.QueryConsistency(start, end)
+	return b.fsm.QueryConsistency(logID, start, end)
+}
+
+// CreateLog creates a new log, identified by id, with its own history
+// and hyper trees. This must be called from the Leader or it will fail.
+func (b *RaftBalloon) CreateLog(id string) error {
+	if err := ValidateLogID(id); err != nil {
+		return err
+	}
+	cmd := &commands.CreateLogCommand{LogId: id}
+	resp, err := b.raftApply(commands.CreateLogCommandType, cmd)
+	if err != nil {
+		return err
+	}
+	return resp.(*fsmGenericResponse).error
+}
+
+// DeleteLog deletes the log identified by id and all its data.
+// This must be called from the Leader or it will fail.
+func (b *RaftBalloon) DeleteLog(id string) error {
+	cmd := &commands.DeleteLogCommand{LogId: id}
+	resp, err := b.raftApply(commands.DeleteLogCommandType, cmd)
+	if err != nil {
+		return err
+	}
+	return resp.(*fsmGenericResponse).error
+}
+
+// Logs returns the ids of the logs hosted by the cluster, starting with
+// the default one.
+func (b *RaftBalloon) Logs() []string {
+	return b.fsm.Logs()
+}
+
+func newProtocolSnapshot(logID string, snapshot *balloon.Snapshot) *protocol.Snapshot {
+	if isDefaultLog(logID) {
+		logID = ""
+	}
+	return &protocol.Snapshot{
+		HistoryDigest: snapshot.HistoryDigest,
+		HyperDigest:   snapshot.HyperDigest,
+		Version:       snapshot.Version,
+		EventDigest:   snapshot.EventDigest,
+		LogId:         logID,
+		TreeFormat:    snapshot.TreeFormat,
+	}
 }
 
 // Join joins a node, identified by id and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
-// This must be called from the Leader or it will fail.
+// This must be called from the Leader or it will fail. Nodes whose hasher
+// differs from the one of this store are rejected with ErrHasherMismatch.
 func (b *RaftBalloon) Join(nodeID, addr string, metadata map[string]string) error {
 
 	log.Infof("received join request for remote node %s at %s", nodeID, addr)
 
+	hasher := metadata[HasherMetadataKey]
+	if hasher == "" {
+		hasher = hashing.DefaultHasher
+	}
+	if hasher != b.hasher {
+		log.Infof("rejecting node %s at %s: its hasher %q does not match %q", nodeID, addr, hasher, b.hasher)
+		return ErrHasherMismatch
+	}
+
 	configFuture := b.raft.api.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		log.Errorf("failed to get raft servers configuration: %v", err)
@@ -421,10 +549,10 @@ func (b *RaftBalloon) Join(nodeID, addr string, metadata map[string]string) erro
 		// that node may need to be removed from the config first.
 		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(addr) {
 			// However if *both* the ID and the address are the same, then nothing -- not even
-			// a join operation -- is needed.
+			// a join operation -- is needed, but the node can bring new metadata.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
-				log.Infof("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
-				return nil
+				log.Infof("node %s at %s already member of cluster, updating its metadata", nodeID, addr)
+				return b.SetMetadata(nodeID, metadata)
 			}
 
 			future := b.raft.api.RemoveServer(srv.ID, 0, 0)
@@ -455,6 +583,9 @@ func (b *RaftBalloon) Join(nodeID, addr string, metadata map[string]string) erro
 // this node.
 func (b *RaftBalloon) SetMetadata(nodeInvolved string, md map[string]string) error {
 	cmd := b.fsm.setMetadata(nodeInvolved, md)
+	if cmd == nil {
+		return nil
+	}
 	_, err := b.WaitForLeader(5 * time.Second)
 	if err != nil {
 		return err
@@ -468,12 +599,23 @@ func (b *RaftBalloon) SetMetadata(nodeInvolved string, md map[string]string) err
 	return resp.(*fsmGenericResponse).error
 }
 
+// Hasher returns the id of the hasher the trees are built with.
+func (b *RaftBalloon) Hasher() string {
+	return b.hasher
+}
+
+// Metadata returns the value of the metadata key of the given node.
+func (b *RaftBalloon) Metadata(nodeID, key string) string {
+	return b.fsm.Metadata(nodeID, key)
+}
+
 // TODO Improve info structure.
 func (b *RaftBalloon) Info() map[string]interface{} {
 	m := make(map[string]interface{})
 	m["nodeID"] = b.ID()
 	m["leaderID"], _ = b.LeaderID()
 	m["meta"] = b.fsm.meta
+	m["hasher"] = b.hasher
 	return m
 }
 
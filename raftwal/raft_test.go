@@ -29,6 +29,7 @@ import (
 
 	"github.com/bbva/qed/protocol"
 
+	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/storage/rocks"
 	metrics_utils "github.com/bbva/qed/testutils/metrics"
@@ -57,7 +58,7 @@ func newNode(t *testing.T, id int) (*RaftBalloon, func()) {
 	raftPath := fmt.Sprintf("/var/tmp/raft-test/node%d/raft", id)
 	err = os.MkdirAll(raftPath, os.FileMode(0755))
 	require.NoError(t, err)
-	r, err := NewRaftBalloon(raftPath, raftAddr(id), fmt.Sprintf("%d", id), db, make(chan *protocol.Snapshot, 25000))
+	r, err := NewRaftBalloon(raftPath, raftAddr(id), fmt.Sprintf("%d", id), db, "", make(chan *protocol.Snapshot, 25000))
 	require.NoError(t, err)
 
 	return r, func() {
@@ -133,11 +134,33 @@ func Test_Raft_MultiNode_Join(t *testing.T) {
 	err = r1.Open(false, map[string]string{"foo": "bar"})
 	require.NoError(t, err)
 
-	err = r0.Join("1", string(r1.raft.transport.LocalAddr()), map[string]string{"foo": "bar"})
+	err = r0.Join("1", string(r1.raft.transport.LocalAddr()), map[string]string{"foo": "bar", HasherMetadataKey: hashing.SHA256})
 	require.NoError(t, err)
 
 }
 
+func Test_Raft_MultiNode_JoinHasherMismatch(t *testing.T) {
+
+	log.SetLogger("Test_Raft_MultiNode_JoinHasherMismatch", log.SILENT)
+
+	r0, clean0 := newNode(t, 3)
+	defer func() {
+		err := r0.Close(true)
+		require.NoError(t, err)
+		clean0()
+	}()
+
+	err := r0.Open(true, map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+
+	_, err = r0.WaitForLeader(10 * time.Second)
+	require.NoError(t, err)
+
+	err = r0.Join("4", raftAddr(4), map[string]string{HasherMetadataKey: hashing.BLAKE2B256})
+	require.Equal(t, ErrHasherMismatch, err, "a node with a different hasher must not join")
+
+}
+
 func Test_Raft_MultiNode_JoinRemove(t *testing.T) {
 
 	r0, clean0 := newNode(t, 5)
@@ -213,7 +236,7 @@ func Test_Raft_SingleNode_SnapshotOnDisk(t *testing.T) {
 	rand.Seed(42)
 	expectedBalloonVersion := uint64(rand.Intn(50))
 	for i := uint64(0); i < expectedBalloonVersion; i++ {
-		_, err = r0.Add([]byte(fmt.Sprintf("Test Event %d", i)))
+		_, err = r0.Add(DefaultLogID, []byte(fmt.Sprintf("Test Event %d", i)))
 		require.NoError(t, err)
 	}
 	// force snapshot
@@ -286,7 +309,7 @@ func Test_Raft_SingleNode_SnapshotConsistency(t *testing.T) {
 				require.NoError(t, err)
 				wgSnap.Done()
 			}
-			_, err = r0.Add([]byte(fmt.Sprintf("Test Event %d", i)))
+			_, err = r0.Add(DefaultLogID, []byte(fmt.Sprintf("Test Event %d", i)))
 			require.NoError(t, err)
 		}
 	}()
@@ -365,6 +388,18 @@ func Test_Raft_MultiNode_WithMetadata(t *testing.T) {
 	time.Sleep(1 * time.Second)
 
 	require.Equal(t, r0.Info()["meta"], r1.Info()["meta"], "Both nodes must have the same metadata.")
+
+	// joining again updates the metadata of the node
+	err = r0.Join("1", string(r1.raft.transport.LocalAddr()), map[string]string{"nodeID": "1", "foo": "bar"})
+	require.NoError(t, err)
+	err = r0.Join("1", string(r1.raft.transport.LocalAddr()), map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	require.Equal(t, "bar", r1.Metadata("1", "foo"), "A member must be able to update its metadata.")
+	require.Equal(t, "1", r1.Metadata("1", "nodeID"))
+	require.Equal(t, r0.Info()["meta"], r1.Info()["meta"], "Both nodes must have the same metadata.")
 }
 
 func Test_Raft_MultiNode_Remove_WithMetadata(t *testing.T) {
@@ -464,7 +499,7 @@ func newNodeBench(b *testing.B, id int) (*RaftBalloon, func()) {
 	snapshotsCh := make(chan *protocol.Snapshot, 10000)
 	snapshotsDrainer(snapshotsCh)
 
-	node, err := NewRaftBalloon(raftPath, raftAddr(id), fmt.Sprintf("%d", id), store, snapshotsCh)
+	node, err := NewRaftBalloon(raftPath, raftAddr(id), fmt.Sprintf("%d", id), store, "", snapshotsCh)
 	require.NoError(b, err)
 
 	srvCloseF := metrics_utils.StartMetricsServer(node, store)
@@ -505,7 +540,7 @@ func BenchmarkRaftAdd(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			event := utilrand.Bytes(128)
-			_, err := raftNode.Add(event)
+			_, err := raftNode.Add(DefaultLogID, event)
 			require.NoError(b, err)
 		}
 	})
@@ -20,6 +20,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+
+	"github.com/bbva/qed/hashing"
 )
 
 type Config struct {
@@ -56,15 +58,42 @@ type Config struct {
 	// Path to Raft storage directory.
 	RaftPath string
 
+	// Hash algorithm used to build the trees: sha256, sha512-256,
+	// sha3-256 or blake2b-256. It is recorded in the store on first boot
+	// and cannot be changed afterwards.
+	Hasher string
+
 	// Gossip management server bind address/port.
 	GossipAddr string
 
 	// List of nodes, through which a gossip cluster can be joined (protocol://host:port).
 	GossipJoinAddr []string
 
-	// Path to the private key file used to sign snapshots.
+	// File with the keys to encrypt the gossip traffic, the primary key
+	// first. If empty, the gossip traffic is not encrypted.
+	GossipKeyringPath string
+
+	// Token which admits this node in the gossip network with the server
+	// role. It must be issued for the key of GossipPrivateKeyPath.
+	GossipJoinToken string
+
+	// Path to the private key file the gossip agent signs its messages
+	// with. If empty, a new key is generated on every start.
+	GossipPrivateKeyPath string
+
+	// Public key files whose join tokens admit the gossip peers. If
+	// empty, any node may join the gossip network.
+	GossipAdmissionKeys []string
+
+	// Path to the private key file used to sign snapshots: an ed25519,
+	// ECDSA P-256 or RSA key in PEM, PKCS#8 or OpenSSH format.
 	PrivateKeyPath string
 
+	// Path to the file that keeps the signing keys across rotations. If
+	// it already exists, its active key is used instead of PrivateKeyPath.
+	// Defaults to keyring.json in DBPath.
+	KeyringPath string
+
 	// Enable TLS service
 	EnableTLS bool
 
@@ -92,6 +121,7 @@ func DefaultConfig() *Config {
 		GossipJoinAddr:    []string{},
 		DBPath:            currentDir + "/db",
 		RaftPath:          currentDir + "/wal",
+		Hasher:            hashing.DefaultHasher,
 		EnableTLS:         false,
 		SSLCertificate:    "",
 		SSLCertificateKey: "",
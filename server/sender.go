@@ -17,7 +17,6 @@
 package server
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/bbva/qed/gossip"
@@ -100,7 +99,11 @@ func (s Sender) batcher(id int, ch chan *protocol.Snapshot) {
 
 	for {
 		select {
-		case snap := <-ch:
+		case snap, ok := <-ch:
+			if !ok {
+				// the server closes the channel when it stops
+				return
+			}
 			if len(batch.Snapshots) == s.BatchSize {
 				payload, err := batch.Encode()
 				if err != nil {
@@ -120,6 +123,7 @@ func (s Sender) batcher(id int, ch chan *protocol.Snapshot) {
 			ss, err := s.doSign(snap)
 			if err != nil {
 				log.Errorf("Failed signing message: %v", err)
+				continue
 			}
 			batch.Snapshots = append(batch.Snapshots, ss)
 		case <-time.After(s.Interval):
@@ -151,10 +155,10 @@ func (s Sender) Stop() {
 }
 
 func (s *Sender) doSign(snapshot *protocol.Snapshot) (*protocol.SignedSnapshot, error) {
-	signature, err := s.signer.Sign([]byte(fmt.Sprintf("%v", snapshot)))
+	signed, err := protocol.SignSnapshot(s.signer, snapshot, time.Now())
 	if err != nil {
 		log.Info("Publisher: error signing snapshot")
 		return nil, err
 	}
-	return &protocol.SignedSnapshot{Snapshot: snapshot, Signature: signature}, nil
+	return signed, nil
 }
@@ -28,12 +28,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/bbva/qed/api/apihttp"
 	"github.com/bbva/qed/api/mgmthttp"
 	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
 	"github.com/bbva/qed/protocol"
@@ -53,7 +55,7 @@ type Server struct {
 	metrics            *serverMetrics
 	metricsServer      *metrics.Server
 	prometheusRegistry *prometheus.Registry
-	signer             sign.Signer
+	keyring            *sign.Keyring
 	sender             *Sender
 	agent              *gossip.Agent
 	snapshotsCh        chan *protocol.Snapshot
@@ -81,6 +83,93 @@ func serverInfo(conf *Config) http.HandlerFunc {
 	}
 }
 
+// serverKeys publishes the signing keys of the servers of the cluster,
+// with their validity windows, so agents and clients can verify the
+// snapshots of whichever node signed them.
+func (s *Server) serverKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		keys, err := s.clusterKeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(keys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+}
+
+// clusterKeys returns the union of the signing keys of this server and
+// the ones every node of the cluster published in its metadata.
+func (s *Server) clusterKeys() (*sign.KeySet, error) {
+	nodes, err := s.raftBalloon.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	sets := []*sign.KeySet{s.keyring.KeySet()}
+	for _, node := range nodes {
+		data := s.raftBalloon.Metadata(string(node.ID), "Keys")
+		if data == "" {
+			continue
+		}
+		var keys sign.KeySet
+		if err := json.Unmarshal([]byte(data), &keys); err != nil {
+			return nil, fmt.Errorf("unable to decode the keys of node %s: %v", node.ID, err)
+		}
+		sets = append(sets, &keys)
+	}
+	return sign.MergeKeySets(sets...), nil
+}
+
+// metadata returns the metadata the server shares with the rest of the
+// cluster through Raft, its signing keys included.
+func (s *Server) metadata() (map[string]string, error) {
+	keys, err := json.Marshal(s.keyring.KeySet())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"HTTPAddr":                s.conf.HTTPAddr,
+		"MgmtAddr":                s.conf.MgmtAddr,
+		"Keys":                    string(keys),
+		raftwal.HasherMetadataKey: s.raftBalloon.Hasher(),
+	}, nil
+}
+
+// publishKeys shares the current signing keys of the server with the
+// rest of the cluster. Only the leader applies metadata, so a follower
+// joins the leader again with its new metadata.
+func (s *Server) publishKeys() error {
+	metadata, err := s.metadata()
+	if err != nil {
+		return err
+	}
+	if s.raftBalloon.IsLeader() {
+		return s.raftBalloon.SetMetadata(s.conf.NodeID, metadata)
+	}
+	leaderID, err := s.raftBalloon.LeaderID()
+	if err != nil {
+		return err
+	}
+	addr := s.raftBalloon.Metadata(leaderID, "MgmtAddr")
+	if addr == "" {
+		return fmt.Errorf("unknown management address of the leader %q", leaderID)
+	}
+	return join(addr, s.conf.RaftAddr, s.conf.NodeID, metadata)
+}
+
 // NewServer creates a new Server based on the parameters it receives.
 func NewServer(conf *Config) (*Server, error) {
 
@@ -89,6 +178,11 @@ func NewServer(conf *Config) (*Server, error) {
 		bootstrap = true
 	}
 
+	// the hasher is advertised in /info, so it must not be empty
+	if conf.Hasher == "" {
+		conf.Hasher = hashing.DefaultHasher
+	}
+
 	server := &Server{
 		conf:      conf,
 		bootstrap: bootstrap,
@@ -111,7 +205,10 @@ func NewServer(conf *Config) (*Server, error) {
 	}
 
 	// Create signer
-	server.signer, err = sign.NewEd25519SignerFromFile(conf.PrivateKeyPath)
+	if conf.KeyringPath == "" {
+		conf.KeyringPath = filepath.Join(conf.DBPath, "keyring.json")
+	}
+	server.keyring, err = sign.LoadKeyring(conf.KeyringPath, conf.PrivateKeyPath)
 	if err != nil {
 		return nil, err
 	}
@@ -122,8 +219,12 @@ func NewServer(conf *Config) (*Server, error) {
 	// Create gossip agent
 	config := gossip.DefaultConfig()
 	config.BindAddr = conf.GossipAddr
-	config.Role = "server"
+	config.Role = gossip.ServerRole
 	config.NodeName = conf.NodeID
+	config.KeyringPath = conf.GossipKeyringPath
+	config.JoinToken = conf.GossipJoinToken
+	config.PrivateKeyPath = conf.GossipPrivateKeyPath
+	config.AdmissionKeys = conf.GossipAdmissionKeys
 
 	server.agent, err = gossip.NewAgentFromConfig(config)
 	if err != nil {
@@ -134,10 +235,10 @@ func NewServer(conf *Config) (*Server, error) {
 	server.snapshotsCh = make(chan *protocol.Snapshot, 1<<16)
 
 	// Create sender
-	server.sender = NewSender(server.agent, server.signer, 500, 2, 3)
+	server.sender = NewSender(server.agent, server.keyring, 500, 2, 3)
 
 	// Create RaftBalloon
-	server.raftBalloon, err = raftwal.NewRaftBalloon(conf.RaftPath, conf.RaftAddr, conf.NodeID, store, server.snapshotsCh)
+	server.raftBalloon, err = raftwal.NewRaftBalloon(conf.RaftPath, conf.RaftAddr, conf.NodeID, store, conf.Hasher, server.snapshotsCh)
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +246,7 @@ func NewServer(conf *Config) (*Server, error) {
 	// Create http endpoints
 	httpMux := apihttp.NewApiHttp(server.raftBalloon)
 	httpMux.HandleFunc("/info", serverInfo(conf))
+	httpMux.HandleFunc("/keys", server.serverKeys())
 
 	if conf.EnableTLS {
 		server.httpServer = newTLSServer(conf.HTTPAddr, httpMux)
@@ -154,6 +256,7 @@ func NewServer(conf *Config) (*Server, error) {
 
 	// Create management endpoints
 	mgmtMux := mgmthttp.NewMgmtHttp(server.raftBalloon)
+	mgmtMux.HandleFunc("/keys/rotate", mgmthttp.RotateKeyHandle(server.keyring, server.publishKeys))
 	server.mgmtServer = newHTTPServer(conf.MgmtAddr, mgmtMux)
 
 	// register qed metrics
@@ -181,6 +284,10 @@ func join(joinAddr, raftAddr, nodeID string, metadata map[string]string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("join request to %s failed: %s %s", joinAddr, resp.Status, bytes.TrimSpace(msg))
+	}
 	_, _ = io.Copy(ioutil.Discard, resp.Body)
 
 	return nil
@@ -191,10 +298,12 @@ func (s *Server) Start() error {
 	s.metrics.Instances.Inc()
 	log.Infof("Starting QED server %s\n", s.conf.NodeID)
 
-	metadata := map[string]string{}
-	metadata["HTTPAddr"] = s.conf.HTTPAddr
+	metadata, err := s.metadata()
+	if err != nil {
+		return err
+	}
 
-	err := s.raftBalloon.Open(s.bootstrap, metadata)
+	err = s.raftBalloon.Open(s.bootstrap, metadata)
 	if err != nil {
 		return err
 	}
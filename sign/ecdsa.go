@@ -0,0 +1,115 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// ECDSASigner signs with ECDSA over the P-256 curve and SHA-256 digests.
+// Signatures are ASN.1 DER encoded.
+type ECDSASigner struct {
+	ECDSAVerifier
+	privateKey *ecdsa.PrivateKey
+}
+
+func NewECDSASigner() Signer {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	signer, _ := newECDSASigner(privateKey)
+	return signer
+
+}
+
+func newECDSASigner(privateKey *ecdsa.PrivateKey) (*ECDSASigner, error) {
+	verifier, err := newECDSAVerifier(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ECDSASigner{*verifier, privateKey}, nil
+}
+
+func (s *ECDSASigner) Sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return s.privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+type ECDSAVerifier struct {
+	publicKey *ecdsa.PublicKey
+	encoded   []byte
+}
+
+// NewECDSAVerifier returns a verifier for a P-256 public key in the PKIX,
+// ASN.1 DER form.
+func NewECDSAVerifier(publicKey []byte) (Verifier, error) {
+	pk, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPublicKey, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not ECDSA")
+	}
+	return newECDSAVerifier(ecdsaPublicKey)
+}
+
+func newECDSAVerifier(publicKey *ecdsa.PublicKey) (*ECDSAVerifier, error) {
+	if publicKey.Curve != elliptic.P256() {
+		return nil, errors.New("only ECDSA keys over the P-256 curve are supported")
+	}
+	encoded, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ECDSAVerifier{publicKey, encoded}, nil
+}
+
+func (v *ECDSAVerifier) PublicKey() []byte {
+	return v.encoded
+}
+
+func (v *ECDSAVerifier) Algorithm() string {
+	return ECDSAP256SHA256
+}
+
+func (v *ECDSAVerifier) KeyID() string {
+	return KeyID(v.encoded)
+}
+
+func (v *ECDSAVerifier) Verify(message, sig []byte) (bool, error) {
+	var rs struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil || len(rest) != 0 {
+		return false, nil
+	}
+	digest := sha256.Sum256(message)
+	return ecdsa.Verify(v.publicKey, digest[:], rs.R, rs.S), nil
+}
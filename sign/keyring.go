@@ -0,0 +1,350 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyInfo is the public description of a key of a keyring.
+type KeyInfo struct {
+	KeyId     string
+	Algorithm string
+	PublicKey []byte
+	// NotBefore and NotAfter bound the validity window of the key, in
+	// milliseconds since the Unix epoch. NotAfter is zero while the key
+	// is active.
+	NotBefore int64
+	NotAfter  int64 `json:",omitempty"`
+	// CrossSignature is the signature of the rotation statement of the
+	// key made by the previous key, CrossSignedBy. Both are empty for
+	// the first key of a keyring.
+	CrossSignedBy  string `json:",omitempty"`
+	CrossSignature []byte `json:",omitempty"`
+}
+
+// ValidAt returns true if the key was valid at the given time, in
+// milliseconds since the Unix epoch.
+func (k *KeyInfo) ValidAt(timestamp int64) bool {
+	return timestamp >= k.NotBefore && (k.NotAfter == 0 || timestamp < k.NotAfter)
+}
+
+// rotationMessage returns the statement the previous key signs to
+// introduce a new key: the key id, the algorithm and the public key,
+// each prefixed by its 2 bytes big-endian length, and the start of its
+// validity window as 8 bytes big-endian.
+func rotationMessage(k *KeyInfo) []byte {
+	var buf bytes.Buffer
+	var num [8]byte
+	buf.WriteString("qed key rotation")
+	for _, field := range [][]byte{[]byte(k.KeyId), []byte(k.Algorithm), k.PublicKey} {
+		binary.BigEndian.PutUint16(num[:2], uint16(len(field)))
+		buf.Write(num[:2])
+		buf.Write(field)
+	}
+	binary.BigEndian.PutUint64(num[:], uint64(k.NotBefore))
+	buf.Write(num[:])
+	return buf.Bytes()
+}
+
+// KeySet is the list of the keys of a keyring, from the oldest to the
+// active one, as published by the servers.
+type KeySet struct {
+	Keys []*KeyInfo
+}
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// Key returns the key with the given id.
+func (s *KeySet) Key(keyID string) (*KeyInfo, error) {
+	for _, k := range s.Keys {
+		if k.KeyId == keyID {
+			return k, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Verifier returns a verifier for the key with the given id.
+func (s *KeySet) Verifier(keyID string) (Verifier, error) {
+	k, err := s.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifier(k.Algorithm, k.PublicKey)
+}
+
+// Check verifies that every key of the set is either one of the trusted
+// keys or was cross-signed by a key that comes before it in the set and
+// passed the check, and that every id matches its public key. Whoever
+// trusts the anchors can then trust all the keys of the set. A set can
+// hold several chains, like the union of the keyrings of a cluster.
+func (s *KeySet) Check(trusted *KeySet) error {
+	if trusted == nil || len(trusted.Keys) == 0 {
+		return errors.New("no trusted key to anchor the key set")
+	}
+	checked := make(map[string]*KeyInfo, len(s.Keys))
+	for _, k := range s.Keys {
+		if k.KeyId != KeyID(k.PublicKey) {
+			return fmt.Errorf("key id %s does not match its public key", k.KeyId)
+		}
+		if anchor, err := trusted.Key(k.KeyId); err == nil {
+			if !bytes.Equal(anchor.PublicKey, k.PublicKey) {
+				return fmt.Errorf("key %s does not match the trusted one", k.KeyId)
+			}
+			checked[k.KeyId] = k
+			continue
+		}
+		previous, ok := checked[k.CrossSignedBy]
+		if !ok {
+			return fmt.Errorf("key %s is not trusted nor cross-signed by a trusted key", k.KeyId)
+		}
+		verifier, err := NewVerifier(previous.Algorithm, previous.PublicKey)
+		if err != nil {
+			return err
+		}
+		ok, err = verifier.Verify(rotationMessage(k), k.CrossSignature)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("invalid cross-signature of key %s", k.KeyId)
+		}
+		checked[k.KeyId] = k
+	}
+	return nil
+}
+
+// MergeKeySets returns the union of the given key sets, keeping the
+// order in which the keys come. A key found in several sets is kept
+// once, with the widest of its validity windows.
+func MergeKeySets(sets ...*KeySet) *KeySet {
+	merged := &KeySet{}
+	seen := make(map[string]*KeyInfo)
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		for _, k := range set.Keys {
+			if m, ok := seen[k.KeyId]; ok {
+				if k.NotBefore < m.NotBefore {
+					m.NotBefore = k.NotBefore
+				}
+				if m.NotAfter != 0 && (k.NotAfter == 0 || k.NotAfter > m.NotAfter) {
+					m.NotAfter = k.NotAfter
+				}
+				continue
+			}
+			info := *k
+			seen[k.KeyId] = &info
+			merged.Keys = append(merged.Keys, &info)
+		}
+	}
+	return merged
+}
+
+type keyringEntry struct {
+	KeyInfo
+	// PrivateKeyPath is where the private key is loaded from. It is
+	// kept only in the keyring file, never published.
+	PrivateKeyPath string
+}
+
+// Keyring holds the keys a server signs with: the active one and the
+// ones it retired. It implements Signer with the active key. Keys are
+// rotated with Rotate, and the keyring is kept in a file, if any, so
+// rotations survive restarts.
+type Keyring struct {
+	mu      sync.RWMutex
+	path    string
+	entries []*keyringEntry
+	active  Signer
+}
+
+// LoadKeyring loads the keyring kept at path. If there is no keyring
+// there yet, it creates one with the key at privateKeyPath as its first
+// key. An empty path keeps the keyring in memory only.
+func LoadKeyring(path, privateKeyPath string) (*Keyring, error) {
+
+	k := &Keyring{path: path}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &k.entries); err != nil {
+				return nil, fmt.Errorf("unable to decode keyring %s: %v", path, err)
+			}
+			if len(k.entries) == 0 {
+				return nil, fmt.Errorf("empty keyring %s", path)
+			}
+			// the keyring file is trusted, so its first key anchors it
+			set := k.keySet()
+			if err := set.Check(&KeySet{Keys: set.Keys[:1]}); err != nil {
+				return nil, err
+			}
+			last := k.entries[len(k.entries)-1]
+			k.active, err = NewSignerFromFile(last.PrivateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			if k.active.KeyID() != last.KeyId {
+				return nil, fmt.Errorf("private key %s does not match the active key %s", last.PrivateKeyPath, last.KeyId)
+			}
+			return k, nil
+		}
+	}
+
+	signer, err := NewSignerFromFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	k.entries = []*keyringEntry{{
+		KeyInfo:        newKeyInfo(signer, time.Now()),
+		PrivateKeyPath: privateKeyPath,
+	}}
+	k.active = signer
+
+	return k, k.save()
+}
+
+func newKeyInfo(v Verifier, now time.Time) KeyInfo {
+	return KeyInfo{
+		KeyId:     v.KeyID(),
+		Algorithm: v.Algorithm(),
+		PublicKey: v.PublicKey(),
+		NotBefore: now.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// save writes the keyring to its file, through a temporary file so a
+// failure does not leave a truncated keyring behind.
+func (k *Keyring) save() error {
+	if k.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(k.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// Rotate makes the key at privateKeyPath the active key. The new key is
+// cross-signed by the previous active key, whose validity window ends
+// when the new one starts.
+func (k *Keyring) Rotate(privateKeyPath string) (*KeyInfo, error) {
+
+	signer, err := NewSignerFromFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, e := range k.entries {
+		if e.KeyId == signer.KeyID() {
+			return nil, fmt.Errorf("key %s was already used by the keyring", e.KeyId)
+		}
+	}
+
+	previous := k.entries[len(k.entries)-1]
+	entry := &keyringEntry{
+		KeyInfo:        newKeyInfo(signer, time.Now()),
+		PrivateKeyPath: privateKeyPath,
+	}
+	if entry.NotBefore <= previous.NotBefore {
+		entry.NotBefore = previous.NotBefore + 1
+	}
+	entry.CrossSignedBy = previous.KeyId
+	entry.CrossSignature, err = k.active.Sign(rotationMessage(&entry.KeyInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	previous.NotAfter = entry.NotBefore
+	k.entries = append(k.entries, entry)
+	if err := k.save(); err != nil {
+		k.entries = k.entries[:len(k.entries)-1]
+		previous.NotAfter = 0
+		return nil, err
+	}
+	k.active = signer
+
+	info := entry.KeyInfo
+	return &info, nil
+}
+
+// Active returns the signer of the active key. Callers that sign and
+// need to know which key signed must take it once, as the keyring can
+// rotate between calls.
+func (k *Keyring) Active() Signer {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// KeySet returns the public keys of the keyring.
+func (k *Keyring) KeySet() *KeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keySet()
+}
+
+func (k *Keyring) keySet() *KeySet {
+	set := &KeySet{Keys: make([]*KeyInfo, 0, len(k.entries))}
+	for _, e := range k.entries {
+		info := e.KeyInfo
+		set.Keys = append(set.Keys, &info)
+	}
+	return set
+}
+
+func (k *Keyring) Sign(message []byte) ([]byte, error) {
+	return k.Active().Sign(message)
+}
+
+func (k *Keyring) Verify(message, sig []byte) (bool, error) {
+	return k.Active().Verify(message, sig)
+}
+
+func (k *Keyring) KeyID() string {
+	return k.Active().KeyID()
+}
+
+func (k *Keyring) Algorithm() string {
+	return k.Active().Algorithm()
+}
+
+func (k *Keyring) PublicKey() []byte {
+	return k.Active().PublicKey()
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeEd25519PrivateKey writes a new ed25519 private key in the OpenSSH
+// format to the given file, and returns its key id.
+func writeEd25519PrivateKey(t *testing.T, path string) string {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	pub := ssh.Marshal(struct {
+		KeyType string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, publicKey})
+
+	block := ssh.Marshal(struct {
+		Check1, Check2 uint32
+		KeyType        string
+		Pub, Priv      []byte
+		Comment        string
+	}{42, 42, ssh.KeyAlgoED25519, publicKey, privateKey, "test"})
+	for i := byte(1); len(block)%8 != 0; i++ {
+		block = append(block, i)
+	}
+
+	key := append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName, KdfName, KdfOpts string
+		NumKeys                      uint32
+		PubKey, PrivKeyBlock         []byte
+	}{"none", "none", "", 1, pub, block})...)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: key})
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	return KeyID(publicKey)
+}
+
+func TestKeyringRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-keyring-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	firstKey := writeEd25519PrivateKey(t, filepath.Join(dir, "first"))
+	secondKey := writeEd25519PrivateKey(t, filepath.Join(dir, "second"))
+	writeEd25519PrivateKey(t, filepath.Join(dir, "third"))
+
+	keyring, err := LoadKeyring(path, filepath.Join(dir, "first"))
+	assert.NoError(t, err)
+	assert.Equal(t, firstKey, keyring.KeyID(), "The first key should be active")
+
+	message := []byte("send reinforcements, we're going to advance")
+	firstSig, _ := keyring.Sign(message)
+
+	info, err := keyring.Rotate(filepath.Join(dir, "second"))
+	assert.NoError(t, err)
+	assert.Equal(t, secondKey, info.KeyId)
+	assert.Equal(t, firstKey, info.CrossSignedBy, "The new key should be cross-signed by the previous one")
+	assert.Equal(t, secondKey, keyring.KeyID(), "The second key should be active")
+
+	_, err = keyring.Rotate(filepath.Join(dir, "first"))
+	assert.Error(t, err, "A retired key should not be active again")
+	_, err = keyring.Rotate(filepath.Join(dir, "missing"))
+	assert.Error(t, err, "A missing key should not be active")
+
+	keys := keyring.KeySet()
+	anchor := &KeySet{Keys: keyring.KeySet().Keys[:1]}
+	assert.Len(t, keys.Keys, 2)
+	assert.NoError(t, keys.Check(anchor))
+	assert.Error(t, keys.Check(nil), "A key set without anchor should not be trusted")
+	assert.Error(t, keys.Check(&KeySet{Keys: keyring.KeySet().Keys[1:]}), "Keys older than the anchor should not be trusted")
+	assert.Equal(t, keys.Keys[1].NotBefore, keys.Keys[0].NotAfter, "The validity windows should be contiguous")
+	assert.True(t, keys.Keys[0].ValidAt(keys.Keys[0].NotBefore))
+	assert.False(t, keys.Keys[0].ValidAt(keys.Keys[0].NotAfter))
+	assert.True(t, keys.Keys[1].ValidAt(keys.Keys[1].NotBefore+1e9), "The active key should not expire")
+
+	verifier, err := keys.Verifier(firstKey)
+	assert.NoError(t, err)
+	ok, _ := verifier.Verify(message, firstSig)
+	assert.True(t, ok, "Retired keys should still verify their signatures")
+	_, err = keys.Verifier("unknown")
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// the rotation survives a restart, whatever the configured key
+	keyring, err = LoadKeyring(path, filepath.Join(dir, "third"))
+	assert.NoError(t, err)
+	assert.Equal(t, secondKey, keyring.KeyID(), "The rotated key should be active after a restart")
+	assert.Equal(t, keys, keyring.KeySet())
+
+	keys.Keys[1].CrossSignature[0] ^= 0xff
+	assert.Error(t, keys.Check(anchor), "A wrong cross-signature should be detected")
+
+	keys = keyring.KeySet()
+	keys.Keys[1].CrossSignedBy = secondKey
+	assert.Error(t, keys.Check(anchor), "A key not cross-signed by the previous one should be detected")
+
+	keys = keyring.KeySet()
+	keys.Keys[0].PublicKey = keys.Keys[1].PublicKey
+	assert.Error(t, keys.Check(anchor), "A key id not matching its public key should be detected")
+
+}
+
+func TestMergeKeySets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-keyring-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeEd25519PrivateKey(t, filepath.Join(dir, "first"))
+	secondKey := writeEd25519PrivateKey(t, filepath.Join(dir, "second"))
+	thirdKey := writeEd25519PrivateKey(t, filepath.Join(dir, "third"))
+
+	// two nodes start with the same key and rotate to different ones
+	node1, err := LoadKeyring("", filepath.Join(dir, "first"))
+	assert.NoError(t, err)
+	node2, err := LoadKeyring("", filepath.Join(dir, "first"))
+	assert.NoError(t, err)
+	anchor := &KeySet{Keys: node1.KeySet().Keys[:1]}
+	_, err = node1.Rotate(filepath.Join(dir, "second"))
+	assert.NoError(t, err)
+
+	merged := MergeKeySets(node1.KeySet(), node2.KeySet(), nil)
+	assert.Len(t, merged.Keys, 2)
+	assert.Zero(t, merged.Keys[0].NotAfter, "The shared key should be valid while a node uses it")
+	assert.NoError(t, merged.Check(anchor))
+
+	_, err = node2.Rotate(filepath.Join(dir, "third"))
+	assert.NoError(t, err)
+	merged = MergeKeySets(node1.KeySet(), node2.KeySet())
+	assert.Len(t, merged.Keys, 3)
+	assert.Equal(t, secondKey, merged.Keys[1].KeyId)
+	assert.Equal(t, thirdKey, merged.Keys[2].KeyId)
+	assert.NotZero(t, merged.Keys[0].NotAfter)
+	assert.NoError(t, merged.Check(anchor), "Every chain of the union should be anchored")
+
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// ed25519SPKIPrefix is the PKIX, ASN.1 DER encoding of an ed25519 public
+// key without the 32 bytes of the key itself.
+var ed25519SPKIPrefix = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+
+// NewSignerFromFile loads a private key from a file and returns a signer
+// for its algorithm. See ParsePrivateKey for the supported formats.
+func NewSignerFromFile(privateKeyPath string) (Signer, error) {
+	data, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
+
+// ParsePrivateKey returns a signer for a PEM encoded private key. The
+// format is detected from the PEM block type: PKCS#8 ("PRIVATE KEY"),
+// SEC 1 ("EC PRIVATE KEY"), PKCS#1 ("RSA PRIVATE KEY") or OpenSSH
+// ("OPENSSH PRIVATE KEY"). ECDSA keys must be over the P-256 curve.
+func ParsePrivateKey(data []byte) (Signer, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		key, err = ssh.ParseRawPrivateKey(data)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var signer Signer
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		signer, err = newECDSASigner(k)
+	case *rsa.PrivateKey:
+		signer, err = newRSAPSSSigner(k)
+	case *ed25519.PrivateKey:
+		signer = &Ed25519Signer{*k, k.Public().(ed25519.PublicKey)}
+	case interface{ Seed() []byte }:
+		// ed25519 keys of the standard library, from PKCS#8
+		privateKey := ed25519.NewKeyFromSeed(k.Seed())
+		signer = &Ed25519Signer{privateKey, privateKey.Public().(ed25519.PublicKey)}
+	default:
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	message := []byte("test message")
+	sig, err := signer.Sign(message)
+	if err != nil {
+		return nil, err
+	}
+	if result, _ := signer.Verify(message, sig); !result {
+		return nil, errors.New("key is unusable")
+	}
+
+	return signer, nil
+
+}
+
+// NewVerifierFromFile loads a public key from a file and returns a
+// verifier for its algorithm. See ParsePublicKey for the supported
+// formats.
+func NewVerifierFromFile(publicKeyPath string) (Verifier, error) {
+	data, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(data)
+}
+
+// NewKeySetFromFiles loads the public keys of the given files, in any
+// of the formats of ParsePublicKey, into a key set.
+func NewKeySetFromFiles(publicKeyPaths []string) (*KeySet, error) {
+	keys := &KeySet{}
+	for _, path := range publicKeyPaths {
+		verifier, err := NewVerifierFromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys.Keys = append(keys.Keys, &KeyInfo{
+			KeyId:     verifier.KeyID(),
+			Algorithm: verifier.Algorithm(),
+			PublicKey: verifier.PublicKey(),
+		})
+	}
+	return keys, nil
+}
+
+// ParsePublicKey returns a verifier for a public key, either PEM encoded
+// in the PKIX form ("PUBLIC KEY") or in the OpenSSH authorized_keys
+// format, as in the .pub files of ssh-keygen.
+func ParsePublicKey(data []byte) (Verifier, error) {
+
+	var key interface{}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unsupported public key type %q", block.Type)
+		}
+		if len(block.Bytes) == len(ed25519SPKIPrefix)+ed25519.PublicKeySize && bytes.HasPrefix(block.Bytes, ed25519SPKIPrefix) {
+			return NewEd25519Verifier(block.Bytes[len(ed25519SPKIPrefix):])
+		}
+		var err error
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		cryptoPublicKey, ok := pk.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errors.New("unsupported public key")
+		}
+		key = cryptoPublicKey.CryptoPublicKey()
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return newECDSAVerifier(k)
+	case *rsa.PublicKey:
+		return newRSAPSSVerifier(k)
+	case ed25519.PublicKey:
+		return NewEd25519Verifier(k)
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", key)
+	}
+
+}
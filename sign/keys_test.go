@@ -0,0 +1,163 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	sec1, err := x509.MarshalECPrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+	ecdsaPKCS8, err := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	assert.NoError(t, err)
+	// PKCS#8 wrapping of the ed25519 seed, RFC 8410
+	ed25519PKCS8 := append([]byte{0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x04, 0x22, 0x04, 0x20}, ed25519Key.Seed()...)
+
+	testCases := []struct {
+		blockType string
+		der       []byte
+		algorithm string
+	}{
+		{"EC PRIVATE KEY", sec1, ECDSAP256SHA256},
+		{"PRIVATE KEY", ecdsaPKCS8, ECDSAP256SHA256},
+		{"RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), RSAPSSSHA256},
+		{"PRIVATE KEY", rsaPKCS8, RSAPSSSHA256},
+		{"PRIVATE KEY", ed25519PKCS8, Ed25519},
+	}
+
+	for i, c := range testCases {
+		signer, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: c.blockType, Bytes: c.der}))
+		assert.NoErrorf(t, err, "The key should be parsed for case %d", i)
+		assert.Equalf(t, c.algorithm, signer.Algorithm(), "The algorithm should match for case %d", i)
+		testSign(t, signer)
+	}
+
+	dir, err := ioutil.TempDir("", "qed-keys-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyID := writeEd25519PrivateKey(t, filepath.Join(dir, "openssh"))
+	signer, err := NewSignerFromFile(filepath.Join(dir, "openssh"))
+	assert.NoError(t, err, "OpenSSH keys should be loaded")
+	assert.Equal(t, keyID, signer.KeyID())
+
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "DSA PRIVATE KEY", Bytes: []byte{0x00}}))
+	assert.Error(t, err, "Unsupported keys should be rejected")
+	_, err = ParsePrivateKey([]byte("not a key"))
+	assert.Error(t, err, "Data without keys should be rejected")
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	p384, err := x509.MarshalECPrivateKey(p384Key)
+	assert.NoError(t, err)
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p384}))
+	assert.Error(t, err, "ECDSA keys over other curves should be rejected")
+
+}
+
+func TestParsePublicKey(t *testing.T) {
+
+	rsaSigner, err := NewRSAPSSSigner(2048)
+	assert.NoError(t, err)
+	ed25519Signer := NewEd25519Signer()
+
+	for _, signer := range []Signer{ed25519Signer, NewECDSASigner(), rsaSigner} {
+
+		der := signer.PublicKey()
+		if signer.Algorithm() == Ed25519 {
+			der = append(append([]byte{}, ed25519SPKIPrefix...), der...)
+		}
+		verifier, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		assert.NoError(t, err, "PEM keys should be parsed for %s", signer.Algorithm())
+		assert.Equal(t, signer.KeyID(), verifier.KeyID(), "The key ids must match for %s", signer.Algorithm())
+		assert.Equal(t, signer.Algorithm(), verifier.Algorithm())
+
+	}
+
+	sshKey, err := ssh.NewPublicKey(ed25519.PublicKey(ed25519Signer.PublicKey()))
+	assert.NoError(t, err)
+	verifier, err := ParsePublicKey(ssh.MarshalAuthorizedKey(sshKey))
+	assert.NoError(t, err, "OpenSSH keys should be parsed")
+	assert.Equal(t, ed25519Signer.KeyID(), verifier.KeyID())
+
+	sshKey, err = ssh.NewPublicKey(&rsaSigner.(*RSAPSSSigner).privateKey.PublicKey)
+	assert.NoError(t, err)
+	verifier, err = ParsePublicKey(ssh.MarshalAuthorizedKey(sshKey))
+	assert.NoError(t, err, "OpenSSH RSA keys should be parsed")
+	assert.Equal(t, rsaSigner.KeyID(), verifier.KeyID())
+
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0x00}}))
+	assert.Error(t, err, "Unsupported keys should be rejected")
+
+}
+
+func TestNewKeySetFromFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-keys-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	signers := []Signer{NewEd25519Signer(), NewECDSASigner()}
+	var paths []string
+	for i, signer := range signers {
+		der := signer.PublicKey()
+		if signer.Algorithm() == Ed25519 {
+			der = append(append([]byte{}, ed25519SPKIPrefix...), der...)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("key%d.pub", i))
+		err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+		assert.NoError(t, err)
+		paths = append(paths, path)
+	}
+
+	keys, err := NewKeySetFromFiles(paths)
+	assert.NoError(t, err, "The keys should be loaded")
+	assert.Len(t, keys.Keys, len(signers))
+	for i, signer := range signers {
+		assert.Equal(t, signer.KeyID(), keys.Keys[i].KeyId, "The keys should keep the order of the files")
+		assert.Equal(t, signer.Algorithm(), keys.Keys[i].Algorithm)
+		assert.Equal(t, signer.PublicKey(), keys.Keys[i].PublicKey)
+	}
+
+	_, err = NewKeySetFromFiles(append(paths, filepath.Join(dir, "missing.pub")))
+	assert.Error(t, err, "Missing files should fail")
+
+}
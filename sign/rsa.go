@@ -0,0 +1,107 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// minRSAKeyBits is the smallest RSA key size accepted.
+const minRSAKeyBits = 2048
+
+// pssOptions salts the signatures with as many bytes as the digest.
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+// RSAPSSSigner signs with RSASSA-PSS and SHA-256 digests.
+type RSAPSSSigner struct {
+	RSAPSSVerifier
+	privateKey *rsa.PrivateKey
+}
+
+func NewRSAPSSSigner(bits int) (Signer, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return newRSAPSSSigner(privateKey)
+}
+
+func newRSAPSSSigner(privateKey *rsa.PrivateKey) (*RSAPSSSigner, error) {
+	verifier, err := newRSAPSSVerifier(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &RSAPSSSigner{*verifier, privateKey}, nil
+}
+
+func (s *RSAPSSSigner) Sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return rsa.SignPSS(rand.Reader, s.privateKey, crypto.SHA256, digest[:], pssOptions)
+}
+
+type RSAPSSVerifier struct {
+	publicKey *rsa.PublicKey
+	encoded   []byte
+}
+
+// NewRSAPSSVerifier returns a verifier for an RSA public key in the PKIX,
+// ASN.1 DER form.
+func NewRSAPSSVerifier(publicKey []byte) (Verifier, error) {
+	pk, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	rsaPublicKey, ok := pk.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+	return newRSAPSSVerifier(rsaPublicKey)
+}
+
+func newRSAPSSVerifier(publicKey *rsa.PublicKey) (*RSAPSSVerifier, error) {
+	if publicKey.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA keys must have at least %d bits", minRSAKeyBits)
+	}
+	encoded, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &RSAPSSVerifier{publicKey, encoded}, nil
+}
+
+func (v *RSAPSSVerifier) PublicKey() []byte {
+	return v.encoded
+}
+
+func (v *RSAPSSVerifier) Algorithm() string {
+	return RSAPSSSHA256
+}
+
+func (v *RSAPSSVerifier) KeyID() string {
+	return KeyID(v.encoded)
+}
+
+func (v *RSAPSSVerifier) Verify(message, sig []byte) (bool, error) {
+	digest := sha256.Sum256(message)
+	return rsa.VerifyPSS(v.publicKey, crypto.SHA256, digest[:], sig, pssOptions) == nil, nil
+}
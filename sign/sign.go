@@ -18,7 +18,10 @@ package sign
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 
 	"golang.org/x/crypto/ed25519"
@@ -27,7 +30,52 @@ import (
 
 type Signer interface {
 	Sign(message []byte) ([]byte, error)
+	Verifier
+}
+
+// Verifier checks signatures made by a Signer using only its public key.
+type Verifier interface {
 	Verify(message, sig []byte) (bool, error)
+	// KeyID identifies the key of the signer, see KeyID.
+	KeyID() string
+	// Algorithm is the signature algorithm of the key.
+	Algorithm() string
+	// PublicKey returns the public key, as given to NewVerifier.
+	PublicKey() []byte
+}
+
+// Identifiers of the signature algorithms.
+const (
+	Ed25519          = "ed25519"
+	ECDSAP256SHA256  = "ecdsa-p256-sha256"
+	RSAPSSSHA256     = "rsa-pss-sha256"
+	DefaultAlgorithm = Ed25519
+)
+
+// NewVerifier returns a verifier for a public key of the given signature
+// algorithm. Ed25519 keys are raw, ECDSA and RSA keys are in the PKIX, ASN.1
+// DER form. An empty algorithm refers to the default one.
+func NewVerifier(algorithm string, publicKey []byte) (Verifier, error) {
+	if algorithm == "" {
+		algorithm = DefaultAlgorithm
+	}
+	switch algorithm {
+	case Ed25519:
+		return NewEd25519Verifier(publicKey)
+	case ECDSAP256SHA256:
+		return NewECDSAVerifier(publicKey)
+	case RSAPSSSHA256:
+		return NewRSAPSSVerifier(publicKey)
+	default:
+		return nil, fmt.Errorf("unknown signature algorithm %q", algorithm)
+	}
+}
+
+// KeyID returns the identifier of a public key: the first 8 bytes of
+// its sha256 digest, hex encoded.
+func KeyID(publicKey []byte) string {
+	digest := sha256.Sum256(publicKey)
+	return hex.EncodeToString(digest[:8])
 }
 
 type Ed25519Signer struct {
@@ -57,10 +105,14 @@ func NewEd25519SignerFromFile(privateKeyPath string) (Signer, error) {
 	}
 
 	pk, err := ssh.ParseRawPrivateKey(privateKeyBytes)
-	privateKey := *pk.(*ed25519.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
+	edPrivateKey, ok := pk.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not ed25519")
+	}
+	privateKey := *edPrivateKey
 
 	signer := &Ed25519Signer{
 		privateKey,
@@ -78,6 +130,20 @@ func NewEd25519SignerFromFile(privateKeyPath string) (Signer, error) {
 
 }
 
+// PublicKey returns the raw public key of the signer, the one to give to
+// NewEd25519Verifier to check its signatures.
+func (s *Ed25519Signer) PublicKey() []byte {
+	return []byte(s.publicKey)
+}
+
+func (s *Ed25519Signer) Algorithm() string {
+	return Ed25519
+}
+
+func (s *Ed25519Signer) KeyID() string {
+	return KeyID(s.publicKey)
+}
+
 func (s *Ed25519Signer) Sign(message []byte) ([]byte, error) {
 	return ed25519.Sign(s.privateKey, message), nil
 }
@@ -85,3 +151,32 @@ func (s *Ed25519Signer) Sign(message []byte) ([]byte, error) {
 func (s *Ed25519Signer) Verify(message, sig []byte) (bool, error) {
 	return ed25519.Verify(s.publicKey, message, sig), nil
 }
+
+type Ed25519Verifier struct {
+	publicKey ed25519.PublicKey
+}
+
+// NewEd25519Verifier returns a verifier for the given raw ed25519
+// public key.
+func NewEd25519Verifier(publicKey []byte) (Verifier, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key size %d", len(publicKey))
+	}
+	return &Ed25519Verifier{ed25519.PublicKey(publicKey)}, nil
+}
+
+func (v *Ed25519Verifier) PublicKey() []byte {
+	return []byte(v.publicKey)
+}
+
+func (v *Ed25519Verifier) Algorithm() string {
+	return Ed25519
+}
+
+func (v *Ed25519Verifier) KeyID() string {
+	return KeyID(v.publicKey)
+}
+
+func (v *Ed25519Verifier) Verify(message, sig []byte) (bool, error) {
+	return ed25519.Verify(v.publicKey, message, sig), nil
+}
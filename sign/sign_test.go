@@ -35,6 +35,65 @@ func testSign(t *testing.T, signer Signer) {
 }
 func TestEdSign(t *testing.T) { testSign(t, NewEd25519Signer()) }
 
+func TestECDSASign(t *testing.T) { testSign(t, NewECDSASigner()) }
+
+func TestRSAPSSSign(t *testing.T) {
+	signer, err := NewRSAPSSSigner(2048)
+	assert.NoError(t, err)
+	testSign(t, signer)
+
+	_, err = NewRSAPSSSigner(1024)
+	assert.Error(t, err, "Short RSA keys should be rejected")
+}
+
+func TestNewVerifier(t *testing.T) {
+
+	rsaSigner, err := NewRSAPSSSigner(2048)
+	assert.NoError(t, err)
+
+	message := []byte("send reinforcements, we're going to advance")
+	for _, signer := range []Signer{NewEd25519Signer(), NewECDSASigner(), rsaSigner} {
+		sig, _ := signer.Sign(message)
+
+		verifier, err := NewVerifier(signer.Algorithm(), signer.PublicKey())
+		assert.NoError(t, err)
+		assert.Equal(t, signer.KeyID(), verifier.KeyID(), "The key ids must match for %s", signer.Algorithm())
+
+		result, _ := verifier.Verify(message, sig)
+		assert.True(t, result, "Must be verified for %s", signer.Algorithm())
+		result, _ = verifier.Verify([]byte("send three and fourpence, we're going to a dance"), sig)
+		assert.False(t, result, "Must not be verified for %s", signer.Algorithm())
+	}
+
+	_, err = NewVerifier(ECDSAP256SHA256, rsaSigner.PublicKey())
+	assert.Error(t, err, "The key must be of the algorithm")
+	_, err = NewVerifier("unknown", rsaSigner.PublicKey())
+	assert.Error(t, err)
+
+}
+
+func TestEdVerifier(t *testing.T) {
+
+	signer := NewEd25519Signer().(*Ed25519Signer)
+	message := []byte("send reinforcements, we're going to advance")
+	sig, _ := signer.Sign(message)
+
+	verifier, err := NewEd25519Verifier(signer.PublicKey())
+	assert.NoError(t, err)
+	assert.Equal(t, signer.KeyID(), verifier.KeyID(), "The key ids must match")
+	assert.Len(t, verifier.KeyID(), 16)
+
+	result, _ := verifier.Verify(message, sig)
+	assert.True(t, result, "Must be verified")
+
+	result, _ = verifier.Verify([]byte("send three and fourpence, we're going to a dance"), sig)
+	assert.False(t, result, "Must not be verified")
+
+	_, err = NewEd25519Verifier([]byte("short"))
+	assert.Error(t, err)
+
+}
+
 func syncBenchmark(b *testing.B, signer Signer, iterations int) {
 
 	b.N = iterations
@@ -0,0 +1,449 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshotstore
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+)
+
+// NextVersionHeader is set on the pages of snapshots which do not reach
+// the end of the requested range, to the version the next page starts at.
+const NextVersionHeader = "X-Next-Version"
+
+// APIKeyHeader carries the key which authorizes the requests that write
+// or delete snapshots.
+const APIKeyHeader = "Api-Key"
+
+// PostBatch stores a batch of snapshots:
+//
+//	POST /batch
+//
+// The body is an encoded protocol.BatchSnapshots. If everything is
+// alright, the HTTP status is 204 and there is no body. The snapshots of
+// other logs than the default one are skipped. If a snapshot conflicts
+// with the stored one of the same version, the rest are stored and the
+// HTTP status is 409. If a snapshot is not signed by a trusted key, the
+// HTTP status is 400.
+func PostBatch(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var batch protocol.BatchSnapshots
+		if err := batch.Decode(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(batch.Snapshots) == 0 {
+			http.Error(w, "Empty batch received", http.StatusBadRequest)
+			return
+		}
+
+		err = store.PutBatch(&batch)
+		if err == ErrUntrustedSnapshot {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == ErrSnapshotConflict {
+			log.Infof("Batch with conflicting snapshots received")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Infof("Unable to store batch: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	}
+}
+
+// Snapshot reads or writes a single snapshot:
+//
+//	GET /snapshot?v={version}
+//	GET /snapshot?signature={hex encoded signature}
+//	POST /snapshot?v={version}
+//
+// GET returns the encoded protocol.SignedSnapshot, or a 404 status if
+// there is none. POST stores the encoded protocol.SignedSnapshot of the
+// body under the version, answering with a 204 status, a 400 if it is a
+// snapshot of another version or log or is not signed by a trusted key,
+// or a 409 if the store has another snapshot of the version.
+func Snapshot(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		q := r.URL.Query()
+		switch r.Method {
+		case "GET":
+			var snapshot *protocol.SignedSnapshot
+			var err error
+			if q.Get("signature") != "" {
+				signature, decodeErr := hex.DecodeString(q.Get("signature"))
+				if decodeErr != nil {
+					http.Error(w, "Invalid signature: "+decodeErr.Error(), http.StatusBadRequest)
+					return
+				}
+				snapshot, err = store.GetSnapshotBySignature(signature)
+			} else {
+				version, parseErr := parseVersion(q.Get("v"))
+				if parseErr != nil {
+					http.Error(w, parseErr.Error(), http.StatusBadRequest)
+					return
+				}
+				snapshot, err = store.GetSnapshot(version)
+			}
+			if err == ErrSnapshotNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			out, err := snapshot.Encode()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(out)
+
+		case "POST":
+			version, err := parseVersion(q.Get("v"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			buf, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var snapshot protocol.SignedSnapshot
+			if err := snapshot.Decode(buf); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if snapshot.Snapshot == nil || snapshot.Snapshot.Version != version || snapshot.Snapshot.LogId != "" {
+				http.Error(w, "Snapshot of the default log and the given version expected", http.StatusBadRequest)
+				return
+			}
+			err = store.PutSnapshot(version, &snapshot)
+			if err == ErrUntrustedSnapshot {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err == ErrSnapshotConflict {
+				log.Infof("Conflicting snapshot %d received", version)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	}
+}
+
+// Snapshots reads or deletes the snapshots of a range of versions:
+//
+//	GET /snapshots?start={version}&end={version}&limit={n}
+//	DELETE /snapshots?start={version}&end={version}
+//
+// Both ends of the range are inclusive. The end defaults to the last
+// version. GET returns a page of up to limit snapshots, never more than
+// pageSize, as an encoded protocol.BatchSnapshots sorted by version. If
+// the page does not reach the end of the range, the NextVersionHeader
+// tells where the next one starts. DELETE answers with a 204 status.
+func Snapshots(store *Store, pageSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" && r.Method != "DELETE" {
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		start, err := parseVersion(q.Get("start"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end := uint64(math.MaxUint64)
+		if q.Get("end") != "" {
+			end, err = parseVersion(q.Get("end"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if start > end {
+			http.Error(w, "The start of the range is after its end", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			if err := store.DeleteRange(start, end); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		limit := pageSize
+		if q.Get("limit") != "" {
+			limit, err = strconv.Atoi(q.Get("limit"))
+			if err != nil || limit <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			if limit > pageSize {
+				limit = pageSize
+			}
+		}
+
+		page, next, more, err := store.GetPage(start, end, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		batch := protocol.BatchSnapshots{Snapshots: make([]*protocol.SignedSnapshot, len(page))}
+		for i := range page {
+			batch.Snapshots[i] = &page[i]
+		}
+		out, err := batch.Encode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if more {
+			w.Header().Set(NextVersionHeader, strconv.FormatUint(next, 10))
+		}
+		w.Write(out)
+
+	}
+}
+
+// Cosignatures reads or writes the cosignatures of a snapshot:
+//
+//	GET /cosignatures?v={version}
+//	POST /cosignatures
+//
+// GET returns the encoded protocol.CosignedSnapshot of the version, or a
+// 404 status if there is no snapshot. POST stores the cosignatures of the
+// encoded protocol.CosignedSnapshot of the body, answering with a 204
+// status, a 400 if the snapshot is not signed by a trusted key, or a 409
+// if the store has another snapshot for its version.
+func Cosignatures(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.Method {
+		case "GET":
+			version, err := parseVersion(r.URL.Query().Get("v"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cosigned, err := store.GetCosignatures(version)
+			if err == ErrSnapshotNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			out, err := cosigned.Encode()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(out)
+
+		case "POST":
+			buf, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var cosigned protocol.CosignedSnapshot
+			if err := cosigned.Decode(buf); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if cosigned.Snapshot == nil || cosigned.Snapshot.Snapshot == nil || cosigned.Snapshot.Snapshot.LogId != "" {
+				http.Error(w, "Cosignatures of a snapshot of the default log expected", http.StatusBadRequest)
+				return
+			}
+			err = store.PutCosignatures(&cosigned)
+			if err == ErrUntrustedSnapshot {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err == ErrSnapshotConflict {
+				log.Infof("Cosignatures of a conflicting snapshot %d received", cosigned.Snapshot.Snapshot.Version)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	}
+}
+
+// Count returns the number of snapshots in the store as a decimal number:
+//
+//	GET /count
+func Count(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		count, err := store.Count()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(strconv.FormatUint(count, 10)))
+
+	}
+}
+
+// Latest returns the encoded protocol.SignedSnapshot with the greatest
+// version, or a 404 status if the store is empty:
+//
+//	GET /latest
+func Latest(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshot, err := store.Latest()
+		if err == ErrSnapshotNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out, err := snapshot.Encode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(out)
+
+	}
+}
+
+// AuthWritesMiddleware is an HTTP handler wrapper which only lets the
+// requests that write or delete snapshots through if their APIKeyHeader
+// is the given key. Reads need no key. Without a key, every write is
+// rejected.
+//
+// If the key does not match it will raise a `http.StatusUnauthorized`
+// error.
+func AuthWritesMiddleware(apiKey string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			key := r.Header.Get(APIKeyHeader)
+			if apiKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+				http.Error(w, "Missing or invalid Api-Key header", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// NewSnapshotStoreHTTP returns a new *http.ServeMux with the handlers of
+// the snapshot store. The handlers which write or delete snapshots need
+// the given API key.
+//
+//	/batch -> PostBatch
+//	/snapshot -> Snapshot
+//	/snapshots -> Snapshots
+//	/cosignatures -> Cosignatures
+//	/count -> Count
+//	/latest -> Latest
+func NewSnapshotStoreHTTP(store *Store, pageSize int, apiKey string) *http.ServeMux {
+	api := http.NewServeMux()
+	api.HandleFunc("/batch", AuthWritesMiddleware(apiKey, PostBatch(store)))
+	api.HandleFunc("/snapshot", AuthWritesMiddleware(apiKey, Snapshot(store)))
+	api.HandleFunc("/snapshots", AuthWritesMiddleware(apiKey, Snapshots(store, pageSize)))
+	api.HandleFunc("/cosignatures", AuthWritesMiddleware(apiKey, Cosignatures(store)))
+	api.HandleFunc("/count", Count(store))
+	api.HandleFunc("/latest", Latest(store))
+	return api
+}
+
+func parseVersion(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Missing version")
+	}
+	version, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid version %q", s)
+	}
+	return version, nil
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshotstore_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/snapshotstore"
+	"github.com/bbva/qed/storage/bplus"
+)
+
+var (
+	_ gossip.SnapshotStore    = (*snapshotstore.Store)(nil)
+	_ gossip.CosignatureStore = (*snapshotstore.Store)(nil)
+	_ gossip.CosignatureStore = (*gossip.RestSnapshotStore)(nil)
+)
+
+func TestRestSnapshotStore(t *testing.T) {
+	store, err := snapshotstore.NewStore(bplus.NewBPlusTreeStore())
+	require.NoError(t, err)
+	defer store.Close()
+
+	server := httptest.NewServer(snapshotstore.NewSnapshotStoreHTTP(store, 3, "my-key"))
+	defer server.Close()
+	conf := gossip.DefaultRestSnapshotStoreConfig()
+	conf.Endpoint = []string{server.URL}
+	conf.DialTimeout, conf.ReadTimeout = time.Second, time.Second
+	conf.APIKey = "my-key"
+	client := gossip.NewRestSnapshotStoreFromConfig(conf)
+
+	batch := &protocol.BatchSnapshots{}
+	for v := uint64(1); v <= 10; v++ {
+		batch.Snapshots = append(batch.Snapshots, &protocol.SignedSnapshot{
+			Snapshot:  &protocol.Snapshot{Version: v},
+			Signature: []byte{0xa, byte(v)},
+		})
+	}
+	require.NoError(t, client.PutBatch(batch))
+	require.NoError(t, client.PutSnapshot(20, &protocol.SignedSnapshot{
+		Snapshot:  &protocol.Snapshot{Version: 20},
+		Signature: []byte{0xa, 20},
+	}))
+
+	count, err := client.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), count)
+
+	latest, err := client.Latest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), latest.Snapshot.Version)
+
+	s, err := client.GetSnapshot(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), s.Snapshot.Version)
+	_, err = client.GetSnapshot(15)
+	require.Error(t, err, "Missing versions should not be found")
+
+	s, err = client.GetSnapshotBySignature([]byte{0xa, 20})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), s.Snapshot.Version)
+
+	// the range is read in pages of three snapshots
+	snapshots, err := client.GetRange(2, 20)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 10)
+	for i, v := range []uint64{2, 3, 4, 5, 6, 7, 8, 9, 10, 20} {
+		require.Equal(t, v, snapshots[i].Snapshot.Version)
+	}
+
+	require.NoError(t, client.DeleteRange(5, math.MaxUint64))
+	snapshots, err = client.GetRange(0, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 4)
+
+	require.NoError(t, client.DeleteRange(0, math.MaxUint64))
+	_, err = client.Latest()
+	require.Equal(t, snapshotstore.ErrSnapshotNotFound, err, "An empty store has no latest snapshot")
+	require.NoError(t, client.PutBatch(batch))
+
+	require.Error(t, client.PutBatch(&protocol.BatchSnapshots{}), "Empty batches should be rejected")
+	require.Error(t, client.PutSnapshot(4, &protocol.SignedSnapshot{
+		Snapshot:  &protocol.Snapshot{Version: 4},
+		Signature: []byte{0xb, 4},
+	}), "Conflicting snapshots should be rejected")
+	require.Error(t, client.PutSnapshot(4, &protocol.SignedSnapshot{
+		Snapshot:  &protocol.Snapshot{Version: 4, LogId: "other"},
+		Signature: []byte{0xb, 4},
+	}), "Snapshots of other logs should be rejected")
+	s, err = client.GetSnapshot(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xa, 4}, s.Signature, "Stored snapshots should not be replaced")
+
+	cosigned := &protocol.CosignedSnapshot{
+		Snapshot:     &protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: 30}, Signature: []byte{0xa, 30}},
+		Cosignatures: []*protocol.Cosignature{{Witness: "witness0", KeyId: "0a", Signature: []byte{0x1}}},
+	}
+	require.NoError(t, client.PutCosignatures(cosigned))
+	stored, err := client.GetCosignatures(30)
+	require.NoError(t, err)
+	require.Equal(t, cosigned, stored)
+	cosigned.Snapshot.Signature = []byte{0xb}
+	require.Error(t, client.PutCosignatures(cosigned), "Cosignatures of another snapshot should be rejected")
+	_, err = client.GetCosignatures(31)
+	require.Error(t, err, "Missing versions should not be found")
+
+	anonymous := gossip.NewRestSnapshotStore([]string{server.URL}, time.Second, time.Second)
+	require.Error(t, anonymous.PutSnapshot(40, &protocol.SignedSnapshot{
+		Snapshot:  &protocol.Snapshot{Version: 40},
+		Signature: []byte{0xa, 40},
+	}), "Writes without the api key should be rejected")
+	require.Error(t, anonymous.DeleteRange(0, math.MaxUint64), "Deletes without the api key should be rejected")
+	count, err = anonymous.Count()
+	require.NoError(t, err, "Reads should not need the api key")
+	require.Equal(t, uint64(11), count)
+
+}
+
+func TestSnapshotStoreHTTP(t *testing.T) {
+	store, err := snapshotstore.NewStore(bplus.NewBPlusTreeStore())
+	require.NoError(t, err)
+	defer store.Close()
+	api := snapshotstore.NewSnapshotStoreHTTP(store, 2, "my-key")
+
+	for v := uint64(1); v <= 3; v++ {
+		require.NoError(t, store.PutSnapshot(v, &protocol.SignedSnapshot{Snapshot: &protocol.Snapshot{Version: v}}))
+	}
+
+	testCases := []struct {
+		method, url, apiKey string
+		status              int
+		next                string
+	}{
+		{"GET", "/snapshots?start=1", "my-key", http.StatusOK, "3"},
+		{"GET", "/snapshots?start=1&limit=10", "my-key", http.StatusOK, "3"},
+		{"GET", "/snapshots?start=1&limit=3&end=2", "my-key", http.StatusOK, ""},
+		{"GET", "/snapshots?start=3&end=1", "my-key", http.StatusBadRequest, ""},
+		{"GET", "/snapshots", "my-key", http.StatusBadRequest, ""},
+		{"GET", "/snapshots?start=1&limit=0", "my-key", http.StatusBadRequest, ""},
+		{"GET", "/snapshot?v=x", "my-key", http.StatusBadRequest, ""},
+		{"GET", "/snapshot?signature=zz", "my-key", http.StatusBadRequest, ""},
+		{"GET", "/snapshot?v=9", "my-key", http.StatusNotFound, ""},
+		{"PUT", "/snapshot?v=1", "my-key", http.StatusMethodNotAllowed, ""},
+		{"GET", "/batch", "my-key", http.StatusMethodNotAllowed, ""},
+		{"GET", "/cosignatures?v=1", "my-key", http.StatusOK, ""},
+		{"GET", "/cosignatures?v=9", "my-key", http.StatusNotFound, ""},
+		{"POST", "/cosignatures", "my-key", http.StatusBadRequest, ""},
+		{"PUT", "/cosignatures", "my-key", http.StatusMethodNotAllowed, ""},
+		{"GET", "/snapshot?v=1", "", http.StatusOK, ""},
+		{"POST", "/batch", "", http.StatusUnauthorized, ""},
+		{"POST", "/snapshot?v=4", "other-key", http.StatusUnauthorized, ""},
+		{"DELETE", "/snapshots?start=1", "", http.StatusUnauthorized, ""},
+		{"POST", "/cosignatures", "", http.StatusUnauthorized, ""},
+	}
+
+	for i, c := range testCases {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		req.Header.Set(snapshotstore.APIKeyHeader, c.apiKey)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		require.Equalf(t, c.status, rec.Code, "Wrong status for case %d", i)
+		require.Equalf(t, c.next, rec.Header().Get(snapshotstore.NextVersionHeader), "Wrong next version for case %d", i)
+	}
+
+}
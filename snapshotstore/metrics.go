@@ -0,0 +1,108 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshotstore
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bbva/qed/metrics"
+)
+
+// namespace is the leading part of all published metrics.
+const namespace = "qed"
+
+// subsystem associated with metrics for the snapshot store
+const subsystem = "snapshot_store"
+
+type storeMetrics struct {
+	Instances prometheus.Gauge
+	Snapshots prometheus.GaugeFunc
+	Requests  *prometheus.CounterVec
+}
+
+func newStoreMetrics(store *Store) *storeMetrics {
+	return &storeMetrics{
+		Instances: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "instances",
+				Help:      "Number of snapshot stores currently running",
+			},
+		),
+		Snapshots: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "snapshots",
+				Help:      "Number of snapshots in the store",
+			},
+			func() float64 {
+				count, _ := store.Count()
+				return float64(count)
+			},
+		),
+		Requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "requests_total",
+				Help:      "Number of requests served by handler, method and status code",
+			},
+			[]string{"handler", "method", "code"},
+		),
+	}
+}
+
+// collectors satisfies the prom.PrometheusCollector interface.
+func (m *storeMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.Instances,
+		m.Snapshots,
+		m.Requests,
+	}
+}
+
+// RegisterMetrics registers the metrics of the service.
+func (m *storeMetrics) RegisterMetrics(registry metrics.Registry) {
+	if registry != nil {
+		registry.MustRegister(m.collectors()...)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts the requests served by the handlers of mux.
+func (m *storeMetrics) instrument(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r)
+		_, pattern := mux.Handler(r)
+		m.Requests.WithLabelValues(pattern, r.Method, strconv.Itoa(sw.status)).Inc()
+	}
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshotstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/sign"
+	"github.com/bbva/qed/storage"
+)
+
+// Config of the snapshot store service.
+type Config struct {
+	// Log level
+	Log string `desc:"Set log level to info, error or debug"`
+
+	// REST API bind address/port.
+	HTTPAddr string `desc:"Snapshot store REST API bind address/port"`
+
+	// Metrics bind address/port.
+	MetricsAddr string `desc:"Bind address/port to expose metrics on"`
+
+	// Path to storage directory.
+	DBPath string `desc:"Path to the directory of the snapshots database"`
+
+	// Maximum number of snapshots returned in a page of a range read.
+	PageSize int `desc:"Maximum number of snapshots in a page of a range read"`
+
+	// Key the agents send to write or delete snapshots.
+	APIKey string `desc:"Key required in the Api-Key header to write or delete snapshots"`
+
+	// Public keys of the servers whose snapshots are stored.
+	TrustedKeys []string `desc:"Paths to the public keys of the QED servers whose snapshots are stored"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Log:         "info",
+		HTTPAddr:    "127.0.0.1:8888",
+		MetricsAddr: "127.0.0.1:18888",
+		DBPath:      "/var/tmp/qed/snapshots",
+		PageSize:    1000,
+	}
+}
+
+// Service serves a snapshot store kept in a database.
+type Service struct {
+	conf          *Config
+	store         *Store
+	metrics       *storeMetrics
+	metricsServer *metrics.Server
+	httpServer    *http.Server
+}
+
+// NewService serves the snapshot store kept in the given database, which
+// is closed along with the service. The database is opened by the caller,
+// so the package does not depend on any storage engine. Only the
+// snapshots signed by the trusted keys are stored, and writes need the
+// API key of the configuration. The service does not listen until it is
+// started.
+func NewService(conf *Config, db storage.ManagedStore) (*Service, error) {
+	if conf.APIKey == "" {
+		db.Close()
+		return nil, errors.New("the snapshot store needs an api key to authorize writes")
+	}
+	keys, err := sign.NewKeySetFromFiles(conf.TrustedKeys)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to load trusted key %v", err)
+	}
+	store, err := NewVerifyingStore(db, keys)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Service{
+		conf:          conf,
+		store:         store,
+		metrics:       newStoreMetrics(store),
+		metricsServer: metrics.NewServer(conf.MetricsAddr),
+	}
+	s.metrics.RegisterMetrics(s.metricsServer)
+	db.RegisterMetrics(s.metricsServer)
+
+	api := NewSnapshotStoreHTTP(store, conf.PageSize, conf.APIKey)
+	s.httpServer = &http.Server{
+		Addr:         conf.HTTPAddr,
+		Handler:      s.metrics.instrument(api),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
+	return s, nil
+}
+
+func (s *Service) Start() {
+	s.metrics.Instances.Inc()
+	log.Infof("Starting snapshot store on %s", s.conf.HTTPAddr)
+
+	log.Debugf("	* Starting metrics HTTP server in addr: %s", s.conf.MetricsAddr)
+	s.metricsServer.Start()
+
+	go func() {
+		log.Debug("	* Starting snapshot store HTTP server in addr: ", s.conf.HTTPAddr)
+		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("Can't start snapshot store HTTP server: %s", err)
+		}
+	}()
+}
+
+// Shutdown stops serving requests and closes the database.
+func (s *Service) Shutdown() error {
+	s.metrics.Instances.Dec()
+	log.Infof("Shutting down snapshot store")
+
+	log.Debugf("Metrics enabled: stopping server...")
+	s.metricsServer.Shutdown()
+
+	log.Debugf("Stopping snapshot store HTTP server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	log.Debugf("Closing snapshots database...")
+	return s.store.Close()
+}
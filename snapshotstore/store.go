@@ -0,0 +1,470 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package snapshotstore implements the snapshot store service, which
+// keeps the snapshots published by the agents in a persistent store and
+// serves them to the auditors and monitors through a REST API.
+package snapshotstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
+)
+
+// ErrSnapshotNotFound is returned when the store has no snapshot for
+// the requested version or signature.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// ErrSnapshotConflict is returned when a snapshot, or the cosignatures
+// of a snapshot, are stored for a version the store already has another
+// snapshot of. The stored snapshot is never replaced, as two snapshots
+// of the same version are the evidence of an equivocation.
+var ErrSnapshotConflict = errors.New("the snapshot does not match the stored one")
+
+// ErrUnsupportedLog is returned when a snapshot of a log other than the
+// default one is stored, as snapshots are stored by version only.
+var ErrUnsupportedLog = errors.New("the store only keeps snapshots of the default log")
+
+// ErrUntrustedSnapshot is returned when a snapshot is not signed by one
+// of the trusted keys of a verifying store.
+var ErrUntrustedSnapshot = errors.New("the snapshot is not signed by a trusted key")
+
+// Store keeps signed snapshots by version in a storage engine, along
+// with an index of their signatures and the cosignatures of the
+// witnesses. It implements the SnapshotStore interface of the gossip
+// agents.
+type Store struct {
+	mu    sync.RWMutex
+	db    storage.Store
+	keys  *sign.KeySet
+	count uint64
+}
+
+// NewStore returns a snapshot store over the given storage engine,
+// counting the snapshots it already contains. The snapshots are stored
+// without verifying their signatures, as the local stores of the agents
+// only keep the snapshots the agents already verified.
+func NewStore(db storage.Store) (*Store, error) {
+	return newStore(db, nil)
+}
+
+// NewVerifyingStore is like NewStore, but it only stores the snapshots
+// signed by one of the trusted keys, failing with ErrUntrustedSnapshot
+// otherwise.
+func NewVerifyingStore(db storage.Store, keys *sign.KeySet) (*Store, error) {
+	if keys == nil || len(keys.Keys) == 0 {
+		return nil, errors.New("a verifying snapshot store needs trusted keys")
+	}
+	return newStore(db, keys)
+}
+
+func newStore(db storage.Store, keys *sign.KeySet) (*Store, error) {
+	s := &Store{db: db, keys: keys}
+	for start := uint64(0); ; {
+		kvs, next, more, err := s.scan(start, math.MaxUint64, 1000)
+		if err != nil {
+			return nil, err
+		}
+		s.count += uint64(len(kvs))
+		if !more {
+			break
+		}
+		start = next
+	}
+	return s, nil
+}
+
+// PutBatch stores every snapshot of the default log in the batch,
+// skipping the snapshots of other logs. The snapshots which conflict with
+// the stored ones are not stored, and ErrSnapshotConflict is returned
+// after storing the rest. An untrusted snapshot stops the batch with
+// ErrUntrustedSnapshot.
+func (s *Store) PutBatch(b *protocol.BatchSnapshots) error {
+	var conflict error
+	for _, snapshot := range b.Snapshots {
+		if snapshot == nil || snapshot.Snapshot == nil {
+			return errors.New("batch with an empty snapshot")
+		}
+		if snapshot.Snapshot.LogId != "" {
+			continue
+		}
+		err := s.PutSnapshot(snapshot.Snapshot.Version, snapshot)
+		if err == ErrSnapshotConflict {
+			conflict = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return conflict
+}
+
+// PutSnapshot stores a snapshot of the default log under its version.
+// Storing the same snapshot again does nothing, and storing another one
+// for the same version fails with ErrSnapshotConflict.
+func (s *Store) PutSnapshot(version uint64, snapshot *protocol.SignedSnapshot) error {
+	if snapshot.Snapshot == nil || snapshot.Snapshot.Version != version {
+		return fmt.Errorf("the snapshot is not of version %d", version)
+	}
+	if snapshot.Snapshot.LogId != "" {
+		return ErrUnsupportedLog
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(version, snapshot)
+}
+
+func (s *Store) put(version uint64, snapshot *protocol.SignedSnapshot) error {
+	if s.keys != nil {
+		if err := snapshot.VerifyKeySet(s.keys); err != nil {
+			log.Infof("Rejecting snapshot %d: %v", version, err)
+			return ErrUntrustedSnapshot
+		}
+	}
+	encoded, err := snapshot.Encode()
+	if err != nil {
+		return err
+	}
+	key := util.Uint64AsBytes(version)
+
+	previous, err := s.get(version)
+	switch {
+	case err == ErrSnapshotNotFound:
+	case err != nil:
+		return err
+	case bytes.Equal(previous.Signature, snapshot.Signature):
+	default:
+		return ErrSnapshotConflict
+	}
+
+	mutations := []*storage.Mutation{
+		storage.NewMutation(storage.SnapshotsTable, key, encoded),
+	}
+	if len(snapshot.Signature) > 0 {
+		mutations = append(mutations, storage.NewMutation(storage.SnapshotSignaturesTable, snapshot.Signature, key))
+	}
+	if err := s.db.Mutate(mutations); err != nil {
+		return err
+	}
+	if previous == nil {
+		s.count++
+	}
+	return nil
+}
+
+// PutCosignatures stores the cosignatures of a snapshot of the default
+// log, and the snapshot itself if the store does not have it. A witness
+// replaces its previous cosignature of the same version. It fails with
+// ErrSnapshotConflict if the store has another snapshot for the version.
+//
+// The cosignatures are not verified, as the store does not know the keys
+// of the witnesses.
+func (s *Store) PutCosignatures(c *protocol.CosignedSnapshot) error {
+	if c.Snapshot == nil || c.Snapshot.Snapshot == nil {
+		return errors.New("cosignatures without a snapshot")
+	}
+	if c.Snapshot.Snapshot.LogId != "" {
+		return ErrUnsupportedLog
+	}
+	version := c.Snapshot.Snapshot.Version
+
+	var mutations []*storage.Mutation
+	for _, cosignature := range c.Cosignatures {
+		if cosignature == nil {
+			continue
+		}
+		if _, err := hex.DecodeString(cosignature.KeyId); err != nil || cosignature.KeyId == "" {
+			return fmt.Errorf("invalid key id %q in a cosignature", cosignature.KeyId)
+		}
+		encoded, err := json.Marshal(cosignature)
+		if err != nil {
+			return err
+		}
+		key := append(util.Uint64AsBytes(version), cosignature.KeyId...)
+		mutations = append(mutations, storage.NewMutation(storage.CosignaturesTable, key, encoded))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, err := s.get(version)
+	switch {
+	case err == ErrSnapshotNotFound:
+		if err := s.put(version, c.Snapshot); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !bytes.Equal(previous.Signature, c.Snapshot.Signature):
+		return ErrSnapshotConflict
+	}
+	if len(mutations) == 0 {
+		return nil
+	}
+	return s.db.Mutate(mutations)
+}
+
+// GetCosignatures returns the snapshot of the given version along with
+// its cosignatures, which may be none.
+func (s *Store) GetCosignatures(version uint64) (*protocol.CosignedSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, err := s.get(version)
+	if err != nil {
+		return nil, err
+	}
+	start := util.Uint64AsBytes(version)
+	kvs, err := s.db.GetRange(storage.CosignaturesTable, start, append(start, 0xff))
+	if err != nil {
+		return nil, err
+	}
+	c := &protocol.CosignedSnapshot{
+		Snapshot:     snapshot,
+		Cosignatures: make([]*protocol.Cosignature, len(kvs)),
+	}
+	for i, kv := range kvs {
+		c.Cosignatures[i] = new(protocol.Cosignature)
+		if err := json.Unmarshal(kv.Value, c.Cosignatures[i]); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// GetSnapshot returns the snapshot of the given version.
+func (s *Store) GetSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(version)
+}
+
+// Latest returns the snapshot with the greatest version, or
+// ErrSnapshotNotFound if the store is empty. Versions may have gaps, so
+// the count of the store is not the latest version.
+func (s *Store) Latest() (*protocol.SignedSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	kv, err := s.db.GetLast(storage.SnapshotsTable)
+	if err == storage.ErrKeyNotFound {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot protocol.SignedSnapshot
+	if err := snapshot.Decode(kv.Value); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// GetSnapshotBySignature returns the snapshot with the given signature.
+func (s *Store) GetSnapshotBySignature(signature []byte) (*protocol.SignedSnapshot, error) {
+	if len(signature) == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	kv, err := s.db.Get(storage.SnapshotSignaturesTable, signature)
+	if err == storage.ErrKeyNotFound {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.get(util.BytesAsUint64(kv.Value))
+}
+
+// GetRange returns the snapshots with a version in the range
+// [start, end], sorted by version.
+func (s *Store) GetRange(start, end uint64) ([]protocol.SignedSnapshot, error) {
+	result := make([]protocol.SignedSnapshot, 0)
+	for {
+		page, next, more, err := s.GetPage(start, end, 1000)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, page...)
+		if !more {
+			return result, nil
+		}
+		start = next
+	}
+}
+
+// GetPage returns up to limit snapshots with a version in the range
+// [start, end], sorted by version. If there may be more snapshots in the
+// range, more is true and the next page starts at the version next.
+func (s *Store) GetPage(start, end uint64, limit int) (page []protocol.SignedSnapshot, next uint64, more bool, err error) {
+	s.mu.RLock()
+	kvs, next, more, err := s.scan(start, end, limit)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	page = make([]protocol.SignedSnapshot, len(kvs))
+	for i, kv := range kvs {
+		if err := page[i].Decode(kv.Value); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return page, next, more, nil
+}
+
+// DeleteRange deletes the snapshots with a version in the range
+// [start, end], along with their signatures and cosignatures.
+func (s *Store) DeleteRange(start, end uint64) error {
+	if start > end {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted uint64
+	for from := start; ; {
+		kvs, next, more, err := s.scan(from, end, 1000)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			var snapshot protocol.SignedSnapshot
+			if err := snapshot.Decode(kv.Value); err != nil {
+				return err
+			}
+			if err := s.deleteSignature(snapshot.Signature); err != nil {
+				return err
+			}
+		}
+		deleted += uint64(len(kvs))
+		if !more {
+			break
+		}
+		from = next
+	}
+	if err := s.deleteCosignatures(start, end); err != nil {
+		return err
+	}
+
+	startKey := util.Uint64AsBytes(start)
+	if end == math.MaxUint64 {
+		// there is no key after the last version, so the range ends at
+		// the first key longer than every version
+		err := s.db.DeleteRange(storage.SnapshotsTable, startKey, append(util.Uint64AsBytes(end), 0x0))
+		if err != nil {
+			return err
+		}
+	} else if err := s.db.DeleteRange(storage.SnapshotsTable, startKey, util.Uint64AsBytes(end+1)); err != nil {
+		return err
+	}
+	s.count -= deleted
+	return nil
+}
+
+// Count returns the number of snapshots in the store.
+func (s *Store) Count() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count, nil
+}
+
+// Close closes the underlying storage engine.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) get(version uint64) (*protocol.SignedSnapshot, error) {
+	kv, err := s.db.Get(storage.SnapshotsTable, util.Uint64AsBytes(version))
+	if err == storage.ErrKeyNotFound {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot protocol.SignedSnapshot
+	if err := snapshot.Decode(kv.Value); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *Store) deleteSignature(signature []byte) error {
+	if len(signature) == 0 {
+		return nil
+	}
+	end := append(append(make([]byte, 0, len(signature)+1), signature...), 0x0)
+	return s.db.DeleteRange(storage.SnapshotSignaturesTable, signature, end)
+}
+
+// deleteCosignatures deletes the cosignatures of the versions in the
+// range [start, end]. Key ids are hex strings, so every cosignature of
+// a version is before its version followed by 0xff.
+func (s *Store) deleteCosignatures(start, end uint64) error {
+	return s.db.DeleteRange(storage.CosignaturesTable, util.Uint64AsBytes(start), append(util.Uint64AsBytes(end), 0xff))
+}
+
+// scan reads up to limit pairs with a version in the range [start, end].
+// The range is read in windows of versions, which grow while they are
+// empty so sparse ranges are traversed in a few reads.
+func (s *Store) scan(start, end uint64, limit int) (kvs storage.KVRange, next uint64, more bool, err error) {
+	if limit <= 0 || start > end {
+		return nil, 0, false, nil
+	}
+
+	window := uint64(limit)
+	for from := start; ; {
+		to := end
+		if end-from > window-1 {
+			to = from + window - 1
+		}
+		found, err := s.db.GetRange(storage.SnapshotsTable, util.Uint64AsBytes(from), util.Uint64AsBytes(to))
+		if err != nil {
+			return nil, 0, false, err
+		}
+		kvs = append(kvs, found...)
+
+		if len(kvs) >= limit {
+			kvs = kvs[:limit]
+			last := util.BytesAsUint64(kvs[limit-1].Key)
+			if last == end {
+				return kvs, 0, false, nil
+			}
+			return kvs, last + 1, true, nil
+		}
+		if to == end {
+			return kvs, 0, false, nil
+		}
+
+		from = to + 1
+		if len(found) == 0 && window < math.MaxUint64/2 {
+			window *= 2
+		} else if len(found) > 0 {
+			window = uint64(limit)
+		}
+	}
+}
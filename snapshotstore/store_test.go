@@ -0,0 +1,253 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshotstore
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/sign"
+	"github.com/bbva/qed/storage/bplus"
+)
+
+func snapshot(version uint64) *protocol.SignedSnapshot {
+	return &protocol.SignedSnapshot{
+		Snapshot:  &protocol.Snapshot{Version: version, EventDigest: []byte{byte(version)}},
+		Signature: []byte{0xa, byte(version >> 8), byte(version)},
+	}
+}
+
+func TestStore(t *testing.T) {
+	store, err := NewStore(bplus.NewBPlusTreeStore())
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.Latest()
+	require.Equal(t, ErrSnapshotNotFound, err, "An empty store has no latest snapshot")
+
+	batch := &protocol.BatchSnapshots{}
+	for v := uint64(0); v < 10; v++ {
+		batch.Snapshots = append(batch.Snapshots, snapshot(v))
+	}
+	require.NoError(t, store.PutBatch(batch))
+	require.NoError(t, store.PutSnapshot(100, snapshot(100)))
+	// storing a version again does nothing, but another snapshot of the
+	// same version is never stored
+	require.NoError(t, store.PutSnapshot(5, snapshot(5)))
+	conflict := snapshot(5)
+	conflict.Signature = []byte{0xb}
+	require.Equal(t, ErrSnapshotConflict, store.PutSnapshot(5, conflict))
+	require.Equal(t, ErrSnapshotConflict, store.PutBatch(&protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{conflict, snapshot(101)}}))
+	s, err := store.GetSnapshot(5)
+	require.NoError(t, err)
+	require.Equal(t, snapshot(5), s, "A stored snapshot must not be replaced")
+	_, err = store.GetSnapshotBySignature(conflict.Signature)
+	require.Equal(t, ErrSnapshotNotFound, err)
+	require.NoError(t, store.DeleteRange(101, 101))
+
+	// the snapshots of other logs are not stored
+	other := snapshot(200)
+	other.Snapshot.LogId = "other"
+	require.Equal(t, ErrUnsupportedLog, store.PutSnapshot(200, other))
+	require.NoError(t, store.PutBatch(&protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{other}}))
+	_, err = store.GetSnapshot(200)
+	require.Equal(t, ErrSnapshotNotFound, err)
+	require.Error(t, store.PutSnapshot(201, snapshot(200)), "Snapshots must be stored under their version")
+
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), count, "Stored versions should be counted once")
+
+	latest, err := store.Latest()
+	require.NoError(t, err)
+	require.Equal(t, snapshot(100), latest, "The latest snapshot is the greatest version, whatever the count")
+
+	s, err = store.GetSnapshot(7)
+	require.NoError(t, err)
+	require.Equal(t, snapshot(7), s)
+	_, err = store.GetSnapshot(50)
+	require.Equal(t, ErrSnapshotNotFound, err)
+
+	s, err = store.GetSnapshotBySignature(snapshot(100).Signature)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), s.Snapshot.Version)
+	_, err = store.GetSnapshotBySignature([]byte{0xb})
+	require.Equal(t, ErrSnapshotNotFound, err)
+
+	snapshots, err := store.GetRange(3, 100)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 8)
+	require.Equal(t, uint64(3), snapshots[0].Snapshot.Version)
+	require.Equal(t, uint64(100), snapshots[7].Snapshot.Version)
+
+	require.NoError(t, store.DeleteRange(2, 5))
+	snapshots, err = store.GetRange(0, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 7)
+	_, err = store.GetSnapshotBySignature(snapshot(3).Signature)
+	require.Equal(t, ErrSnapshotNotFound, err, "Deleted snapshots should not be found by signature")
+	count, _ = store.Count()
+	require.Equal(t, uint64(7), count)
+
+	require.NoError(t, store.DeleteRange(9, math.MaxUint64))
+	count, _ = store.Count()
+	require.Equal(t, uint64(5), count)
+	_, err = store.GetSnapshot(100)
+	require.Equal(t, ErrSnapshotNotFound, err)
+
+}
+
+func TestStorePages(t *testing.T) {
+	db := bplus.NewBPlusTreeStore()
+	store, err := NewStore(db)
+	require.NoError(t, err)
+
+	// sparse versions, far apart
+	versions := []uint64{1, 2, 3, 1 << 20, 1<<20 + 1, 1 << 40, math.MaxUint64}
+	for _, v := range versions {
+		require.NoError(t, store.PutSnapshot(v, snapshot(v)))
+	}
+
+	var read []uint64
+	start := uint64(0)
+	for {
+		page, next, more, err := store.GetPage(start, math.MaxUint64, 2)
+		require.NoError(t, err)
+		require.True(t, len(page) <= 2, "Pages should not exceed the limit")
+		for _, s := range page {
+			read = append(read, s.Snapshot.Version)
+		}
+		if !more {
+			break
+		}
+		start = next
+	}
+	require.Equal(t, versions, read)
+
+	page, _, more, err := store.GetPage(4, 1<<20-1, 2)
+	require.NoError(t, err)
+	require.Empty(t, page)
+	require.False(t, more)
+
+	// the snapshots are counted when the store is reopened
+	reopened, err := NewStore(db)
+	require.NoError(t, err)
+	count, _ := reopened.Count()
+	require.Equal(t, uint64(len(versions)), count)
+
+}
+
+func TestStoreCosignatures(t *testing.T) {
+	store, err := NewStore(bplus.NewBPlusTreeStore())
+	require.NoError(t, err)
+	defer store.Close()
+
+	cosignature := func(keyId string, timestamp int64) *protocol.Cosignature {
+		return &protocol.Cosignature{Witness: "witness", KeyId: keyId, Timestamp: timestamp, Signature: []byte{0x1}}
+	}
+
+	// the snapshot is stored along with its first cosignatures
+	require.NoError(t, store.PutCosignatures(&protocol.CosignedSnapshot{
+		Snapshot:     snapshot(1),
+		Cosignatures: []*protocol.Cosignature{cosignature("0a", 1)},
+	}))
+	s, err := store.GetSnapshot(1)
+	require.NoError(t, err)
+	require.Equal(t, snapshot(1), s)
+
+	// a witness replaces its cosignature
+	require.NoError(t, store.PutCosignatures(&protocol.CosignedSnapshot{
+		Snapshot:     snapshot(1),
+		Cosignatures: []*protocol.Cosignature{cosignature("0b", 1), cosignature("0a", 2)},
+	}))
+	cosigned, err := store.GetCosignatures(1)
+	require.NoError(t, err)
+	require.Equal(t, snapshot(1), cosigned.Snapshot)
+	require.Equal(t, []*protocol.Cosignature{cosignature("0a", 2), cosignature("0b", 1)}, cosigned.Cosignatures)
+
+	conflict := snapshot(1)
+	conflict.Signature = []byte{0xb}
+	err = store.PutCosignatures(&protocol.CosignedSnapshot{Snapshot: conflict, Cosignatures: []*protocol.Cosignature{cosignature("0c", 1)}})
+	require.Equal(t, ErrSnapshotConflict, err)
+	err = store.PutCosignatures(&protocol.CosignedSnapshot{Snapshot: snapshot(1), Cosignatures: []*protocol.Cosignature{cosignature("\xff", 1)}})
+	require.Error(t, err, "Cosignatures must be named by a key id")
+
+	require.NoError(t, store.PutSnapshot(2, snapshot(2)))
+	cosigned, err = store.GetCosignatures(2)
+	require.NoError(t, err)
+	require.Empty(t, cosigned.Cosignatures)
+	_, err = store.GetCosignatures(3)
+	require.Equal(t, ErrSnapshotNotFound, err)
+
+	// a conflicting snapshot keeps the cosignatures of the stored one
+	require.Equal(t, ErrSnapshotConflict, store.PutSnapshot(1, conflict))
+	cosigned, err = store.GetCosignatures(1)
+	require.NoError(t, err)
+	require.Equal(t, snapshot(1), cosigned.Snapshot)
+	require.Len(t, cosigned.Cosignatures, 2)
+
+	require.NoError(t, store.PutCosignatures(&protocol.CosignedSnapshot{
+		Snapshot:     snapshot(2),
+		Cosignatures: []*protocol.Cosignature{cosignature("0a", 1)},
+	}))
+	require.NoError(t, store.DeleteRange(2, 2))
+	require.NoError(t, store.PutSnapshot(2, snapshot(2)))
+	cosigned, err = store.GetCosignatures(2)
+	require.NoError(t, err)
+	require.Empty(t, cosigned.Cosignatures, "The cosignatures must be deleted with their snapshots")
+
+}
+
+func TestVerifyingStore(t *testing.T) {
+	signer := sign.NewEd25519Signer()
+	keys := &sign.KeySet{Keys: []*sign.KeyInfo{{
+		KeyId:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		PublicKey: signer.PublicKey(),
+	}}}
+
+	_, err := NewVerifyingStore(bplus.NewBPlusTreeStore(), &sign.KeySet{})
+	require.Error(t, err, "A verifying store needs trusted keys")
+	store, err := NewVerifyingStore(bplus.NewBPlusTreeStore(), keys)
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now()
+	signed, err := protocol.SignSnapshot(signer, &protocol.Snapshot{Version: 1, EventDigest: []byte{0x1}}, now)
+	require.NoError(t, err)
+	require.NoError(t, store.PutSnapshot(1, signed))
+
+	untrusted, err := protocol.SignSnapshot(sign.NewEd25519Signer(), &protocol.Snapshot{Version: 2, EventDigest: []byte{0x2}}, now)
+	require.NoError(t, err)
+	require.Equal(t, ErrUntrustedSnapshot, store.PutSnapshot(2, untrusted), "Snapshots of unknown keys must be rejected")
+	require.Equal(t, ErrUntrustedSnapshot, store.PutBatch(&protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{untrusted}}))
+	require.Equal(t, ErrUntrustedSnapshot, store.PutSnapshot(3, snapshot(3)), "Unsigned snapshots must be rejected")
+	require.Equal(t, ErrUntrustedSnapshot, store.PutCosignatures(&protocol.CosignedSnapshot{Snapshot: untrusted}))
+
+	tampered, err := protocol.SignSnapshot(signer, &protocol.Snapshot{Version: 4, HyperDigest: []byte{0x4}}, now)
+	require.NoError(t, err)
+	tampered.Snapshot.HyperDigest = []byte{0x5}
+	require.Equal(t, ErrUntrustedSnapshot, store.PutSnapshot(4, tampered), "Tampered snapshots must be rejected")
+
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count, "Only the trusted snapshot should be stored")
+}
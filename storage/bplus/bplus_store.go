@@ -77,8 +77,12 @@ func (s BPlusTreeStore) Get(table storage.Table, key []byte) (*storage.KVPair, e
 
 func (s BPlusTreeStore) GetLast(table storage.Table) (*storage.KVPair, error) {
 	result := new(storage.KVPair)
-	s.db.DescendGreaterThan(KVItem{[]byte{table.Prefix()}, nil}, func(i btree.Item) bool {
+	// descend from the first key of the next table
+	s.db.DescendLessOrEqual(KVItem{[]byte{table.Prefix() + 1}, nil}, func(i btree.Item) bool {
 		item := i.(KVItem)
+		if item.Key[0] != table.Prefix() || len(item.Key) == 1 {
+			return false
+		}
 		result.Key = item.Key[1:]
 		result.Value = item.Value
 		return false
@@ -89,6 +93,37 @@ func (s BPlusTreeStore) GetLast(table storage.Table) (*storage.KVPair, error) {
 	return result, nil
 }
 
+func (s BPlusTreeStore) GetLastInRange(table storage.Table, start, end []byte) (*storage.KVPair, error) {
+	var result *storage.KVPair
+	startKey := append([]byte{table.Prefix()}, start...)
+	endKey := append([]byte{table.Prefix()}, end...)
+	s.db.DescendLessOrEqual(KVItem{endKey, nil}, func(i btree.Item) bool {
+		item := i.(KVItem)
+		if bytes.Compare(item.Key, startKey) >= 0 {
+			result = &storage.KVPair{Key: item.Key[1:], Value: item.Value}
+		}
+		return false
+	})
+	if result == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+	return result, nil
+}
+
+func (s *BPlusTreeStore) DeleteRange(table storage.Table, start, end []byte) error {
+	startKey := append([]byte{table.Prefix()}, start...)
+	endKey := append([]byte{table.Prefix()}, end...)
+	keys := make([]btree.Item, 0)
+	s.db.AscendRange(KVItem{startKey, nil}, KVItem{endKey, nil}, func(i btree.Item) bool {
+		keys = append(keys, i)
+		return true
+	})
+	for _, k := range keys {
+		s.db.Delete(k)
+	}
+	return nil
+}
+
 func (s BPlusTreeStore) GetAll(table storage.Table) storage.KVPairReader {
 	return NewBPlusKVPairReader(table, s.db)
 }
@@ -264,3 +264,84 @@ func openBPlusTreeStore() (*BPlusTreeStore, func()) {
 		store.Close()
 	}
 }
+
+func TestGetLastInRange(t *testing.T) {
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	var testCases = []struct {
+		start, end byte
+		ok         bool
+		expected   byte
+	}{
+		{10, 50, true, 48},
+		{10, 20, true, 20},
+		{11, 11, false, 0},
+		{1, 9, false, 0},
+		{40, 100, true, 48},
+		{49, 100, false, 0},
+		{20, 10, false, 0},
+	}
+
+	table := storage.HyperVersionedTable
+	for i := 10; i < 50; i += 2 {
+		store.Mutate([]*storage.Mutation{
+			{table, []byte{byte(i)}, []byte("Value")},
+		})
+	}
+
+	for i, test := range testCases {
+		kv, err := store.GetLastInRange(table, []byte{test.start}, []byte{test.end})
+		if !test.ok {
+			require.Equalf(t, storage.ErrKeyNotFound, err, "The key should not be found in test case %d", i)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equalf(t, []byte{test.expected}, kv.Key, "Wrong key in test case %d", i)
+	}
+
+}
+
+func TestGetLastIgnoresOtherTables(t *testing.T) {
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	store.Mutate([]*storage.Mutation{
+		{storage.HyperCacheTable, []byte{0x1}, []byte("Value1")},
+		{storage.HistoryCacheTable, []byte{0xff}, []byte("Value2")},
+	})
+
+	kv, err := store.GetLast(storage.HyperCacheTable)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x1}, kv.Key, "The key should belong to the requested table")
+
+	_, err = store.GetLast(storage.FSMStateTable)
+	require.Equal(t, storage.ErrKeyNotFound, err, "An empty table should not have a last key")
+}
+
+func TestDeleteRange(t *testing.T) {
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	for i := 0; i < 10; i++ {
+		store.Mutate([]*storage.Mutation{
+			{storage.LogsTable, []byte{byte(i)}, []byte("Value")},
+			{storage.HyperCacheTable, []byte{byte(i)}, []byte("Value")},
+		})
+	}
+
+	err := store.DeleteRange(storage.LogsTable, []byte{2}, []byte{5})
+	require.NoError(t, err)
+
+	kvs, err := store.GetRange(storage.LogsTable, []byte{0}, []byte{9})
+	require.NoError(t, err)
+	keys := make([]byte, 0)
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key[0])
+	}
+	require.Equal(t, []byte{0, 1, 5, 6, 7, 8, 9}, keys, "The end of the range should not be deleted")
+
+	kvs, err = store.GetRange(storage.HyperCacheTable, []byte{0}, []byte{9})
+	require.NoError(t, err)
+	require.Len(t, kvs, 10, "Other tables should not be affected")
+}
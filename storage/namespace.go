@@ -0,0 +1,163 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+// NamespacedStore is a view of a store that keeps every table of a log
+// in the LogsTable of the underlying store, prefixed with a namespace.
+// Namespaces must not be prefixes of each other.
+type NamespacedStore struct {
+	store     Store
+	namespace []byte
+}
+
+func NewNamespacedStore(store Store, namespace []byte) *NamespacedStore {
+	return &NamespacedStore{
+		store:     store,
+		namespace: namespace,
+	}
+}
+
+// Key returns the key of the underlying LogsTable where the given
+// key of a table is stored.
+func (s *NamespacedStore) Key(table Table, key []byte) []byte {
+	k := make([]byte, 0, len(s.namespace)+1+len(key))
+	k = append(k, s.namespace...)
+	k = append(k, table.Prefix())
+	return append(k, key...)
+}
+
+// Mutations translates mutations of the namespaced tables into
+// mutations of the underlying store, so they can be written along
+// with other mutations in a single batch.
+func (s *NamespacedStore) Mutations(mutations []*Mutation) []*Mutation {
+	translated := make([]*Mutation, len(mutations))
+	for i, m := range mutations {
+		translated[i] = NewMutation(LogsTable, s.Key(m.Table, m.Key), m.Value)
+	}
+	return translated
+}
+
+func (s *NamespacedStore) Mutate(mutations []*Mutation) error {
+	return s.store.Mutate(s.Mutations(mutations))
+}
+
+func (s *NamespacedStore) Get(table Table, key []byte) (*KVPair, error) {
+	kv, err := s.store.Get(LogsTable, s.Key(table, key))
+	if err != nil {
+		return nil, err
+	}
+	return &KVPair{Key: key, Value: kv.Value}, nil
+}
+
+func (s *NamespacedStore) GetRange(table Table, start, end []byte) (KVRange, error) {
+	kvs, err := s.store.GetRange(LogsTable, s.Key(table, start), s.Key(table, end))
+	if err != nil {
+		return nil, err
+	}
+	result := make(KVRange, len(kvs))
+	for i, kv := range kvs {
+		result[i] = KVPair{Key: s.strip(kv.Key), Value: kv.Value}
+	}
+	return result, nil
+}
+
+func (s *NamespacedStore) GetAll(table Table) KVPairReader {
+	start, end := s.tableRange(table)
+	kvs, err := s.store.GetRange(LogsTable, start, end)
+	if err != nil {
+		kvs = NewKVRange()
+	}
+	return &namespacedKVPairReader{store: s, kvs: kvs}
+}
+
+func (s *NamespacedStore) GetLast(table Table) (*KVPair, error) {
+	start, end := s.tableRange(table)
+	return s.getLastInRange(start, end)
+}
+
+func (s *NamespacedStore) GetLastInRange(table Table, start, end []byte) (*KVPair, error) {
+	return s.getLastInRange(s.Key(table, start), s.Key(table, end))
+}
+
+func (s *NamespacedStore) getLastInRange(start, end []byte) (*KVPair, error) {
+	kv, err := s.store.GetLastInRange(LogsTable, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &KVPair{Key: s.strip(kv.Key), Value: kv.Value}, nil
+}
+
+func (s *NamespacedStore) DeleteRange(table Table, start, end []byte) error {
+	return s.store.DeleteRange(LogsTable, s.Key(table, start), s.Key(table, end))
+}
+
+// Drop deletes every table of the namespace.
+func (s *NamespacedStore) Drop() error {
+	return s.store.DeleteRange(LogsTable, s.namespace, nextPrefix(s.namespace))
+}
+
+// Close does nothing because the underlying store is shared
+// with other namespaces.
+func (s *NamespacedStore) Close() error {
+	return nil
+}
+
+// tableRange returns the bounds of the keys of a table. Keys are never
+// empty so no key can match the upper bound, which is the prefix of
+// the next table.
+func (s *NamespacedStore) tableRange(table Table) (start, end []byte) {
+	start = s.Key(table, nil)
+	end = nextPrefix(start)
+	return
+}
+
+func (s *NamespacedStore) strip(key []byte) []byte {
+	return key[len(s.namespace)+1:]
+}
+
+// nextPrefix returns the smallest key greater than every key
+// starting with the given prefix.
+func nextPrefix(prefix []byte) []byte {
+	next := make([]byte, len(prefix))
+	copy(next, prefix)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i] < 0xff {
+			next[i]++
+			return next[:i+1]
+		}
+	}
+	// all bytes are 0xff, so there is no greater prefix
+	return append(next, 0xff)
+}
+
+type namespacedKVPairReader struct {
+	store *NamespacedStore
+	kvs   KVRange
+}
+
+func (r *namespacedKVPairReader) Read(buffer []*KVPair) (n int, err error) {
+	for n = 0; n < len(buffer) && len(r.kvs) > 0; n++ {
+		kv := r.kvs[0]
+		buffer[n] = &KVPair{Key: r.store.strip(kv.Key), Value: kv.Value}
+		r.kvs = r.kvs[1:]
+	}
+	return n, nil
+}
+
+func (r *namespacedKVPairReader) Close() {
+	r.kvs = nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bplus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedStore(t *testing.T) {
+	store := bplus.NewBPlusTreeStore()
+	defer store.Close()
+
+	a := storage.NewNamespacedStore(store, []byte("a\x00"))
+	b := storage.NewNamespacedStore(store, []byte("b\x00"))
+
+	for i := byte(1); i <= 3; i++ {
+		require.NoError(t, a.Mutate([]*storage.Mutation{
+			storage.NewMutation(storage.HyperCacheTable, []byte{i}, []byte{i}),
+		}))
+	}
+	require.NoError(t, b.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HyperCacheTable, []byte{0x1}, []byte("b")),
+	}))
+
+	kv, err := a.Get(storage.HyperCacheTable, []byte{0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x1}, kv.Value, "Each namespace should keep its own values")
+
+	kv, err = b.Get(storage.HyperCacheTable, []byte{0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), kv.Value, "Each namespace should keep its own values")
+
+	_, err = a.Get(storage.HistoryCacheTable, []byte{0x1})
+	require.Equal(t, storage.ErrKeyNotFound, err, "Tables should not share keys")
+
+	_, err = store.Get(storage.HyperCacheTable, []byte{0x1})
+	require.Equal(t, storage.ErrKeyNotFound, err, "The tables of the underlying store should not be used")
+
+	kvs, err := a.GetRange(storage.HyperCacheTable, []byte{0x1}, []byte{0x2})
+	require.NoError(t, err)
+	require.Equal(t, storage.KVRange{{Key: []byte{0x1}, Value: []byte{0x1}}, {Key: []byte{0x2}, Value: []byte{0x2}}}, kvs)
+
+	kv, err = a.GetLast(storage.HyperCacheTable)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x3}, kv.Key, "The last key should belong to the namespace")
+
+	reader := a.GetAll(storage.HyperCacheTable)
+	buff := make([]*storage.KVPair, 10)
+	n, err := reader.Read(buff)
+	require.NoError(t, err)
+	require.Equal(t, 3, n, "All the keys of the table should be read")
+	reader.Close()
+
+	require.NoError(t, a.Drop())
+	_, err = a.GetLast(storage.HyperCacheTable)
+	require.Equal(t, storage.ErrKeyNotFound, err, "A dropped namespace should be empty")
+
+	kv, err = b.Get(storage.HyperCacheTable, []byte{0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), kv.Value, "Dropping a namespace should not affect the rest")
+}
@@ -50,6 +50,12 @@ func newRocksDBMetrics(store *RocksDBStore) *rocksDBMetrics {
 	tables = append(tables, newPerTableMetrics(storage.HyperCacheTable, store))
 	tables = append(tables, newPerTableMetrics(storage.HistoryCacheTable, store))
 	tables = append(tables, newPerTableMetrics(storage.FSMStateTable, store))
+	tables = append(tables, newPerTableMetrics(storage.HyperVersionedTable, store))
+	tables = append(tables, newPerTableMetrics(storage.LogsTable, store))
+	tables = append(tables, newPerTableMetrics(storage.SnapshotsTable, store))
+	tables = append(tables, newPerTableMetrics(storage.SnapshotSignaturesTable, store))
+	tables = append(tables, newPerTableMetrics(storage.CosignaturesTable, store))
+	tables = append(tables, newPerTableMetrics(storage.BalloonMetadataTable, store))
 	return &rocksDBMetrics{
 		blockCacheMetrics:  newBlockCacheMetrics(store.stats, store.blockCache),
 		bloomFilterMetrics: newBloomFilterMetrics(store.stats),
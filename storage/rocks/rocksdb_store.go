@@ -78,6 +78,12 @@ func NewRocksDBStoreOpts(opts *Options) (*RocksDBStore, error) {
 		storage.HyperCacheTable.String(),
 		storage.HistoryCacheTable.String(),
 		storage.FSMStateTable.String(),
+		storage.HyperVersionedTable.String(),
+		storage.LogsTable.String(),
+		storage.SnapshotsTable.String(),
+		storage.SnapshotSignaturesTable.String(),
+		storage.CosignaturesTable.String(),
+		storage.BalloonMetadataTable.String(),
 	}
 
 	// env
@@ -106,6 +112,12 @@ func NewRocksDBStoreOpts(opts *Options) (*RocksDBStore, error) {
 		getHyperCacheTableOpts(blockCache),
 		getHistoryCacheTableOpts(blockCache),
 		getFsmStateTableOpts(),
+		getHyperVersionedTableOpts(blockCache),
+		getLogsTableOpts(blockCache),
+		getSnapshotsTableOpts(blockCache),
+		getSnapshotsTableOpts(blockCache),
+		getSnapshotsTableOpts(blockCache),
+		getBalloonMetadataTableOpts(),
 	}
 
 	db, cfHandles, err := rocksdb.OpenDBColumnFamilies(opts.Path, globalOpts, cfNames, cfOpts)
@@ -307,6 +319,90 @@ func getFsmStateTableOpts() *rocksdb.Options {
 	return opts
 }
 
+// The balloon metadata table only holds a few keys written once, when
+// the store is created, and read when the balloon is opened.
+func getBalloonMetadataTableOpts() *rocksdb.Options {
+	opts := rocksdb.NewDefaultOptions()
+	opts.SetCompression(rocksdb.SnappyCompression)
+	opts.SetWriteBufferSize(1 * 1024 * 1024)
+	opts.SetMaxWriteBufferNumber(2)
+	return opts
+}
+
+// The hyper versioned table receives an append-only workload of
+// ~1KB batches, keyed by position and version, and is only read
+// when querying past states of the hyper tree. Reads always seek
+// backwards to find the last version of a batch.
+func getHyperVersionedTableOpts(blockCache *rocksdb.Cache) *rocksdb.Options {
+
+	bbto := rocksdb.NewDefaultBlockBasedTableOptions()
+	// Use the shared block cache, but don't pin index and filters
+	// because this table is rarely read.
+	bbto.SetBlockCache(blockCache)
+	bbto.SetCacheIndexAndFilterBlocks(true)
+	bbto.SetBlockSize(16 * 1024)
+
+	opts := rocksdb.NewDefaultOptions()
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.SetCompression(rocksdb.SnappyCompression)
+
+	// large write buffers to absorb the append-only workload
+	opts.SetWriteBufferSize(64 * 1024 * 1024)
+	opts.SetMaxWriteBufferNumber(3)
+	opts.SetMinWriteBufferNumberToMerge(2)
+	opts.SetLevel0FileNumCompactionTrigger(8)
+	opts.SetTargetFileSizeBase(64 * 1024 * 1024)
+	opts.SetMaxBytesForLevelBase(512 * 1024 * 1024)
+
+	// io parallelism
+	opts.SetMaxBackgroundCompactions(2)
+	opts.SetMaxBackgroundFlushes(1)
+	return opts
+}
+
+// The logs table holds the trees of every log apart from the default
+// one, so it receives the mixed workload of the hyper table along with
+// the insert-only workload of the history table, namespaced by log.
+func getLogsTableOpts(blockCache *rocksdb.Cache) *rocksdb.Options {
+
+	bbto := rocksdb.NewDefaultBlockBasedTableOptions()
+	bbto.SetFilterPolicy(rocksdb.NewFullBloomFilterPolicy(10))
+	bbto.SetCacheIndexAndFilterBlocks(true)
+	bbto.SetCacheIndexAndFilterBlocksWithHighPriority(true)
+	bbto.SetBlockCache(blockCache)
+	bbto.SetBlockSize(16 * 1024)
+
+	opts := rocksdb.NewDefaultOptions()
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.SetCompression(rocksdb.SnappyCompression)
+
+	opts.SetWriteBufferSize(64 * 1024 * 1024)
+	opts.SetMaxWriteBufferNumber(3)
+	opts.SetMinWriteBufferNumberToMerge(2)
+	opts.SetLevel0FileNumCompactionTrigger(8)
+	opts.SetTargetFileSizeBase(64 * 1024 * 1024)
+	opts.SetMaxBytesForLevelBase(512 * 1024 * 1024)
+
+	// io parallelism
+	opts.SetMaxBackgroundCompactions(4)
+	opts.SetMaxBackgroundFlushes(1)
+	return opts
+}
+
+// getSnapshotsTableOpts returns the options of the tables of the snapshot
+// stores, written once and read by version or signature.
+func getSnapshotsTableOpts(blockCache *rocksdb.Cache) *rocksdb.Options {
+
+	bbto := rocksdb.NewDefaultBlockBasedTableOptions()
+	bbto.SetFilterPolicy(rocksdb.NewFullBloomFilterPolicy(10))
+	bbto.SetBlockCache(blockCache)
+
+	opts := rocksdb.NewDefaultOptions()
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.SetCompression(rocksdb.SnappyCompression)
+	return opts
+}
+
 func (s *RocksDBStore) Mutate(mutations []*storage.Mutation) error {
 	batch := rocksdb.NewWriteBatch()
 	defer batch.Destroy()
@@ -374,6 +470,37 @@ func (s *RocksDBStore) GetLast(table storage.Table) (*storage.KVPair, error) {
 	return nil, storage.ErrKeyNotFound
 }
 
+func (s *RocksDBStore) DeleteRange(table storage.Table, start, end []byte) error {
+	batch := rocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.DeleteRangeCF(s.cfHandles[table], start, end)
+	return s.db.Write(s.wo, batch)
+}
+
+func (s *RocksDBStore) GetLastInRange(table storage.Table, start, end []byte) (*storage.KVPair, error) {
+	it := s.db.NewIteratorCF(s.ro, s.cfHandles[table])
+	defer it.Close()
+	it.SeekForPrev(end)
+	if it.Valid() {
+		keySlice := it.Key()
+		key := make([]byte, keySlice.Size())
+		copy(key, keySlice.Data())
+		keySlice.Free()
+		if bytes.Compare(key, start) < 0 {
+			return nil, storage.ErrKeyNotFound
+		}
+		result := new(storage.KVPair)
+		result.Key = key
+		valueSlice := it.Value()
+		value := make([]byte, valueSlice.Size())
+		copy(value, valueSlice.Data())
+		valueSlice.Free()
+		result.Value = value
+		return result, nil
+	}
+	return nil, storage.ErrKeyNotFound
+}
+
 type RocksDBKVPairReader struct {
 	it *rocksdb.Iterator
 }
@@ -489,6 +616,12 @@ func (s *RocksDBStore) Backup(w io.Writer, id uint64) error {
 		storage.HyperCacheTable,
 		storage.HistoryCacheTable,
 		storage.FSMStateTable,
+		storage.HyperVersionedTable,
+		storage.LogsTable,
+		storage.SnapshotsTable,
+		storage.SnapshotSignaturesTable,
+		storage.CosignaturesTable,
+		storage.BalloonMetadataTable,
 	}
 	for _, table := range tables {
 
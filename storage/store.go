@@ -39,11 +39,42 @@ const (
 	// FSMStateTable contains the current state of the FSM (index, term, version...).
 	// key -> state
 	FSMStateTable
+	// HyperVersionedTable contains a copy of every batch of the hyper tree
+	// for each version in which it was modified.
+	// Position+Version -> Batch
+	HyperVersionedTable
+	// LogsTable contains the tables of every log but the default one,
+	// each of them under the namespace of its log.
+	// Namespace+TablePrefix+Key -> Value
+	LogsTable
+	// SnapshotsTable contains the signed snapshots kept by a snapshot store.
+	// Version -> SignedSnapshot
+	SnapshotsTable
+	// SnapshotSignaturesTable indexes the snapshots of a snapshot store
+	// by their signature.
+	// Signature -> Version
+	SnapshotSignaturesTable
+	// CosignaturesTable contains the cosignatures of the snapshots of a
+	// snapshot store made by the witnesses.
+	// Version+KeyId -> Cosignature
+	CosignaturesTable
+	// BalloonMetadataTable contains the settings of a balloon that are
+	// fixed when its store is created (tree format, versioned since...).
+	// key -> value
+	BalloonMetadataTable
 )
 
 // FSMStateTableKey single key to persist fsm state.
 var FSMStateTableKey = []byte{0xab}
 
+// FSMLogsTableKey single key to persist the ids of the logs created
+// apart from the default one.
+var FSMLogsTableKey = []byte{0xac}
+
+// FSMHasherTableKey single key to persist the id of the hasher used to
+// build the trees.
+var FSMHasherTableKey = []byte{0xad}
+
 // String returns a string representation of the table.
 func (t Table) String() string {
 	var s string
@@ -56,6 +87,18 @@ func (t Table) String() string {
 		s = "history"
 	case FSMStateTable:
 		s = "fsm"
+	case HyperVersionedTable:
+		s = "hyper_versioned"
+	case LogsTable:
+		s = "logs"
+	case SnapshotsTable:
+		s = "snapshots"
+	case SnapshotSignaturesTable:
+		s = "snapshot_signatures"
+	case CosignaturesTable:
+		s = "cosignatures"
+	case BalloonMetadataTable:
+		s = "balloon_metadata"
 	}
 	return s
 }
@@ -71,6 +114,18 @@ func (t Table) Prefix() byte {
 		prefix = byte(0x1)
 	case FSMStateTable:
 		prefix = byte(0x2)
+	case HyperVersionedTable:
+		prefix = byte(0x4)
+	case LogsTable:
+		prefix = byte(0x5)
+	case SnapshotsTable:
+		prefix = byte(0x6)
+	case SnapshotSignaturesTable:
+		prefix = byte(0x7)
+	case CosignaturesTable:
+		prefix = byte(0x8)
+	case BalloonMetadataTable:
+		prefix = byte(0x9)
 	default:
 		prefix = byte(0x3)
 	}
@@ -87,6 +142,11 @@ type Store interface {
 	Get(table Table, key []byte) (*KVPair, error)
 	GetAll(table Table) KVPairReader
 	GetLast(table Table) (*KVPair, error)
+	// GetLastInRange returns the pair with the greatest key in the
+	// range [start, end] or ErrKeyNotFound if the range is empty.
+	GetLastInRange(table Table, start, end []byte) (*KVPair, error)
+	// DeleteRange deletes every pair with a key in the range [start, end).
+	DeleteRange(table Table, start, end []byte) error
 	Close() error
 }
 
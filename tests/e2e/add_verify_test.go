@@ -91,7 +91,8 @@ func TestAddVerify(t *testing.T) {
 		})
 
 		let("Verify events", func(t *testing.T) {
-			first.HyperDigest = last.HyperDigest
+			// proofs are taken at the queried version, so each one
+			// verifies against the snapshot of that version
 			assert.True(t, client.DigestVerify(resultFirst, first, hashing.NewSha256Hasher), "The first proof should be valid")
 			assert.True(t, client.DigestVerify(resultLast, last, hashing.NewSha256Hasher), "The last proof should be valid")
 		})
@@ -125,16 +126,18 @@ func TestAddVerify(t *testing.T) {
 		let("Verify both proofs against index i event", func(t *testing.T) {
 			snap := &protocol.Snapshot{
 				HistoryDigest: s[j].HistoryDigest,
-				HyperDigest:   s[9].HyperDigest,
+				HyperDigest:   s[j].HyperDigest,
 				Version:       s[j].Version,
+				TreeFormat:    s[j].TreeFormat,
 				EventDigest:   s[i].EventDigest,
 			}
 			assert.True(t, client.DigestVerify(p1, snap, hashing.NewSha256Hasher), "p1 should be valid")
 
 			snap = &protocol.Snapshot{
 				HistoryDigest: s[k].HistoryDigest,
-				HyperDigest:   s[9].HyperDigest,
+				HyperDigest:   s[k].HyperDigest,
 				Version:       s[k].Version,
+				TreeFormat:    s[k].TreeFormat,
 				EventDigest:   s[i].EventDigest,
 			}
 			assert.True(t, client.DigestVerify(p2, snap, hashing.NewSha256Hasher), "p2 should be valid")